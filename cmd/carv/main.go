@@ -1,15 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/dev-dami/carv/pkg/ast"
 	"github.com/dev-dami/carv/pkg/codegen"
+	"github.com/dev-dami/carv/pkg/docgen"
 	"github.com/dev-dami/carv/pkg/lexer"
 	"github.com/dev-dami/carv/pkg/module"
 	"github.com/dev-dami/carv/pkg/parser"
@@ -30,27 +38,15 @@ func main() {
 	case "help", "-h", "--help":
 		printUsage()
 	case "build":
-		if len(os.Args) < 3 {
-			fmt.Fprintln(os.Stderr, "usage: carv build [--target arm] <file.carv>")
-			os.Exit(1)
-		}
-		target := ""
-		fileArg := os.Args[2]
-		if os.Args[2] == "--target" {
-			if len(os.Args) < 5 {
-				fmt.Fprintln(os.Stderr, "usage: carv build --target <arm|host> <file.carv>")
-				os.Exit(1)
-			}
-			target = os.Args[3]
-			fileArg = os.Args[4]
-		}
-		buildFile(fileArg, target)
+		buildProject(os.Args[2:])
 	case "emit-c":
-		if len(os.Args) < 3 {
-			fmt.Fprintln(os.Stderr, "usage: carv emit-c <file.carv>")
-			os.Exit(1)
-		}
-		emitC(os.Args[2])
+		emitC(os.Args[2:])
+	case "run":
+		runProject(os.Args[2:])
+	case "test":
+		testProject(os.Args[2:])
+	case "doc":
+		docProject(os.Args[2:])
 	case "init":
 		initProject()
 	case "add":
@@ -58,10 +54,16 @@ func main() {
 	case "remove":
 		removePackage()
 	case "install":
-		installPackages()
+		installPackages(os.Args[2:])
+	case "update":
+		updatePackages(os.Args[2:])
+	case "vendor":
+		vendorPackages(os.Args[2:])
+	case "script":
+		runScript(os.Args[2:])
 	default:
 		if strings.HasSuffix(os.Args[1], ".carv") {
-			buildFile(os.Args[1], "")
+			buildProject(os.Args[1:2])
 		} else {
 			fmt.Fprintf(os.Stderr, "unknown command: %s\n", os.Args[1])
 			os.Exit(1)
@@ -76,23 +78,66 @@ Usage:
   carv <command> [arguments]
 
 Commands:
-  build <file>    Compile to native binary via C
+  build [file]    Compile to native binary via C
+  run [file]      Build for the host and run it
   emit-c <file>   Output generated C code
+  test [files]    Build and run test functions on the host
+  doc [file]      Generate API docs for pub declarations
   init            Initialize a new Carv project with carv.toml
   add <name>      Add a dependency to carv.toml
   remove <name>   Remove a dependency from carv.toml
-  install         Install all dependencies from carv.toml
+  install         Install all dependencies and write carv.lock
+  update [names]  Move locked dependencies to their newest allowed versions
+  vendor          Copy locked dependencies into vendor/
+  script [name]   Run a [scripts] entry from carv.toml, or list them
   version         Print version info
   help            Show this help
 
 Package Management:
   carv add <name> [--git <url>] [--path <localpath>] [--version <ver>]
   carv remove <name>
-  carv install
+  carv install [--locked] [--offline]
+  carv update [name...]
+  carv vendor
+  --version takes a semver requirement such as 1.2, ^1.2.3, ~1.2 or >=1.0, <2.0.
+  --locked fails if carv.lock does not match what install would write.
+  --offline installs only from the package cache ($CARV_CACHE or ~/.cache/carv).
+  [dev-dependencies] are installed by carv test, not carv install.
+
+Scripts:
+  carv script <name> [args...]
+  [scripts] prebuild and postbuild run before and after carv build, with
+  CARV_TARGET, CARV_CC, CARV_OBJCOPY, CARV_C_FILE, CARV_BINARY and more set.
+
+Building:
+  carv build [-p <member>|--workspace] [--target <name>] [--output <dir>]
+             [--debug|--no-debug]
+             [--optimize|--no-optimize] [--no-heap] [--mem-report[=json]]
+             [-I <dir>] [-l <lib>] [file.carv]
+  Without a file, builds [package].entry using the [build] table of carv.toml.
+  Targets: host, cortex-m0, cortex-m0plus, cortex-m3, cortex-m4, cortex-m4f,
+  cortex-m7, or a [targets.<name>] entry of carv.toml.
+  --no-heap (or [build] memory = "static") allocates nothing at run time.
+  --mem-report prints stack, static data and arena use after the build.
+  -p builds one member of a [workspace] (repeatable); --workspace builds
+  every member with an entry, as does carv build at a workspace root.
+
+Running:
+  carv run [file.carv] [-- args...]
+
+Testing:
+  carv test [--filter <name>] [file.carv...]
+
+Documentation:
+  carv doc [--format md|html] [-o <dir>] [file.carv]
 
 Examples:
   carv build hello.carv
+  carv run hello.carv -- --verbose input.txt
   carv emit-c hello.carv
+  carv emit-c --target cortex-m0 hello.carv
+  carv test --filter parse
+  carv doc --format html
   carv hello.carv
   carv init
   carv add mylib --git https://github.com/user/mylib
@@ -145,7 +190,60 @@ main();
 	fmt.Println("  carv build src/main.carv")
 }
 
-func emitC(filename string) {
+// emitC prints the C generated for a file. With --target, the runtime is
+// generated for that profile instead of the host.
+func emitC(args []string) {
+	const usage = "usage: carv emit-c [--target <name>] <file.carv>"
+
+	targetName, filename := "", ""
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--target" && i+1 < len(args):
+			i++
+			targetName = args[i]
+		case !strings.HasPrefix(args[i], "-") && filename == "":
+			filename = args[i]
+		default:
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(1)
+		}
+	}
+	if filename == "" {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	var custom map[string]module.Target
+	if root, err := module.FindProjectRoot(filepath.Dir(filename)); err == nil {
+		if cfg, err := module.LoadConfig(root); err == nil && cfg != nil {
+			custom = cfg.Targets
+			if targetName == "" {
+				targetName = cfg.Build.Target
+			}
+		}
+	}
+	target, err := module.ResolveTarget(targetName, custom)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+
+	program, checker := compileSource(filename, target, false)
+
+	gen := codegen.NewCGenerator()
+	gen.SetTypeInfo(checker.TypeInfo())
+	gen.SetMoves(checker.Moves())
+	gen.SetCaptures(checker.Captures())
+	gen.SetTarget(target)
+	cCode := gen.Generate(program)
+	fmt.Print(cCode)
+}
+
+// compileSource parses and type checks filename for target, printing every
+// diagnostic and exiting on any error; warnings do not stop the build. Syntax
+// errors do not stop the checker: it still runs over whatever parsed, so a
+// single run reports as many problems as possible.
+func compileSource(filename string, target *module.Target, staticMemory bool) (*ast.Program, *types.Checker) {
 	content, err := os.ReadFile(filename)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error reading file: %s\n", err)
@@ -156,103 +254,862 @@ func emitC(filename string) {
 	p := parser.New(l)
 	program := p.ParseProgram()
 
-	if len(p.Errors()) > 0 {
-		for _, msg := range p.Errors() {
-			fmt.Fprintln(os.Stderr, msg)
-		}
-		os.Exit(1)
+	failed := false
+	for _, msg := range p.Errors() {
+		fmt.Fprintln(os.Stderr, msg)
+		failed = true
 	}
 
 	checker := types.NewChecker()
+	checker.SetStaticMemory(staticMemory)
+	if !target.IsHost() {
+		checker.SetFreestanding(target.Name)
+	}
+	if core, device := target.VectorTable(); core != nil {
+		checker.SetVectorTable(core, device)
+	}
+	setLintLevels(checker, filename)
 	if !checker.Check(program) {
 		for _, msg := range checker.Errors() {
 			fmt.Fprintln(os.Stderr, msg)
 		}
+		failed = true
+	}
+
+	for _, msg := range checker.Warnings() {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+
+	if failed {
 		os.Exit(1)
 	}
+	return program, checker
+}
 
-	if len(checker.Warnings()) > 0 {
-		for _, msg := range checker.Warnings() {
-			fmt.Fprintln(os.Stderr, msg)
+// setLintLevels applies the [lints] table of the carv.toml of the project
+// filename is in, if there is one.
+func setLintLevels(checker *types.Checker, filename string) {
+	root, err := module.FindProjectRoot(filepath.Dir(filename))
+	if err != nil {
+		return
+	}
+	cfg, err := module.LoadConfig(root)
+	if err != nil || cfg == nil {
+		return
+	}
+	for name, value := range cfg.Lints {
+		level, err := types.ParseLintLevel(value)
+		if err == nil {
+			err = checker.SetLintLevel(name, level)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: carv.toml: [lints] %s\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// runProject builds a file (or the project's entry) for the host and runs
+// it. Arguments after the file, or after "--", are passed to the program.
+func runProject(args []string) {
+	file := ""
+	if len(args) > 0 && args[0] != "--" {
+		file, args = args[0], args[1:]
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	root, err := module.FindProjectRoot(cwd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error finding project root: %s\n", err)
+		os.Exit(1)
+	}
+	cfg, err := module.LoadConfig(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading carv.toml: %s\n", err)
+		os.Exit(1)
+	}
+
+	build := module.DefaultBuild()
+	if cfg != nil {
+		build = cfg.Build
+	}
+	// carv run executes the binary here, so it always builds for the host.
+	target, err := module.ResolveTarget("host", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if file == "" {
+		if cfg == nil || cfg.Package.Entry == "" {
+			fmt.Fprintln(os.Stderr, "usage: carv run [file.carv] [-- args...]")
+			os.Exit(1)
+		}
+		file = filepath.Join(root, cfg.Package.Entry)
+	}
+
+	binFile := buildCached(file, root, build, target)
+
+	cmd := exec.Command(binFile, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			code := exitErr.ExitCode()
+			if code < 0 {
+				code = 1
+			}
+			os.Exit(code)
 		}
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
 		os.Exit(1)
 	}
+}
+
+// buildCached compiles filename with build into a per-file directory under
+// the user cache and returns the binary's path. The C compiler is skipped
+// when the generated C and the compiler command line both match the
+// previous build.
+func buildCached(filename, root string, build module.BuildConfig, target *module.Target) string {
+	static, _ := build.StaticMemory()
+	program, checker := compileSource(filename, target, static)
 
 	gen := codegen.NewCGenerator()
 	gen.SetTypeInfo(checker.TypeInfo())
-	cCode := gen.Generate(program)
-	fmt.Print(cCode)
+	gen.SetMoves(checker.Moves())
+	gen.SetCaptures(checker.Captures())
+	gen.SetTarget(target)
+	gen.SetSourceFile(filename)
+	if static {
+		gen.SetStaticMemory(build.StaticArenaSize())
+	}
+	cCode := []byte(gen.Generate(program))
+
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		absPath = filename
+	}
+	cacheRoot, err := os.UserCacheDir()
+	if err != nil {
+		cacheRoot = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(absPath))
+	dir := filepath.Join(cacheRoot, "carv", "run", hex.EncodeToString(sum[:8]))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "error creating cache dir: %s\n", err)
+		os.Exit(1)
+	}
+
+	cFile := filepath.Join(dir, "main.c")
+	binFile := filepath.Join(dir, strings.TrimSuffix(filepath.Base(filename), ".carv"))
+
+	compiler, flags := build.CompilerCommand(target, root, cFile, binFile)
+	stampFile := filepath.Join(dir, "build.sha256")
+	h := sha256.New()
+	h.Write([]byte(strings.Join(append([]string{compiler}, flags...), "\x00")))
+	h.Write([]byte{0})
+	h.Write(cCode)
+	stamp := []byte(hex.EncodeToString(h.Sum(nil)))
+
+	prev, _ := os.ReadFile(stampFile)
+	if _, err := os.Stat(binFile); err == nil && bytes.Equal(prev, stamp) {
+		return binFile
+	}
+
+	// Leave no stale stamp behind, or a failed build would reuse the old binary.
+	os.Remove(stampFile)
+	if err := os.WriteFile(cFile, cCode, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing C file: %s\n", err)
+		os.Exit(1)
+	}
+	if err := runCmd(compiler, flags...); err != nil {
+		fmt.Fprintf(os.Stderr, "compilation failed: %s\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(stampFile, stamp, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing build stamp: %s\n", err)
+		os.Exit(1)
+	}
+	return binFile
 }
 
-func buildFile(filename string, target string) {
-	content, err := os.ReadFile(filename)
+// testProject builds a host test harness for each file that declares test
+// functions, runs it, and fails if any test failed. Without file arguments it
+// tests every .carv file under the project's src directory.
+func testProject(args []string) {
+	filter := ""
+	var files []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--filter" {
+			if i+1 >= len(args) {
+				fmt.Fprintln(os.Stderr, "usage: carv test [--filter <name>] [file.carv...]")
+				os.Exit(1)
+			}
+			filter = args[i+1]
+			i++
+			continue
+		}
+		files = append(files, args[i])
+	}
+
+	cwd, err := os.Getwd()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error reading file: %s\n", err)
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	root, err := module.FindProjectRoot(cwd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error finding project root: %s\n", err)
+		os.Exit(1)
+	}
+	cfg, err := module.LoadConfig(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading carv.toml: %s\n", err)
 		os.Exit(1)
 	}
+	if cfg != nil && len(cfg.DevDeps) > 0 {
+		installDevDependencies(root, cfg)
+	}
+	// Tests link against the same [build] includes and libraries as the
+	// program, but are always built unoptimized and with debug info.
+	build := module.DefaultBuild()
+	if cfg != nil {
+		build = cfg.Build
+	}
+	build.Optimize = false
+	build.Debug = true
 
-	l := lexer.New(string(content))
-	p := parser.New(l)
-	program := p.ParseProgram()
+	if len(files) == 0 {
+		for _, file := range findSourceFiles(root) {
+			if rel, err := filepath.Rel(cwd, file); err == nil {
+				file = rel
+			}
+			files = append(files, file)
+		}
+	}
 
-	if len(p.Errors()) > 0 {
-		for _, msg := range p.Errors() {
-			fmt.Fprintln(os.Stderr, msg)
+	outDir := filepath.Join("build", "test")
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+
+	host, err := module.ResolveTarget("host", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+
+	ran, failed := 0, 0
+	for _, file := range files {
+		program, checker := compileSource(file, host, false)
+		if len(codegen.TestNames(program)) == 0 {
+			continue
+		}
+
+		gen := codegen.NewCGenerator()
+		gen.SetTypeInfo(checker.TypeInfo())
+		gen.SetMoves(checker.Moves())
+		gen.SetCaptures(checker.Captures())
+		gen.SetTestMode(true)
+		gen.SetSourceFile(file)
+		cCode := gen.Generate(program)
+
+		base := strings.ReplaceAll(filepath.ToSlash(strings.TrimSuffix(filepath.Clean(file), ".carv")), "/", "_")
+		cFile := filepath.Join(outDir, base+"_test.c")
+		binFile, err := filepath.Abs(filepath.Join(outDir, base+"_test"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
 		}
+		if err := os.WriteFile(cFile, []byte(cCode), 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing C file: %s\n", err)
+			os.Exit(1)
+		}
+		compiler, flags := build.CompilerCommand(host, root, cFile, binFile)
+		if err := runCmd(compiler, flags...); err != nil {
+			fmt.Fprintf(os.Stderr, "compilation failed: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("running tests in %s\n", file)
+		var runArgs []string
+		if filter != "" {
+			runArgs = append(runArgs, filter)
+		}
+		ran++
+		if err := runCmd(binFile, runArgs...); err != nil {
+			failed++
+		}
+		fmt.Println()
+	}
+
+	if ran == 0 {
+		fmt.Println("no test functions found")
+		return
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d test file(s) failed\n", failed, ran)
 		os.Exit(1)
 	}
+}
 
-	checker := types.NewChecker()
-	if !checker.Check(program) {
-		for _, msg := range checker.Errors() {
-			fmt.Fprintln(os.Stderr, msg)
+// findSourceFiles lists the .carv files under root/src, or under root when
+// there is no src directory. Installed packages and build output are skipped.
+func findSourceFiles(root string) []string {
+	dir := filepath.Join(root, "src")
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		dir = root
+	}
+	var files []string
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if name := d.Name(); name == "carv_modules" || name == "build" || (strings.HasPrefix(name, ".") && path != dir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(path, ".carv") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files
+}
+
+// docProject writes API docs for the entry file (or the project's configured
+// entry) and every module it requires, one page per module.
+func docProject(args []string) {
+	format := docgen.Markdown
+	outDir := filepath.Join("build", "doc")
+	entry := ""
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--format", "-o":
+			if i+1 >= len(args) {
+				fmt.Fprintln(os.Stderr, "usage: carv doc [--format md|html] [-o <dir>] [file.carv]")
+				os.Exit(1)
+			}
+			if args[i] == "-o" {
+				outDir = args[i+1]
+			} else {
+				f, err := docgen.ParseFormat(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error: %s\n", err)
+					os.Exit(1)
+				}
+				format = f
+			}
+			i++
+		default:
+			entry = args[i]
+		}
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	root, err := module.FindProjectRoot(cwd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error finding project root: %s\n", err)
+		os.Exit(1)
+	}
+	cfg, err := module.LoadConfig(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading carv.toml: %s\n", err)
+		os.Exit(1)
+	}
+	if entry == "" {
+		if cfg == nil || cfg.Package.Entry == "" {
+			fmt.Fprintln(os.Stderr, "usage: carv doc [--format md|html] [-o <dir>] [file.carv]")
+			os.Exit(1)
 		}
+		entry = filepath.Join(root, cfg.Package.Entry)
+	}
+	if cfg == nil {
+		// Outside a project, name modules relative to the entry file.
+		root = filepath.Dir(entry)
+	}
+
+	loader := module.NewLoader(root)
+	if cfg != nil {
+		loader.SetConfig(cfg)
+	}
+	first, err := loader.LoadFile(entry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
 		os.Exit(1)
 	}
 
-	if len(checker.Warnings()) > 0 {
-		for _, msg := range checker.Warnings() {
-			fmt.Fprintln(os.Stderr, msg)
+	var mods []*docgen.Module
+	queue := []*module.Module{first}
+	seen := map[string]bool{first.Path: true}
+	for len(queue) > 0 {
+		mod := queue[0]
+		queue = queue[1:]
+		doc := docgen.Extract(mod.Name(), mod.Program)
+		mods = append(mods, doc)
+
+		for _, stmt := range mod.Program.Statements {
+			req, ok := stmt.(*ast.RequireStatement)
+			if !ok {
+				continue
+			}
+			dep, err := loader.Load(req.Path.Value, mod.Path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				os.Exit(1)
+			}
+			if dep.IsBuiltin {
+				continue
+			}
+			doc.Imports = append(doc.Imports, dep.Name())
+			if seen[dep.Path] {
+				continue
+			}
+			seen[dep.Path] = true
+			queue = append(queue, dep)
 		}
+	}
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
 		os.Exit(1)
 	}
+	pages := docgen.Generate(mods, format)
+	for _, page := range pages {
+		if err := os.WriteFile(filepath.Join(outDir, page.Path), []byte(page.Content), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("Documented %d module(s) in %s\n", len(mods), outDir)
+}
+
+const buildUsage = "usage: carv build [-p <member>|--workspace] [--target <name>] [--output <dir>] [--debug|--no-debug] [--optimize|--no-optimize] [--no-heap] [--mem-report[=json]] [-I <dir>] [-l <lib>] [file.carv]"
+
+// buildProject builds the current project, or the workspace members picked
+// with -p or --workspace. At a workspace root that has no entry of its own,
+// every member with an entry is built.
+func buildProject(args []string) {
+	var names []string
+	all := false
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-p", "--package":
+			if i+1 >= len(args) {
+				fmt.Fprintln(os.Stderr, buildUsage)
+				os.Exit(1)
+			}
+			i++
+			names = append(names, args[i])
+		case "--workspace":
+			all = true
+		case "--target", "--output", "-I", "-l":
+			rest = append(rest, args[i])
+			if i+1 < len(args) {
+				i++
+				rest = append(rest, args[i])
+			}
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	if len(names) == 0 && !all {
+		// A virtual workspace root builds its members.
+		cfg, _ := module.LoadConfig(cwd)
+		if cfg == nil || cfg.Workspace == nil || cfg.Package.Entry != "" || hasSourceArg(rest) {
+			buildPackage(rest)
+			return
+		}
+		all = true
+	}
+
+	root, err := module.FindProjectRoot(cwd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error finding project root: %s\n", err)
+		os.Exit(1)
+	}
+	ws := findWorkspace(root)
+	if ws == nil {
+		fmt.Fprintln(os.Stderr, "error: -p and --workspace need a carv.toml with a [workspace] table")
+		os.Exit(1)
+	}
+	var members []*module.Member
+	for _, name := range names {
+		m := ws.Member(name)
+		if m == nil {
+			fmt.Fprintf(os.Stderr, "error: %s is not a member of the workspace\n", name)
+			os.Exit(1)
+		}
+		members = append(members, m)
+	}
+	if all {
+		for i := range ws.Members {
+			if ws.Members[i].Config.Package.Entry != "" {
+				members = append(members, &ws.Members[i])
+			}
+		}
+	}
+	if len(members) > 1 && hasSourceArg(rest) {
+		fmt.Fprintln(os.Stderr, "error: a source file cannot be given when building several members")
+		os.Exit(1)
+	}
+
+	// Paths on the command line stay relative to where carv was run.
+	for i := 0; i+1 < len(rest); i++ {
+		switch rest[i] {
+		case "--output", "-I", "-l":
+			i++
+			rest[i] = cliPath(cwd, rest[i], rest[i-1])
+		}
+	}
+	for _, m := range members {
+		fmt.Printf("Building %s\n", m.Name)
+		if err := os.Chdir(m.Dir); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+		buildPackage(rest)
+	}
+}
+
+// cliPath makes the value of the command-line flag relative to dir, where
+// carv was run, rather than the project root that [build] paths are
+// relative to. A -l that names a library, not a file, is left alone.
+func cliPath(dir, value, flag string) string {
+	if filepath.IsAbs(value) || flag == "-l" && !module.IsLibraryFile(value) {
+		return value
+	}
+	return filepath.Join(dir, value)
+}
+
+// hasSourceArg reports whether carv build arguments name a source file.
+func hasSourceArg(args []string) bool {
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--target" || args[i] == "--output" || args[i] == "-I" || args[i] == "-l":
+			i++
+		case !strings.HasPrefix(args[i], "-"):
+			return true
+		}
+	}
+	return false
+}
+
+// buildPackage compiles a file, or the project's [package].entry, to a
+// native binary. Settings come from the [build] table of carv.toml and are
+// overridden by command-line flags.
+func buildPackage(args []string) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	root, err := module.FindProjectRoot(cwd)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error finding project root: %s\n", err)
+		os.Exit(1)
+	}
+	cfg, err := module.LoadConfig(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading carv.toml: %s\n", err)
+		os.Exit(1)
+	}
+
+	build := module.DefaultBuild()
+	if cfg != nil {
+		build = cfg.Build
+	} else {
+		// Outside a project, build next to the source file as before.
+		root, build.Output = "", ""
+	}
+
+	file := ""
+	outputFlag := false
+	memReport := ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "--mem-report", "--mem-report=table":
+			memReport = "table"
+			continue
+		case "--mem-report=json":
+			memReport = "json"
+			continue
+		case "--debug":
+			build.Debug = true
+			continue
+		case "--no-debug":
+			build.Debug = false
+			continue
+		case "--optimize":
+			build.Optimize = true
+			continue
+		case "--no-optimize":
+			build.Optimize = false
+			continue
+		case "--no-heap":
+			build.Memory = "static"
+			continue
+		case "--target", "--output", "-I", "-l":
+			if i+1 >= len(args) {
+				fmt.Fprintln(os.Stderr, buildUsage)
+				os.Exit(1)
+			}
+			i++
+		default:
+			if strings.HasPrefix(arg, "-") || file != "" {
+				fmt.Fprintln(os.Stderr, buildUsage)
+				os.Exit(1)
+			}
+			file = arg
+			continue
+		}
+		switch arg {
+		case "--target":
+			build.Target = args[i]
+		case "--output":
+			build.Output, outputFlag = args[i], true
+		case "-I":
+			build.Includes = append(build.Includes, cliPath(cwd, args[i], arg))
+		case "-l":
+			build.Libraries = append(build.Libraries, cliPath(cwd, args[i], arg))
+		}
+	}
+
+	if file == "" {
+		if cfg == nil || cfg.Package.Entry == "" {
+			fmt.Fprintln(os.Stderr, buildUsage)
+			os.Exit(1)
+		}
+		file = filepath.Join(root, cfg.Package.Entry)
+	}
+
+	var custom map[string]module.Target
+	if cfg != nil {
+		custom = cfg.Targets
+	}
+	target, err := module.ResolveTarget(build.Target, custom)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+
+	static, err := build.StaticMemory()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+
+	outDir, cFile, outFile := outputPaths(file, root, build, outputFlag, target)
+	if build.Output != "" {
+		if err := os.MkdirAll(outDir, 0o755); err != nil {
+			fmt.Fprintf(os.Stderr, "error creating output dir: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// A JSON report owns stdout; progress goes to stderr instead.
+	progress := io.Writer(os.Stdout)
+	if memReport == "json" {
+		progress = os.Stderr
+	}
+
+	hookEnv := module.ScriptEnv{Root: root, Config: cfg, Build: build, Target: target, Source: file, CFile: cFile, Binary: outFile}
+	runHook(module.PreBuildScript, hookEnv, progress)
+
+	program, checker := compileSource(file, target, static)
 
 	gen := codegen.NewCGenerator()
 	gen.SetTypeInfo(checker.TypeInfo())
+	gen.SetMoves(checker.Moves())
+	gen.SetCaptures(checker.Captures())
+	gen.SetSourceFile(file)
+	gen.SetTarget(target)
+	if static {
+		gen.SetStaticMemory(build.StaticArenaSize())
+	}
 	cCode := gen.Generate(program)
 
-	baseName := strings.TrimSuffix(filename, ".carv")
-	cFile := baseName + ".c"
-	outFile := baseName
-
 	if err := os.WriteFile(cFile, []byte(cCode), 0o644); err != nil {
 		fmt.Fprintf(os.Stderr, "error writing C file: %s\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Generated %s\n", cFile)
-
-	var compiler string
-	var flags []string
+	fmt.Fprintf(progress, "Generated %s\n", cFile)
 
-	switch target {
-	case "arm":
-		compiler = "arm-none-eabi-gcc"
-		outFile += ".elf"
-		flags = []string{"-mcpu=cortex-m4", "-mthumb", "-Os", "-ffreestanding", "-nostdlib", "-DCARV_TARGET_ARM", "-o", outFile, cFile}
-	default:
-		compiler = "gcc"
-		flags = []string{"-O2", "-o", outFile, cFile}
-	}
+	compiler, flags := build.CompilerCommand(target, root, cFile, outFile)
 
-	fmt.Printf("Compiling: %s %s\n", compiler, strings.Join(flags, " "))
+	fmt.Fprintf(progress, "Compiling: %s %s\n", compiler, strings.Join(flags, " "))
 
 	if err := runCmd(compiler, flags...); err != nil {
 		fmt.Fprintf(os.Stderr, "compilation failed: %s\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Built %s\n", outFile)
+	fmt.Fprintf(progress, "Built %s\n", outFile)
+	if static {
+		printMemoryStats(progress, gen.MemoryStats())
+	}
+	runHook(module.PostBuildScript, hookEnv, progress)
+
+	if memReport != "" {
+		report := gen.MemReport()
+		if usage, ok := stackUsage(build, target, root, cFile); ok {
+			report.ApplyStackUsage(usage)
+		}
+		if memReport == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(report); err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				os.Exit(1)
+			}
+		} else {
+			fmt.Println()
+			report.WriteTable(os.Stdout)
+		}
+	}
+}
+
+// outputPaths returns where carv build writes the C file and binary for
+// file: next to it outside a project, else under [build] output, which is
+// relative to the project unless it came from --output.
+func outputPaths(file, root string, build module.BuildConfig, outputFlag bool, target *module.Target) (outDir, cFile, outFile string) {
+	base := strings.TrimSuffix(filepath.Base(file), ".carv")
+	outDir = filepath.Dir(file)
+	if build.Output != "" {
+		outDir = build.Output
+		if !outputFlag && root != "" && !filepath.IsAbs(outDir) {
+			outDir = filepath.Join(root, outDir)
+		}
+	}
+	return outDir, filepath.Join(outDir, base+".c"), filepath.Join(outDir, target.BinaryName(base))
+}
+
+// runHook runs the [scripts] entry name if the project defines one, and
+// exits if it fails.
+func runHook(name string, env module.ScriptEnv, w io.Writer) {
+	if env.Config == nil || env.Config.Scripts[name] == "" {
+		return
+	}
+	script := env.Config.Scripts[name]
+	fmt.Fprintf(w, "Running %s: %s\n", name, script)
+
+	cmd := module.ScriptCommand(script, nil, env.Root)
+	cmd.Env = env.Environ(os.Environ())
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %s\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// runScript runs a [scripts] entry with any further arguments appended,
+// or lists the entries when no name is given.
+func runScript(args []string) {
+	root, cfg := loadProject()
+	if len(args) == 0 {
+		if len(cfg.Scripts) == 0 {
+			fmt.Println("No scripts defined in carv.toml.")
+			return
+		}
+		names := make([]string, 0, len(cfg.Scripts))
+		for name := range cfg.Scripts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  %-12s %s\n", name, cfg.Scripts[name])
+		}
+		return
+	}
+
+	name := args[0]
+	script, ok := cfg.Scripts[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "error: no script named %q in [scripts]\n", name)
+		os.Exit(1)
+	}
+
+	target, err := module.ResolveTarget(cfg.Build.Target, cfg.Targets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	env := module.ScriptEnv{Root: root, Config: cfg, Build: cfg.Build, Target: target}
+	if cfg.Package.Entry != "" {
+		env.Source = filepath.Join(root, cfg.Package.Entry)
+		_, env.CFile, env.Binary = outputPaths(env.Source, root, cfg.Build, false, target)
+	}
+
+	cmd := module.ScriptCommand(script, args[1:], root)
+	cmd.Env = env.Environ(os.Environ())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.ExitCode())
+		}
+		fmt.Fprintf(os.Stderr, "error running %s: %s\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// stackUsage compiles cFile once more with -fstack-usage and reads the
+// frame sizes gcc reports. It returns false when the compiler cannot
+// provide them, and the report keeps its own estimates.
+func stackUsage(build module.BuildConfig, target *module.Target, root, cFile string) (map[string]codegen.StackUsage, bool) {
+	dir, err := os.MkdirTemp("", "carv-stack-*")
+	if err != nil {
+		return nil, false
+	}
+	defer os.RemoveAll(dir)
+
+	compiler, args := build.StackUsageCommand(target, root, cFile, filepath.Join(dir, "out.o"))
+	if err := exec.Command(compiler, args...).Run(); err != nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "out.su"))
+	if err != nil || len(data) == 0 {
+		return nil, false
+	}
+	return codegen.ParseStackUsage(data), true
+}
+
+// printMemoryStats reports where a static-memory build placed its data.
+func printMemoryStats(w io.Writer, stats codegen.MemoryStats) {
+	arena := "no arena"
+	if stats.ArenaSize > 0 {
+		arena = fmt.Sprintf("arena %d bytes", stats.ArenaSize)
+	}
+	fmt.Fprintf(w, "Static memory: %s, %d async frame(s) and %d object(s) in static storage, %d object(s) on the stack\n",
+		arena, stats.StaticFrames, stats.StaticObjects, stats.StackObjects)
 }
 
 func runCmd(name string, args ...string) error {
@@ -325,6 +1182,13 @@ func addPackage() {
 		os.Exit(1)
 	}
 
+	if ver != "" {
+		if _, err := module.ParseConstraint(ver); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
 	dep := module.Dependency{
 		Version: ver,
 		Git:     gitURL,
@@ -341,19 +1205,10 @@ func addPackage() {
 		os.Exit(1)
 	}
 
-	// If it's a git dependency, clone it immediately.
-	if gitURL != "" {
-		modDir := filepath.Join(root, "carv_modules", name)
-		if _, err := os.Stat(modDir); err == nil {
-			fmt.Printf("  %s already installed, skipping clone\n", name)
-		} else {
-			if err := gitClone(gitURL, "", modDir); err != nil {
-				fmt.Fprintf(os.Stderr, "warning: failed to clone %s: %s\n", name, err)
-			}
-		}
-	}
-
 	fmt.Printf("Added dependency '%s' to carv.toml\n", name)
+	if gitURL != "" || localPath != "" {
+		install(root, cfg, false, false)
+	}
 }
 
 func removePackage() {
@@ -407,7 +1262,32 @@ func removePackage() {
 	fmt.Printf("Removed dependency '%s'\n", name)
 }
 
-func installPackages() {
+func installPackages(args []string) {
+	locked, offline := false, false
+	for _, arg := range args {
+		switch arg {
+		case "--locked":
+			locked = true
+		case "--offline":
+			offline = true
+		default:
+			fmt.Fprintf(os.Stderr, "unknown install option: %s\n", arg)
+			os.Exit(1)
+		}
+	}
+
+	root, cfg := loadProject()
+	if len(cfg.Dependencies) == 0 && !locked && findWorkspace(root) == nil {
+		fmt.Println("No dependencies to install.")
+		return
+	}
+
+	install(root, cfg, locked, offline)
+}
+
+// loadProject finds the enclosing project and reads its carv.toml, exiting
+// if there is none.
+func loadProject() (string, *module.Config) {
 	cwd, err := os.Getwd()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %s\n", err)
@@ -429,160 +1309,225 @@ func installPackages() {
 		fmt.Fprintln(os.Stderr, "error: no carv.toml found. Run 'carv init' first.")
 		os.Exit(1)
 	}
+	return root, cfg
+}
 
-	modsDir := filepath.Join(root, "carv_modules")
-	if err := os.MkdirAll(modsDir, 0o755); err != nil {
-		fmt.Fprintf(os.Stderr, "error creating carv_modules: %s\n", err)
+// findWorkspace returns the workspace the project at root belongs to, or
+// nil, exiting if its carv.toml is invalid.
+func findWorkspace(root string) *module.Workspace {
+	ws, err := module.FindWorkspace(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading workspace: %s\n", err)
 		os.Exit(1)
 	}
+	return ws
+}
 
-	if len(cfg.Dependencies) == 0 {
-		fmt.Println("No dependencies to install.")
-		return
+// dependencyRoot returns where carv.lock and carv_modules live for the
+// project at root: the workspace root if it is in a workspace, which is
+// then returned too.
+func dependencyRoot(root string) (string, *module.Workspace) {
+	if ws := findWorkspace(root); ws != nil {
+		return ws.Root, ws
 	}
+	return root, nil
+}
 
-	var lockPkgs []module.LockedPackage
-	installed := 0
-	skipped := 0
-
-	for name, dep := range cfg.Dependencies {
-		destDir := filepath.Join(modsDir, name)
-
-		if _, err := os.Stat(destDir); err == nil {
-			fmt.Printf("  %s already installed, skipping\n", name)
-			skipped++
-			// Still record in lock file.
-			lp := module.LockedPackage{
-				Name:    name,
-				Version: dep.Version,
-			}
-			if dep.Git != "" {
-				lp.Source = "git+" + dep.Git
-				lp.Revision = getGitRevision(destDir)
-			} else if dep.Path != "" {
-				lp.Source = "path+" + dep.Path
-			}
-			lockPkgs = append(lockPkgs, lp)
-			continue
-		}
-
-		if dep.Git != "" {
-			branch := dep.Branch
-			if branch == "" && dep.Tag != "" {
-				branch = dep.Tag
-			}
-			fmt.Printf("  Cloning %s from %s...\n", name, dep.Git)
-			if err := gitClone(dep.Git, branch, destDir); err != nil {
-				fmt.Fprintf(os.Stderr, "  error installing %s: %s\n", name, err)
-				continue
-			}
-			lp := module.LockedPackage{
-				Name:     name,
-				Version:  dep.Version,
-				Source:   "git+" + dep.Git,
-				Revision: getGitRevision(destDir),
-			}
-			lockPkgs = append(lockPkgs, lp)
-			installed++
-		} else if dep.Path != "" {
-			srcPath := dep.Path
-			if !filepath.IsAbs(srcPath) {
-				srcPath = filepath.Join(root, srcPath)
-			}
-			fmt.Printf("  Linking %s from %s...\n", name, srcPath)
-			if err := os.Symlink(srcPath, destDir); err != nil {
-				// Fallback to copy.
-				fmt.Printf("  Symlink failed, copying instead...\n")
-				if err := copyDir(srcPath, destDir); err != nil {
-					fmt.Fprintf(os.Stderr, "  error installing %s: %s\n", name, err)
-					continue
-				}
-			}
-			lp := module.LockedPackage{
-				Name:    name,
-				Version: dep.Version,
-				Source:  "path+" + dep.Path,
-			}
-			lockPkgs = append(lockPkgs, lp)
-			installed++
-		} else {
-			fmt.Fprintf(os.Stderr, "  %s: no git or path source specified, skipping\n", name)
-			skipped++
-		}
+// resolveDependencies resolves the whole workspace if there is one, else
+// the project's own carv.toml.
+func resolveDependencies(resolver *module.Resolver, ws *module.Workspace, cfg *module.Config) (*module.LockFile, error) {
+	if ws != nil {
+		return resolver.ResolveWorkspace(ws)
 	}
+	return resolver.Resolve(cfg)
+}
 
-	// Write lock file.
-	lf := &module.LockFile{Packages: lockPkgs}
-	if err := module.SaveLock(root, lf); err != nil {
-		fmt.Fprintf(os.Stderr, "warning: failed to write carv.lock: %s\n", err)
+// loadLock reads carv.lock, exiting if it is unreadable.
+func loadLock(root string) *module.LockFile {
+	lf, err := module.LoadLock(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading carv.lock: %s\n", err)
+		os.Exit(1)
 	}
-
-	fmt.Printf("\nInstalled %d, skipped %d dependencies.\n", installed, skipped)
+	return lf
 }
 
-// gitClone clones a git repository. If branch is non-empty, it clones that branch.
-func gitClone(url, branch, destDir string) error {
-	if _, err := exec.LookPath("git"); err != nil {
-		return fmt.Errorf("git is not installed or not in PATH")
+// install resolves and installs the dependencies of cfg, or of the whole
+// workspace root is in, keeping the revisions in carv.lock, and writes
+// carv.lock. With locked set, it fails
+// instead if the result differs from the existing carv.lock, before
+// anything is installed; with offline set, it fails rather than fetch
+// anything missing from the package cache.
+func install(root string, cfg *module.Config, locked, offline bool) {
+	root, ws := dependencyRoot(root)
+	current := loadLock(root)
+	resolver := module.NewResolver(root)
+	resolver.Log = os.Stdout
+	resolver.Lock = current
+	resolver.Offline = offline
+	resolver.DryRun = locked
+	lf, err := resolveDependencies(resolver, ws, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
 	}
 
-	args := []string{"clone", "--depth", "1"}
-	if branch != "" {
-		args = append(args, "--branch", branch)
+	if locked {
+		if diffs := current.Diff(lf); len(diffs) > 0 {
+			fmt.Fprintln(os.Stderr, "error: carv.lock does not match the dependencies (--locked):")
+			for _, d := range diffs {
+				fmt.Fprintf(os.Stderr, "  %s\n", d)
+			}
+			os.Exit(1)
+		}
+		// The packages are in the cache now, so this only links them.
+		resolver.DryRun = false
+		if lf, err = resolveDependencies(resolver, ws, cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+	} else if err := module.SaveLock(root, lf); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to write carv.lock: %s\n", err)
 	}
-	args = append(args, url, destDir)
 
-	cmd := exec.Command("git", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	installed := 0
+	for _, pkg := range lf.Packages {
+		if !pkg.Dev {
+			installed++
+		}
+	}
+	fmt.Printf("\nInstalled %d dependencies.\n", installed)
 }
 
-// getGitRevision returns the HEAD commit hash for a git repo directory.
-func getGitRevision(dir string) string {
-	cmd := exec.Command("git", "-C", dir, "rev-parse", "HEAD")
-	out, err := cmd.Output()
+// installDevDependencies installs [dev-dependencies] along with the
+// regular ones for carv test, updating carv.lock if that adds anything.
+func installDevDependencies(root string, cfg *module.Config) {
+	root, ws := dependencyRoot(root)
+	current := loadLock(root)
+	resolver := module.NewResolver(root)
+	resolver.Log = os.Stdout
+	resolver.Lock = current
+	resolver.Dev = true
+	lf, err := resolveDependencies(resolver, ws, cfg)
 	if err != nil {
-		return ""
+		fmt.Fprintf(os.Stderr, "error installing dev-dependencies: %s\n", err)
+		os.Exit(1)
+	}
+	if len(current.Diff(lf)) > 0 {
+		if err := module.SaveLock(root, lf); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to write carv.lock: %s\n", err)
+		}
 	}
-	return strings.TrimSpace(string(out))
 }
 
-// copyDir recursively copies a directory tree.
-func copyDir(src, dst string) error {
-	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
+// updatePackages resolves the named dependencies, or all of them, afresh
+// instead of keeping their carv.lock revisions, and rewrites carv.lock.
+func updatePackages(names []string) {
+	root, cfg := loadProject()
+	root, ws := dependencyRoot(root)
+	current := loadLock(root)
+
+	resolver := module.NewResolver(root)
+	resolver.Log = os.Stdout
+	resolver.Dev = true
+	if len(names) > 0 {
+		resolver.Lock = current
+		resolver.Update = make(map[string]bool)
+		for _, name := range names {
+			if !dependsOn(cfg, ws, name) && current.Find(name) == nil {
+				fmt.Fprintf(os.Stderr, "error: %s is not a dependency\n", name)
+				os.Exit(1)
+			}
+			resolver.Update[name] = true
 		}
+	}
 
-		relPath, err := filepath.Rel(src, path)
-		if err != nil {
-			return err
-		}
-		targetPath := filepath.Join(dst, relPath)
+	lf, err := resolveDependencies(resolver, ws, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+	if err := module.SaveLock(root, lf); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing carv.lock: %s\n", err)
+		os.Exit(1)
+	}
 
-		if d.IsDir() {
-			return os.MkdirAll(targetPath, 0o755)
+	changed := 0
+	for _, pkg := range lf.Packages {
+		old := current.Find(pkg.Name)
+		switch {
+		case old == nil:
+			fmt.Printf("  Added %s %s\n", pkg.Name, lockedVersion(pkg))
+		case old.Revision != pkg.Revision || old.Version != pkg.Version || old.Source != pkg.Source:
+			fmt.Printf("  Updated %s %s -> %s\n", pkg.Name, lockedVersion(*old), lockedVersion(pkg))
+		default:
+			continue
 		}
-
-		return copyFile(path, targetPath)
-	})
+		changed++
+	}
+	for _, old := range current.Packages {
+		if lf.Find(old.Name) == nil {
+			fmt.Printf("  Removed %s %s\n", old.Name, lockedVersion(old))
+			changed++
+		}
+	}
+	if changed == 0 {
+		fmt.Println("carv.lock is up to date.")
+	}
 }
 
-// copyFile copies a single file.
-func copyFile(src, dst string) error {
-	in, err := os.Open(src)
-	if err != nil {
-		return err
+// vendorPackages copies the locked dependencies into vendor/, where
+// imports find them before carv_modules/ and the package cache.
+func vendorPackages(args []string) {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, "usage: carv vendor")
+		os.Exit(1)
+	}
+	root, _ := loadProject()
+	root, _ = dependencyRoot(root)
+	lf := loadLock(root)
+	if len(lf.Packages) == 0 {
+		fmt.Println("No locked dependencies to vendor. Run 'carv install' first.")
+		return
+	}
+	if err := module.Vendor(root, lf, module.DefaultCache()); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
 	}
-	defer in.Close()
+	fmt.Printf("Vendored %d dependencies into vendor/.\n", len(lf.Packages))
+}
 
-	out, err := os.Create(dst)
-	if err != nil {
-		return err
+// dependsOn reports whether cfg, or any carv.toml of the workspace,
+// declares a dependency called name.
+func dependsOn(cfg *module.Config, ws *module.Workspace, name string) bool {
+	if _, ok := cfg.Dependencies[name]; ok {
+		return true
 	}
-	defer out.Close()
+	if ws != nil {
+		if _, ok := ws.Config.Dependencies[name]; ok {
+			return true
+		}
+		for _, m := range ws.Members {
+			if _, ok := m.Config.Dependencies[name]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	_, err = io.Copy(out, in)
-	return err
+// lockedVersion names a locked package's version, with its revision for
+// git packages.
+func lockedVersion(pkg module.LockedPackage) string {
+	rev := pkg.Revision
+	if len(rev) > 8 {
+		rev = rev[:8]
+	}
+	switch {
+	case pkg.Version == "":
+		return rev
+	case rev == "":
+		return pkg.Version
+	}
+	return pkg.Version + " (" + rev + ")"
 }
@@ -1,12 +1,33 @@
 package ast
 
-import "github.com/dev-dami/carv/pkg/lexer"
+import (
+	"strings"
+
+	"github.com/dev-dami/carv/pkg/lexer"
+)
 
 type Node interface {
 	TokenLiteral() string
 	Pos() (line, col int)
+	Range() Span
+}
+
+// Span is the half-open byte range [Start, End) of source text covered by a
+// node, including any nested nodes and punctuation. The parser fills it in
+// once a node is complete; nodes built by hand have an empty span.
+type Span struct {
+	Start int
+	End   int
 }
 
+func (s *Span) Range() Span { return *s }
+
+// SetRange records the node's source range.
+func (s *Span) SetRange(start, end int) { s.Start, s.End = start, end }
+
+// IsZero reports whether no range has been recorded.
+func (s Span) IsZero() bool { return s.Start == 0 && s.End == 0 }
+
 type Statement interface {
 	Node
 	statementNode()
@@ -23,7 +44,38 @@ type TypeExpr interface {
 }
 
 type Program struct {
+	Span
 	Statements []Statement
+
+	// Source is the text the program was parsed from and Tokens is the full
+	// token stream, comments and whitespace included as leading trivia. Together
+	// with node spans they form a lossless view of the file.
+	Source string
+	Tokens []lexer.Token
+}
+
+// Text returns the exact source text covered by n.
+func (p *Program) Text(n Node) string {
+	r := n.Range()
+	if r.Start < 0 || r.End > len(p.Source) || r.Start > r.End {
+		return ""
+	}
+	return p.Source[r.Start:r.End]
+}
+
+// Render rebuilds the source from the token stream and its trivia. For a
+// program produced by the parser the result is identical to Source.
+func (p *Program) Render() string {
+	var out strings.Builder
+	for _, tok := range p.Tokens {
+		for _, tr := range tok.Leading {
+			out.WriteString(tr.Text)
+		}
+		if tok.End <= len(p.Source) {
+			out.WriteString(p.Source[tok.Offset:tok.End])
+		}
+	}
+	return out.String()
 }
 
 func (p *Program) TokenLiteral() string {
@@ -41,6 +93,7 @@ func (p *Program) Pos() (int, int) {
 }
 
 type Identifier struct {
+	Span
 	Token lexer.Token
 	Value string
 }
@@ -49,7 +102,19 @@ func (i *Identifier) expressionNode()      {}
 func (i *Identifier) TokenLiteral() string { return i.Token.Literal }
 func (i *Identifier) Pos() (int, int)      { return i.Token.Line, i.Token.Column }
 
+// BadExpr stands in for an expression that failed to parse. The parser has
+// already reported the error; later passes treat it as having any type.
+type BadExpr struct {
+	Span
+	Token lexer.Token
+}
+
+func (be *BadExpr) expressionNode()      {}
+func (be *BadExpr) TokenLiteral() string { return be.Token.Literal }
+func (be *BadExpr) Pos() (int, int)      { return be.Token.Line, be.Token.Column }
+
 type IntegerLiteral struct {
+	Span
 	Token lexer.Token
 	Value int64
 }
@@ -59,6 +124,7 @@ func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
 func (il *IntegerLiteral) Pos() (int, int)      { return il.Token.Line, il.Token.Column }
 
 type FloatLiteral struct {
+	Span
 	Token lexer.Token
 	Value float64
 }
@@ -68,6 +134,7 @@ func (fl *FloatLiteral) TokenLiteral() string { return fl.Token.Literal }
 func (fl *FloatLiteral) Pos() (int, int)      { return fl.Token.Line, fl.Token.Column }
 
 type StringLiteral struct {
+	Span
 	Token lexer.Token
 	Value string
 }
@@ -77,6 +144,7 @@ func (sl *StringLiteral) TokenLiteral() string { return sl.Token.Literal }
 func (sl *StringLiteral) Pos() (int, int)      { return sl.Token.Line, sl.Token.Column }
 
 type InterpolatedString struct {
+	Span
 	Token lexer.Token
 	Parts []Expression
 }
@@ -86,6 +154,7 @@ func (is *InterpolatedString) TokenLiteral() string { return is.Token.Literal }
 func (is *InterpolatedString) Pos() (int, int)      { return is.Token.Line, is.Token.Column }
 
 type CharLiteral struct {
+	Span
 	Token lexer.Token
 	Value rune
 }
@@ -95,6 +164,7 @@ func (cl *CharLiteral) TokenLiteral() string { return cl.Token.Literal }
 func (cl *CharLiteral) Pos() (int, int)      { return cl.Token.Line, cl.Token.Column }
 
 type BoolLiteral struct {
+	Span
 	Token lexer.Token
 	Value bool
 }
@@ -104,6 +174,7 @@ func (bl *BoolLiteral) TokenLiteral() string { return bl.Token.Literal }
 func (bl *BoolLiteral) Pos() (int, int)      { return bl.Token.Line, bl.Token.Column }
 
 type NilLiteral struct {
+	Span
 	Token lexer.Token
 }
 
@@ -112,6 +183,7 @@ func (nl *NilLiteral) TokenLiteral() string { return nl.Token.Literal }
 func (nl *NilLiteral) Pos() (int, int)      { return nl.Token.Line, nl.Token.Column }
 
 type ArrayLiteral struct {
+	Span
 	Token    lexer.Token
 	Elements []Expression
 }
@@ -121,6 +193,7 @@ func (al *ArrayLiteral) TokenLiteral() string { return al.Token.Literal }
 func (al *ArrayLiteral) Pos() (int, int)      { return al.Token.Line, al.Token.Column }
 
 type MapLiteral struct {
+	Span
 	Token lexer.Token
 	Pairs map[Expression]Expression
 }
@@ -130,6 +203,7 @@ func (ml *MapLiteral) TokenLiteral() string { return ml.Token.Literal }
 func (ml *MapLiteral) Pos() (int, int)      { return ml.Token.Line, ml.Token.Column }
 
 type PrefixExpression struct {
+	Span
 	Token    lexer.Token
 	Operator string
 	Right    Expression
@@ -140,6 +214,7 @@ func (pe *PrefixExpression) TokenLiteral() string { return pe.Token.Literal }
 func (pe *PrefixExpression) Pos() (int, int)      { return pe.Token.Line, pe.Token.Column }
 
 type InfixExpression struct {
+	Span
 	Token    lexer.Token
 	Left     Expression
 	Operator string
@@ -151,6 +226,7 @@ func (ie *InfixExpression) TokenLiteral() string { return ie.Token.Literal }
 func (ie *InfixExpression) Pos() (int, int)      { return ie.Token.Line, ie.Token.Column }
 
 type CallExpression struct {
+	Span
 	Token     lexer.Token
 	Function  Expression
 	Arguments []Expression
@@ -161,6 +237,7 @@ func (ce *CallExpression) TokenLiteral() string { return ce.Token.Literal }
 func (ce *CallExpression) Pos() (int, int)      { return ce.Token.Line, ce.Token.Column }
 
 type IndexExpression struct {
+	Span
 	Token lexer.Token
 	Left  Expression
 	Index Expression
@@ -171,6 +248,7 @@ func (ie *IndexExpression) TokenLiteral() string { return ie.Token.Literal }
 func (ie *IndexExpression) Pos() (int, int)      { return ie.Token.Line, ie.Token.Column }
 
 type MemberExpression struct {
+	Span
 	Token  lexer.Token
 	Object Expression
 	Member *Identifier
@@ -181,6 +259,7 @@ func (me *MemberExpression) TokenLiteral() string { return me.Token.Literal }
 func (me *MemberExpression) Pos() (int, int)      { return me.Token.Line, me.Token.Column }
 
 type AssignExpression struct {
+	Span
 	Token    lexer.Token
 	Left     Expression
 	Operator string
@@ -192,6 +271,7 @@ func (ae *AssignExpression) TokenLiteral() string { return ae.Token.Literal }
 func (ae *AssignExpression) Pos() (int, int)      { return ae.Token.Line, ae.Token.Column }
 
 type IfExpression struct {
+	Span
 	Token       lexer.Token
 	Condition   Expression
 	Consequence *BlockStatement
@@ -203,6 +283,7 @@ func (ie *IfExpression) TokenLiteral() string { return ie.Token.Literal }
 func (ie *IfExpression) Pos() (int, int)      { return ie.Token.Line, ie.Token.Column }
 
 type MatchExpression struct {
+	Span
 	Token lexer.Token
 	Value Expression
 	Arms  []*MatchArm
@@ -213,6 +294,7 @@ func (me *MatchExpression) TokenLiteral() string { return me.Token.Literal }
 func (me *MatchExpression) Pos() (int, int)      { return me.Token.Line, me.Token.Column }
 
 type MatchArm struct {
+	Span
 	Token   lexer.Token
 	Pattern Expression
 	Body    Expression
@@ -222,11 +304,13 @@ func (ma *MatchArm) TokenLiteral() string { return ma.Token.Literal }
 func (ma *MatchArm) Pos() (int, int)      { return ma.Token.Line, ma.Token.Column }
 
 type FunctionLiteral struct {
+	Span
 	Token      lexer.Token
 	Name       *Identifier
 	Parameters []*Parameter
 	ReturnType TypeExpr
 	Body       *BlockStatement
+	Move       bool // move fn: takes what it captures by value
 }
 
 func (fl *FunctionLiteral) expressionNode()      {}
@@ -234,6 +318,7 @@ func (fl *FunctionLiteral) TokenLiteral() string { return fl.Token.Literal }
 func (fl *FunctionLiteral) Pos() (int, int)      { return fl.Token.Line, fl.Token.Column }
 
 type Parameter struct {
+	Span
 	Token   lexer.Token
 	Name    *Identifier
 	Type    TypeExpr
@@ -244,6 +329,7 @@ func (p *Parameter) TokenLiteral() string { return p.Token.Literal }
 func (p *Parameter) Pos() (int, int)      { return p.Token.Line, p.Token.Column }
 
 type SpawnExpression struct {
+	Span
 	Token lexer.Token
 	Body  *BlockStatement
 }
@@ -253,6 +339,7 @@ func (se *SpawnExpression) TokenLiteral() string { return se.Token.Literal }
 func (se *SpawnExpression) Pos() (int, int)      { return se.Token.Line, se.Token.Column }
 
 type AwaitExpression struct {
+	Span
 	Token lexer.Token
 	Value Expression
 }
@@ -262,6 +349,7 @@ func (ae *AwaitExpression) TokenLiteral() string { return ae.Token.Literal }
 func (ae *AwaitExpression) Pos() (int, int)      { return ae.Token.Line, ae.Token.Column }
 
 type SendExpression struct {
+	Span
 	Token   lexer.Token
 	Channel Expression
 	Value   Expression
@@ -272,6 +360,7 @@ func (se *SendExpression) TokenLiteral() string { return se.Token.Literal }
 func (se *SendExpression) Pos() (int, int)      { return se.Token.Line, se.Token.Column }
 
 type RecvExpression struct {
+	Span
 	Token   lexer.Token
 	Channel Expression
 }
@@ -281,6 +370,7 @@ func (re *RecvExpression) TokenLiteral() string { return re.Token.Literal }
 func (re *RecvExpression) Pos() (int, int)      { return re.Token.Line, re.Token.Column }
 
 type NewExpression struct {
+	Span
 	Token     lexer.Token
 	Type      TypeExpr
 	Arguments []Expression
@@ -291,6 +381,7 @@ func (ne *NewExpression) TokenLiteral() string { return ne.Token.Literal }
 func (ne *NewExpression) Pos() (int, int)      { return ne.Token.Line, ne.Token.Column }
 
 type CastExpression struct {
+	Span
 	Token lexer.Token
 	Value Expression
 	Type  TypeExpr
@@ -301,6 +392,7 @@ func (ce *CastExpression) TokenLiteral() string { return ce.Token.Literal }
 func (ce *CastExpression) Pos() (int, int)      { return ce.Token.Line, ce.Token.Column }
 
 type IsExpression struct {
+	Span
 	Token lexer.Token
 	Value Expression
 	Type  TypeExpr
@@ -311,6 +403,7 @@ func (ie *IsExpression) TokenLiteral() string { return ie.Token.Literal }
 func (ie *IsExpression) Pos() (int, int)      { return ie.Token.Line, ie.Token.Column }
 
 type OkExpression struct {
+	Span
 	Token lexer.Token
 	Value Expression
 }
@@ -320,6 +413,7 @@ func (oe *OkExpression) TokenLiteral() string { return oe.Token.Literal }
 func (oe *OkExpression) Pos() (int, int)      { return oe.Token.Line, oe.Token.Column }
 
 type ErrExpression struct {
+	Span
 	Token lexer.Token
 	Value Expression
 }
@@ -329,6 +423,7 @@ func (ee *ErrExpression) TokenLiteral() string { return ee.Token.Literal }
 func (ee *ErrExpression) Pos() (int, int)      { return ee.Token.Line, ee.Token.Column }
 
 type TryExpression struct {
+	Span
 	Token lexer.Token
 	Value Expression
 }
@@ -338,6 +433,7 @@ func (te *TryExpression) TokenLiteral() string { return te.Token.Literal }
 func (te *TryExpression) Pos() (int, int)      { return te.Token.Line, te.Token.Column }
 
 type BlockExpression struct {
+	Span
 	Token lexer.Token
 	Block *BlockStatement
 }
@@ -347,6 +443,7 @@ func (be *BlockExpression) TokenLiteral() string { return be.Token.Literal }
 func (be *BlockExpression) Pos() (int, int)      { return be.Token.Line, be.Token.Column }
 
 type BorrowExpression struct {
+	Span
 	Token   lexer.Token
 	Mutable bool
 	Value   Expression
@@ -357,6 +454,7 @@ func (be *BorrowExpression) TokenLiteral() string { return be.Token.Literal }
 func (be *BorrowExpression) Pos() (int, int)      { return be.Token.Line, be.Token.Column }
 
 type DerefExpression struct {
+	Span
 	Token lexer.Token
 	Value Expression
 }
@@ -368,6 +466,7 @@ func (de *DerefExpression) Pos() (int, int)      { return de.Token.Line, de.Toke
 // AsmExpression represents an inline assembly call: asm("template").
 // It compiles to a C __asm__ volatile("template") statement.
 type AsmExpression struct {
+	Span
 	Token    lexer.Token
 	Template *StringLiteral // required: the assembly template string
 }
@@ -305,6 +305,11 @@ func TestFunctionStatement(t *testing.T) {
 	assertNodeLiteralPos(t, n, "fn", 12, 1)
 }
 
+func TestAttribute(t *testing.T) {
+	n := &Attribute{Token: tok("#", 11, 1)}
+	assertNodeLiteralPos(t, n, "#", 11, 1)
+}
+
 func TestClassStatement(t *testing.T) {
 	n := &ClassStatement{Token: tok("class", 13, 1)}
 	n.statementNode()
@@ -500,6 +505,7 @@ func TestExpressionInterfaceSatisfaction(t *testing.T) {
 	var _ Expression = (*BlockExpression)(nil)
 	var _ Expression = (*BorrowExpression)(nil)
 	var _ Expression = (*DerefExpression)(nil)
+	var _ Expression = (*BadExpr)(nil)
 }
 
 func TestStatementInterfaceSatisfaction(t *testing.T) {
@@ -523,6 +529,7 @@ func TestStatementInterfaceSatisfaction(t *testing.T) {
 	var _ Statement = (*RequireStatement)(nil)
 	var _ Statement = (*ModuleStatement)(nil)
 	var _ Statement = (*SelectStatement)(nil)
+	var _ Statement = (*BadStmt)(nil)
 }
 
 func TestTypeExprInterfaceSatisfaction(t *testing.T) {
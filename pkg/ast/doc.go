@@ -2,6 +2,9 @@
 //
 // Design decisions:
 //   - Every node carries token/position metadata so diagnostics can point to source locations.
+//   - Every node also embeds a Span with its full start/end byte range. Program keeps the
+//     source and token stream (with comment/whitespace trivia), so tools like formatters
+//     can recover the exact text of any node.
 //   - Expressions, statements, and type expressions are modeled as separate interfaces to keep
 //     parsing, checking, and codegen passes explicit.
 //
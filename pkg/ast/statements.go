@@ -2,7 +2,19 @@ package ast
 
 import "github.com/dev-dami/carv/pkg/lexer"
 
+// BadStmt stands in for a statement that failed to parse. Its span covers
+// the tokens the parser skipped while recovering.
+type BadStmt struct {
+	Span
+	Token lexer.Token
+}
+
+func (bs *BadStmt) statementNode()       {}
+func (bs *BadStmt) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BadStmt) Pos() (int, int)      { return bs.Token.Line, bs.Token.Column }
+
 type LetStatement struct {
+	Span
 	Token   lexer.Token
 	Name    *Identifier
 	Type    TypeExpr
@@ -17,6 +29,7 @@ func (ls *LetStatement) TokenLiteral() string { return ls.Token.Literal }
 func (ls *LetStatement) Pos() (int, int)      { return ls.Token.Line, ls.Token.Column }
 
 type ConstStatement struct {
+	Span
 	Token  lexer.Token
 	Name   *Identifier
 	Type   TypeExpr
@@ -30,6 +43,7 @@ func (cs *ConstStatement) TokenLiteral() string { return cs.Token.Literal }
 func (cs *ConstStatement) Pos() (int, int)      { return cs.Token.Line, cs.Token.Column }
 
 type ReturnStatement struct {
+	Span
 	Token       lexer.Token
 	ReturnValue Expression
 }
@@ -39,6 +53,7 @@ func (rs *ReturnStatement) TokenLiteral() string { return rs.Token.Literal }
 func (rs *ReturnStatement) Pos() (int, int)      { return rs.Token.Line, rs.Token.Column }
 
 type ExpressionStatement struct {
+	Span
 	Token      lexer.Token
 	Expression Expression
 }
@@ -48,6 +63,7 @@ func (es *ExpressionStatement) TokenLiteral() string { return es.Token.Literal }
 func (es *ExpressionStatement) Pos() (int, int)      { return es.Token.Line, es.Token.Column }
 
 type BlockStatement struct {
+	Span
 	Token      lexer.Token
 	Statements []Statement
 }
@@ -57,6 +73,7 @@ func (bs *BlockStatement) TokenLiteral() string { return bs.Token.Literal }
 func (bs *BlockStatement) Pos() (int, int)      { return bs.Token.Line, bs.Token.Column }
 
 type ForStatement struct {
+	Span
 	Token     lexer.Token
 	Init      Statement
 	Condition Expression
@@ -69,6 +86,7 @@ func (fs *ForStatement) TokenLiteral() string { return fs.Token.Literal }
 func (fs *ForStatement) Pos() (int, int)      { return fs.Token.Line, fs.Token.Column }
 
 type ForInStatement struct {
+	Span
 	Token    lexer.Token
 	Key      *Identifier
 	Value    *Identifier
@@ -81,6 +99,7 @@ func (fis *ForInStatement) TokenLiteral() string { return fis.Token.Literal }
 func (fis *ForInStatement) Pos() (int, int)      { return fis.Token.Line, fis.Token.Column }
 
 type WhileStatement struct {
+	Span
 	Token     lexer.Token
 	Condition Expression
 	Body      *BlockStatement
@@ -91,6 +110,7 @@ func (ws *WhileStatement) TokenLiteral() string { return ws.Token.Literal }
 func (ws *WhileStatement) Pos() (int, int)      { return ws.Token.Line, ws.Token.Column }
 
 type LoopStatement struct {
+	Span
 	Token lexer.Token
 	Body  *BlockStatement
 }
@@ -100,6 +120,7 @@ func (ls *LoopStatement) TokenLiteral() string { return ls.Token.Literal }
 func (ls *LoopStatement) Pos() (int, int)      { return ls.Token.Line, ls.Token.Column }
 
 type BreakStatement struct {
+	Span
 	Token lexer.Token
 }
 
@@ -108,6 +129,7 @@ func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
 func (bs *BreakStatement) Pos() (int, int)      { return bs.Token.Line, bs.Token.Column }
 
 type ContinueStatement struct {
+	Span
 	Token lexer.Token
 }
 
@@ -116,6 +138,7 @@ func (cs *ContinueStatement) TokenLiteral() string { return cs.Token.Literal }
 func (cs *ContinueStatement) Pos() (int, int)      { return cs.Token.Line, cs.Token.Column }
 
 type FunctionStatement struct {
+	Span
 	Token      lexer.Token
 	Name       *Identifier
 	Parameters []*Parameter
@@ -124,20 +147,38 @@ type FunctionStatement struct {
 	Public     bool
 	Async      bool
 	Unsafe     bool
+	Test       bool // declared with `test fn` or #[test]; only built by `carv test`
+	Interrupt  bool // declared with `interrupt fn`; run by the hardware, never called
+	Attributes []*Attribute
+	Doc        string // text of the /// comments above the declaration
 }
 
 func (fs *FunctionStatement) statementNode()       {}
 func (fs *FunctionStatement) TokenLiteral() string { return fs.Token.Literal }
 func (fs *FunctionStatement) Pos() (int, int)      { return fs.Token.Line, fs.Token.Column }
 
+// Attribute is an #[name] or #[name(arg, ...)] annotation on a declaration.
+type Attribute struct {
+	Span
+	Token lexer.Token // the '#' token
+	Name  *Identifier
+	Args  []*Identifier
+}
+
+func (a *Attribute) TokenLiteral() string { return a.Token.Literal }
+func (a *Attribute) Pos() (int, int)      { return a.Token.Line, a.Token.Column }
+
 type ClassStatement struct {
+	Span
 	Token      lexer.Token
 	Name       *Identifier
+	Lifetime   string // the lifetime of the references it holds, like 'a
 	Fields     []*FieldDecl
 	Methods    []*MethodDecl
 	Implements []*Identifier
 	Public     bool
 	Packed     bool
+	Doc        string
 }
 
 func (cs *ClassStatement) statementNode()       {}
@@ -155,18 +196,21 @@ const (
 )
 
 type FieldDecl struct {
+	Span
 	Token   lexer.Token
 	Name    *Identifier
 	Type    TypeExpr
 	Default Expression
 	Public  bool
 	Static  bool
+	Doc     string
 }
 
 func (fd *FieldDecl) TokenLiteral() string { return fd.Token.Literal }
 func (fd *FieldDecl) Pos() (int, int)      { return fd.Token.Line, fd.Token.Column }
 
 type MethodDecl struct {
+	Span
 	Token      lexer.Token
 	Name       *Identifier
 	Receiver   ReceiverKind
@@ -176,16 +220,19 @@ type MethodDecl struct {
 	Public     bool
 	Static     bool
 	Async      bool
+	Doc        string
 }
 
 func (md *MethodDecl) TokenLiteral() string { return md.Token.Literal }
 func (md *MethodDecl) Pos() (int, int)      { return md.Token.Line, md.Token.Column }
 
 type InterfaceStatement struct {
+	Span
 	Token   lexer.Token
 	Name    *Identifier
 	Methods []*MethodSignature
 	Public  bool
+	Doc     string
 }
 
 func (is *InterfaceStatement) statementNode()       {}
@@ -193,17 +240,20 @@ func (is *InterfaceStatement) TokenLiteral() string { return is.Token.Literal }
 func (is *InterfaceStatement) Pos() (int, int)      { return is.Token.Line, is.Token.Column }
 
 type MethodSignature struct {
+	Span
 	Token      lexer.Token
 	Name       *Identifier
 	Receiver   ReceiverKind
 	Parameters []*Parameter
 	ReturnType TypeExpr
+	Doc        string
 }
 
 func (ms *MethodSignature) TokenLiteral() string { return ms.Token.Literal }
 func (ms *MethodSignature) Pos() (int, int)      { return ms.Token.Line, ms.Token.Column }
 
 type ImplStatement struct {
+	Span
 	Token     lexer.Token
 	Type      *Identifier
 	Interface *Identifier
@@ -215,6 +265,7 @@ func (is *ImplStatement) TokenLiteral() string { return is.Token.Literal }
 func (is *ImplStatement) Pos() (int, int)      { return is.Token.Line, is.Token.Column }
 
 type TypeAliasStatement struct {
+	Span
 	Token  lexer.Token
 	Name   *Identifier
 	Type   TypeExpr
@@ -226,6 +277,7 @@ func (tas *TypeAliasStatement) TokenLiteral() string { return tas.Token.Literal
 func (tas *TypeAliasStatement) Pos() (int, int)      { return tas.Token.Line, tas.Token.Column }
 
 type ImportStatement struct {
+	Span
 	Token lexer.Token
 	Path  *StringLiteral
 	Alias *Identifier
@@ -237,6 +289,7 @@ func (is *ImportStatement) TokenLiteral() string { return is.Token.Literal }
 func (is *ImportStatement) Pos() (int, int)      { return is.Token.Line, is.Token.Column }
 
 type RequireStatement struct {
+	Span
 	Token lexer.Token
 	Path  *StringLiteral
 	Alias *Identifier
@@ -249,6 +302,7 @@ func (rs *RequireStatement) TokenLiteral() string { return rs.Token.Literal }
 func (rs *RequireStatement) Pos() (int, int)      { return rs.Token.Line, rs.Token.Column }
 
 type ModuleStatement struct {
+	Span
 	Token lexer.Token
 	Name  *Identifier
 }
@@ -258,6 +312,7 @@ func (ms *ModuleStatement) TokenLiteral() string { return ms.Token.Literal }
 func (ms *ModuleStatement) Pos() (int, int)      { return ms.Token.Line, ms.Token.Column }
 
 type SelectStatement struct {
+	Span
 	Token lexer.Token
 	Cases []*SelectCase
 }
@@ -267,6 +322,7 @@ func (ss *SelectStatement) TokenLiteral() string { return ss.Token.Literal }
 func (ss *SelectStatement) Pos() (int, int)      { return ss.Token.Line, ss.Token.Column }
 
 type SelectCase struct {
+	Span
 	Token   lexer.Token
 	Comm    Expression
 	Body    *BlockStatement
@@ -279,6 +335,7 @@ func (sc *SelectCase) Pos() (int, int)      { return sc.Token.Line, sc.Token.Col
 // UnsafeStatement represents an `unsafe { ... }` block.
 // Inside an unsafe block, inline assembly (via asm expressions) is permitted.
 type UnsafeStatement struct {
+	Span
 	Token lexer.Token
 	Body  *BlockStatement
 }
@@ -286,3 +343,15 @@ type UnsafeStatement struct {
 func (us *UnsafeStatement) statementNode()       {}
 func (us *UnsafeStatement) TokenLiteral() string { return us.Token.Literal }
 func (us *UnsafeStatement) Pos() (int, int)      { return us.Token.Line, us.Token.Column }
+
+// CriticalStatement represents a `critical { ... }` block, which runs with
+// interrupts held off.
+type CriticalStatement struct {
+	Span
+	Token lexer.Token
+	Body  *BlockStatement
+}
+
+func (cs *CriticalStatement) statementNode()       {}
+func (cs *CriticalStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *CriticalStatement) Pos() (int, int)      { return cs.Token.Line, cs.Token.Column }
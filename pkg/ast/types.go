@@ -3,6 +3,7 @@ package ast
 import "github.com/dev-dami/carv/pkg/lexer"
 
 type BasicType struct {
+	Span
 	Token lexer.Token
 	Name  string
 }
@@ -12,8 +13,11 @@ func (bt *BasicType) TokenLiteral() string { return bt.Token.Literal }
 func (bt *BasicType) Pos() (int, int)      { return bt.Token.Line, bt.Token.Column }
 
 type NamedType struct {
-	Token lexer.Token
-	Name  *Identifier
+	Span
+	Token    lexer.Token
+	Name     *Identifier
+	Lifetime string     // of a class with one, like View<'a>; "" if left out
+	Args     []TypeExpr // of a built-in generic, like the u32 of Atomic<u32>
 }
 
 func (nt *NamedType) typeExprNode()        {}
@@ -21,6 +25,7 @@ func (nt *NamedType) TokenLiteral() string { return nt.Token.Literal }
 func (nt *NamedType) Pos() (int, int)      { return nt.Token.Line, nt.Token.Column }
 
 type ArrayType struct {
+	Span
 	Token       lexer.Token
 	ElementType TypeExpr
 	Size        Expression
@@ -31,6 +36,7 @@ func (at *ArrayType) TokenLiteral() string { return at.Token.Literal }
 func (at *ArrayType) Pos() (int, int)      { return at.Token.Line, at.Token.Column }
 
 type MapType struct {
+	Span
 	Token     lexer.Token
 	KeyType   TypeExpr
 	ValueType TypeExpr
@@ -41,6 +47,7 @@ func (mt *MapType) TokenLiteral() string { return mt.Token.Literal }
 func (mt *MapType) Pos() (int, int)      { return mt.Token.Line, mt.Token.Column }
 
 type FunctionType struct {
+	Span
 	Token      lexer.Token
 	Parameters []TypeExpr
 	ReturnType TypeExpr
@@ -51,6 +58,7 @@ func (ft *FunctionType) TokenLiteral() string { return ft.Token.Literal }
 func (ft *FunctionType) Pos() (int, int)      { return ft.Token.Line, ft.Token.Column }
 
 type ChannelType struct {
+	Span
 	Token       lexer.Token
 	ElementType TypeExpr
 	SendOnly    bool
@@ -62,6 +70,7 @@ func (ct *ChannelType) TokenLiteral() string { return ct.Token.Literal }
 func (ct *ChannelType) Pos() (int, int)      { return ct.Token.Line, ct.Token.Column }
 
 type OptionalType struct {
+	Span
 	Token lexer.Token
 	Inner TypeExpr
 }
@@ -71,9 +80,11 @@ func (ot *OptionalType) TokenLiteral() string { return ot.Token.Literal }
 func (ot *OptionalType) Pos() (int, int)      { return ot.Token.Line, ot.Token.Column }
 
 type RefType struct {
-	Token   lexer.Token
-	Inner   TypeExpr
-	Mutable bool
+	Span
+	Token    lexer.Token
+	Inner    TypeExpr
+	Mutable  bool
+	Lifetime string // like 'a, or "" if left out
 }
 
 func (rt *RefType) typeExprNode()        {}
@@ -81,6 +92,7 @@ func (rt *RefType) TokenLiteral() string { return rt.Token.Literal }
 func (rt *RefType) Pos() (int, int)      { return rt.Token.Line, rt.Token.Column }
 
 type ResultType struct {
+	Span
 	Token   lexer.Token
 	OkType  TypeExpr
 	ErrType TypeExpr
@@ -91,6 +103,7 @@ func (rt *ResultType) TokenLiteral() string { return rt.Token.Literal }
 func (rt *ResultType) Pos() (int, int)      { return rt.Token.Line, rt.Token.Column }
 
 type VolatileType struct {
+	Span
 	Token lexer.Token
 	Inner TypeExpr
 }
@@ -0,0 +1,132 @@
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/dev-dami/carv/pkg/ast"
+	"github.com/dev-dami/carv/pkg/types"
+)
+
+// The methods of an atomic are the GCC __atomic builtins where the target
+// has them: everywhere on the host, and on Cortex-M for loads and stores of
+// up to a word, and for read-modify-writes of up to a word on the cores
+// with LDREX and STREX. Everything else, all of it on the M0 family, runs
+// in a critical section, with interrupts held off, which orders memory
+// at least as strongly as any ordering asks for.
+
+// atomicOrders are the __atomic memory orders, by their names in Ordering.
+var atomicOrders = map[string]string{
+	"Relaxed": "__ATOMIC_RELAXED",
+	"Acquire": "__ATOMIC_ACQUIRE",
+	"Release": "__ATOMIC_RELEASE",
+	"AcqRel":  "__ATOMIC_ACQ_REL",
+	"SeqCst":  "__ATOMIC_SEQ_CST",
+}
+
+// noExclusiveAccess are the Cortex-M cores without LDREX and STREX.
+var noExclusiveAccess = map[string]bool{"cortex-m0": true, "cortex-m0plus": true, "cortex-m1": true}
+
+func (g *CGenerator) emitAtomicMacros() {
+	g.writeln("#define CARV_ATOMIC_LOCKED(body) ({ uint32_t __carv_crit = carv_critical_enter(); __auto_type __carv_r = (body); carv_critical_exit(__carv_crit); __carv_r; })")
+	g.writeln("#define CARV_ATOMIC_LOAD_LOCKED(p) CARV_ATOMIC_LOCKED(*(p))")
+	g.writeln("#define CARV_ATOMIC_STORE_LOCKED(p, v) ((void)CARV_ATOMIC_LOCKED(*(p) = (v)))")
+	g.writeln("#define CARV_ATOMIC_FETCH_ADD_LOCKED(p, v) CARV_ATOMIC_LOCKED(({ __typeof__(*(p)) __carv_old = *(p); *(p) = __carv_old + (v); __carv_old; }))")
+	g.writeln("#define CARV_ATOMIC_FETCH_SUB_LOCKED(p, v) CARV_ATOMIC_LOCKED(({ __typeof__(*(p)) __carv_old = *(p); *(p) = __carv_old - (v); __carv_old; }))")
+	g.writeln("#define CARV_ATOMIC_CAS_LOCKED(p, e, d) CARV_ATOMIC_LOCKED(({ carv_bool __carv_ok = *(p) == (e); if (__carv_ok) *(p) = (d); __carv_ok; }))")
+	g.writeln("")
+}
+
+// atomicLockFree reports whether the target has a load or store, or with
+// rmw a read-modify-write, of a ctype in one instruction sequence that
+// interrupts cannot split.
+func (g *CGenerator) atomicLockFree(ctype string, rmw bool) bool {
+	if g.target == nil || g.target.Arch != "arm" {
+		return true
+	}
+	if newCLayout(g.targetIntBits()/8, g.pointerBytes()).sizeOf(ctype) > 4 {
+		return false
+	}
+	return !rmw || !noExclusiveAccess[g.target.CPU]
+}
+
+// atomicOrder is the __atomic memory order of the ordering args[i], which
+// is SeqCst if there are not that many args.
+func atomicOrder(args []ast.Expression, i int) string {
+	if i < len(args) {
+		return atomicOrders[types.OrderingOf(args[i])]
+	}
+	return atomicOrders["SeqCst"]
+}
+
+// failureOrder is the order of a failed compare_exchange when only the
+// success order is given: the success order without its release part.
+func failureOrder(success string) string {
+	switch success {
+	case "__ATOMIC_ACQ_REL":
+		return "__ATOMIC_ACQUIRE"
+	case "__ATOMIC_RELEASE":
+		return "__ATOMIC_RELAXED"
+	}
+	return success
+}
+
+// generateAtomicCall generates a call of the method of the atomic t that
+// ptr points to.
+func (g *CGenerator) generateAtomicCall(e *ast.CallExpression, method string, t *types.AtomicType, ptr string) (string, bool) {
+	ctype := checkerTypeToCString(t.Inner)
+	args := e.Arguments
+	switch method {
+	case "load":
+		if !g.atomicLockFree(ctype, false) {
+			g.use("interrupts")
+			return fmt.Sprintf("CARV_ATOMIC_LOAD_LOCKED(%s)", ptr), true
+		}
+		return fmt.Sprintf("__atomic_load_n(%s, %s)", ptr, atomicOrder(args, 0)), true
+	case "store":
+		value := g.generateExpression(args[0])
+		if !g.atomicLockFree(ctype, false) {
+			g.use("interrupts")
+			return fmt.Sprintf("CARV_ATOMIC_STORE_LOCKED(%s, %s)", ptr, value), true
+		}
+		return fmt.Sprintf("__atomic_store_n(%s, %s, %s)", ptr, value, atomicOrder(args, 1)), true
+	case "fetch_add", "fetch_sub":
+		value := g.generateExpression(args[0])
+		if !g.atomicLockFree(ctype, true) {
+			g.use("interrupts")
+			if method == "fetch_add" {
+				return fmt.Sprintf("CARV_ATOMIC_FETCH_ADD_LOCKED(%s, %s)", ptr, value), true
+			}
+			return fmt.Sprintf("CARV_ATOMIC_FETCH_SUB_LOCKED(%s, %s)", ptr, value), true
+		}
+		return fmt.Sprintf("__atomic_%s(%s, %s, %s)", method, ptr, value, atomicOrder(args, 1)), true
+	case "compare_exchange":
+		expected := g.generateExpression(args[0])
+		desired := g.generateExpression(args[1])
+		if !g.atomicLockFree(ctype, true) {
+			g.use("interrupts")
+			return fmt.Sprintf("CARV_ATOMIC_CAS_LOCKED(%s, %s, %s)", ptr, expected, desired), true
+		}
+		success := atomicOrder(args, 2)
+		failure := failureOrder(success)
+		if len(args) > 3 {
+			failure = atomicOrder(args, 3)
+		}
+		// The builtin writes what it found over expected, which Carv
+		// code cannot see, so it gets a copy.
+		return fmt.Sprintf("({ %s __carv_expected = %s; __atomic_compare_exchange_n(%s, &__carv_expected, %s, 0, %s, %s); })",
+			ctype, expected, ptr, desired, success, failure), true
+	}
+	return "", false
+}
+
+// generateFenceCall generates fence(order?) or compiler_barrier(),
+// reporting false for any other builtin fn.
+func generateFenceCall(fn string, args []ast.Expression) (string, bool) {
+	switch fn {
+	case "fence":
+		return fmt.Sprintf("__atomic_thread_fence(%s)", atomicOrder(args, 0)), true
+	case "compiler_barrier":
+		return "__atomic_signal_fence(__ATOMIC_SEQ_CST)", true
+	}
+	return "", false
+}
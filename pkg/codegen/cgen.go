@@ -16,8 +16,12 @@ type cgenVar struct {
 }
 
 type cgenScope struct {
-	parent *cgenScope
-	vars   map[string]*cgenVar
+	parent   *cgenScope
+	vars     map[string]*cgenVar
+	order    []string // vars in declaration order, for dropping in reverse
+	function bool     // the outermost scope of a function body
+	loop     bool     // the body of a loop, which break and continue leave
+	exit     string   // run after the drops whenever the scope is left
 }
 
 type interfaceInfo struct {
@@ -34,6 +38,7 @@ type implInfo struct {
 type capturedVar struct {
 	Name  string
 	CType string
+	Mode  types.CaptureMode
 }
 
 type CGenerator struct {
@@ -44,6 +49,10 @@ type CGenerator struct {
 	scope           *cgenScope
 	fnReturnTypes   map[string]string
 	typeInfo        map[ast.Expression]types.Type
+	moves           map[ast.Expression]bool
+	captures        map[*ast.FunctionLiteral][]types.Capture
+	classes         map[string]*ast.ClassStatement
+	dropImpls       map[string]bool // classes that implement Drop
 	preamble        []string
 	inFunction      bool
 	funcRetType     string
@@ -53,12 +62,27 @@ type CGenerator struct {
 	closureDefs     []string
 	captureMap      map[string]string // varName -> "__env->varName" during closure function generation
 	lastClosureType string
+	closureTypes    map[string]string // signature -> carv_closure_N
+	closureTypeDefs []string          // function value types and wrapper prototypes
+	functions       map[string]*ast.FunctionStatement
+	fnValues        map[string]bool            // functions wrapped to be used as values
+	fileStatics     map[*ast.LetStatement]bool // top-level statics; true if their initializer is constant
 	hasAsync        bool
 	asyncFns        map[string]*asyncFnInfo
 	inAsyncFn       bool
 	asyncFnName     string
 	asyncStateID    int
 	builtinAliases  map[string]string
+	testMode        bool
+	sourceFile      string
+	target          *module.Target
+	program         *ast.Program
+	staticMemory    bool
+	arenaSize       int
+	staticSlot      bool // a `new` here must outlive the enclosing C block
+	memStats        MemoryStats
+	programCode     string          // the generated program without its runtime
+	uses            map[string]bool // optional runtime features the program calls
 }
 
 type asyncFnInfo struct {
@@ -80,6 +104,13 @@ func NewCGenerator() *CGenerator {
 		interfaces:     make(map[string]*interfaceInfo),
 		asyncFns:       make(map[string]*asyncFnInfo),
 		builtinAliases: make(map[string]string),
+		classes:        make(map[string]*ast.ClassStatement),
+		dropImpls:      make(map[string]bool),
+		closureTypes:   make(map[string]string),
+		functions:      make(map[string]*ast.FunctionStatement),
+		fnValues:       make(map[string]bool),
+		fileStatics:    make(map[*ast.LetStatement]bool),
+		uses:           make(map[string]bool),
 	}
 	g.scope = newScope(nil)
 	return g
@@ -95,6 +126,41 @@ func (g *CGenerator) SetTypeInfo(info map[ast.Expression]types.Type) {
 	g.typeInfo = info
 }
 
+// SetTarget selects the target profile the runtime is emitted for. Without
+// one, the runtime assumes the host.
+func (g *CGenerator) SetTarget(t *module.Target) {
+	g.target = t
+}
+
+func (g *CGenerator) targetIntBits() int {
+	if g.target == nil || g.target.IntBits == 0 {
+		return 64
+	}
+	return g.target.IntBits
+}
+
+// emitTargetConfig records the target profile as preprocessor defines, so
+// the runtime and any hand-written C can adapt to it.
+func (g *CGenerator) emitTargetConfig() {
+	if g.target == nil {
+		return
+	}
+	g.writeln("")
+	g.writeln("// Target: " + g.target.Name)
+	if g.freestanding() {
+		g.writeln("#define CARV_FREESTANDING 1")
+	}
+	if g.target.Arch == "arm" {
+		g.writeln("#ifndef CARV_TARGET_ARM")
+		g.writeln("#define CARV_TARGET_ARM 1")
+		g.writeln("#endif")
+	}
+	g.writeln(fmt.Sprintf("#define CARV_INT_BITS %d", g.targetIntBits()))
+	if g.target.PointerBits != 0 {
+		g.writeln(fmt.Sprintf("#define CARV_POINTER_BITS %d", g.target.PointerBits))
+	}
+}
+
 func (g *CGenerator) addPreamble(stmt string) {
 	g.preamble = append(g.preamble, stmt)
 }
@@ -153,6 +219,12 @@ func checkerTypeToCString(t types.Type) string {
 	if vol, ok := t.(*types.VolatileType); ok {
 		return "volatile " + checkerTypeToCString(vol.Inner)
 	}
+	if a, ok := t.(*types.AtomicType); ok {
+		return checkerTypeToCString(a.Inner)
+	}
+	if m, ok := t.(*types.MutexType); ok {
+		return checkerTypeToCString(m.Inner)
+	}
 	if arr, ok := t.(*types.ArrayType); ok {
 		elem := checkerTypeToCString(arr.Element)
 		switch elem {
@@ -180,11 +252,7 @@ func checkerTypeToCString(t types.Type) string {
 			}
 			return iface.Name + "_ref"
 		}
-		inner := checkerTypeToCString(ref.Inner)
-		if ref.Mutable {
-			return inner + "*"
-		}
-		return "const " + inner + "*"
+		return refToC(checkerTypeToCString(ref.Inner), ref.Mutable)
 	}
 	if iface, ok := t.(*types.InterfaceType); ok {
 		return iface.Name + "_ref"
@@ -201,7 +269,7 @@ func checkerTypeToCString(t types.Type) string {
 func (g *CGenerator) resolveType(expr ast.Expression) string {
 	if g.typeInfo != nil {
 		if t, ok := g.typeInfo[expr]; ok {
-			if cs := checkerTypeToCString(t); cs != "" && cs != "void" {
+			if cs := g.checkerTypeToC(t); cs != "" && cs != "void" {
 				return cs
 			}
 		}
@@ -223,21 +291,24 @@ func (g *CGenerator) exitScope() {
 	}
 }
 
-func (g *CGenerator) emitScopeDrops() {
-	if g.scope == nil {
-		return
-	}
-	for name, v := range g.scope.vars {
-		if v.Owned {
-			switch v.CType {
-			case "carv_string":
-				g.writeln(fmt.Sprintf("carv_string_drop(&%s);", name))
-			}
-		}
-	}
+// enterFunctionScope starts the scope of a function body, which return
+// and ? leave.
+func (g *CGenerator) enterFunctionScope() {
+	g.enterScope()
+	g.scope.function = true
+}
+
+// enterLoopScope starts the scope of a loop body, which break and
+// continue leave.
+func (g *CGenerator) enterLoopScope() {
+	g.enterScope()
+	g.scope.loop = true
 }
 
 func (g *CGenerator) declareVar(name, ctype string, mutable, owned bool) {
+	if _, exists := g.scope.vars[name]; !exists {
+		g.scope.order = append(g.scope.order, name)
+	}
 	g.scope.vars[name] = &cgenVar{CType: ctype, Mutable: mutable, Owned: owned}
 }
 
@@ -260,6 +331,7 @@ func (g *CGenerator) getVarType(name string) string {
 func (g *CGenerator) collectFunctionReturnTypes(program *ast.Program) {
 	for _, stmt := range program.Statements {
 		if fn, ok := stmt.(*ast.FunctionStatement); ok {
+			g.functions[fn.Name.Value] = fn
 			g.enterScope()
 			for _, p := range fn.Parameters {
 				pType := g.typeToC(p.Type)
@@ -354,6 +426,8 @@ func (g *CGenerator) collectAsyncLocalsFromStatement(stmt ast.Statement, info *a
 		}
 	case *ast.BlockStatement:
 		g.collectAsyncLocalsFromBlock(s, info, seen)
+	case *ast.CriticalStatement:
+		g.collectAsyncLocalsFromBlock(s.Body, info, seen)
 	}
 }
 
@@ -374,11 +448,25 @@ func (g *CGenerator) inferResultPayloadTypes(body *ast.BlockStatement) (okType,
 }
 
 func (g *CGenerator) Generate(program *ast.Program) string {
+	program = g.selectTests(program)
+	g.program = program
 	g.collectBuiltinModuleAliases(program)
 	g.collectFunctionReturnTypes(program)
 	g.collectInterfacesAndImpls(program)
 	g.collectAsyncFunctions(program)
-	g.emitRuntime()
+
+	for _, stmt := range program.Statements {
+		if cls, ok := stmt.(*ast.ClassStatement); ok {
+			g.classes[cls.Name.Value] = cls
+			g.writeln(fmt.Sprintf("typedef struct %s %s;", cls.Name.Value, cls.Name.Value))
+		}
+	}
+
+	// Function value types are declared as they are met, anywhere in the
+	// program, and go between the class names and the class bodies, which
+	// may hold them.
+	forwardOutput := g.output.String()
+	g.output.Reset()
 
 	for _, stmt := range program.Statements {
 		if cls, ok := stmt.(*ast.ClassStatement); ok {
@@ -387,6 +475,7 @@ func (g *CGenerator) Generate(program *ast.Program) string {
 	}
 
 	g.generateInterfaceTypedefs()
+	g.generateFileStatics(program)
 
 	for _, stmt := range program.Statements {
 		if fn, ok := stmt.(*ast.FunctionStatement); ok {
@@ -401,9 +490,15 @@ func (g *CGenerator) Generate(program *ast.Program) string {
 	}
 
 	g.generateImplMethodDecls()
+	g.generateClassDrops(program)
 
 	g.writeln("")
 
+	// Closures are lifted out of the bodies that make them, into code
+	// that goes after the declarations and before every body.
+	declOutput := g.output.String()
+	g.output.Reset()
+
 	for _, stmt := range program.Statements {
 		if fn, ok := stmt.(*ast.FunctionStatement); ok {
 			g.generateFunction(fn)
@@ -430,9 +525,51 @@ func (g *CGenerator) Generate(program *ast.Program) string {
 		}
 	}
 
+	if g.testMode {
+		g.generateTestMain(program)
+	} else {
+		g.generateMain(program, asyncMain)
+	}
+
+	mainBody := g.output.String()
+	g.output.Reset()
+
+	g.output.WriteString(forwardOutput)
+	for _, def := range g.closureTypeDefs {
+		g.writeln(def)
+	}
+	g.output.WriteString(declOutput)
+	for _, def := range g.closureDefs {
+		g.writeln(def)
+	}
+	g.output.WriteString(preMainOutput)
+	g.output.WriteString(mainBody)
+
+	// The runtime goes first but is written last, once the program shows
+	// which parts of it are needed.
+	code := g.output.String()
+	g.programCode = code
+	g.output.Reset()
+	if g.testMode {
+		g.use("assert")
+	}
+	g.emitRuntime(g.uses)
+	g.output.WriteString(code)
+
+	return g.output.String()
+}
+
+func (g *CGenerator) generateMain(program *ast.Program, asyncMain *ast.FunctionStatement) {
 	g.writeln("")
-	g.writeln("int main(void) {")
-	g.indent++
+	if g.freestanding() {
+		g.writeln("int main(void) {")
+		g.indent++
+	} else {
+		g.writeln("int main(int argc, char** argv) {")
+		g.indent++
+		g.writeln("carv_argc = argc;")
+		g.writeln("carv_argv = argv;")
+	}
 
 	if asyncMain != nil {
 		g.writeln("carv_loop loop;")
@@ -450,23 +587,13 @@ func (g *CGenerator) Generate(program *ast.Program) string {
 				g.generateStatement(stmt)
 			}
 		}
+		g.emitScopeDrops()
 	}
 
 	g.writeln("carv_arena_free_all();")
 	g.writeln("return 0;")
 	g.indent--
 	g.writeln("}")
-
-	mainBody := g.output.String()
-	g.output.Reset()
-
-	g.output.WriteString(preMainOutput)
-	for _, def := range g.closureDefs {
-		g.writeln(def)
-	}
-	g.output.WriteString(mainBody)
-
-	return g.output.String()
 }
 
 func (g *CGenerator) collectBuiltinModuleAliases(program *ast.Program) {
@@ -488,646 +615,6 @@ func (g *CGenerator) collectBuiltinModuleAliases(program *ast.Program) {
 	}
 }
 
-func (g *CGenerator) emitRuntime() {
-	g.writeln("#include <stdio.h>")
-	g.writeln("#include <stdlib.h>")
-	g.writeln("#include <string.h>")
-	g.writeln("#include <stdint.h>")
-	g.writeln("#include <stddef.h>")
-	g.writeln("#include <stdbool.h>")
-	g.writeln("#include <unistd.h>")
-	g.writeln("#include <sys/types.h>")
-	g.writeln("#include <sys/socket.h>")
-	g.writeln("#include <netinet/in.h>")
-	g.writeln("#include <arpa/inet.h>")
-	g.writeln("#include <dirent.h>")
-	g.writeln("")
-	g.writeln("// Arena allocator for automatic memory management")
-	g.writeln("#define CARV_ARENA_BLOCK_SIZE (1024 * 1024)  // 1MB blocks")
-	g.writeln("typedef struct carv_arena_block {")
-	g.writeln("    char* data;")
-	g.writeln("    size_t used;")
-	g.writeln("    size_t capacity;")
-	g.writeln("    struct carv_arena_block* next;")
-	g.writeln("} carv_arena_block;")
-	g.writeln("")
-	g.writeln("typedef struct {")
-	g.writeln("    carv_arena_block* head;")
-	g.writeln("    carv_arena_block* current;")
-	g.writeln("} carv_arena;")
-	g.writeln("")
-	g.writeln("static carv_arena carv_global_arena = {NULL, NULL};")
-	g.writeln("")
-	g.writeln("static carv_arena_block* carv_arena_new_block(size_t min_size) {")
-	g.writeln("    size_t size = min_size > CARV_ARENA_BLOCK_SIZE ? min_size : CARV_ARENA_BLOCK_SIZE;")
-	g.writeln("    carv_arena_block* block = (carv_arena_block*)malloc(sizeof(carv_arena_block));")
-	g.writeln("    block->data = (char*)malloc(size);")
-	g.writeln("    block->used = 0;")
-	g.writeln("    block->capacity = size;")
-	g.writeln("    block->next = NULL;")
-	g.writeln("    return block;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("static void* carv_arena_alloc(size_t size) {")
-	g.writeln("    size = (size + 7) & ~7;  // 8-byte alignment")
-	g.writeln("    if (!carv_global_arena.current || carv_global_arena.current->used + size > carv_global_arena.current->capacity) {")
-	g.writeln("        carv_arena_block* block = carv_arena_new_block(size);")
-	g.writeln("        if (carv_global_arena.current) {")
-	g.writeln("            carv_global_arena.current->next = block;")
-	g.writeln("        } else {")
-	g.writeln("            carv_global_arena.head = block;")
-	g.writeln("        }")
-	g.writeln("        carv_global_arena.current = block;")
-	g.writeln("    }")
-	g.writeln("    void* ptr = carv_global_arena.current->data + carv_global_arena.current->used;")
-	g.writeln("    carv_global_arena.current->used += size;")
-	g.writeln("    return ptr;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("static void carv_arena_free_all(void) {")
-	g.writeln("    carv_arena_block* block = carv_global_arena.head;")
-	g.writeln("    while (block) {")
-	g.writeln("        carv_arena_block* next = block->next;")
-	g.writeln("        free(block->data);")
-	g.writeln("        free(block);")
-	g.writeln("        block = next;")
-	g.writeln("    }")
-	g.writeln("    carv_global_arena.head = NULL;")
-	g.writeln("    carv_global_arena.current = NULL;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("typedef long long carv_int;")
-	g.writeln("typedef double carv_float;")
-	g.writeln("typedef bool carv_bool;")
-	g.writeln("typedef struct { char* data; size_t len; bool owned; } carv_string;")
-	g.writeln("")
-	g.writeln("// Create string from C string literal (NOT owned - never freed)")
-	g.writeln("static carv_string carv_string_lit(const char* s) {")
-	g.writeln("    return (carv_string){(char*)s, strlen(s), false};")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("// Create owned string from heap allocation")
-	g.writeln("static carv_string carv_string_own(char* data, size_t len) {")
-	g.writeln("    return (carv_string){data, len, true};")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("// Clone a string (always returns owned copy)")
-	g.writeln("static carv_string carv_string_clone(carv_string s) {")
-	g.writeln("    if (!s.data) return (carv_string){NULL, 0, false};")
-	g.writeln("    char* copy = (char*)carv_arena_alloc(s.len + 1);")
-	g.writeln("    memcpy(copy, s.data, s.len + 1);")
-	g.writeln("    return (carv_string){copy, s.len, true};")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("// Move ownership (source zeroed)")
-	g.writeln("static carv_string carv_string_move(carv_string* s) {")
-	g.writeln("    carv_string out = *s;")
-	g.writeln("    s->data = NULL;")
-	g.writeln("    s->len = 0;")
-	g.writeln("    s->owned = false;")
-	g.writeln("    return out;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("// Drop a string (free if owned)")
-	g.writeln("static void carv_string_drop(carv_string* s) {")
-	g.writeln("    // Note: with arena allocator, we don't actually free individual strings")
-	g.writeln("    // This is a no-op for now but the interface exists for future per-alloc freeing")
-	g.writeln("    s->data = NULL;")
-	g.writeln("    s->len = 0;")
-	g.writeln("    s->owned = false;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("static carv_string carv_strdup_str(const char* s) {")
-	g.writeln("    size_t len = strlen(s) + 1;")
-	g.writeln("    char* copy = (char*)carv_arena_alloc(len);")
-	g.writeln("    memcpy(copy, s, len);")
-	g.writeln("    return (carv_string){copy, len - 1, true};")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("typedef struct { carv_int* data; carv_int len; carv_int cap; } carv_int_array;")
-	g.writeln("typedef struct { carv_float* data; carv_int len; carv_int cap; } carv_float_array;")
-	g.writeln("typedef struct { carv_string* data; carv_int len; carv_int cap; } carv_string_array;")
-	g.writeln("typedef struct { carv_bool* data; carv_int len; carv_int cap; } carv_bool_array;")
-	g.writeln("")
-	g.writeln("carv_int_array carv_new_int_array(carv_int len) {")
-	g.writeln("    carv_int_array arr;")
-	g.writeln("    arr.data = (carv_int*)carv_arena_alloc(len * sizeof(carv_int));")
-	g.writeln("    arr.len = len;")
-	g.writeln("    arr.cap = len;")
-	g.writeln("    return arr;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("carv_float_array carv_new_float_array(carv_int len) {")
-	g.writeln("    carv_float_array arr;")
-	g.writeln("    arr.data = (carv_float*)carv_arena_alloc(len * sizeof(carv_float));")
-	g.writeln("    arr.len = len;")
-	g.writeln("    arr.cap = len;")
-	g.writeln("    return arr;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("carv_string_array carv_new_string_array(carv_int len) {")
-	g.writeln("    carv_string_array arr;")
-	g.writeln("    arr.data = (carv_string*)carv_arena_alloc(len * sizeof(carv_string));")
-	g.writeln("    arr.len = len;")
-	g.writeln("    arr.cap = len;")
-	g.writeln("    return arr;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("void carv_print_int(carv_int x) { printf(\"%lld\\n\", x); }")
-	g.writeln("void carv_print_float(carv_float x) { printf(\"%g\\n\", x); }")
-	g.writeln("void carv_print_bool(carv_bool x) { printf(\"%s\\n\", x ? \"true\" : \"false\"); }")
-	g.writeln("void carv_print_string(carv_string x) { printf(\"%s\\n\", x.data); }")
-	g.writeln("")
-	g.writeln("void carv_print_int_array(carv_int_array arr) {")
-	g.writeln("    printf(\"[\");")
-	g.writeln("    for (carv_int i = 0; i < arr.len; i++) {")
-	g.writeln("        if (i > 0) printf(\", \");")
-	g.writeln("        printf(\"%lld\", arr.data[i]);")
-	g.writeln("    }")
-	g.writeln("    printf(\"]\");")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("void carv_print_float_array(carv_float_array arr) {")
-	g.writeln("    printf(\"[\");")
-	g.writeln("    for (carv_int i = 0; i < arr.len; i++) {")
-	g.writeln("        if (i > 0) printf(\", \");")
-	g.writeln("        printf(\"%g\", arr.data[i]);")
-	g.writeln("    }")
-	g.writeln("    printf(\"]\");")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("void carv_print_string_array(carv_string_array arr) {")
-	g.writeln("    printf(\"[\");")
-	g.writeln("    for (carv_int i = 0; i < arr.len; i++) {")
-	g.writeln("        if (i > 0) printf(\", \");")
-	g.writeln("        printf(\"%s\", arr.data[i].data);")
-	g.writeln("    }")
-	g.writeln("    printf(\"]\");")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("void carv_print_bool_array(carv_bool_array arr) {")
-	g.writeln("    printf(\"[\");")
-	g.writeln("    for (carv_int i = 0; i < arr.len; i++) {")
-	g.writeln("        if (i > 0) printf(\", \");")
-	g.writeln("        printf(\"%s\", arr.data[i] ? \"true\" : \"false\");")
-	g.writeln("    }")
-	g.writeln("    printf(\"]\");")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_string carv_read_file(carv_string path) {")
-	g.writeln("    FILE* f = fopen(path.data, \"rb\");")
-	g.writeln("    if (!f) return (carv_string){NULL, 0, false};")
-	g.writeln("    fseek(f, 0, SEEK_END);")
-	g.writeln("    long len = ftell(f);")
-	g.writeln("    fseek(f, 0, SEEK_SET);")
-	g.writeln("    char* buf = (char*)carv_arena_alloc(len + 1);")
-	g.writeln("    size_t rd = fread(buf, 1, len, f);")
-	g.writeln("    buf[rd] = '\\0';")
-	g.writeln("    fclose(f);")
-	g.writeln("    return carv_string_own(buf, rd);")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_bool carv_write_file(carv_string path, carv_string content) {")
-	g.writeln("    FILE* f = fopen(path.data, \"wb\");")
-	g.writeln("    if (!f) return false;")
-	g.writeln("    size_t written = fwrite(content.data, 1, content.len, f);")
-	g.writeln("    fclose(f);")
-	g.writeln("    return written == content.len;")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_bool carv_file_exists(carv_string path) {")
-	g.writeln("    FILE* f = fopen(path.data, \"r\");")
-	g.writeln("    if (f) { fclose(f); return true; }")
-	g.writeln("    return false;")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_bool carv_append_file(carv_string path, carv_string content) {")
-	g.writeln("    FILE* f = fopen(path.data, \"ab\");")
-	g.writeln("    if (!f) return false;")
-	g.writeln("    size_t written = fwrite(content.data, 1, content.len, f);")
-	g.writeln("    fclose(f);")
-	g.writeln("    return written == content.len;")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_bool carv_delete_file(carv_string path) {")
-	g.writeln("    return remove(path.data) == 0;")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_string_array carv_list_dir(carv_string path) {")
-	g.writeln("    carv_string_array arr = {NULL, 0, 0};")
-	g.writeln("    DIR* d = opendir(path.data);")
-	g.writeln("    if (!d) return arr;")
-	g.writeln("    carv_int cap = 16;")
-	g.writeln("    arr.data = (carv_string*)carv_arena_alloc(cap * sizeof(carv_string));")
-	g.writeln("    arr.len = 0;")
-	g.writeln("    arr.cap = cap;")
-	g.writeln("    struct dirent* entry;")
-	g.writeln("    while ((entry = readdir(d)) != NULL) {")
-	g.writeln("        if (strcmp(entry->d_name, \".\") == 0 || strcmp(entry->d_name, \"..\") == 0) continue;")
-	g.writeln("        if (arr.len >= arr.cap) {")
-	g.writeln("            carv_int new_cap = arr.cap * 2;")
-	g.writeln("            carv_string* new_data = (carv_string*)carv_arena_alloc(new_cap * sizeof(carv_string));")
-	g.writeln("            memcpy(new_data, arr.data, arr.len * sizeof(carv_string));")
-	g.writeln("            arr.data = new_data;")
-	g.writeln("            arr.cap = new_cap;")
-	g.writeln("        }")
-	g.writeln("        arr.data[arr.len++] = carv_strdup_str(entry->d_name);")
-	g.writeln("    }")
-	g.writeln("    closedir(d);")
-	g.writeln("    return arr;")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_int carv_tcp_listen(carv_string host, carv_int port) {")
-	g.writeln("    int fd = socket(AF_INET, SOCK_STREAM, 0);")
-	g.writeln("    if (fd < 0) return -1;")
-	g.writeln("    int opt = 1;")
-	g.writeln("    setsockopt(fd, SOL_SOCKET, SO_REUSEADDR, &opt, sizeof(opt));")
-	g.writeln("    struct sockaddr_in addr;")
-	g.writeln("    memset(&addr, 0, sizeof(addr));")
-	g.writeln("    addr.sin_family = AF_INET;")
-	g.writeln("    addr.sin_port = htons((uint16_t)port);")
-	g.writeln("    if (!host.data || host.len == 0 || strcmp(host.data, \"0.0.0.0\") == 0) {")
-	g.writeln("        addr.sin_addr.s_addr = INADDR_ANY;")
-	g.writeln("    } else if (inet_pton(AF_INET, host.data, &addr.sin_addr) <= 0) {")
-	g.writeln("        close(fd);")
-	g.writeln("        return -1;")
-	g.writeln("    }")
-	g.writeln("    if (bind(fd, (struct sockaddr*)&addr, sizeof(addr)) < 0) {")
-	g.writeln("        close(fd);")
-	g.writeln("        return -1;")
-	g.writeln("    }")
-	g.writeln("    if (listen(fd, 16) < 0) {")
-	g.writeln("        close(fd);")
-	g.writeln("        return -1;")
-	g.writeln("    }")
-	g.writeln("    return fd;")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_int carv_tcp_accept(carv_int listener_fd) {")
-	g.writeln("    int conn_fd = accept((int)listener_fd, NULL, NULL);")
-	g.writeln("    if (conn_fd < 0) return -1;")
-	g.writeln("    return conn_fd;")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_string carv_tcp_read(carv_int conn_fd, carv_int max_bytes) {")
-	g.writeln("    if (max_bytes <= 0) return carv_strdup_str(\"\");")
-	g.writeln("    char* buf = (char*)carv_arena_alloc((size_t)max_bytes + 1);")
-	g.writeln("    ssize_t n = recv((int)conn_fd, buf, (size_t)max_bytes, 0);")
-	g.writeln("    if (n <= 0) {")
-	g.writeln("        buf[0] = '\\0';")
-	g.writeln("        return carv_string_own(buf, 0);")
-	g.writeln("    }")
-	g.writeln("    buf[n] = '\\0';")
-	g.writeln("    return carv_string_own(buf, (size_t)n);")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_int carv_tcp_write(carv_int conn_fd, carv_string data) {")
-	g.writeln("    if (!data.data || data.len == 0) return 0;")
-	g.writeln("    ssize_t n = send((int)conn_fd, data.data, data.len, 0);")
-	g.writeln("    if (n < 0) return -1;")
-	g.writeln("    return (carv_int)n;")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_bool carv_tcp_close(carv_int fd) {")
-	g.writeln("    return close((int)fd) == 0;")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_string_array carv_split(carv_string str, carv_string sep) {")
-	g.writeln("    carv_string_array arr = {NULL, 0, 0};")
-	g.writeln("    if (!str.data || !sep.data) return arr;")
-	g.writeln("    size_t sep_len = sep.len;")
-	g.writeln("    if (sep_len == 0) {")
-	g.writeln("        arr = carv_new_string_array(1);")
-	g.writeln("        arr.data[0] = carv_string_clone(str);")
-	g.writeln("        return arr;")
-	g.writeln("    }")
-	g.writeln("    // Count occurrences")
-	g.writeln("    carv_int count = 1;")
-	g.writeln("    char* p = str.data;")
-	g.writeln("    while ((p = strstr(p, sep.data)) != NULL) { count++; p += sep_len; }")
-	g.writeln("    arr = carv_new_string_array(count);")
-	g.writeln("    // Split")
-	g.writeln("    char* start = str.data;")
-	g.writeln("    carv_int idx = 0;")
-	g.writeln("    while ((p = strstr(start, sep.data)) != NULL) {")
-	g.writeln("        size_t part_len = p - start;")
-	g.writeln("        char* part = (char*)carv_arena_alloc(part_len + 1);")
-	g.writeln("        memcpy(part, start, part_len);")
-	g.writeln("        part[part_len] = '\\0';")
-	g.writeln("        arr.data[idx] = carv_string_own(part, part_len);")
-	g.writeln("        idx++;")
-	g.writeln("        start = p + sep_len;")
-	g.writeln("    }")
-	g.writeln("    size_t tail_len = (size_t)(str.data + str.len - start);")
-	g.writeln("    char* tail = (char*)carv_arena_alloc(tail_len + 1);")
-	g.writeln("    memcpy(tail, start, tail_len);")
-	g.writeln("    tail[tail_len] = '\\0';")
-	g.writeln("    arr.data[idx] = carv_string_own(tail, tail_len);")
-	g.writeln("    return arr;")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_string carv_join(carv_string_array arr, carv_string sep) {")
-	g.writeln("    if (arr.len == 0) return carv_strdup_str(\"\");")
-	g.writeln("    size_t sep_len = sep.data ? sep.len : 0;")
-	g.writeln("    size_t total_len = 0;")
-	g.writeln("    for (carv_int i = 0; i < arr.len; i++) {")
-	g.writeln("        if (arr.data[i].data) total_len += arr.data[i].len;")
-	g.writeln("    }")
-	g.writeln("    if (arr.len > 0) total_len += sep_len * (size_t)(arr.len - 1);")
-	g.writeln("    char* result = (char*)carv_arena_alloc(total_len + 1);")
-	g.writeln("    result[0] = '\\0';")
-	g.writeln("    for (carv_int i = 0; i < arr.len; i++) {")
-	g.writeln("        if (i > 0 && sep.data) strcat(result, sep.data);")
-	g.writeln("        if (arr.data[i].data) strcat(result, arr.data[i].data);")
-	g.writeln("    }")
-	g.writeln("    return carv_string_own(result, total_len);")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_string carv_trim(carv_string str) {")
-	g.writeln("    if (!str.data) return carv_strdup_str(\"\");")
-	g.writeln("    char* start = str.data;")
-	g.writeln("    char* end = str.data + str.len;")
-	g.writeln("    while (start < end && (*start == ' ' || *start == '\\t' || *start == '\\n' || *start == '\\r')) start++;")
-	g.writeln("    if (start == end) return carv_strdup_str(\"\");")
-	g.writeln("    char* last = end - 1;")
-	g.writeln("    while (last > start && (*last == ' ' || *last == '\\t' || *last == '\\n' || *last == '\\r')) last--;")
-	g.writeln("    size_t len = (size_t)(last - start + 1);")
-	g.writeln("    char* result = (char*)carv_arena_alloc(len + 1);")
-	g.writeln("    memcpy(result, start, len);")
-	g.writeln("    result[len] = '\\0';")
-	g.writeln("    return carv_string_own(result, len);")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_string carv_substr(carv_string str, carv_int start, carv_int end) {")
-	g.writeln("    if (!str.data) return carv_strdup_str(\"\");")
-	g.writeln("    size_t str_len = str.len;")
-	g.writeln("    if (start < 0) start = 0;")
-	g.writeln("    if (end < 0) end = (carv_int)str_len;")
-	g.writeln("    if ((size_t)start >= str_len) return carv_strdup_str(\"\");")
-	g.writeln("    if ((size_t)end > str_len) end = (carv_int)str_len;")
-	g.writeln("    if (end <= start) return carv_strdup_str(\"\");")
-	g.writeln("    size_t len = (size_t)(end - start);")
-	g.writeln("    char* result = (char*)carv_arena_alloc(len + 1);")
-	g.writeln("    memcpy(result, str.data + start, len);")
-	g.writeln("    result[len] = '\\0';")
-	g.writeln("    return carv_string_own(result, len);")
-	g.writeln("}")
-	g.writeln("")
-
-	g.writeln("carv_string carv_int_to_string(carv_int val) {")
-	g.writeln("    char* buf = (char*)carv_arena_alloc(32);")
-	g.writeln("    int len = snprintf(buf, 32, \"%lld\", val);")
-	g.writeln("    return carv_string_own(buf, len);")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("carv_string carv_float_to_string(carv_float val) {")
-	g.writeln("    char* buf = (char*)carv_arena_alloc(64);")
-	g.writeln("    int len = snprintf(buf, 64, \"%g\", val);")
-	g.writeln("    return carv_string_own(buf, len);")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("carv_string carv_bool_to_string(carv_bool val) {")
-	g.writeln("    return carv_strdup_str(val ? \"true\" : \"false\");")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("carv_string carv_concat(carv_string a, carv_string b) {")
-	g.writeln("    size_t total = a.len + b.len;")
-	g.writeln("    char* result = (char*)carv_arena_alloc(total + 1);")
-	g.writeln("    memcpy(result, a.data, a.len);")
-	g.writeln("    memcpy(result + a.len, b.data, b.len + 1);")
-	g.writeln("    return carv_string_own(result, total);")
-	g.writeln("}")
-	g.writeln("")
-
-	// GPIO HAL
-	g.writeln("#ifdef CARV_TARGET_ARM")
-	g.writeln("// ARM implementations provided by vendor HAL at link time")
-	g.writeln("extern void carv_pin_mode(carv_int pin, carv_int mode);")
-	g.writeln("extern void carv_digital_write(carv_int pin, carv_bool value);")
-	g.writeln("extern carv_bool carv_digital_read(carv_int pin);")
-	g.writeln("extern carv_int carv_analog_read(carv_int pin);")
-	g.writeln("extern void carv_analog_write(carv_int pin, carv_int value);")
-	g.writeln("#else")
-	g.writeln("// Host stubs for testing")
-	g.writeln("static void carv_pin_mode(carv_int pin, carv_int mode) { (void)pin; (void)mode; }")
-	g.writeln("static void carv_digital_write(carv_int pin, carv_bool value) { (void)pin; (void)value; }")
-	g.writeln("static carv_bool carv_digital_read(carv_int pin) { (void)pin; return false; }")
-	g.writeln("static carv_int carv_analog_read(carv_int pin) { (void)pin; return 0; }")
-	g.writeln("static void carv_analog_write(carv_int pin, carv_int value) { (void)pin; (void)value; }")
-	g.writeln("#endif")
-	g.writeln("")
-
-	// UART HAL
-	g.writeln("#ifdef CARV_TARGET_ARM")
-	g.writeln("extern carv_int carv_uart_init(carv_int port, carv_int baud);")
-	g.writeln("extern carv_int carv_uart_write(carv_int handle, carv_string data);")
-	g.writeln("extern carv_string carv_uart_read(carv_int handle, carv_int max_bytes);")
-	g.writeln("extern carv_int carv_uart_available(carv_int handle);")
-	g.writeln("#else")
-	g.writeln("static carv_int carv_uart_init(carv_int port, carv_int baud) { (void)port; (void)baud; return 0; }")
-	g.writeln("static carv_int carv_uart_write(carv_int handle, carv_string data) { (void)handle; (void)data; return 0; }")
-	g.writeln("static carv_string carv_uart_read(carv_int handle, carv_int max_bytes) { (void)handle; (void)max_bytes; return carv_string_lit(\"\"); }")
-	g.writeln("static carv_int carv_uart_available(carv_int handle) { (void)handle; return 0; }")
-	g.writeln("#endif")
-	g.writeln("")
-
-	// SPI HAL
-	g.writeln("#ifdef CARV_TARGET_ARM")
-	g.writeln("extern carv_int carv_spi_init(carv_int bus, carv_int speed);")
-	g.writeln("extern carv_string carv_spi_transfer(carv_int handle, carv_string data);")
-	g.writeln("extern carv_int carv_spi_write(carv_int handle, carv_string data);")
-	g.writeln("extern carv_string carv_spi_read(carv_int handle, carv_int len);")
-	g.writeln("#else")
-	g.writeln("static carv_int carv_spi_init(carv_int bus, carv_int speed) { (void)bus; (void)speed; return 0; }")
-	g.writeln("static carv_string carv_spi_transfer(carv_int handle, carv_string data) { (void)handle; (void)data; return carv_string_lit(\"\"); }")
-	g.writeln("static carv_int carv_spi_write(carv_int handle, carv_string data) { (void)handle; (void)data; return 0; }")
-	g.writeln("static carv_string carv_spi_read(carv_int handle, carv_int len) { (void)handle; (void)len; return carv_string_lit(\"\"); }")
-	g.writeln("#endif")
-	g.writeln("")
-
-	// I2C HAL
-	g.writeln("#ifdef CARV_TARGET_ARM")
-	g.writeln("extern carv_int carv_i2c_init(carv_int bus, carv_int addr);")
-	g.writeln("extern carv_int carv_i2c_write(carv_int handle, carv_string data);")
-	g.writeln("extern carv_string carv_i2c_read(carv_int handle, carv_int len);")
-	g.writeln("#else")
-	g.writeln("static carv_int carv_i2c_init(carv_int bus, carv_int addr) { (void)bus; (void)addr; return 0; }")
-	g.writeln("static carv_int carv_i2c_write(carv_int handle, carv_string data) { (void)handle; (void)data; return 0; }")
-	g.writeln("static carv_string carv_i2c_read(carv_int handle, carv_int len) { (void)handle; (void)len; return carv_string_lit(\"\"); }")
-	g.writeln("#endif")
-	g.writeln("")
-
-	// Timer HAL
-	g.writeln("#ifdef CARV_TARGET_ARM")
-	g.writeln("extern carv_int carv_timer_init(carv_int id, carv_int prescaler);")
-	g.writeln("extern void carv_timer_start(carv_int handle);")
-	g.writeln("extern void carv_timer_stop(carv_int handle);")
-	g.writeln("extern carv_int carv_timer_get_count(carv_int handle);")
-	g.writeln("extern void carv_delay_ms(carv_int ms);")
-	g.writeln("extern void carv_delay_us(carv_int us);")
-	g.writeln("#else")
-	g.writeln("static carv_int carv_timer_init(carv_int id, carv_int prescaler) { (void)id; (void)prescaler; return 0; }")
-	g.writeln("static void carv_timer_start(carv_int handle) { (void)handle; }")
-	g.writeln("static void carv_timer_stop(carv_int handle) { (void)handle; }")
-	g.writeln("static carv_int carv_timer_get_count(carv_int handle) { (void)handle; return 0; }")
-	g.writeln("static void carv_delay_ms(carv_int ms) { (void)ms; }")
-	g.writeln("static void carv_delay_us(carv_int us) { (void)us; }")
-	g.writeln("#endif")
-	g.writeln("")
-
-	g.writeln("typedef enum { CARV_TYPE_INT, CARV_TYPE_FLOAT, CARV_TYPE_BOOL, CARV_TYPE_STRING } carv_type_tag;")
-	g.writeln("typedef struct { carv_bool is_ok; carv_type_tag ok_tag; carv_type_tag err_tag; union { carv_int ok_int; carv_float ok_float; carv_bool ok_bool; carv_string ok_str; void* ok_ptr; } ok; union { carv_string err_str; carv_int err_code; } err; } carv_result;")
-	g.writeln("")
-	g.writeln("static carv_result carv_ok_int(carv_int val) { carv_result r; memset(&r, 0, sizeof(r)); r.is_ok = true; r.ok_tag = CARV_TYPE_INT; r.ok.ok_int = val; return r; }")
-	g.writeln("static carv_result carv_ok_float(carv_float val) { carv_result r; memset(&r, 0, sizeof(r)); r.is_ok = true; r.ok_tag = CARV_TYPE_FLOAT; r.ok.ok_float = val; return r; }")
-	g.writeln("static carv_result carv_ok_bool(carv_bool val) { carv_result r; memset(&r, 0, sizeof(r)); r.is_ok = true; r.ok_tag = CARV_TYPE_BOOL; r.ok.ok_bool = val; return r; }")
-	g.writeln("static carv_result carv_ok_str(carv_string val) { carv_result r; memset(&r, 0, sizeof(r)); r.is_ok = true; r.ok_tag = CARV_TYPE_STRING; r.ok.ok_str = val; return r; }")
-	g.writeln("static carv_result carv_err_str(carv_string val) { carv_result r; memset(&r, 0, sizeof(r)); r.is_ok = false; r.err_tag = CARV_TYPE_STRING; r.err.err_str = val; return r; }")
-	g.writeln("static carv_result carv_err_code(carv_int val) { carv_result r; memset(&r, 0, sizeof(r)); r.is_ok = false; r.err_tag = CARV_TYPE_INT; r.err.err_code = val; return r; }")
-	g.writeln("")
-
-	// Map runtime: open-addressing hash map with string keys
-	g.writeln("// --- Map runtime ---")
-	g.writeln("typedef enum { CARV_MAP_VAL_INT, CARV_MAP_VAL_FLOAT, CARV_MAP_VAL_BOOL, CARV_MAP_VAL_STRING } carv_map_val_tag;")
-	g.writeln("typedef struct { carv_string key; carv_map_val_tag tag; union { carv_int i; carv_float f; carv_bool b; carv_string s; } val; bool occupied; } carv_map_entry;")
-	g.writeln("typedef struct { carv_map_entry* entries; carv_int cap; carv_int len; } carv_map;")
-	g.writeln("")
-	g.writeln("static uint64_t carv_map_hash(carv_string key) {")
-	g.writeln("    uint64_t h = 14695981039346656037ULL;")
-	g.writeln("    for (size_t i = 0; i < key.len; i++) {")
-	g.writeln("        h ^= (uint64_t)(unsigned char)key.data[i];")
-	g.writeln("        h *= 1099511628211ULL;")
-	g.writeln("    }")
-	g.writeln("    return h;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("static carv_map carv_map_new(carv_int cap) {")
-	g.writeln("    carv_map m;")
-	g.writeln("    m.cap = cap < 8 ? 8 : cap;")
-	g.writeln("    m.len = 0;")
-	g.writeln("    m.entries = (carv_map_entry*)carv_arena_alloc(m.cap * sizeof(carv_map_entry));")
-	g.writeln("    memset(m.entries, 0, m.cap * sizeof(carv_map_entry));")
-	g.writeln("    return m;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("static carv_map_entry* carv_map_find(carv_map* m, carv_string key) {")
-	g.writeln("    uint64_t h = carv_map_hash(key);")
-	g.writeln("    for (carv_int i = 0; i < m->cap; i++) {")
-	g.writeln("        carv_int idx = (carv_int)((h + (uint64_t)i) % (uint64_t)m->cap);")
-	g.writeln("        carv_map_entry* e = &m->entries[idx];")
-	g.writeln("        if (!e->occupied) return e;")
-	g.writeln("        if (e->key.len == key.len && memcmp(e->key.data, key.data, key.len) == 0) return e;")
-	g.writeln("    }")
-	g.writeln("    return NULL;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("static void carv_map_grow(carv_map* m) {")
-	g.writeln("    carv_int old_cap = m->cap;")
-	g.writeln("    carv_map_entry* old = m->entries;")
-	g.writeln("    m->cap = old_cap * 2;")
-	g.writeln("    m->entries = (carv_map_entry*)carv_arena_alloc(m->cap * sizeof(carv_map_entry));")
-	g.writeln("    memset(m->entries, 0, m->cap * sizeof(carv_map_entry));")
-	g.writeln("    m->len = 0;")
-	g.writeln("    for (carv_int i = 0; i < old_cap; i++) {")
-	g.writeln("        if (old[i].occupied) {")
-	g.writeln("            carv_map_entry* e = carv_map_find(m, old[i].key);")
-	g.writeln("            *e = old[i];")
-	g.writeln("            m->len++;")
-	g.writeln("        }")
-	g.writeln("    }")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("static void carv_map_set_int(carv_map* m, carv_string key, carv_int val) {")
-	g.writeln("    if (m->len * 2 >= m->cap) carv_map_grow(m);")
-	g.writeln("    carv_map_entry* e = carv_map_find(m, key);")
-	g.writeln("    if (!e->occupied) { m->len++; e->occupied = true; e->key = key; }")
-	g.writeln("    e->tag = CARV_MAP_VAL_INT; e->val.i = val;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("static void carv_map_set_float(carv_map* m, carv_string key, carv_float val) {")
-	g.writeln("    if (m->len * 2 >= m->cap) carv_map_grow(m);")
-	g.writeln("    carv_map_entry* e = carv_map_find(m, key);")
-	g.writeln("    if (!e->occupied) { m->len++; e->occupied = true; e->key = key; }")
-	g.writeln("    e->tag = CARV_MAP_VAL_FLOAT; e->val.f = val;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("static void carv_map_set_bool(carv_map* m, carv_string key, carv_bool val) {")
-	g.writeln("    if (m->len * 2 >= m->cap) carv_map_grow(m);")
-	g.writeln("    carv_map_entry* e = carv_map_find(m, key);")
-	g.writeln("    if (!e->occupied) { m->len++; e->occupied = true; e->key = key; }")
-	g.writeln("    e->tag = CARV_MAP_VAL_BOOL; e->val.b = val;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("static void carv_map_set_str(carv_map* m, carv_string key, carv_string val) {")
-	g.writeln("    if (m->len * 2 >= m->cap) carv_map_grow(m);")
-	g.writeln("    carv_map_entry* e = carv_map_find(m, key);")
-	g.writeln("    if (!e->occupied) { m->len++; e->occupied = true; e->key = key; }")
-	g.writeln("    e->tag = CARV_MAP_VAL_STRING; e->val.s = val;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("static carv_int carv_map_get_int(carv_map* m, carv_string key) {")
-	g.writeln("    carv_map_entry* e = carv_map_find(m, key);")
-	g.writeln("    if (e && e->occupied) return e->val.i;")
-	g.writeln("    return 0;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("static carv_float carv_map_get_float(carv_map* m, carv_string key) {")
-	g.writeln("    carv_map_entry* e = carv_map_find(m, key);")
-	g.writeln("    if (e && e->occupied) return e->val.f;")
-	g.writeln("    return 0.0;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("static carv_bool carv_map_get_bool(carv_map* m, carv_string key) {")
-	g.writeln("    carv_map_entry* e = carv_map_find(m, key);")
-	g.writeln("    if (e && e->occupied) return e->val.b;")
-	g.writeln("    return false;")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("static carv_string carv_map_get_str(carv_map* m, carv_string key) {")
-	g.writeln("    carv_map_entry* e = carv_map_find(m, key);")
-	g.writeln("    if (e && e->occupied) return e->val.s;")
-	g.writeln("    return (carv_string){NULL, 0, false};")
-	g.writeln("}")
-	g.writeln("")
-	g.writeln("static void carv_print_map(carv_map m) {")
-	g.writeln("    printf(\"{\");")
-	g.writeln("    int first = 1;")
-	g.writeln("    for (carv_int i = 0; i < m.cap; i++) {")
-	g.writeln("        if (!m.entries[i].occupied) continue;")
-	g.writeln("        if (!first) printf(\", \");")
-	g.writeln("        first = 0;")
-	g.writeln("        printf(\"\\\"%s\\\": \", m.entries[i].key.data);")
-	g.writeln("        switch (m.entries[i].tag) {")
-	g.writeln("        case CARV_MAP_VAL_INT: printf(\"%lld\", m.entries[i].val.i); break;")
-	g.writeln("        case CARV_MAP_VAL_FLOAT: printf(\"%g\", m.entries[i].val.f); break;")
-	g.writeln("        case CARV_MAP_VAL_BOOL: printf(\"%s\", m.entries[i].val.b ? \"true\" : \"false\"); break;")
-	g.writeln("        case CARV_MAP_VAL_STRING: printf(\"\\\"%s\\\"\", m.entries[i].val.s.data); break;")
-	g.writeln("        }")
-	g.writeln("    }")
-	g.writeln("    printf(\"}\");")
-	g.writeln("}")
-	g.writeln("")
-
-	if g.hasAsync {
-		g.emitEventLoopRuntime()
-	}
-}
-
 func (g *CGenerator) emitEventLoopRuntime() {
 	g.writeln("typedef struct carv_loop carv_loop;")
 	g.writeln("typedef struct carv_task {")
@@ -1142,17 +629,43 @@ func (g *CGenerator) emitEventLoopRuntime() {
 	g.writeln("    int ready_cap;")
 	g.writeln("};")
 	g.writeln("")
+	if g.staticMemory {
+		g.writeln("#ifndef CARV_MAX_TASKS")
+		g.writeln("#define CARV_MAX_TASKS 8")
+		g.writeln("#endif")
+		g.writeln("static carv_task* carv_ready_slots[CARV_MAX_TASKS];")
+		g.writeln("")
+	}
 	g.writeln("static void carv_loop_init(carv_loop* loop) {")
-	g.writeln("    loop->ready = NULL;")
-	g.writeln("    loop->ready_count = 0;")
-	g.writeln("    loop->ready_cap = 0;")
+	if g.staticMemory {
+		g.writeln("    loop->ready = carv_ready_slots;")
+		g.writeln("    loop->ready_count = 0;")
+		g.writeln("    loop->ready_cap = CARV_MAX_TASKS;")
+	} else {
+		g.writeln("    loop->ready = NULL;")
+		g.writeln("    loop->ready_count = 0;")
+		g.writeln("    loop->ready_cap = 0;")
+	}
 	g.writeln("}")
 	g.writeln("")
 	g.writeln("static void carv_loop_add_task(carv_loop* loop, carv_task* task) {")
 	g.writeln("    if (loop->ready_count >= loop->ready_cap) {")
-	g.writeln("        int newcap = loop->ready_cap == 0 ? 4 : loop->ready_cap * 2;")
-	g.writeln("        loop->ready = (carv_task**)realloc(loop->ready, newcap * sizeof(carv_task*));")
-	g.writeln("        loop->ready_cap = newcap;")
+	switch {
+	case g.staticMemory:
+		g.writeln("        carv_out_cstr(\"carv: too many tasks (raise CARV_MAX_TASKS)\\n\");")
+		g.writeln("        carv_halt();")
+	case g.freestanding():
+		// No heap: grow into the arena and leave the old array behind.
+		g.writeln("        int newcap = loop->ready_cap == 0 ? 4 : loop->ready_cap * 2;")
+		g.writeln("        carv_task** grown = (carv_task**)carv_arena_alloc(newcap * sizeof(carv_task*));")
+		g.writeln("        if (loop->ready_count) memcpy(grown, loop->ready, loop->ready_count * sizeof(carv_task*));")
+		g.writeln("        loop->ready = grown;")
+		g.writeln("        loop->ready_cap = newcap;")
+	default:
+		g.writeln("        int newcap = loop->ready_cap == 0 ? 4 : loop->ready_cap * 2;")
+		g.writeln("        loop->ready = (carv_task**)realloc(loop->ready, newcap * sizeof(carv_task*));")
+		g.writeln("        loop->ready_cap = newcap;")
+	}
 	g.writeln("    }")
 	g.writeln("    loop->ready[loop->ready_count++] = task;")
 	g.writeln("}")
@@ -1169,7 +682,9 @@ func (g *CGenerator) emitEventLoopRuntime() {
 	g.writeln("            }")
 	g.writeln("        }")
 	g.writeln("    }")
-	g.writeln("    if (loop->ready) free(loop->ready);")
+	if !g.freestanding() && !g.staticMemory {
+		g.writeln("    if (loop->ready) free(loop->ready);")
+	}
 	g.writeln("}")
 	g.writeln("")
 }
@@ -1177,6 +692,10 @@ func (g *CGenerator) emitEventLoopRuntime() {
 func (g *CGenerator) generateFunctionDecl(fn *ast.FunctionStatement) {
 	fnName := g.safeName(fn.Name.Value)
 	params := g.paramsToC(fn.Parameters)
+	if fn.Interrupt {
+		g.writeln(g.interruptSignature(fn) + ";")
+		return
+	}
 	if fn.Async {
 		frameName := fnName + "_frame"
 		g.writeln(fmt.Sprintf("typedef struct %s %s;", frameName, frameName))
@@ -1192,6 +711,7 @@ func (g *CGenerator) inferFunctionReturnType(fn *ast.FunctionStatement) string {
 		return g.typeToC(fn.ReturnType)
 	}
 	if g.functionReturnsResult(fn.Body) {
+		g.use("result")
 		return "carv_result"
 	}
 	retType := g.inferReturnTypeFromBody(fn.Body)
@@ -1279,7 +799,7 @@ func (g *CGenerator) generateAsyncFunction(fn *ast.FunctionStatement) {
 	g.inAsyncFn = true
 	g.asyncFnName = fn.Name.Value
 	g.asyncStateID = 0
-	g.enterScope()
+	g.enterFunctionScope()
 
 	for _, p := range fn.Parameters {
 		pType := g.typeToC(p.Type)
@@ -1316,7 +836,15 @@ func (g *CGenerator) generateAsyncFunction(fn *ast.FunctionStatement) {
 	frameType := frameName + "*"
 	g.writeln(fmt.Sprintf("%s %s(%s) {", frameType, fnName, g.paramsToC(fn.Parameters)))
 	g.indent++
-	g.writeln(fmt.Sprintf("%s* f = (%s*)carv_arena_alloc(sizeof(%s));", frameName, frameName, frameName))
+	if g.staticMemory {
+		// Async functions cannot recurse in static mode, so one frame each suffices.
+		g.writeln(fmt.Sprintf("static %s frame;", frameName))
+		g.writeln(fmt.Sprintf("%s* f = &frame;", frameName))
+		g.memStats.StaticFrames++
+	} else {
+		g.use("arena")
+		g.writeln(fmt.Sprintf("%s* f = (%s*)carv_arena_alloc(sizeof(%s));", frameName, frameName, frameName))
+	}
 	g.writeln("f->__state = 0;")
 	for _, p := range fn.Parameters {
 		pName := p.Name.Value
@@ -1442,9 +970,13 @@ func (g *CGenerator) generateFunction(fn *ast.FunctionStatement) {
 	retType := g.inferFunctionReturnType(fn)
 	params := g.paramsToC(fn.Parameters)
 	fnName := g.safeName(fn.Name.Value)
-	g.writeln(fmt.Sprintf("%s %s(%s) {", retType, fnName, params))
+	if fn.Interrupt {
+		g.writeln(g.interruptSignature(fn) + " {")
+	} else {
+		g.writeln(fmt.Sprintf("%s %s(%s) {", retType, fnName, params))
+	}
 	g.indent++
-	g.enterScope()
+	g.enterFunctionScope()
 
 	g.inFunction = true
 	g.funcRetType = retType
@@ -1455,15 +987,15 @@ func (g *CGenerator) generateFunction(fn *ast.FunctionStatement) {
 
 	for _, p := range fn.Parameters {
 		pType := g.typeToC(p.Type)
-		g.declareVar(p.Name.Value, pType, false, false)
+		g.declareVar(p.Name.Value, pType, false, g.dropFunc(pType) != "")
 	}
 
 	for _, stmt := range fn.Body.Statements {
 		g.generateStatement(stmt)
 	}
 
-	g.writeln("__carv_exit:;")
 	g.emitScopeDrops()
+	g.writeln("__carv_exit:;")
 	if retType != "void" {
 		g.writeln("return __carv_retval;")
 	}
@@ -1484,9 +1016,29 @@ func (g *CGenerator) analyzeCaptured(fn *ast.FunctionLiteral) []capturedVar {
 	seen := make(map[string]bool)
 	var captures []capturedVar
 	g.walkForCaptures(fn.Body, paramSet, seen, &captures)
+	for i := range captures {
+		captures[i].Mode = g.captureMode(fn, captures[i].Name)
+	}
 	return captures
 }
 
+// SetCaptures gives Generate how the checker found each closure to
+// capture its variables. Without them every capture is copied, or moved,
+// into the closure, and changes the closure makes are not seen outside it.
+func (g *CGenerator) SetCaptures(captures map[*ast.FunctionLiteral][]types.Capture) {
+	g.captures = captures
+}
+
+// captureMode returns how the closure fn captures name.
+func (g *CGenerator) captureMode(fn *ast.FunctionLiteral, name string) types.CaptureMode {
+	for _, c := range g.captures[fn] {
+		if c.Name == name {
+			return c.Mode
+		}
+	}
+	return types.CaptureMove
+}
+
 func (g *CGenerator) walkForCaptures(node ast.Node, params map[string]bool, seen map[string]bool, captures *[]capturedVar) {
 	if node == nil {
 		return
@@ -1505,6 +1057,8 @@ func (g *CGenerator) walkForCaptures(node ast.Node, params map[string]bool, seen
 		for _, stmt := range n.Statements {
 			g.walkForCaptures(stmt, params, seen, captures)
 		}
+	case *ast.CriticalStatement:
+		g.walkForCaptures(n.Body, params, seen, captures)
 	case *ast.LetStatement:
 		g.walkForCaptures(n.Value, params, seen, captures)
 	case *ast.ConstStatement:
@@ -1557,7 +1111,15 @@ func (g *CGenerator) walkForCaptures(node ast.Node, params map[string]bool, seen
 	case *ast.DerefExpression:
 		g.walkForCaptures(n.Value, params, seen, captures)
 	case *ast.FunctionLiteral:
-		// Don't descend into nested closures
+		// What a nested closure captures, this one has to capture for it.
+		inner := make(map[string]bool, len(params)+len(n.Parameters))
+		for name := range params {
+			inner[name] = true
+		}
+		for _, p := range n.Parameters {
+			inner[p.Name.Value] = true
+		}
+		g.walkForCaptures(n.Body, inner, seen, captures)
 	}
 }
 
@@ -1567,38 +1129,33 @@ func (g *CGenerator) generateClosureExpression(fn *ast.FunctionLiteral) string {
 
 	envName := fmt.Sprintf("__closure_%d_env", id)
 	fnName := fmt.Sprintf("__closure_%d_fn", id)
-	closureType := fmt.Sprintf("__closure_%d", id)
 
 	retType := g.closureReturnType(fn)
 	paramTypes := g.closureParamTypes(fn)
+	closureType := g.closureType(retType, paramTypes)
 
 	// Emit env struct
 	var envDef strings.Builder
 	envDef.WriteString("typedef struct { ")
 	for _, c := range captures {
-		envDef.WriteString(fmt.Sprintf("%s %s; ", c.CType, c.Name))
+		if c.Mode == types.CaptureMove {
+			envDef.WriteString(fmt.Sprintf("%s %s; ", c.CType, c.Name))
+		} else {
+			envDef.WriteString(fmt.Sprintf("%s* %s; ", c.CType, c.Name))
+		}
 	}
 	envDef.WriteString(fmt.Sprintf("} %s;", envName))
 	g.closureDefs = append(g.closureDefs, envDef.String())
 
-	// Emit fn_ptr typedef (fat pointer)
-	var fnPtrSig strings.Builder
-	fnPtrSig.WriteString("void*")
-	for _, pt := range paramTypes {
-		fnPtrSig.WriteString(", " + pt)
-	}
-	closureTypeDef := fmt.Sprintf("typedef struct { void* env; %s (*fn_ptr)(%s); } %s;",
-		retType, fnPtrSig.String(), closureType)
-	g.closureDefs = append(g.closureDefs, closureTypeDef)
-
 	// Emit lambda-lifted function
 	var liftedFn strings.Builder
-	liftedFn.WriteString(fmt.Sprintf("static %s %s(%s* __env", retType, fnName, envName))
+	liftedFn.WriteString(fmt.Sprintf("static %s %s(void* __envp", retType, fnName))
 	for _, p := range fn.Parameters {
 		pType := g.typeToC(p.Type)
 		liftedFn.WriteString(fmt.Sprintf(", %s %s", pType, p.Name.Value))
 	}
 	liftedFn.WriteString(") {\n")
+	liftedFn.WriteString(fmt.Sprintf("    %s* __env = (%s*)__envp;\n", envName, envName))
 
 	oldOutput := g.output
 	oldIndent := g.indent
@@ -1610,15 +1167,19 @@ func (g *CGenerator) generateClosureExpression(fn *ast.FunctionLiteral) string {
 	g.indent = 1
 	g.inFunction = true
 	g.funcRetType = retType
-	g.enterScope()
+	g.enterFunctionScope()
 
 	g.captureMap = make(map[string]string)
 	for _, c := range captures {
-		g.captureMap[c.Name] = fmt.Sprintf("__env->%s", c.Name)
+		if c.Mode == types.CaptureMove {
+			g.captureMap[c.Name] = fmt.Sprintf("__env->%s", c.Name)
+		} else {
+			g.captureMap[c.Name] = fmt.Sprintf("(*__env->%s)", c.Name)
+		}
 	}
 	for _, p := range fn.Parameters {
 		pType := g.typeToC(p.Type)
-		g.declareVar(p.Name.Value, pType, p.Mutable, false)
+		g.declareVar(p.Name.Value, pType, p.Mutable, g.dropFunc(pType) != "")
 	}
 
 	if retType != "void" {
@@ -1629,8 +1190,8 @@ func (g *CGenerator) generateClosureExpression(fn *ast.FunctionLiteral) string {
 		g.generateStatement(stmt)
 	}
 
-	g.writeln("__carv_exit:;")
 	g.emitScopeDrops()
+	g.writeln("__carv_exit:;")
 	if retType != "void" {
 		g.writeln("return __carv_retval;")
 	}
@@ -1651,12 +1212,15 @@ func (g *CGenerator) generateClosureExpression(fn *ast.FunctionLiteral) string {
 	envVar := fmt.Sprintf("__env_%d", id)
 	clVar := fmt.Sprintf("__cl_%d", id)
 
+	g.use("arena")
 	g.writeln(fmt.Sprintf("%s* %s = (%s*)carv_arena_alloc(sizeof(%s));", envName, envVar, envName, envName))
 	for _, c := range captures {
-		if g.isMoveType(c.CType) {
-			g.writeln(fmt.Sprintf("%s->%s = carv_string_move(&%s);", envVar, c.Name, c.Name))
+		name := &ast.Identifier{Value: c.Name}
+		code := g.generateIdentifier(name)
+		if c.Mode == types.CaptureMove {
+			g.writeln(fmt.Sprintf("%s->%s = %s;", envVar, c.Name, g.takeValue(name, code)))
 		} else {
-			g.writeln(fmt.Sprintf("%s->%s = %s;", envVar, c.Name, g.safeName(c.Name)))
+			g.writeln(fmt.Sprintf("%s->%s = &%s;", envVar, c.Name, code))
 		}
 	}
 	g.writeln(fmt.Sprintf("%s %s = { .env = %s, .fn_ptr = %s };", closureType, clVar, envVar, fnName))
@@ -1681,13 +1245,8 @@ func (g *CGenerator) closureParamTypes(fn *ast.FunctionLiteral) []string {
 	return pts
 }
 
-func (g *CGenerator) isMoveType(ctype string) bool {
-	return ctype == "carv_string" || strings.HasSuffix(ctype, "_array") || strings.HasSuffix(ctype, "*")
-}
-
 func (g *CGenerator) generateClassDecl(cls *ast.ClassStatement) {
 	className := cls.Name.Value
-	g.writeln(fmt.Sprintf("typedef struct %s %s;", className, className))
 	g.writeln(fmt.Sprintf("struct %s {", className))
 	g.indent++
 
@@ -1704,9 +1263,16 @@ func (g *CGenerator) generateClassDecl(cls *ast.ClassStatement) {
 	}
 	g.writeln("")
 
-	g.writeln(fmt.Sprintf("%s* %s_new(void) {", className, className))
-	g.indent++
-	g.writeln(fmt.Sprintf("%s* self = (%s*)carv_arena_alloc(sizeof(%s));", className, className, className))
+	if g.staticMemory {
+		// Instances are placed by the caller; see placeObject.
+		g.writeln(fmt.Sprintf("%s* %s_init(%s* self) {", className, className, className))
+		g.indent++
+	} else {
+		g.writeln(fmt.Sprintf("%s* %s_new(void) {", className, className))
+		g.indent++
+		g.use("arena")
+		g.writeln(fmt.Sprintf("%s* self = (%s*)carv_arena_alloc(sizeof(%s));", className, className, className))
+	}
 	for _, field := range cls.Fields {
 		if field.Default != nil {
 			defaultVal := g.generateExpression(field.Default)
@@ -1736,6 +1302,7 @@ func (g *CGenerator) zeroValue(cType string) string {
 	case "carv_result":
 		return "(carv_result){0}"
 	case "carv_map":
+		g.use("map")
 		return "carv_map_new(8)"
 	default:
 		if strings.HasSuffix(cType, "_array") {
@@ -1744,6 +1311,9 @@ func (g *CGenerator) zeroValue(cType string) string {
 		if strings.HasSuffix(cType, "*") {
 			return "NULL"
 		}
+		if isClosureType(cType) {
+			return "(" + cType + "){NULL, NULL}"
+		}
 		return "0"
 	}
 }
@@ -1779,7 +1349,7 @@ func (g *CGenerator) generateClassMethods(cls *ast.ClassStatement) {
 		params := g.methodParamsToC(className, method.Receiver, method.Parameters)
 		g.writeln(fmt.Sprintf("%s %s_%s(%s) {", retType, className, method.Name.Value, params))
 		g.indent++
-		g.enterScope()
+		g.enterFunctionScope()
 
 		g.inFunction = true
 		g.funcRetType = retType
@@ -1788,12 +1358,17 @@ func (g *CGenerator) generateClassMethods(cls *ast.ClassStatement) {
 			g.writeln(fmt.Sprintf("%s __carv_retval = %s;", retType, g.zeroValue(retType)))
 		}
 
+		for _, p := range method.Parameters {
+			pType := g.typeToC(p.Type)
+			g.declareVar(p.Name.Value, pType, false, g.dropFunc(pType) != "")
+		}
+
 		for _, stmt := range method.Body.Statements {
 			g.generateStatement(stmt)
 		}
 
-		g.writeln("__carv_exit:;")
 		g.emitScopeDrops()
+		g.writeln("__carv_exit:;")
 		if retType != "void" {
 			g.writeln("return __carv_retval;")
 		}
@@ -1827,18 +1402,32 @@ func (g *CGenerator) generateStatement(stmt ast.Statement) {
 	case *ast.WhileStatement:
 		g.generateWhileStatement(s)
 	case *ast.BreakStatement:
+		g.emitDrops(g.dropsLeaving(true))
 		g.writeln("break;")
 	case *ast.ContinueStatement:
+		g.emitDrops(g.dropsLeaving(true))
 		g.writeln("continue;")
 	case *ast.BlockStatement:
 		g.generateBlockStatement(s)
 	case *ast.UnsafeStatement:
 		g.generateUnsafeStatement(s)
+	case *ast.CriticalStatement:
+		g.generateCriticalStatement(s)
 	}
 }
 
 func (g *CGenerator) generateLetStatement(s *ast.LetStatement) {
-	varType := g.inferType(s.Value)
+	if g.isFileStatic(s) {
+		if !g.fileStatics[s] {
+			g.staticSlot = true
+			value := g.generateExpression(s.Value)
+			g.staticSlot = false
+			g.flushPreamble()
+			g.writeln(fmt.Sprintf("%s = %s;", s.Name.Value, value))
+		}
+		return
+	}
+	varType := g.declaredType(s)
 	varName := s.Name.Value
 	g.lastClosureType = ""
 	value := g.generateExpression(s.Value)
@@ -1853,10 +1442,8 @@ func (g *CGenerator) generateLetStatement(s *ast.LetStatement) {
 		g.arrayLengths[varName] = len(arr.Elements)
 	}
 
-	isOwned := false
-	if varType == "carv_string" || strings.HasSuffix(varType, "_array") || strings.HasSuffix(varType, "*") {
-		isOwned = true
-	}
+	// A static lives for the whole program, so it is never dropped.
+	isOwned := !s.Static && g.dropFunc(varType) != ""
 	g.declareVar(varName, varType, s.Mutable, isOwned)
 
 	if varType == "carv_result" {
@@ -1873,6 +1460,26 @@ func (g *CGenerator) generateLetStatement(s *ast.LetStatement) {
 	g.writeln(fmt.Sprintf("%s%s %s = %s;", prefix, varType, varName, value))
 }
 
+// declaredType is the C type of the variable s declares: the one its
+// annotation gives, if the value may have another C type, like a literal
+// stored in a u32 or a volatile, or else the value's.
+func (g *CGenerator) declaredType(s *ast.LetStatement) string {
+	switch t := s.Type.(type) {
+	case *ast.BasicType:
+		switch t.Name {
+		case "u8", "u16", "u32", "u64", "i8", "i16", "i32", "i64", "f32", "f64", "usize", "isize":
+			return g.typeToC(t)
+		}
+	case *ast.VolatileType:
+		return g.typeToC(t)
+	case *ast.NamedType:
+		if len(t.Args) > 0 {
+			return g.typeToC(t)
+		}
+	}
+	return g.inferType(s.Value)
+}
+
 func (g *CGenerator) generateConstStatement(s *ast.ConstStatement) {
 	varType := g.inferType(s.Value)
 	varName := s.Name.Value
@@ -1892,6 +1499,7 @@ func (g *CGenerator) generateReturnStatement(s *ast.ReturnStatement) {
 			g.flushPreamble()
 			g.writeln(fmt.Sprintf("__carv_retval = %s;", value))
 		}
+		g.emitDrops(g.dropsLeaving(false))
 		g.writeln("goto __carv_exit;")
 		return
 	}
@@ -1945,12 +1553,13 @@ func (g *CGenerator) generateForStatement(s *ast.ForStatement) {
 
 	g.writeRaw(") {\n")
 	g.indent++
-	g.enterScope()
+	g.enterLoopScope()
 
 	for _, stmt := range s.Body.Statements {
 		g.generateStatement(stmt)
 	}
 
+	g.emitScopeDrops()
 	g.exitScope()
 	g.indent--
 	g.writeln("}")
@@ -1966,15 +1575,17 @@ func (g *CGenerator) generateForInStatement(s *ast.ForInStatement) {
 
 	g.writeln(fmt.Sprintf("for (carv_int %s = 0; %s < %s.len; %s++) {", idxVar, idxVar, iterableExpr, idxVar))
 	g.indent++
-	g.enterScope()
+	g.enterLoopScope()
 
 	elemType := g.inferArrayElemType(s.Iterable)
 	g.writeln(fmt.Sprintf("%s %s = %s.data[%s];", elemType, iterName, iterableExpr, idxVar))
+	g.declareVar(iterName, elemType, false, false)
 
 	for _, stmt := range s.Body.Statements {
 		g.generateStatement(stmt)
 	}
 
+	g.emitScopeDrops()
 	g.exitScope()
 	g.indent--
 	g.writeln("}")
@@ -1985,11 +1596,14 @@ func (g *CGenerator) generateWhileStatement(s *ast.WhileStatement) {
 	g.flushPreamble()
 	g.writeln(fmt.Sprintf("while (%s) {", cond))
 	g.indent++
+	g.enterLoopScope()
 
 	for _, stmt := range s.Body.Statements {
 		g.generateStatement(stmt)
 	}
 
+	g.emitScopeDrops()
+	g.exitScope()
 	g.indent--
 	g.writeln("}")
 }
@@ -2003,6 +1617,7 @@ func (g *CGenerator) generateBlockStatement(s *ast.BlockStatement) {
 		g.generateStatement(stmt)
 	}
 
+	g.emitScopeDrops()
 	g.exitScope()
 	g.indent--
 	g.writeln("}")
@@ -2020,6 +1635,7 @@ func (g *CGenerator) generateUnsafeStatement(s *ast.UnsafeStatement) {
 		g.generateStatement(stmt)
 	}
 
+	g.emitScopeDrops()
 	g.exitScope()
 	g.indent--
 	g.writeln("}")
@@ -2038,25 +1654,30 @@ func (g *CGenerator) generateIfStatement(e *ast.IfExpression) {
 	g.flushPreamble()
 	g.writeln(fmt.Sprintf("if (%s) {", cond))
 	g.indent++
-
-	for _, stmt := range e.Consequence.Statements {
-		g.generateStatement(stmt)
-	}
-
+	g.generateBranch(e.Consequence)
 	g.indent--
 
 	if e.Alternative != nil {
 		g.writeln("} else {")
 		g.indent++
-		for _, stmt := range e.Alternative.Statements {
-			g.generateStatement(stmt)
-		}
+		g.generateBranch(e.Alternative)
 		g.indent--
 	}
 
 	g.writeln("}")
 }
 
+// generateBranch emits the statements of an if or else branch, in a scope
+// of their own.
+func (g *CGenerator) generateBranch(body *ast.BlockStatement) {
+	g.enterScope()
+	for _, stmt := range body.Statements {
+		g.generateStatement(stmt)
+	}
+	g.emitScopeDrops()
+	g.exitScope()
+}
+
 func (g *CGenerator) generateExpression(expr ast.Expression) string {
 	switch e := expr.(type) {
 	case *ast.IntegerLiteral:
@@ -2073,15 +1694,7 @@ func (g *CGenerator) generateExpression(expr ast.Expression) string {
 	case *ast.NilLiteral:
 		return "NULL"
 	case *ast.Identifier:
-		if g.captureMap != nil {
-			if mapped, ok := g.captureMap[e.Value]; ok {
-				return mapped
-			}
-		}
-		if mapped, ok := g.asyncFrameVarRef(e.Value); ok {
-			return mapped
-		}
-		return g.safeName(e.Value)
+		return g.moveOut(e, g.generateIdentifier(e))
 	case *ast.ArrayLiteral:
 		return g.generateArrayLiteral(e)
 	case *ast.MapLiteral:
@@ -2099,7 +1712,7 @@ func (g *CGenerator) generateExpression(expr ast.Expression) string {
 	case *ast.IndexExpression:
 		return g.generateIndexExpression(e)
 	case *ast.MemberExpression:
-		return g.generateMemberExpression(e)
+		return g.moveOut(e, g.generateMemberExpression(e))
 	case *ast.NewExpression:
 		return g.generateNewExpression(e)
 	case *ast.OkExpression:
@@ -2117,7 +1730,7 @@ func (g *CGenerator) generateExpression(expr ast.Expression) string {
 		return "(&" + inner + ")"
 	case *ast.DerefExpression:
 		inner := g.generateExpression(e.Value)
-		return "(*" + inner + ")"
+		return g.moveOut(e, "(*"+inner+")")
 	case *ast.CastExpression:
 		return g.generateCastExpression(e)
 	case *ast.FunctionLiteral:
@@ -2128,6 +1741,21 @@ func (g *CGenerator) generateExpression(expr ast.Expression) string {
 	return ""
 }
 
+func (g *CGenerator) generateIdentifier(e *ast.Identifier) string {
+	if g.captureMap != nil {
+		if mapped, ok := g.captureMap[e.Value]; ok {
+			return mapped
+		}
+	}
+	if mapped, ok := g.asyncFrameVarRef(e.Value); ok {
+		return mapped
+	}
+	if value := g.functionValue(e.Value); value != "" {
+		return value
+	}
+	return g.safeName(e.Value)
+}
+
 func (g *CGenerator) generatePrefixExpression(e *ast.PrefixExpression) string {
 	right := g.generateExpression(e.Right)
 	return fmt.Sprintf("(%s%s)", e.Operator, right)
@@ -2140,6 +1768,7 @@ func (g *CGenerator) generateInfixExpression(e *ast.InfixExpression) string {
 		leftType := g.resolveType(e.Left)
 		rightType := g.resolveType(e.Right)
 		if leftType == "carv_string" && rightType == "carv_string" {
+			g.use("strings")
 			return fmt.Sprintf("carv_concat(%s, %s)", left, right)
 		}
 	}
@@ -2176,6 +1805,9 @@ func (g *CGenerator) generateAssignExpression(e *ast.AssignExpression) string {
 
 	switch e.Operator {
 	case "=":
+		if g.holdsOwnedValue(e.Left) {
+			return g.generateDroppingAssign(e.Left, left, right)
+		}
 		return fmt.Sprintf("%s = %s", left, right)
 	case "+=":
 		return fmt.Sprintf("%s += %s", left, right)
@@ -2190,6 +1822,13 @@ func (g *CGenerator) generateAssignExpression(e *ast.AssignExpression) string {
 }
 
 func (g *CGenerator) generateCallExpression(e *ast.CallExpression) string {
+	if g.callsFunctionValue(e.Function) {
+		return g.generateFunctionValueCall(e)
+	}
+	if code, ok := g.generateSyncCall(e); ok {
+		return code
+	}
+
 	if member, ok := e.Function.(*ast.MemberExpression); ok {
 		if lowered, ok := g.generateBuiltinModuleCall(member, e.Arguments); ok {
 			return lowered
@@ -2197,23 +1836,40 @@ func (g *CGenerator) generateCallExpression(e *ast.CallExpression) string {
 		return g.generateMethodCall(member, e.Arguments)
 	}
 
-	fn := g.generateExpression(e.Function)
+	fn := g.calleeCode(e.Function)
 
 	if fn == "print" || fn == "println" {
 		return g.generatePrintCall(e)
 	}
 
+	if fn == "assert" || fn == "assert_eq" {
+		return g.generateAssertCall(fn, e)
+	}
+
 	if fn == "clone" && len(e.Arguments) == 1 {
 		arg := g.generateExpression(e.Arguments[0])
 		argType := g.resolveType(e.Arguments[0])
 		switch argType {
 		case "carv_string":
+			g.use("arena")
 			return fmt.Sprintf("carv_string_clone(%s)", arg)
 		default:
 			return arg
 		}
 	}
 
+	if _, user := g.fnReturnTypes[fn]; !user {
+		if fn == "take" && len(e.Arguments) == 1 {
+			return g.generateTakeCall(e.Arguments[0], nil)
+		}
+		if fn == "exchange" && len(e.Arguments) == 2 {
+			return g.generateTakeCall(e.Arguments[0], e.Arguments[1])
+		}
+		if code, ok := generateFenceCall(fn, e.Arguments); ok {
+			return code
+		}
+	}
+
 	if fn == "len" && len(e.Arguments) == 1 {
 		arg := g.generateExpression(e.Arguments[0])
 		argType := g.resolveType(e.Arguments[0])
@@ -2223,84 +1879,104 @@ func (g *CGenerator) generateCallExpression(e *ast.CallExpression) string {
 		return fmt.Sprintf("%s.len", arg)
 	}
 
+	if fn == "args" && len(e.Arguments) == 0 {
+		g.use("args")
+		return "carv_args()"
+	}
+
 	if fn == "read_file" && len(e.Arguments) == 1 {
+		g.use("fs")
 		arg := g.generateExpression(e.Arguments[0])
 		return fmt.Sprintf("carv_read_file(%s)", arg)
 	}
 
 	if fn == "write_file" && len(e.Arguments) == 2 {
+		g.use("fs")
 		path := g.generateExpression(e.Arguments[0])
 		content := g.generateExpression(e.Arguments[1])
 		return fmt.Sprintf("carv_write_file(%s, %s)", path, content)
 	}
 
 	if fn == "file_exists" && len(e.Arguments) == 1 {
+		g.use("fs")
 		arg := g.generateExpression(e.Arguments[0])
 		return fmt.Sprintf("carv_file_exists(%s)", arg)
 	}
 
 	if fn == "append_file" && len(e.Arguments) == 2 {
+		g.use("fs")
 		path := g.generateExpression(e.Arguments[0])
 		content := g.generateExpression(e.Arguments[1])
 		return fmt.Sprintf("carv_append_file(%s, %s)", path, content)
 	}
 
 	if fn == "delete_file" && len(e.Arguments) == 1 {
+		g.use("fs")
 		arg := g.generateExpression(e.Arguments[0])
 		return fmt.Sprintf("carv_delete_file(%s)", arg)
 	}
 
 	if fn == "list_dir" && len(e.Arguments) == 1 {
+		g.use("fs")
 		arg := g.generateExpression(e.Arguments[0])
 		return fmt.Sprintf("carv_list_dir(%s)", arg)
 	}
 
 	if fn == "tcp_listen" && len(e.Arguments) == 2 {
+		g.use("tcp")
 		host := g.generateExpression(e.Arguments[0])
 		port := g.generateExpression(e.Arguments[1])
 		return fmt.Sprintf("carv_tcp_listen(%s, %s)", host, port)
 	}
 
 	if fn == "tcp_accept" && len(e.Arguments) == 1 {
+		g.use("tcp")
 		listener := g.generateExpression(e.Arguments[0])
 		return fmt.Sprintf("carv_tcp_accept(%s)", listener)
 	}
 
 	if fn == "tcp_read" && len(e.Arguments) == 2 {
+		g.use("tcp")
 		conn := g.generateExpression(e.Arguments[0])
 		maxBytes := g.generateExpression(e.Arguments[1])
 		return fmt.Sprintf("carv_tcp_read(%s, %s)", conn, maxBytes)
 	}
 
 	if fn == "tcp_write" && len(e.Arguments) == 2 {
+		g.use("tcp")
 		conn := g.generateExpression(e.Arguments[0])
 		data := g.generateExpression(e.Arguments[1])
 		return fmt.Sprintf("carv_tcp_write(%s, %s)", conn, data)
 	}
 
 	if fn == "tcp_close" && len(e.Arguments) == 1 {
+		g.use("tcp")
 		fd := g.generateExpression(e.Arguments[0])
 		return fmt.Sprintf("carv_tcp_close(%s)", fd)
 	}
 
 	if fn == "split" && len(e.Arguments) == 2 {
+		g.use("strings")
 		str := g.generateExpression(e.Arguments[0])
 		sep := g.generateExpression(e.Arguments[1])
 		return fmt.Sprintf("carv_split(%s, %s)", str, sep)
 	}
 
 	if fn == "join" && len(e.Arguments) == 2 {
+		g.use("strings")
 		arr := g.generateExpression(e.Arguments[0])
 		sep := g.generateExpression(e.Arguments[1])
 		return fmt.Sprintf("carv_join(%s, %s)", arr, sep)
 	}
 
 	if fn == "trim" && len(e.Arguments) == 1 {
+		g.use("strings")
 		arg := g.generateExpression(e.Arguments[0])
 		return fmt.Sprintf("carv_trim(%s)", arg)
 	}
 
 	if fn == "substr" && len(e.Arguments) >= 2 {
+		g.use("strings")
 		str := g.generateExpression(e.Arguments[0])
 		start := g.generateExpression(e.Arguments[1])
 		end := "-1"
@@ -2310,18 +1986,6 @@ func (g *CGenerator) generateCallExpression(e *ast.CallExpression) string {
 		return fmt.Sprintf("carv_substr(%s, %s, %s)", str, start, end)
 	}
 
-	if ident, ok := e.Function.(*ast.Identifier); ok {
-		if varType := g.getVarType(ident.Value); strings.HasPrefix(varType, "__closure_") {
-			clName := g.safeName(ident.Value)
-			var callArgs []string
-			callArgs = append(callArgs, clName+".env")
-			for _, arg := range e.Arguments {
-				callArgs = append(callArgs, g.generateExpression(arg))
-			}
-			return fmt.Sprintf("%s.fn_ptr(%s)", clName, strings.Join(callArgs, ", "))
-		}
-	}
-
 	var args []string
 	for _, arg := range e.Arguments {
 		args = append(args, g.generateExpression(arg))
@@ -2339,6 +2003,10 @@ func (g *CGenerator) generateBuiltinModuleCall(member *ast.MemberExpression, arg
 		return "", false
 	}
 
+	if feature := builtinFeature(member.Member.Value); feature != "" {
+		g.use(feature)
+	}
+
 	switch member.Member.Value {
 	// File I/O
 	case "read_file", "file_exists", "delete_file", "list_dir":
@@ -2417,6 +2085,7 @@ func (g *CGenerator) generateMethodCall(member *ast.MemberExpression, args []ast
 		objType := g.resolveType(member.Object)
 		switch objType {
 		case "carv_string":
+			g.use("arena")
 			return fmt.Sprintf("carv_string_clone(%s)", obj)
 		default:
 			return fmt.Sprintf("%s /* clone not yet implemented for %s */", obj, objType)
@@ -2434,6 +2103,9 @@ func (g *CGenerator) generateMethodCall(member *ast.MemberExpression, args []ast
 	}
 
 	className := g.inferClassName(member.Object)
+	if cls := g.classBehindRef(member.Object); cls != "" {
+		obj, className = "(*"+obj+")", cls
+	}
 	if className == "" {
 		className = "Unknown"
 	}
@@ -2447,6 +2119,37 @@ func (g *CGenerator) generateMethodCall(member *ast.MemberExpression, args []ast
 	return fmt.Sprintf("%s_%s(%s)", className, methodName, strings.Join(argStrs, ", "))
 }
 
+// refToC is the C type of a reference to inner: a pointer to it, and for a
+// shared reference one that cannot write through. A class value is a
+// pointer already, so a shared reference to one is a C* const*.
+func refToC(inner string, mutable bool) string {
+	switch {
+	case mutable:
+		return inner + "*"
+	case strings.HasSuffix(inner, "*"):
+		return inner + " const*"
+	}
+	return "const " + inner + "*"
+}
+
+// classBehindRef returns the class that expr, a reference to a class
+// value, refers to, or "" if it is not one. A method's self is the
+// instance pointer itself, whatever its receiver.
+func (g *CGenerator) classBehindRef(expr ast.Expression) string {
+	if ident, ok := expr.(*ast.Identifier); ok && ident.Value == "self" {
+		return ""
+	}
+	ctype := g.resolveType(expr)
+	for _, suffix := range []string{"**", "* const*"} {
+		if name, ok := strings.CutSuffix(ctype, suffix); ok {
+			if _, isClass := g.classes[name]; isClass {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
 func (g *CGenerator) isInterfaceRefType(ctype string) bool {
 	if strings.HasSuffix(ctype, "_ref") {
 		name := strings.TrimSuffix(ctype, "_ref")
@@ -2478,13 +2181,13 @@ func (g *CGenerator) inferClassName(expr ast.Expression) string {
 
 func (g *CGenerator) generatePrintCall(e *ast.CallExpression) string {
 	if len(e.Arguments) == 0 {
-		return "printf(\"\\n\")"
+		return "carv_out_cstr(\"\\n\")"
 	}
 
 	var parts []string
 	for i, arg := range e.Arguments {
 		if i > 0 {
-			parts = append(parts, "printf(\" \")")
+			parts = append(parts, "carv_out_cstr(\" \")")
 		}
 
 		argStr := g.generateExpression(arg)
@@ -2495,40 +2198,36 @@ func (g *CGenerator) generatePrintCall(e *ast.CallExpression) string {
 				elemType := g.resolveType(arr.Elements[0])
 				parts = append(parts, g.generateArrayPrint(argStr, elemType))
 			} else {
-				parts = append(parts, fmt.Sprintf("carv_print_int_array(%s)", argStr))
+				parts = append(parts, g.generateArrayPrint(argStr, "carv_int"))
 			}
 			continue
 		}
 
 		switch argType {
-		case "carv_int_array":
-			parts = append(parts, fmt.Sprintf("carv_print_int_array(%s)", argStr))
-		case "carv_float_array":
-			parts = append(parts, fmt.Sprintf("carv_print_float_array(%s)", argStr))
-		case "carv_string_array":
-			parts = append(parts, fmt.Sprintf("carv_print_string_array(%s)", argStr))
-		case "carv_bool_array":
-			parts = append(parts, fmt.Sprintf("carv_print_bool_array(%s)", argStr))
+		case "carv_int_array", "carv_float_array", "carv_string_array", "carv_bool_array":
+			parts = append(parts, g.generateArrayPrint(argStr, strings.TrimSuffix(argType, "_array")))
 		case "carv_map":
+			g.use("print")
 			parts = append(parts, fmt.Sprintf("carv_print_map(%s)", argStr))
 		case "carv_int":
-			parts = append(parts, fmt.Sprintf("printf(\"%%lld\", %s)", argStr))
+			parts = append(parts, fmt.Sprintf("carv_out_int(%s)", argStr))
 		case "carv_float":
-			parts = append(parts, fmt.Sprintf("printf(\"%%g\", %s)", argStr))
+			parts = append(parts, fmt.Sprintf("carv_out_float(%s)", argStr))
 		case "carv_bool":
-			parts = append(parts, fmt.Sprintf("printf(\"%%s\", %s ? \"true\" : \"false\")", argStr))
+			parts = append(parts, fmt.Sprintf("carv_out_bool(%s)", argStr))
 		case "carv_string":
-			parts = append(parts, fmt.Sprintf("printf(\"%%s\", %s.data)", argStr))
+			parts = append(parts, fmt.Sprintf("carv_out_str(%s)", argStr))
 		default:
-			parts = append(parts, fmt.Sprintf("printf(\"%%lld\", (carv_int)%s)", argStr))
+			parts = append(parts, fmt.Sprintf("carv_out_int((carv_int)%s)", argStr))
 		}
 	}
 
-	parts = append(parts, "printf(\"\\n\")")
+	parts = append(parts, "carv_out_cstr(\"\\n\")")
 	return "(" + strings.Join(parts, ", ") + ")"
 }
 
 func (g *CGenerator) generateArrayPrint(argStr string, elemType string) string {
+	g.use("print")
 	switch elemType {
 	case "carv_int":
 		return fmt.Sprintf("carv_print_int_array(%s)", argStr)
@@ -2595,17 +2294,61 @@ func (g *CGenerator) generateMemberExpression(e *ast.MemberExpression) string {
 	if g.isInterfaceRefType(objCType) {
 		return fmt.Sprintf("%s.%s", obj, member)
 	}
+	if g.classBehindRef(e.Object) != "" {
+		return fmt.Sprintf("(*%s)->%s", obj, member)
+	}
 	return fmt.Sprintf("%s->%s", obj, member)
 }
 
 func (g *CGenerator) generateNewExpression(e *ast.NewExpression) string {
 	if named, ok := e.Type.(*ast.NamedType); ok {
 		className := named.Name.Value
+		if g.staticMemory {
+			return g.placeObject(className)
+		}
 		return fmt.Sprintf("%s_new()", className)
 	}
 	return "NULL"
 }
 
+// placeObject gives a class instance storage that needs no allocation: a
+// slot in the C block of a synchronous function that creates it, so each
+// call, recursive or not, gets its own, and a static slot in an async
+// function, whose frame is static too, or for a static. The checker keeps
+// the instance from outliving the block.
+func (g *CGenerator) placeObject(className string) string {
+	slot := fmt.Sprintf("__obj_%d", g.tempCounter)
+	g.tempCounter++
+	if !g.staticSlot && !g.inAsyncFn {
+		g.addPreamble(fmt.Sprintf("%s %s;", className, slot))
+		g.memStats.StackObjects++
+	} else {
+		g.addPreamble(fmt.Sprintf("static %s %s;", className, slot))
+		g.memStats.StaticObjects++
+	}
+	return fmt.Sprintf("%s_init(&%s)", className, slot)
+}
+
+// generateTakeCall lowers take(&mut place) and exchange(&mut place, value):
+// the old value is read out and the zero value, or value, written back.
+func (g *CGenerator) generateTakeCall(ref, value ast.Expression) string {
+	var valType string
+	if b, ok := ref.(*ast.BorrowExpression); ok {
+		valType = g.resolveType(b.Value)
+	} else {
+		valType = strings.TrimPrefix(strings.TrimSuffix(g.resolveType(ref), "*"), "const ")
+	}
+	ptr := g.generateExpression(ref)
+	newValue := "(" + valType + "){0}"
+	if value != nil {
+		newValue = g.generateExpression(value)
+	}
+	id := g.tempCounter
+	g.tempCounter++
+	return fmt.Sprintf("({ %s *__take_%d = %s; %s __old_%d = *__take_%d; *__take_%d = %s; __old_%d; })",
+		valType, id, ptr, valType, id, id, id, newValue, id)
+}
+
 func (g *CGenerator) generateIndexExpression(e *ast.IndexExpression) string {
 	left := g.generateExpression(e.Left)
 	index := g.generateExpression(e.Index)
@@ -2634,6 +2377,7 @@ func (g *CGenerator) generateIndexExpression(e *ast.IndexExpression) string {
 
 func (g *CGenerator) generateArrayLiteral(e *ast.ArrayLiteral) string {
 	if len(e.Elements) == 0 {
+		g.use("arena")
 		return "carv_new_int_array(0)"
 	}
 
@@ -2665,6 +2409,7 @@ func (g *CGenerator) generateMapLiteral(e *ast.MapLiteral) string {
 	if cap < 8 {
 		cap = 8
 	}
+	g.use("map")
 	g.addPreamble(fmt.Sprintf("carv_map %s = carv_map_new(%d);", tempName, cap))
 
 	for key, val := range e.Pairs {
@@ -2700,6 +2445,9 @@ func (g *CGenerator) getArrayType(elemType string) string {
 	case "carv_bool":
 		return "carv_bool_array"
 	default:
+		if isClosureType(elemType) {
+			return elemType + "_array"
+		}
 		return "carv_int_array"
 	}
 }
@@ -2719,6 +2467,7 @@ func (g *CGenerator) generateInterpolatedString(e *ast.InterpolatedString) strin
 		if i == 0 {
 			result = partStr
 		} else {
+			g.use("strings")
 			result = fmt.Sprintf("carv_concat(%s, %s)", result, partStr)
 		}
 	}
@@ -2732,6 +2481,9 @@ func (g *CGenerator) convertToString(expr ast.Expression) string {
 
 	exprStr := g.generateExpression(expr)
 	exprType := g.resolveType(expr)
+	if exprType != "carv_string" {
+		g.use("strings")
+	}
 
 	switch exprType {
 	case "carv_string":
@@ -2754,6 +2506,9 @@ func (g *CGenerator) inferArrayElemType(expr ast.Expression) string {
 			return g.resolveType(e.Elements[0])
 		}
 	case *ast.Identifier:
+		if elem := strings.TrimSuffix(g.resolveType(e), "_array"); isClosureType(elem) {
+			return elem
+		}
 		return "carv_int"
 	}
 	return "carv_int"
@@ -2811,18 +2566,27 @@ func (g *CGenerator) typeToC(typeExpr ast.TypeExpr) string {
 				return named.Name.Value + "_ref"
 			}
 		}
-		inner := g.typeToC(t.Inner)
-		if t.Mutable {
-			return inner + "*"
-		}
-		return "const " + inner + "*"
+		return refToC(g.typeToC(t.Inner), t.Mutable)
 	case *ast.NamedType:
 		if _, isIface := g.interfaces[t.Name.Value]; isIface {
 			return t.Name.Value + "_ref"
 		}
+		if (t.Name.Value == "Atomic" || t.Name.Value == "atomic" || t.Name.Value == "Mutex") && len(t.Args) == 1 {
+			return g.typeToC(t.Args[0])
+		}
 		return t.Name.Value + "*"
 	case *ast.VolatileType:
 		return "volatile " + g.typeToC(t.Inner)
+	case *ast.FunctionType:
+		params := make([]string, len(t.Parameters))
+		for i, p := range t.Parameters {
+			params[i] = g.typeToC(p)
+		}
+		return g.closureType(g.typeToC(t.ReturnType), params)
+	case *ast.ArrayType:
+		if _, ok := t.ElementType.(*ast.FunctionType); ok {
+			return g.typeToC(t.ElementType) + "_array"
+		}
 	}
 	return "void"
 }
@@ -2931,7 +2695,7 @@ func (g *CGenerator) inferCallType(e *ast.CallExpression) string {
 		switch ident.Value {
 		case "read_file", "join", "trim", "substr":
 			return "carv_string"
-		case "split":
+		case "split", "args":
 			return "carv_string_array"
 		case "file_exists", "write_file":
 			return "carv_bool"
@@ -2949,7 +2713,8 @@ func (g *CGenerator) inferCallType(e *ast.CallExpression) string {
 }
 
 func (g *CGenerator) generateOkExpression(e *ast.OkExpression) string {
-	val := g.generateExpression(e.Value)
+	g.use("result")
+	val := g.generatePayload(e.Value)
 	valType := g.resolveType(e.Value)
 
 	switch valType {
@@ -2967,7 +2732,8 @@ func (g *CGenerator) generateOkExpression(e *ast.OkExpression) string {
 }
 
 func (g *CGenerator) generateErrExpression(e *ast.ErrExpression) string {
-	val := g.generateExpression(e.Value)
+	g.use("result")
+	val := g.generatePayload(e.Value)
 	valType := g.resolveType(e.Value)
 
 	switch valType {
@@ -2981,6 +2747,7 @@ func (g *CGenerator) generateErrExpression(e *ast.ErrExpression) string {
 }
 
 func (g *CGenerator) generateTryExpression(e *ast.TryExpression) string {
+	g.use("result")
 	val := g.generateExpression(e.Value)
 	tempName := fmt.Sprintf("__try_%d", g.tempCounter)
 	g.tempCounter++
@@ -2990,7 +2757,11 @@ func (g *CGenerator) generateTryExpression(e *ast.TryExpression) string {
 
 	g.addPreamble(fmt.Sprintf("carv_result %s = %s;", tempName, val))
 	if g.inFunction {
-		g.addPreamble(fmt.Sprintf("if (!%s.is_ok) { __carv_retval = %s; goto __carv_exit; }", tempName, tempName))
+		drops := strings.Join(g.dropsLeaving(false), " ")
+		if drops != "" {
+			drops += " "
+		}
+		g.addPreamble(fmt.Sprintf("if (!%s.is_ok) { __carv_retval = %s; %sgoto __carv_exit; }", tempName, tempName, drops))
 	} else {
 		g.addPreamble(fmt.Sprintf("if (!%s.is_ok) return %s;", tempName, tempName))
 	}
@@ -3126,6 +2897,9 @@ func (g *CGenerator) collectInterfacesAndImpls(program *ast.Program) {
 	}
 	for _, stmt := range program.Statements {
 		if impl, ok := stmt.(*ast.ImplStatement); ok {
+			if impl.Interface.Value == "Drop" {
+				g.dropImpls[impl.Type.Value] = true
+			}
 			g.implList = append(g.implList, &implInfo{
 				ifaceName: impl.Interface.Value,
 				typeName:  impl.Type.Value,
@@ -3203,7 +2977,7 @@ func (g *CGenerator) generateImplMethods(program *ast.Program) {
 			params := g.methodParamsToC(impl.typeName, method.Receiver, method.Parameters)
 			g.writeln(fmt.Sprintf("%s %s_%s(%s) {", retType, impl.typeName, method.Name.Value, params))
 			g.indent++
-			g.enterScope()
+			g.enterFunctionScope()
 
 			g.inFunction = true
 			g.funcRetType = retType
@@ -3214,15 +2988,15 @@ func (g *CGenerator) generateImplMethods(program *ast.Program) {
 
 			for _, p := range method.Parameters {
 				pType := g.typeToC(p.Type)
-				g.declareVar(p.Name.Value, pType, false, false)
+				g.declareVar(p.Name.Value, pType, false, g.dropFunc(pType) != "")
 			}
 
 			for _, stmt := range method.Body.Statements {
 				g.generateStatement(stmt)
 			}
 
-			g.writeln("__carv_exit:;")
 			g.emitScopeDrops()
+			g.writeln("__carv_exit:;")
 			if retType != "void" {
 				g.writeln("return __carv_retval;")
 			}
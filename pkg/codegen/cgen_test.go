@@ -9,6 +9,7 @@ import (
 
 	"github.com/dev-dami/carv/pkg/ast"
 	"github.com/dev-dami/carv/pkg/lexer"
+	"github.com/dev-dami/carv/pkg/module"
 	"github.com/dev-dami/carv/pkg/parser"
 	"github.com/dev-dami/carv/pkg/types"
 )
@@ -59,7 +60,7 @@ func TestGenerateEmptyProgram(t *testing.T) {
 	if !strings.Contains(output, "#include <stdio.h>") {
 		t.Error("expected stdio.h include")
 	}
-	if !strings.Contains(output, "int main(void)") {
+	if !strings.Contains(output, "int main(int argc, char** argv)") {
 		t.Error("expected main function")
 	}
 	if !strings.Contains(output, "return 0;") {
@@ -415,6 +416,40 @@ fn test() {
 	}
 }
 
+func TestTakeAndExchangeBuiltins(t *testing.T) {
+	input := `
+class Buf {
+    name: string = ""
+}
+fn test() {
+    mut names = ["a", "b"];
+    let first = take(&mut names[0]);
+    let second = exchange(&mut names[1], "c");
+    let b = new Buf;
+    let n = take(&mut b.name);
+}
+`
+	program := parser.New(lexer.New(input)).ParseProgram()
+	checker := types.NewChecker()
+	checker.Check(program)
+	gen := NewCGenerator()
+	gen.SetTypeInfo(checker.TypeInfo())
+	output := gen.Generate(program)
+
+	for _, want := range []string{
+		"carv_string *__take_",
+		"= (&names.data[0]);",
+		"= (carv_string){0};",
+		"= carv_string_lit(\"c\");",
+		"= (&b->name);",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output, got:\n%s", want, output)
+		}
+	}
+	compileGeneratedC(t, output)
+}
+
 func TestScopeDropsEmitted(t *testing.T) {
 	gen := NewCGenerator()
 	input := `
@@ -625,6 +660,69 @@ func TestRefParamEmitsConstPointer(t *testing.T) {
 	}
 }
 
+func TestClassRefParamsBuildAndRun(t *testing.T) {
+	input := `class H {
+    a: int = 0
+    fn bump(&mut self) { self.a = self.a + 1; }
+    fn value(&self) -> int { return self.a; }
+}
+fn set(h: &mut H) { h.bump(); h.a = h.a * 10; }
+fn show(h: &H) { println(h.value()); println(h.a); }
+fn main() {
+    mut b = new H;
+    set(&mut b);
+    show(&b);
+}
+main();
+`
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	checker := types.NewChecker()
+	if !checker.Check(program) {
+		t.Fatalf("type errors: %v", checker.Errors())
+	}
+	gen := NewCGenerator()
+	gen.SetTypeInfo(checker.TypeInfo())
+	gen.SetMoves(checker.Moves())
+	output := gen.Generate(program)
+
+	// A class value is a pointer already, so a reference to one is a
+	// pointer to that, read through before ->.
+	for _, want := range []string{
+		"void set(H** h) {",
+		"void show(H* const* h) {",
+		"H_bump((*h));",
+		"(*h)->a = ((*h)->a * 10);",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output", want)
+		}
+	}
+
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found; skipping class reference run")
+	}
+	tmpDir := t.TempDir()
+	cFile := filepath.Join(tmpDir, "refs.c")
+	bin := filepath.Join(tmpDir, "refs")
+	if err := os.WriteFile(cFile, []byte(output), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("gcc", "-Werror=incompatible-pointer-types", "-o", bin, cFile).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, out)
+	}
+	if got := string(out); got != "10\n10\n" {
+		t.Errorf("output = %q, want 10 twice", got)
+	}
+}
+
 func TestConstSelfMethodEmitsConstPointer(t *testing.T) {
 	gen := NewCGenerator()
 	input := `
@@ -1078,10 +1176,10 @@ async fn carv_main() -> int {
 }
 `)
 
-	if strings.Contains(output, "printf(\"%lld\", x)") {
+	if strings.Contains(output, "carv_out_int(x)") {
 		t.Fatalf("expected async poll path to avoid bare local `x`; got:\n%s", output)
 	}
-	if !strings.Contains(output, "printf(\"%lld\", f->x)") {
+	if !strings.Contains(output, "carv_out_int(f->x)") {
 		t.Fatalf("expected async poll path to print frame local `f->x`; got:\n%s", output)
 	}
 }
@@ -1675,8 +1773,8 @@ func TestPrintCallFloat(t *testing.T) {
 let x = 3.14;
 println(x);
 `)
-	if !strings.Contains(output, `printf("%g"`) {
-		t.Errorf("expected printf with %%g for float printing, got:\n%s", output)
+	if !strings.Contains(output, `carv_out_float(x)`) {
+		t.Errorf("expected carv_out_float for float printing, got:\n%s", output)
 	}
 }
 
@@ -1685,8 +1783,8 @@ func TestPrintCallBool(t *testing.T) {
 let b = true;
 println(b);
 `)
-	if !strings.Contains(output, `"true" : "false"`) {
-		t.Errorf("expected ternary for bool printing, got:\n%s", output)
+	if !strings.Contains(output, `carv_out_bool(b)`) {
+		t.Errorf("expected carv_out_bool for bool printing, got:\n%s", output)
 	}
 }
 
@@ -1695,8 +1793,8 @@ func TestPrintCallString(t *testing.T) {
 let s = "hello";
 println(s);
 `)
-	if !strings.Contains(output, `printf("%s", s.data)`) {
-		t.Errorf("expected printf with %%s and .data for string printing, got:\n%s", output)
+	if !strings.Contains(output, `carv_out_str(s)`) {
+		t.Errorf("expected carv_out_str for string printing, got:\n%s", output)
 	}
 }
 
@@ -1706,14 +1804,14 @@ let x = 1;
 let y = 2;
 println(x, y);
 `)
-	if !strings.Contains(output, `printf(" ")`) {
+	if !strings.Contains(output, `carv_out_cstr(" ")`) {
 		t.Errorf("expected space separator between print args, got:\n%s", output)
 	}
 }
 
 func TestPrintCallNoArgs(t *testing.T) {
 	output := generateOutputFromSource(t, `println();`)
-	if !strings.Contains(output, `printf("\n")`) {
+	if !strings.Contains(output, `carv_out_cstr("\n")`) {
 		t.Errorf("expected bare newline for empty println, got:\n%s", output)
 	}
 }
@@ -2517,7 +2615,7 @@ func TestListDirCall(t *testing.T) {
 }
 
 func TestRuntimeIncludesDirent(t *testing.T) {
-	output := generateOutputFromSource(t, ``)
+	output := generateOutputFromSource(t, `let entries = list_dir(".");`)
 	if !strings.Contains(output, "#include <dirent.h>") {
 		t.Errorf("expected dirent.h include in runtime, got:\n%s", output)
 	}
@@ -2596,7 +2694,7 @@ fn main() {
 }
 
 func TestFileIORuntimeEmitted(t *testing.T) {
-	output := generateOutputFromSource(t, ``)
+	output := generateOutputFromSource(t, `let ok = file_exists("data.txt");`)
 	for _, fn := range []string{
 		"carv_read_file",
 		"carv_write_file",
@@ -2610,3 +2708,1073 @@ func TestFileIORuntimeEmitted(t *testing.T) {
 		}
 	}
 }
+
+const testHarnessSource = `fn add(a: int, b: int) -> int { return a + b; }
+print(add(1, 2));
+
+test fn adds() {
+    assert_eq(add(2, 2), 4);
+    assert_eq("ab", "ab");
+}
+
+#[test]
+fn breaks() {
+    assert(add(1, 1) == 3, "one and one");
+}
+`
+
+func TestTestFunctionsOmittedFromNormalBuild(t *testing.T) {
+	output := generateOutputFromSource(t, testHarnessSource)
+	if strings.Contains(output, "adds(") || strings.Contains(output, "carv_run_test(") {
+		t.Fatalf("normal build should not contain tests:\n%s", output)
+	}
+	compileGeneratedC(t, output)
+}
+
+func TestTestHarnessRunsEachTest(t *testing.T) {
+	p := parser.New(lexer.New(testHarnessSource))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	checker := types.NewChecker()
+	if !checker.Check(program) {
+		t.Fatalf("type errors: %v", checker.Errors())
+	}
+	gen := NewCGenerator()
+	gen.SetTypeInfo(checker.TypeInfo())
+	gen.SetTestMode(true)
+	gen.SetSourceFile("math.carv")
+	output := gen.Generate(program)
+
+	if strings.Contains(output, "print(") || strings.Contains(output, "add(1, 2)") {
+		t.Errorf("test harness should skip top-level statements")
+	}
+	for _, want := range []string{
+		`carv_assert_eq_int((carv_int)(add(2, 2)), (carv_int)(4), "math.carv:5:5", "assert_eq(add(2, 2), 4)")`,
+		`carv_assert_eq_str(`,
+		`carv_run_test("adds", "math.carv:4:9", adds, filter, &passed, &failed);`,
+		`carv_run_test("breaks", "math.carv:10:4", breaks, filter, &passed, &failed);`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output", want)
+		}
+	}
+
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found; skipping harness run")
+	}
+	tmpDir := t.TempDir()
+	cFile := filepath.Join(tmpDir, "tests.c")
+	bin := filepath.Join(tmpDir, "tests")
+	if err := os.WriteFile(cFile, []byte(output), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("gcc", "-o", bin, cFile).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin).CombinedOutput()
+	if err == nil {
+		t.Fatalf("expected a failing exit status, got output:\n%s", out)
+	}
+	for _, want := range []string{"adds (math.carv:4:9) ... ok", "breaks (math.carv:10:4) ... FAILED",
+		"math.carv:11:5: assertion failed: one and one", "1 passed, 1 failed"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("expected %q in harness output:\n%s", want, out)
+		}
+	}
+}
+
+func TestArgsBuiltin(t *testing.T) {
+	output := generateOutputFromSource(t, `let a = args();
+print(len(a));`)
+	for _, want := range []string{"carv_argv = argv;", "carv_args()"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output", want)
+		}
+	}
+	compileGeneratedC(t, output)
+}
+
+func TestTargetProfileRuntime(t *testing.T) {
+	src := `let x = 40 + 2;
+println(x);`
+
+	m0, err := module.ResolveTarget("cortex-m0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := NewCGenerator()
+	gen.SetTarget(m0)
+	program := parser.New(lexer.New(src)).ParseProgram()
+	output := gen.Generate(program)
+	for _, want := range []string{"// Target: cortex-m0", "#define CARV_TARGET_ARM 1",
+		"#define CARV_INT_BITS 32", "#define CARV_POINTER_BITS 32", "typedef int32_t carv_int;"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in cortex-m0 output", want)
+		}
+	}
+
+	// A host profile with a 32-bit carv_int must still build and print.
+	narrow, err := module.ResolveTarget("narrow", map[string]module.Target{"narrow": {IntBits: 32}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen = NewCGenerator()
+	gen.SetTarget(narrow)
+	output = gen.Generate(parser.New(lexer.New(src)).ParseProgram())
+	if strings.Contains(output, "CARV_TARGET_ARM 1") {
+		t.Error("host profile should not define CARV_TARGET_ARM")
+	}
+	compileGeneratedC(t, output)
+}
+
+func generateForTarget(t *testing.T, input, target string) string {
+	t.Helper()
+	tgt, err := module.ResolveTarget(target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	gen := NewCGenerator()
+	gen.SetTarget(tgt)
+	return gen.Generate(program)
+}
+
+func TestRuntimeEmitsOnlyUsedFeatures(t *testing.T) {
+	output := generateOutputFromSource(t, `let x = 1;`)
+	for _, unwanted := range []string{"#include <sys/socket.h>", "#include <dirent.h>",
+		"carv_tcp_listen(", "carv_read_file(", "carv_map_new(", "carv_split(", "carv_uart_init("} {
+		if strings.Contains(output, unwanted) {
+			t.Errorf("did not expect %q in the runtime of a program that does not use it", unwanted)
+		}
+	}
+
+	output = generateOutputFromSource(t, `let m = {"a": 1};
+println(m);`)
+	for _, want := range []string{"static carv_map carv_map_new(carv_int cap)", "static void carv_print_map(carv_map m)"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output", want)
+		}
+	}
+	compileGeneratedC(t, output)
+
+	// Features follow the calls made, not names that look like runtime
+	// symbols in the program's own code.
+	output = generateOutputFromSource(t, `fn name_to_string(x: int) -> int { return x; }
+let s = "carv_tcp_listen(";
+println(s, name_to_string(1));`)
+	for _, unwanted := range []string{"#include <sys/socket.h>", "carv_tcp_listen(carv_string", "carv_int_to_string(carv_int"} {
+		if strings.Contains(output, unwanted) {
+			t.Errorf("did not expect %q in the runtime of a program that does not use it", unwanted)
+		}
+	}
+	compileGeneratedC(t, output)
+}
+
+const freestandingSource = `fn half(x: float) -> float {
+    return x / 2.0;
+}
+
+let n = 42;
+let parts = split("a,b", ",");
+let joined = join(parts, "-");
+let m = {"k": 7};
+println(n, -7, half(6.5), true, joined);
+println(m);
+println(f"n={n}", 1e20);
+assert_eq(n, 42);
+`
+
+func TestFreestandingRuntimeNeedsNoLibc(t *testing.T) {
+	output := generateForTarget(t, freestandingSource, "cortex-m4")
+	for _, unwanted := range []string{"#include <stdio.h>", "#include <stdlib.h>", "malloc(", "printf("} {
+		if strings.Contains(output, unwanted) {
+			t.Errorf("did not expect %q in freestanding output", unwanted)
+		}
+	}
+	for _, want := range []string{"int main(void) {", "static char carv_arena_buf[CARV_ARENA_SIZE]",
+		"__attribute__((weak)) void carv_sink_write(const char* data, size_t len)"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in freestanding output", want)
+		}
+	}
+
+	for _, tool := range []string{"gcc", "nm"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found; skipping freestanding link check", tool)
+		}
+	}
+	tmpDir := t.TempDir()
+	cFile := filepath.Join(tmpDir, "fw.c")
+	if err := os.WriteFile(cFile, []byte(output), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	obj := filepath.Join(tmpDir, "fw.o")
+	if out, err := exec.Command("gcc", "-ffreestanding", "-nostdlib", "-O2", "-c", "-o", obj, cFile).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed: %v\n%s", err, out)
+	}
+	undefined, err := exec.Command("nm", "-u", obj).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(undefined)) != "" {
+		t.Errorf("freestanding object needs external symbols:\n%s", undefined)
+	}
+
+	// Link against a sink that writes to stdout to check what gets printed.
+	sink := filepath.Join(tmpDir, "sink.c")
+	if err := os.WriteFile(sink, []byte("#include <stdio.h>\nvoid carv_sink_write(const char* d, size_t n) { fwrite(d, 1, n, stdout); }\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(tmpDir, "fw")
+	if out, err := exec.Command("gcc", "-o", bin, cFile, sink).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, out)
+	}
+	want := "42 -7 3.25 true a-b\n{\"k\": 7}\nn=42 1e+20\n"
+	if string(out) != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestFreestandingRejectsHostedFeatures(t *testing.T) {
+	output := generateForTarget(t, `let s = read_file("config.txt");`, "cortex-m0")
+	if !strings.Contains(output, `#error "carv: fs is not available on target cortex-m0"`) {
+		t.Errorf("expected an #error for fs on a freestanding target, got:\n%s", output)
+	}
+}
+
+const staticMemorySource = `class Counter {
+    count: int = 0
+}
+
+fn bump(n: int) -> int {
+    let c = new Counter;
+    c.count = n;
+    let out: int = c.count;
+    return out + 1;
+}
+
+async fn twice(x: int) -> int {
+    return x * 2;
+}
+
+async fn main() {
+    let k = new Counter;
+    k.count = 5;
+    let v = await twice(bump(3));
+    println(v, k.count);
+}
+`
+
+func generateStaticMemory(t *testing.T, input string, arenaSize int) (string, MemoryStats) {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	gen := NewCGenerator()
+	gen.SetStaticMemory(arenaSize)
+	output := gen.Generate(program)
+	return output, gen.MemoryStats()
+}
+
+func TestStaticMemoryPlacement(t *testing.T) {
+	output, stats := generateStaticMemory(t, staticMemorySource, 2048)
+	for _, want := range []string{
+		"Counter* Counter_init(Counter* self) {",
+		"Counter __obj_0;",
+		"Counter* c = Counter_init(&__obj_0);",
+		"static Counter __obj_1;",
+		"static twice_frame frame;",
+		"static carv_task* carv_ready_slots[CARV_MAX_TASKS];",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in static memory output", want)
+		}
+	}
+	for _, unwanted := range []string{"Counter_new(", "malloc(", "realloc(", "carv_arena_buf"} {
+		if strings.Contains(output, unwanted) {
+			t.Errorf("did not expect %q in static memory output", unwanted)
+		}
+	}
+	want := MemoryStats{ArenaSize: 0, StaticFrames: 2, StackObjects: 1, StaticObjects: 1}
+	if stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+
+	compileGeneratedC(t, output)
+}
+
+func TestStaticMemoryGivesEachCallItsOwnObjects(t *testing.T) {
+	input := `class Node { v: int = 0 }
+class Box { n: Node = nil }
+fn depth(n: int) -> int {
+    let b = new Box;
+    b.n = new Node;
+    b.n.v = n;
+    if n > 0 {
+        depth(n - 1);
+    }
+    return b.n.v;
+}
+println(depth(3));
+`
+	output, stats := generateStaticMemory(t, input, 1024)
+	if !strings.Contains(output, "Node __obj_1;") || strings.Contains(output, "static Node") {
+		t.Errorf("expected the Node in a stack slot, got:\n%s", output)
+	}
+	if stats.StackObjects != 2 || stats.StaticObjects != 0 {
+		t.Errorf("stats = %+v, want 2 stack objects and no static ones", stats)
+	}
+
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found; skipping recursion run")
+	}
+	tmpDir := t.TempDir()
+	cFile := filepath.Join(tmpDir, "depth.c")
+	bin := filepath.Join(tmpDir, "depth")
+	if err := os.WriteFile(cFile, []byte(output), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("gcc", "-o", bin, cFile).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, out)
+	}
+	if got := strings.TrimSpace(string(out)); got != "3" {
+		t.Errorf("depth(3) printed %q, want 3", got)
+	}
+}
+
+func TestStaticMemoryArenaSize(t *testing.T) {
+	output, stats := generateStaticMemory(t, "let n = 4;\nprintln(f\"n={n}\");\n", 1024)
+	if !strings.Contains(output, "#define CARV_ARENA_SIZE 1024") {
+		t.Errorf("expected a 1024-byte static arena, got:\n%s", output)
+	}
+	if stats.ArenaSize != 1024 {
+		t.Errorf("ArenaSize = %d, want 1024", stats.ArenaSize)
+	}
+	if strings.Contains(output, "malloc(") {
+		t.Errorf("static memory output should not call malloc")
+	}
+	compileGeneratedC(t, output)
+}
+
+const memReportSource = `packed class Header {
+    kind: u8 = 0
+    len: u32 = 0
+}
+
+fn fact(n: int) -> int {
+    if n <= 1 {
+        return 1;
+    }
+    return n * fact(n - 1);
+}
+
+fn sum3(a: int) -> int {
+    let xs = [a, a + 1, a + 2];
+    return xs[0] + xs[1] + xs[2];
+}
+
+fn run() -> int {
+    return sum3(4) + fact(5);
+}
+
+static let counter = 0;
+println(run(), counter);
+`
+
+func memReportFor(t *testing.T, input, target string) *MemReport {
+	t.Helper()
+	tgt, err := module.ResolveTarget(target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	gen := NewCGenerator()
+	gen.SetTarget(tgt)
+	gen.Generate(program)
+	return gen.MemReport()
+}
+
+func TestMemReportEstimates(t *testing.T) {
+	r := memReportFor(t, memReportSource, "cortex-m0")
+
+	frames := make(map[string]FunctionMem)
+	for _, fn := range r.Functions {
+		frames[fn.Name] = fn
+	}
+	// On cortex-m0 int and pointers are 4 bytes: sum3 holds a, an array
+	// struct and its three elements, plus the return address and frame
+	// pointer.
+	if got := frames["sum3"]; got.Frame != 40 || got.Source != "estimate" {
+		t.Errorf("sum3 = %+v, want a 40-byte estimated frame", got)
+	}
+	if !frames["fact"].Recursive || frames["run"].Recursive {
+		t.Errorf("only fact should be recursive: %+v", r.Functions)
+	}
+	if r.Bounded || len(r.Recursive) != 1 || r.Recursive[0] != "fact" {
+		t.Errorf("expected an unbounded worst case through fact, got bounded=%v recursive=%v", r.Bounded, r.Recursive)
+	}
+	if len(r.WorstPath) < 2 || r.WorstPath[0] != "main" || r.WorstPath[1] != "run" {
+		t.Errorf("worst path = %v, want it to start main -> run", r.WorstPath)
+	}
+
+	if len(r.Statics) != 1 || r.Statics[0].Name != "counter" || r.Statics[0].Size != 4 || r.Statics[0].Kind != "static let" {
+		t.Errorf("statics = %+v, want counter of 4 bytes", r.Statics)
+	}
+	if len(r.Packed) != 1 || r.Packed[0].Name != "Header" || r.Packed[0].Size != 5 {
+		t.Errorf("packed = %+v, want Header of 5 bytes", r.Packed)
+	}
+	if r.Arena.Reserved != 16*1024 || r.Arena.Growable {
+		t.Errorf("arena = %+v, want the 16 KB freestanding buffer", r.Arena)
+	}
+
+	var out strings.Builder
+	r.WriteTable(&out)
+	for _, want := range []string{"Memory report for cortex-m0 (stack: estimate)", "Recursion: fact", "Header  5", "Arena: 16384 bytes reserved"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in table:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestMemReportStackUsage(t *testing.T) {
+	r := memReportFor(t, memReportSource, "host")
+	usage := ParseStackUsage([]byte("rep.c:12:10:sum3\t96\tstatic\nrep.c:20:10:run\t16\tdynamic,bounded\nbad line\n"))
+	if usage["sum3"] != (StackUsage{Bytes: 96}) || !usage["run"].Dynamic {
+		t.Fatalf("usage = %+v", usage)
+	}
+	r.ApplyStackUsage(usage)
+	if r.StackSource != "gcc -fstack-usage" {
+		t.Errorf("StackSource = %q", r.StackSource)
+	}
+	for _, fn := range r.Functions {
+		switch fn.Name {
+		case "sum3":
+			if fn.Frame != 96 || fn.Source != "gcc" {
+				t.Errorf("sum3 = %+v, want gcc's 96 bytes", fn)
+			}
+		case "fact":
+			if fn.Source != "estimate" {
+				t.Errorf("fact has no gcc entry and should keep its estimate, got %+v", fn)
+			}
+		}
+	}
+	if r.WorstPath[len(r.WorstPath)-1] != "sum3" {
+		t.Errorf("worst path = %v, want it to end in sum3", r.WorstPath)
+	}
+}
+
+const dropSource = `class Guard {
+    name: string = ""
+}
+
+impl Drop for Guard {
+    fn drop(&mut self) {
+        println("drop " + self.name);
+    }
+}
+
+class Holder {
+    inner: Guard
+}
+
+fn make(name: string) -> Guard {
+    let g = new Guard;
+    g.name = name;
+    return g;
+}
+
+fn early(flag: bool) -> int {
+    let a = make("early-a");
+    if flag {
+        let b = make("early-b");
+        return 1;
+    }
+    let c = make("early-c");
+    return 2;
+}
+
+fn consume(g: Guard) {
+    println("consume " + g.name);
+}
+
+fn main() {
+    let x = make("x");
+    let y = x;
+    println("moved");
+    early(true);
+    early(false);
+    for i in [1, 2] {
+        let t = make("loop");
+        if i == 2 {
+            break;
+        }
+    }
+    mut n = 0;
+    while n < 3 {
+        n = n + 1;
+        let w = make("while");
+        if n == 1 {
+            continue;
+        }
+    }
+    consume(make("arg"));
+    let h = new Holder;
+    h.inner = make("field");
+    h.inner = make("field2");
+    mut r = make("r1");
+    r = make("r2");
+    println("end");
+}
+main();
+`
+
+func TestDropsRunDeterministically(t *testing.T) {
+	p := parser.New(lexer.New(dropSource))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	checker := types.NewChecker()
+	if !checker.Check(program) {
+		t.Fatalf("type errors: %v", checker.Errors())
+	}
+	gen := NewCGenerator()
+	gen.SetTypeInfo(checker.TypeInfo())
+	gen.SetMoves(checker.Moves())
+	output := gen.Generate(program)
+
+	for _, want := range []string{
+		"static void carv_drop_Guard(Guard** slot)",
+		"Guard_drop(self);",
+		"carv_string_drop(&self->name);",
+		"carv_drop_Guard(&self->inner);",
+		"carv_arena_release(self, sizeof(Holder));",
+		"carv_move(x)",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output", want)
+		}
+	}
+
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found; skipping drop run")
+	}
+	tmpDir := t.TempDir()
+	cFile := filepath.Join(tmpDir, "drop.c")
+	bin := filepath.Join(tmpDir, "drop")
+	if err := os.WriteFile(cFile, []byte(output), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("gcc", "-o", bin, cFile).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, out)
+	}
+	want := strings.Join([]string{
+		"moved",
+		"drop early-b", "drop early-a",
+		"drop early-c", "drop early-a",
+		"drop loop", "drop loop",
+		"drop while", "drop while", "drop while",
+		"consume arg", "drop arg",
+		"drop field", "drop r1",
+		"end",
+		"drop r2", "drop field2", "drop x",
+	}, "\n") + "\n"
+	if string(out) != want {
+		t.Errorf("drop order:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestTryOperandMovesOut(t *testing.T) {
+	input := `class Guard {
+    name: string = ""
+}
+
+impl Drop for Guard {
+    fn drop(&mut self) {
+        println("drop " + self.name);
+    }
+}
+
+fn check(g: Guard) {
+    println("check " + g.name);
+    return Ok(1);
+}
+
+fn size(s: string) {
+    return Ok(len(s));
+}
+
+fn run() {
+    let g = new Guard;
+    g.name = "try";
+    let v = check(g)?;
+    let s = "owned" + "!";
+    let n = size(s)?;
+    println(n);
+    return Ok(v);
+}
+
+fn main() {
+    run();
+    println("end");
+}
+main();
+`
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	checker := types.NewChecker()
+	if !checker.Check(program) {
+		t.Fatalf("type errors: %v", checker.Errors())
+	}
+	gen := NewCGenerator()
+	gen.SetTypeInfo(checker.TypeInfo())
+	gen.SetMoves(checker.Moves())
+	output := gen.Generate(program)
+
+	// The callee owns what it is passed, so the caller must not drop it.
+	for _, want := range []string{"check(carv_move(g))", "size(carv_string_move(&s))"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output", want)
+		}
+	}
+
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found; skipping try run")
+	}
+	tmpDir := t.TempDir()
+	cFile := filepath.Join(tmpDir, "try.c")
+	bin := filepath.Join(tmpDir, "try")
+	if err := os.WriteFile(cFile, []byte(output), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("gcc", "-o", bin, cFile).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, out)
+	}
+	if want := "check try\ndrop try\n6\nend\n"; string(out) != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+const captureSource = `
+fn main() {
+    mut count = 0;
+    let inc = fn() { count = count + 1; };
+    inc();
+    inc();
+    println(count);
+
+    let name = "carv";
+    let greet = fn() { println(name); };
+    greet();
+    println(name);
+
+    mut n = 0;
+    let outer = fn() {
+        let inner = fn() { n = n + 10; };
+        inner();
+    };
+    outer();
+    outer();
+    println(n);
+
+    let s = "moved";
+    let take = move fn() { println(s); };
+    take();
+}
+main();
+`
+
+func TestClosureCapturesByReference(t *testing.T) {
+	p := parser.New(lexer.New(captureSource))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	checker := types.NewChecker()
+	if !checker.Check(program) {
+		t.Fatalf("type errors: %v", checker.Errors())
+	}
+	gen := NewCGenerator()
+	gen.SetTypeInfo(checker.TypeInfo())
+	gen.SetMoves(checker.Moves())
+	gen.SetCaptures(checker.Captures())
+	output := gen.Generate(program)
+
+	for _, want := range []string{
+		"typedef struct { carv_int* count; } __closure_0_env;",
+		"(*__env->count) = ((*__env->count) + 1);",
+		"__env_0->count = &count;",
+		"typedef struct { carv_string* name; } __closure_1_env;",
+		"__env_3->n = &(*__env->n);",
+		"typedef struct { carv_string s; } __closure_4_env;",
+		"__env_4->s = carv_string_move(&s);",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output:\n%s", want, output)
+		}
+	}
+
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found; skipping closure run")
+	}
+	tmpDir := t.TempDir()
+	cFile := filepath.Join(tmpDir, "capture.c")
+	bin := filepath.Join(tmpDir, "capture")
+	if err := os.WriteFile(cFile, []byte(output), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("gcc", "-o", bin, cFile).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, out)
+	}
+	want := "2\ncarv\ncarv\n20\nmoved\n"
+	if string(out) != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+const fnValueSource = `
+fn double(x: int) -> int { return x * 2; }
+fn tick(n: int) { println(n); }
+
+class Timer {
+    handler: fn(int) = tick
+}
+
+fn apply(f: fn(int) -> int, x: int) -> int {
+    return f(x);
+}
+
+fn adder(k: int) -> fn(int) -> int {
+    return move fn(x: int) -> int { return x + k; };
+}
+
+fn each(handlers: []fn(int), v: int) {
+    for h in handlers {
+        h(v);
+    }
+}
+
+fn main() {
+    let k = 3;
+    let add_k = fn(x: int) -> int { return x + k; };
+    println(apply(double, 5));
+    println(apply(add_k, 5));
+    println(adder(40)(2));
+    let t = new Timer;
+    t.handler(1);
+    each([tick, tick], 2);
+    let table = [double, add_k, adder(100)];
+    println(table[2](1));
+}
+main();
+`
+
+func TestFunctionValues(t *testing.T) {
+	p := parser.New(lexer.New(fnValueSource))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	checker := types.NewChecker()
+	if !checker.Check(program) {
+		t.Fatalf("type errors: %v", checker.Errors())
+	}
+	gen := NewCGenerator()
+	gen.SetTypeInfo(checker.TypeInfo())
+	gen.SetMoves(checker.Moves())
+	gen.SetCaptures(checker.Captures())
+	output := gen.Generate(program)
+
+	// Every fn(int) -> int, closure or function, has the one C type.
+	for _, want := range []string{
+		"typedef struct { void* env; carv_int (*fn_ptr)(void*, carv_int); } carv_closure_0;",
+		"typedef struct { void* env; void (*fn_ptr)(void*, carv_int); } carv_closure_1;",
+		"carv_int apply(carv_closure_0 f, carv_int x)",
+		"void each(carv_closure_1_array handlers, carv_int v)",
+		"static carv_int __carv_fnval_carv_double(void* __env, carv_int __a0) { (void)__env; return carv_double(__a0); }",
+		"__carv_retval = f.fn_ptr(f.env, x);",
+		"carv_closure_0 __cl_1 = { .env = __env_1, .fn_ptr = __closure_1_fn };",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "} __closure_0;") {
+		t.Errorf("closure has a type of its own:\n%s", output)
+	}
+
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found; skipping function value run")
+	}
+	tmpDir := t.TempDir()
+	cFile := filepath.Join(tmpDir, "fnvalue.c")
+	bin := filepath.Join(tmpDir, "fnvalue")
+	if err := os.WriteFile(cFile, []byte(output), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("gcc", "-Werror=incompatible-pointer-types", "-o", bin, cFile).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, out)
+	}
+	want := "10\n8\n42\n1\n2\n2\n101\n"
+	if string(out) != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+const interruptSource = `static mut count = 0;
+static let ticks: Atomic<int> = Atomic(5);
+static let level: Mutex<int> = Mutex(3);
+static let name = "board";
+
+interrupt fn SysTick_Handler() {
+    count = count + 1;
+    ticks.store(ticks.load() + 1);
+    let l = level.lock();
+    *l = *l + 1;
+}
+
+fn read_count() -> int {
+    critical {
+        if count > 100 {
+            return 0;
+        }
+        return count;
+    }
+}
+
+fn main() {
+    mut i = 0;
+    while i < 3 {
+        i = i + 1;
+        critical {
+            count = count + 2;
+            if i == 2 {
+                continue;
+            }
+        }
+    }
+    critical {
+        println(*level.lock());
+    }
+    println(read_count(), ticks.load(), name);
+}
+main();
+`
+
+func TestInterruptHandlers(t *testing.T) {
+	p := parser.New(lexer.New(interruptSource))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	checker := types.NewChecker()
+	if !checker.Check(program) {
+		t.Fatalf("type errors: %v", checker.Errors())
+	}
+	gen := NewCGenerator()
+	gen.SetTypeInfo(checker.TypeInfo())
+	gen.SetMoves(checker.Moves())
+	gen.SetCaptures(checker.Captures())
+	output := gen.Generate(program)
+
+	for _, want := range []string{
+		"#define CARV_INTERRUPT __attribute__((interrupt(\"IRQ\"), used))",
+		"static carv_int count = 0;",
+		"static carv_int ticks = 5;",
+		"static carv_string name = {0};",
+		"CARV_INTERRUPT void SysTick_Handler(void) {",
+		"__atomic_store_n(&ticks, (__atomic_load_n(&ticks, __ATOMIC_SEQ_CST) + 1), __ATOMIC_SEQ_CST);",
+		"carv_int* l = (&level);",
+		"name = carv_string_lit(\"board\");",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in output:\n%s", want, output)
+		}
+	}
+	// Leaving a critical block early turns interrupts back on first.
+	lines := strings.Split(output, "\n")
+	for _, want := range []string{"continue;", "goto __carv_exit;"} {
+		found := false
+		for i := 1; i < len(lines); i++ {
+			if strings.TrimSpace(lines[i]) == want && strings.HasPrefix(strings.TrimSpace(lines[i-1]), "carv_critical_exit(") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected carv_critical_exit right before %q in output:\n%s", want, output)
+		}
+	}
+
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found; skipping interrupt run")
+	}
+	tmpDir := t.TempDir()
+	cFile := filepath.Join(tmpDir, "interrupt.c")
+	bin := filepath.Join(tmpDir, "interrupt")
+	if err := os.WriteFile(cFile, []byte(output), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("gcc", "-o", bin, cFile).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, out)
+	}
+	if want := "3\n6 5 board\n"; string(out) != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+const atomicSource = `static let hits: atomic<u32> = 0;
+static let total: atomic<u64> = 0;
+
+interrupt fn TIM2_IRQHandler() {
+    hits.fetch_add(1, Ordering.Relaxed);
+}
+
+fn main() {
+    let before: u32 = hits.fetch_add(5);
+    hits.fetch_sub(2, Ordering.AcqRel);
+    let seen: u32 = hits.load(Ordering.Acquire);
+    let swapped = hits.compare_exchange(seen, seen + 10, Ordering.AcqRel);
+    let missed = hits.compare_exchange(0, 1);
+    total.store(total.load() + 40, Ordering.Release);
+    fence(Ordering.SeqCst);
+    compiler_barrier();
+    println(before, hits.load(), swapped, missed, total.fetch_add(2), total.load());
+}
+main();
+`
+
+func TestAtomics(t *testing.T) {
+	generate := func(target string) string {
+		t.Helper()
+		program := parser.New(lexer.New(atomicSource)).ParseProgram()
+		checker := types.NewChecker()
+		if !checker.Check(program) {
+			t.Fatalf("type errors: %v", checker.Errors())
+		}
+		tgt, err := module.ResolveTarget(target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gen := NewCGenerator()
+		gen.SetTarget(tgt)
+		gen.SetTypeInfo(checker.TypeInfo())
+		gen.SetMoves(checker.Moves())
+		return gen.Generate(program)
+	}
+
+	output := generate("host")
+	for _, want := range []string{
+		"static uint32_t hits = 0;",
+		"static uint64_t total = 0;",
+		"__atomic_fetch_add(&hits, 1, __ATOMIC_RELAXED);",
+		"uint32_t before = __atomic_fetch_add(&hits, 5, __ATOMIC_SEQ_CST);",
+		"__atomic_fetch_sub(&hits, 2, __ATOMIC_ACQ_REL);",
+		"__atomic_load_n(&hits, __ATOMIC_ACQUIRE)",
+		"__atomic_compare_exchange_n(&hits, &__carv_expected, (seen + 10), 0, __ATOMIC_ACQ_REL, __ATOMIC_ACQUIRE)",
+		"__atomic_store_n(&total, (__atomic_load_n(&total, __ATOMIC_SEQ_CST) + 40), __ATOMIC_RELEASE);",
+		"__atomic_thread_fence(__ATOMIC_SEQ_CST);",
+		"__atomic_signal_fence(__ATOMIC_SEQ_CST);",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected %q in host output:\n%s", want, output)
+		}
+	}
+
+	// The M0 has no LDREX/STREX, so only word loads and stores stay
+	// lock-free; a Cortex-M4 has them, but no 64-bit atomics.
+	m0 := generate("cortex-m0")
+	for _, want := range []string{
+		"CARV_ATOMIC_FETCH_ADD_LOCKED(&hits, 1);",
+		"CARV_ATOMIC_FETCH_SUB_LOCKED(&hits, 2);",
+		"__atomic_load_n(&hits, __ATOMIC_ACQUIRE)",
+		"CARV_ATOMIC_CAS_LOCKED(&hits, seen, (seen + 10))",
+		"CARV_ATOMIC_STORE_LOCKED(&total, (CARV_ATOMIC_LOAD_LOCKED(&total) + 40));",
+	} {
+		if !strings.Contains(m0, want) {
+			t.Errorf("expected %q in cortex-m0 output:\n%s", want, m0)
+		}
+	}
+	m4 := generate("cortex-m4")
+	for _, want := range []string{
+		"__atomic_fetch_add(&hits, 1, __ATOMIC_RELAXED);",
+		"CARV_ATOMIC_FETCH_ADD_LOCKED(&total, 2)",
+	} {
+		if !strings.Contains(m4, want) {
+			t.Errorf("expected %q in cortex-m4 output:\n%s", want, m4)
+		}
+	}
+
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found; skipping atomic run")
+	}
+	tmpDir := t.TempDir()
+	// The M0 code is freestanding and has ARM-only assembly, so it is only
+	// compiled, without that, to check the critical-section fallback.
+	m0File := filepath.Join(tmpDir, "m0.c")
+	if err := os.WriteFile(m0File, []byte(strings.Replace(m0, "#define CARV_TARGET_ARM 1", "", 1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("gcc", "-c", "-o", filepath.Join(tmpDir, "m0.o"), m0File).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed on the cortex-m0 code: %v\n%s", err, out)
+	}
+
+	cFile := filepath.Join(tmpDir, "atomic.c")
+	bin := filepath.Join(tmpDir, "atomic")
+	if err := os.WriteFile(cFile, []byte(output), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("gcc", "-o", bin, cFile).CombinedOutput(); err != nil {
+		t.Fatalf("gcc failed: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin).CombinedOutput()
+	if err != nil {
+		t.Fatalf("run failed: %v\n%s", err, out)
+	}
+	if want := "0 13 true false 40 42\n"; string(out) != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out, want)
+	}
+}
@@ -0,0 +1,168 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dev-dami/carv/pkg/ast"
+	"github.com/dev-dami/carv/pkg/types"
+)
+
+// A function value is a fat pointer: an environment and a function that
+// takes it first. Every function value with the same signature has the
+// same C type, carv_closure_N, whatever it captures, so closures can be
+// stored in one variable, field or array and passed to one parameter. A
+// plain function used as a value is wrapped in a function that ignores the
+// environment.
+
+// closureType returns the C type of function values taking params and
+// returning ret, declaring it, and arrays of it, the first time.
+func (g *CGenerator) closureType(ret string, params []string) string {
+	key := ret + "(" + strings.Join(params, ", ") + ")"
+	if name, ok := g.closureTypes[key]; ok {
+		return name
+	}
+	name := fmt.Sprintf("carv_closure_%d", len(g.closureTypes))
+	g.closureTypes[key] = name
+	sig := append([]string{"void*"}, params...)
+	g.closureTypeDefs = append(g.closureTypeDefs,
+		fmt.Sprintf("typedef struct { void* env; %s (*fn_ptr)(%s); } %s;", ret, strings.Join(sig, ", "), name),
+		fmt.Sprintf("typedef struct { %s* data; carv_int len; carv_int cap; } %s_array;", name, name))
+	return name
+}
+
+// isClosureType reports whether ctype is the C type of function values.
+func isClosureType(ctype string) bool {
+	return strings.HasPrefix(ctype, "carv_closure_") && !strings.HasSuffix(ctype, "_array")
+}
+
+// closureTypeOf returns the C type of values of the function type ft.
+func (g *CGenerator) closureTypeOf(ft *types.FunctionType) string {
+	params := make([]string, len(ft.Params))
+	for i, p := range ft.Params {
+		params[i] = g.checkerTypeToC(p)
+	}
+	ret := "void"
+	if ft.Return != nil {
+		if c := g.checkerTypeToC(ft.Return); c != "" {
+			ret = c
+		}
+	}
+	return g.closureType(ret, params)
+}
+
+// checkerTypeToC is checkerTypeToCString, with function values, and
+// arrays of them, as their closure types.
+func (g *CGenerator) checkerTypeToC(t types.Type) string {
+	switch t := t.(type) {
+	case *types.FunctionType:
+		return g.closureTypeOf(t)
+	case *types.ArrayType:
+		if ft, ok := t.Element.(*types.FunctionType); ok {
+			return g.closureTypeOf(ft) + "_array"
+		}
+	}
+	return checkerTypeToCString(t)
+}
+
+// userFunction returns the function name refers to where the generator
+// is, or nil if it names a variable, or nothing the program declares.
+func (g *CGenerator) userFunction(name string) *ast.FunctionStatement {
+	if g.lookupVar(name) != nil {
+		return nil
+	}
+	if _, captured := g.captureMap[name]; captured {
+		return nil
+	}
+	return g.functions[name]
+}
+
+// functionValue is code for the function name used as a value, or "" if
+// name is not a function that can be.
+func (g *CGenerator) functionValue(name string) string {
+	fn := g.userFunction(name)
+	if fn == nil || fn.Async {
+		return ""
+	}
+	ret := g.typeToC(fn.ReturnType)
+	params := make([]string, len(fn.Parameters))
+	for i, p := range fn.Parameters {
+		params[i] = g.typeToC(p.Type)
+	}
+	ctype := g.closureType(ret, params)
+
+	wrapper := "__carv_fnval_" + g.safeName(name)
+	if !g.fnValues[name] {
+		g.fnValues[name] = true
+		sig := fmt.Sprintf("static %s %s(%s)", ret, wrapper, strings.Join(append([]string{"void*"}, params...), ", "))
+		// Class constructors, which come before the wrappers, may use one.
+		g.closureTypeDefs = append(g.closureTypeDefs, sig+";")
+
+		var def strings.Builder
+		def.WriteString(fmt.Sprintf("static %s %s(void* __env", ret, wrapper))
+		args := make([]string, len(params))
+		for i, pt := range params {
+			args[i] = fmt.Sprintf("__a%d", i)
+			def.WriteString(fmt.Sprintf(", %s %s", pt, args[i]))
+		}
+		call := fmt.Sprintf("%s(%s)", g.safeName(name), strings.Join(args, ", "))
+		if ret == "void" {
+			def.WriteString(fmt.Sprintf(") { (void)__env; %s; }", call))
+		} else {
+			def.WriteString(fmt.Sprintf(") { (void)__env; return %s; }", call))
+		}
+		g.closureDefs = append(g.closureDefs, def.String())
+	}
+	return fmt.Sprintf("((%s){ .env = NULL, .fn_ptr = %s })", ctype, wrapper)
+}
+
+// calleeCode is the code for what a call calls: a function it names is
+// called directly, not through a function value.
+func (g *CGenerator) calleeCode(callee ast.Expression) string {
+	if ident, ok := callee.(*ast.Identifier); ok && g.userFunction(ident.Value) != nil {
+		return g.safeName(ident.Value)
+	}
+	return g.generateExpression(callee)
+}
+
+// callsFunctionValue reports whether a call of callee calls a function
+// value, held in a variable, a field or an element, or returned by a call.
+func (g *CGenerator) callsFunctionValue(callee ast.Expression) bool {
+	switch e := callee.(type) {
+	case *ast.Identifier:
+		return isClosureType(g.getVarType(e.Value))
+	case *ast.MemberExpression:
+		// A method is called as one; only a field holds a function value.
+		cls := g.classes[g.instanceClass(g.resolveType(e.Object))]
+		if cls == nil {
+			return false
+		}
+		for _, f := range cls.Fields {
+			if f.Name.Value == e.Member.Value {
+				_, ok := f.Type.(*ast.FunctionType)
+				return ok
+			}
+		}
+		return false
+	case *ast.IndexExpression, *ast.CallExpression:
+		return isClosureType(g.resolveType(e))
+	}
+	return false
+}
+
+// generateFunctionValueCall calls the function value callee evaluates to.
+func (g *CGenerator) generateFunctionValueCall(e *ast.CallExpression) string {
+	callee := g.generateExpression(e.Function)
+	if _, ok := e.Function.(*ast.CallExpression); ok {
+		// Evaluate the call that returns the function value once.
+		tmp := fmt.Sprintf("__fn_%d", g.tempCounter)
+		g.tempCounter++
+		g.addPreamble(fmt.Sprintf("%s %s = %s;", g.resolveType(e.Function), tmp, callee))
+		callee = tmp
+	}
+	args := []string{callee + ".env"}
+	for _, arg := range e.Arguments {
+		args = append(args, g.generateExpression(arg))
+	}
+	return fmt.Sprintf("%s.fn_ptr(%s)", callee, strings.Join(args, ", "))
+}
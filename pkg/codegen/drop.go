@@ -0,0 +1,214 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dev-dami/carv/pkg/ast"
+)
+
+// Owned values are dropped when their owner goes away: at the end of the
+// scope of the variable that holds them, at a return, break, continue or ?
+// that leaves it, or when the variable is assigned over. Dropping a class
+// instance calls its Drop method, if it has one, then drops its fields.
+// Storage goes back to the arena when it was the arena's latest
+// allocation, which dropping in reverse order of creation makes the common
+// case; anything else waits for carv_arena_free_all.
+//
+// A move leaves the place it came from zeroed, so the drop there does
+// nothing and each value is dropped once.
+
+// SetMoves gives Generate the expressions whose value the checker found
+// to be moved out of a place. Without them nothing is moved, and a program
+// that moves an owned value drops it twice.
+func (g *CGenerator) SetMoves(moves map[ast.Expression]bool) {
+	g.moves = moves
+}
+
+// dropFunc returns the function that drops a value of C type ctype, or ""
+// if the type owns nothing.
+func (g *CGenerator) dropFunc(ctype string) string {
+	switch ctype {
+	case "carv_string", "carv_map", "carv_int_array", "carv_float_array", "carv_string_array", "carv_bool_array":
+		return ctype + "_drop"
+	}
+	if name := strings.TrimSuffix(ctype, "*"); name != ctype && g.classes[name] != nil {
+		return "carv_drop_" + name
+	}
+	return ""
+}
+
+// instanceClass returns the class of an instance, or of a reference to
+// one, of C type ctype, or "".
+func (g *CGenerator) instanceClass(ctype string) string {
+	name := strings.TrimRight(strings.TrimPrefix(ctype, "const "), "*")
+	if name != ctype && g.classes[name] != nil {
+		return name
+	}
+	return ""
+}
+
+// emitScopeDrops drops the variables of the current scope, latest first.
+func (g *CGenerator) emitScopeDrops() {
+	g.emitDrops(g.scopeDrops(g.scope))
+}
+
+func (g *CGenerator) scopeDrops(s *cgenScope) []string {
+	var drops []string
+	for i := len(s.order) - 1; i >= 0; i-- {
+		name := s.order[i]
+		v := s.vars[name]
+		if fn := g.dropFunc(v.CType); v.Owned && fn != "" {
+			drops = append(drops, fmt.Sprintf("%s(&%s);", fn, name))
+		}
+	}
+	if s.exit != "" {
+		drops = append(drops, s.exit)
+	}
+	return drops
+}
+
+// dropsLeaving returns the drops for jumping out of the innermost loop, or
+// out of the function, from where the generator is.
+func (g *CGenerator) dropsLeaving(loop bool) []string {
+	var drops []string
+	for s := g.scope; s != nil; s = s.parent {
+		drops = append(drops, g.scopeDrops(s)...)
+		if loop && s.loop || s.function {
+			return drops
+		}
+	}
+	// Not in a function or loop: leaving ends the program.
+	return nil
+}
+
+func (g *CGenerator) emitDrops(drops []string) {
+	for _, drop := range drops {
+		g.writeln(drop)
+	}
+}
+
+// ownsPlace reports whether the place expr names is owned by the function
+// being generated: an owned variable, or a field of an instance it owns.
+func (g *CGenerator) ownsPlace(expr ast.Expression) bool {
+	switch e := expr.(type) {
+	case *ast.Identifier:
+		v := g.lookupVar(e.Value)
+		return v != nil && v.Owned
+	case *ast.MemberExpression:
+		objType := g.resolveType(e.Object)
+		return g.instanceClass(objType)+"*" == objType && g.ownsPlace(e.Object)
+	}
+	return false
+}
+
+// moveOut is code for the value of expr, given as code, that moves it out
+// of the place expr names if the checker found a move there.
+func (g *CGenerator) moveOut(expr ast.Expression, code string) string {
+	if !g.moves[expr] {
+		return code
+	}
+	return g.takeValue(expr, code)
+}
+
+// takeValue is code for the value in the place expr, given as code, for a
+// new owner. An owned place is left zeroed. A string in a place owned
+// elsewhere is copied, as its owner will still drop it.
+func (g *CGenerator) takeValue(expr ast.Expression, code string) string {
+	ctype := g.resolveType(expr)
+	switch {
+	case g.dropFunc(ctype) == "":
+		return code
+	case g.ownsPlace(expr) && ctype == "carv_string":
+		return fmt.Sprintf("carv_string_move(&%s)", code)
+	case g.ownsPlace(expr):
+		return fmt.Sprintf("carv_move(%s)", code)
+	case ctype == "carv_string":
+		g.use("arena")
+		return fmt.Sprintf("carv_string_clone(%s)", code)
+	}
+	return code
+}
+
+// generatePayload is code for the value put into an Ok or Err, which the
+// result takes from the place it is in.
+func (g *CGenerator) generatePayload(expr ast.Expression) string {
+	code := g.generateExpression(expr)
+	switch expr.(type) {
+	case *ast.Identifier, *ast.MemberExpression, *ast.DerefExpression:
+		if !g.moves[expr] {
+			return g.takeValue(expr, code)
+		}
+	}
+	return code
+}
+
+// holdsOwnedValue reports whether target, which is assigned to, holds a
+// value that the assignment drops: target is an owned variable, or a field
+// of a class instance.
+func (g *CGenerator) holdsOwnedValue(target ast.Expression) bool {
+	if g.dropFunc(g.resolveType(target)) == "" {
+		return false
+	}
+	switch e := target.(type) {
+	case *ast.Identifier:
+		v := g.lookupVar(e.Value)
+		return v != nil && v.Owned
+	case *ast.MemberExpression:
+		return g.instanceClass(g.resolveType(e.Object)) != ""
+	}
+	return false
+}
+
+// generateDroppingAssign assigns right to left, the code for target, and
+// then drops the value left held.
+func (g *CGenerator) generateDroppingAssign(target ast.Expression, left, right string) string {
+	ctype := g.resolveType(target)
+	id := g.tempCounter
+	g.tempCounter++
+	drop := fmt.Sprintf("%s(&__old_%d);", g.dropFunc(ctype), id)
+	if g.instanceClass(ctype) != "" {
+		// A static-memory build gives `new` in a loop the same slot each time.
+		drop = fmt.Sprintf("if (__old_%d != %s) %s", id, left, drop)
+	}
+	return fmt.Sprintf("({ %s __new_%d = %s; %s __old_%d = %s; %s = __new_%d; %s })",
+		ctype, id, right, ctype, id, left, left, id, drop)
+}
+
+// generateClassDrops emits the function that drops an instance of each
+// class: it calls the class's Drop method, drops the fields, latest first,
+// and gives the instance's storage back.
+func (g *CGenerator) generateClassDrops(program *ast.Program) {
+	var classes []*ast.ClassStatement
+	for _, stmt := range program.Statements {
+		if cls, ok := stmt.(*ast.ClassStatement); ok {
+			classes = append(classes, cls)
+			g.writeln(fmt.Sprintf("static void carv_drop_%s(%s** slot);", cls.Name.Value, cls.Name.Value))
+		}
+	}
+	if len(classes) > 0 {
+		g.writeln("")
+	}
+
+	for _, cls := range classes {
+		name := cls.Name.Value
+		g.writeln(fmt.Sprintf("static void carv_drop_%s(%s** slot) {", name, name))
+		g.indent++
+		g.writeln(fmt.Sprintf("%s* self = *slot;", name))
+		g.writeln("if (!self) return;")
+		g.writeln("*slot = NULL;")
+		if g.dropImpls[name] {
+			g.writeln(fmt.Sprintf("%s_drop(self);", name))
+		}
+		for i := len(cls.Fields) - 1; i >= 0; i-- {
+			field := cls.Fields[i]
+			if fn := g.dropFunc(g.typeToC(field.Type)); fn != "" {
+				g.writeln(fmt.Sprintf("%s(&self->%s);", fn, field.Name.Value))
+			}
+		}
+		g.writeln(fmt.Sprintf("carv_arena_release(self, sizeof(%s));", name))
+		g.indent--
+		g.writeln("}")
+		g.writeln("")
+	}
+}
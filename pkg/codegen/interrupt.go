@@ -0,0 +1,170 @@
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/dev-dami/carv/pkg/ast"
+	"github.com/dev-dami/carv/pkg/types"
+)
+
+// An interrupt handler is a C function named like the entry of the vector
+// table it belongs in, USART1_IRQHandler; the board's startup code defines
+// every entry weakly, so the handler takes its place at link time. A
+// critical block saves PRIMASK, masks interrupts, and puts PRIMASK back
+// however the block is left, so critical blocks nest. On the host, where
+// nothing interrupts the program, it only keeps the compiler from moving
+// memory accesses across the block.
+//
+// Atomic<T> and Mutex<T> have the C type of T: an Atomic is only read and
+// written as atomic.go lowers its methods, and locking a Mutex, which the
+// checker only allows with interrupts held off, gives a pointer to it.
+// Top-level statics are file-scope variables, so handlers can reach them.
+
+func (g *CGenerator) emitInterruptRuntime() {
+	g.writeln("#ifdef CARV_TARGET_ARM")
+	g.writeln("#define CARV_INTERRUPT __attribute__((interrupt(\"IRQ\"), used))")
+	g.writeln("static inline uint32_t carv_critical_enter(void) {")
+	g.writeln("    uint32_t primask;")
+	g.writeln("    __asm__ volatile(\"mrs %0, primask\\n\\tcpsid i\" : \"=r\"(primask) : : \"memory\");")
+	g.writeln("    return primask;")
+	g.writeln("}")
+	g.writeln("static inline void carv_critical_exit(uint32_t primask) {")
+	g.writeln("    __asm__ volatile(\"msr primask, %0\" : : \"r\"(primask) : \"memory\");")
+	g.writeln("}")
+	g.writeln("#else")
+	g.writeln("#define CARV_INTERRUPT __attribute__((used))")
+	g.writeln("static inline uint32_t carv_critical_enter(void) { __atomic_signal_fence(__ATOMIC_SEQ_CST); return 0; }")
+	g.writeln("static inline void carv_critical_exit(uint32_t state) { (void)state; __atomic_signal_fence(__ATOMIC_SEQ_CST); }")
+	g.writeln("#endif")
+	g.writeln("")
+	g.emitAtomicMacros()
+}
+
+// interruptSignature is the C signature of the handler fn.
+func (g *CGenerator) interruptSignature(fn *ast.FunctionStatement) string {
+	g.use("interrupts")
+	return fmt.Sprintf("CARV_INTERRUPT void %s(void)", g.safeName(fn.Name.Value))
+}
+
+func (g *CGenerator) generateCriticalStatement(s *ast.CriticalStatement) {
+	g.use("interrupts")
+	state := fmt.Sprintf("__crit_%d", g.tempCounter)
+	g.tempCounter++
+	g.writeln("{")
+	g.indent++
+	g.writeln(fmt.Sprintf("uint32_t %s = carv_critical_enter();", state))
+	g.enterScope()
+	// Whatever leaves the block turns interrupts back on.
+	g.scope.exit = fmt.Sprintf("carv_critical_exit(%s);", state)
+
+	for _, stmt := range s.Body.Statements {
+		g.generateStatement(stmt)
+	}
+
+	g.emitScopeDrops()
+	g.exitScope()
+	g.indent--
+	g.writeln("}")
+}
+
+// syncType returns the Atomic or Mutex type of expr, or of what it
+// refers to, and whether expr is a reference to it.
+func (g *CGenerator) syncType(expr ast.Expression) (types.Type, bool) {
+	t := g.typeInfo[expr]
+	ref, isRef := t.(*types.RefType)
+	if isRef {
+		t = ref.Inner
+	}
+	switch t.(type) {
+	case *types.AtomicType, *types.MutexType:
+		return t, isRef
+	}
+	return nil, false
+}
+
+// generateSyncCall generates Atomic(v), Mutex(v) and the methods of
+// Atomic and Mutex values, reporting false for any other call.
+func (g *CGenerator) generateSyncCall(e *ast.CallExpression) (string, bool) {
+	switch fn := e.Function.(type) {
+	case *ast.Identifier:
+		switch g.typeInfo[e].(type) {
+		case *types.AtomicType, *types.MutexType:
+			if (fn.Value == "Atomic" || fn.Value == "Mutex") && len(e.Arguments) == 1 {
+				return g.generateExpression(e.Arguments[0]), true
+			}
+		}
+	case *ast.MemberExpression:
+		t, isRef := g.syncType(fn.Object)
+		if t == nil {
+			return "", false
+		}
+		ptr := g.generateExpression(fn.Object)
+		if !isRef {
+			ptr = "&" + ptr
+		}
+		if at, ok := t.(*types.AtomicType); ok {
+			return g.generateAtomicCall(e, fn.Member.Value, at, ptr)
+		}
+		if fn.Member.Value == "lock" {
+			return "(" + ptr + ")", true
+		}
+	}
+	return "", false
+}
+
+// isFileStatic reports whether s is a static declared at the top level,
+// which is a file-scope variable.
+func (g *CGenerator) isFileStatic(s *ast.LetStatement) bool {
+	_, ok := g.fileStatics[s]
+	return ok
+}
+
+// generateFileStatics declares the top-level statics of program at file
+// scope. One with a constant initializer starts with its value; any other
+// starts zeroed and is assigned where the program declares it.
+func (g *CGenerator) generateFileStatics(program *ast.Program) {
+	for _, stmt := range program.Statements {
+		s, ok := stmt.(*ast.LetStatement)
+		if !ok || !s.Static {
+			continue
+		}
+		varType := g.declaredType(s)
+		if arr, ok := s.Value.(*ast.ArrayLiteral); ok {
+			varType = g.getArrayType(g.inferArrayElemType(s.Value))
+			g.arrayLengths[s.Name.Value] = len(arr.Elements)
+		}
+		init, constant := g.constantInitializer(s.Value)
+		if !constant {
+			init = g.zeroValue(varType)
+			if init != "0" && init != "0.0" && init != "false" && init != "NULL" {
+				init = "{0}"
+			}
+		}
+		g.fileStatics[s] = constant
+		g.declareVar(s.Name.Value, varType, s.Mutable, false)
+		g.writeln(fmt.Sprintf("static %s %s = %s;", varType, s.Name.Value, init))
+	}
+}
+
+// constantInitializer is the C for expr if it is a constant that can
+// initialize a file-scope variable.
+func (g *CGenerator) constantInitializer(expr ast.Expression) (string, bool) {
+	switch e := expr.(type) {
+	case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.BoolLiteral, *ast.CharLiteral:
+		return g.generateExpression(e), true
+	case *ast.PrefixExpression:
+		switch e.Right.(type) {
+		case *ast.IntegerLiteral, *ast.FloatLiteral:
+			if e.Operator == "-" {
+				return g.generateExpression(e), true
+			}
+		}
+	case *ast.CallExpression:
+		switch g.typeInfo[e].(type) {
+		case *types.AtomicType, *types.MutexType:
+			// Atomic(v) and Mutex(v) are v.
+			return g.constantInitializer(e.Arguments[0])
+		}
+	}
+	return "", false
+}
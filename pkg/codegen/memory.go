@@ -0,0 +1,78 @@
+package codegen
+
+import "fmt"
+
+// MemoryStats describes where a static-memory build keeps its data.
+type MemoryStats struct {
+	ArenaSize     int // bytes in the static arena; 0 when nothing allocates
+	StaticFrames  int // async frames placed in static storage
+	StackObjects  int // class instances placed on the stack
+	StaticObjects int // class instances placed in static slots
+}
+
+// SetStaticMemory makes Generate emit code that never allocates at run
+// time: class instances and async frames get stack or static storage, the
+// event loop has a fixed number of task slots, and the arena, if anything
+// still needs one, is a static buffer of arenaSize bytes.
+func (g *CGenerator) SetStaticMemory(arenaSize int) {
+	g.staticMemory = true
+	g.arenaSize = arenaSize
+}
+
+// MemoryStats reports the placement decisions of the last Generate in
+// static memory mode.
+func (g *CGenerator) MemoryStats() MemoryStats {
+	return g.memStats
+}
+
+// arenaFeatures are the runtime features whose functions allocate.
+var arenaFeatures = []string{"strings", "args", "fs", "tcp", "map"}
+
+// needsArena reports whether a program using the runtime features in used
+// can allocate from the arena.
+func needsArena(used map[string]bool) bool {
+	if used["arena"] {
+		return true
+	}
+	for _, name := range arenaFeatures {
+		if used[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// emitStaticArenaRuntime emits the arena of a static-memory build. It is a
+// fixed buffer of the configured size, or, when nothing allocates, an
+// allocator that only reports the mistake.
+func (g *CGenerator) emitStaticArenaRuntime(needed bool) {
+	if !g.freestanding() {
+		g.writeln("static void carv_halt(void) {")
+		g.writeln("    exit(1);")
+		g.writeln("}")
+		g.writeln("")
+	}
+	if !needed {
+		g.memStats.ArenaSize = 0
+		g.writeln("// Static memory: nothing allocates at run time, so there is no arena.")
+		g.writeln("static void* carv_arena_alloc(size_t size) {")
+		g.writeln("    (void)size;")
+		g.writeln("    carv_out_cstr(\"carv: allocation in static memory mode\\n\");")
+		g.writeln("    carv_halt();")
+		g.writeln("    return NULL;")
+		g.writeln("}")
+		g.writeln("")
+		g.writeln("static void carv_arena_free_all(void) {")
+		g.writeln("}")
+		g.writeln("")
+		g.writeln("static void carv_arena_release(void* ptr, size_t size) {")
+		g.writeln("    (void)ptr;")
+		g.writeln("    (void)size;")
+		g.writeln("}")
+		g.writeln("")
+		return
+	}
+	g.memStats.ArenaSize = g.arenaSize
+	g.writeln(fmt.Sprintf("#define CARV_ARENA_SIZE %d", g.arenaSize))
+	g.emitFixedArena()
+}
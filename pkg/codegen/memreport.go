@@ -0,0 +1,646 @@
+package codegen
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// MemReport estimates the RAM a generated program needs: the stack frame of
+// every function, the deepest path through the call graph, statically
+// allocated data and the arena. Frames are estimated from the locals of the
+// generated C until ApplyStackUsage replaces them with the compiler's own
+// figures.
+type MemReport struct {
+	Target      string        `json:"target"`
+	StackSource string        `json:"stack_source"` // "estimate" or "gcc -fstack-usage"
+	Functions   []FunctionMem `json:"functions"`
+	WorstStack  int           `json:"worst_stack"`
+	WorstPath   []string      `json:"worst_path"`
+	Bounded     bool          `json:"bounded"` // false when recursion makes the worst case unbounded
+	Recursive   []string      `json:"recursive,omitempty"`
+	Statics     []StaticMem   `json:"statics"`
+	StaticTotal int           `json:"static_total"`
+	Packed      []StaticMem   `json:"packed_classes,omitempty"`
+	Arena       ArenaMem      `json:"arena"`
+}
+
+// FunctionMem is the stack use of one generated C function.
+type FunctionMem struct {
+	Name      string   `json:"name"`
+	Frame     int      `json:"frame"`
+	Source    string   `json:"source"`            // "estimate" or "gcc"
+	Dynamic   bool     `json:"dynamic,omitempty"` // gcc could not bound the frame
+	Calls     []string `json:"calls,omitempty"`
+	Recursive bool     `json:"recursive,omitempty"`
+}
+
+// StaticMem is one object with static storage, or the layout of a packed
+// class.
+type StaticMem struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int    `json:"size"`
+	Kind string `json:"kind"`
+}
+
+// ArenaMem describes the arena allocator.
+type ArenaMem struct {
+	Reserved int  `json:"reserved"` // bytes set aside up front
+	Growable bool `json:"growable"` // hosted builds grow it from the heap
+	Sites    int  `json:"sites"`    // carv_arena_alloc calls in the program
+}
+
+// StackUsage is one function's entry in gcc's -fstack-usage output.
+type StackUsage struct {
+	Bytes   int
+	Dynamic bool
+}
+
+// defaultFreestandingArena matches the CARV_ARENA_SIZE default in
+// emitArenaRuntime.
+const defaultFreestandingArena = 16 * 1024
+
+// MemReport analyses the code produced by the last Generate.
+func (g *CGenerator) MemReport() *MemReport {
+	layout := newCLayout(g.targetIntBits()/8, g.pointerBytes())
+	layout.parseStructs(g.output.String())
+
+	r := &MemReport{Target: "host", StackSource: "estimate", Statics: []StaticMem{}}
+	if g.target != nil {
+		r.Target = g.target.Name
+	}
+
+	funcs := parseCFunctions(g.programCode)
+	names := make(map[string]bool, len(funcs))
+	for _, fn := range funcs {
+		names[fn.name] = true
+	}
+	for _, fn := range funcs {
+		r.Functions = append(r.Functions, FunctionMem{
+			Name:   fn.name,
+			Frame:  layout.frameSize(fn),
+			Source: "estimate",
+			Calls:  fn.references(names),
+		})
+		for _, s := range fn.statics {
+			r.Statics = append(r.Statics, StaticMem{Name: fn.name + "." + s.name, Type: s.ctype, Size: layout.sizeOf(s.ctype) * s.count, Kind: staticKind(s)})
+		}
+	}
+	for _, s := range parseFileStatics(g.programCode) {
+		r.Statics = append(r.Statics, StaticMem{Name: s.name, Type: s.ctype, Size: layout.sizeOf(s.ctype) * s.count, Kind: staticKind(s)})
+	}
+	if g.staticMemory && g.hasAsync {
+		r.Statics = append(r.Statics, StaticMem{Name: "carv_ready_slots", Type: "carv_task*[CARV_MAX_TASKS]", Size: 8 * layout.ptr, Kind: "task slots"})
+	}
+	for _, s := range r.Statics {
+		r.StaticTotal += s.Size
+	}
+
+	for _, name := range layout.packed {
+		r.Packed = append(r.Packed, StaticMem{Name: name, Type: "struct " + name, Size: layout.sizeOf(name), Kind: "packed class"})
+	}
+
+	r.Arena.Sites = strings.Count(g.programCode, "carv_arena_alloc(")
+	switch {
+	case g.staticMemory:
+		r.Arena.Reserved = g.memStats.ArenaSize
+	case g.freestanding():
+		r.Arena.Reserved = defaultFreestandingArena
+		for _, flag := range g.target.CFlags {
+			if v, ok := strings.CutPrefix(flag, "-DCARV_ARENA_SIZE="); ok {
+				if n, err := strconv.Atoi(v); err == nil {
+					r.Arena.Reserved = n
+				}
+			}
+		}
+	default:
+		r.Arena.Growable = true
+	}
+
+	r.analyseCallGraph()
+	return r
+}
+
+func (g *CGenerator) pointerBytes() int {
+	if g.target != nil && g.target.PointerBits != 0 {
+		return g.target.PointerBits / 8
+	}
+	return 8
+}
+
+func staticKind(s cDecl) string {
+	switch {
+	case s.readOnly:
+		return "read-only"
+	case strings.HasSuffix(s.ctype, "_frame") && s.name == "frame":
+		return "async frame"
+	case strings.HasPrefix(s.name, "__obj_"):
+		return "object"
+	}
+	return "static let"
+}
+
+// ParseStackUsage reads the .su files gcc writes for -fstack-usage. Each
+// line is "file:line:col:function<TAB>bytes<TAB>qualifiers".
+func ParseStackUsage(data []byte) map[string]StackUsage {
+	usage := make(map[string]StackUsage)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		loc := fields[0]
+		name := loc[strings.LastIndex(loc, ":")+1:]
+		n, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			continue
+		}
+		usage[name] = StackUsage{Bytes: n, Dynamic: strings.Contains(fields[2], "dynamic")}
+	}
+	return usage
+}
+
+// ApplyStackUsage replaces the estimated frames with gcc's figures where it
+// has them and recomputes the worst case.
+func (r *MemReport) ApplyStackUsage(usage map[string]StackUsage) {
+	applied := false
+	for i := range r.Functions {
+		if u, ok := usage[r.Functions[i].Name]; ok {
+			r.Functions[i].Frame = u.Bytes
+			r.Functions[i].Dynamic = u.Dynamic
+			r.Functions[i].Source = "gcc"
+			applied = true
+		}
+	}
+	if applied {
+		r.StackSource = "gcc -fstack-usage"
+		r.analyseCallGraph()
+	}
+}
+
+// analyseCallGraph finds the deepest stack from main, or from every
+// function nobody calls when there is no main, and marks functions that
+// can reach themselves.
+func (r *MemReport) analyseCallGraph() {
+	byName := make(map[string]*FunctionMem, len(r.Functions))
+	called := make(map[string]bool)
+	for i := range r.Functions {
+		fn := &r.Functions[i]
+		fn.Recursive = false
+		byName[fn.Name] = fn
+		for _, c := range fn.Calls {
+			if c != fn.Name {
+				called[c] = true
+			}
+		}
+	}
+
+	// Depth-first search; a call back into a function still on the path
+	// closes a cycle, and everything on it is recursive.
+	const (
+		unvisited = iota
+		active
+		done
+	)
+	state := make(map[string]int)
+	worst := make(map[string]int)
+	next := make(map[string]string)
+	var path []string
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = active
+		path = append(path, name)
+		fn := byName[name]
+		best, bestCallee := 0, ""
+		for _, c := range fn.Calls {
+			switch state[c] {
+			case active:
+				for i := len(path) - 1; i >= 0; i-- {
+					byName[path[i]].Recursive = true
+					if path[i] == c {
+						break
+					}
+				}
+				continue
+			case unvisited:
+				visit(c)
+			}
+			if worst[c] > best {
+				best, bestCallee = worst[c], c
+			}
+		}
+		worst[name] = fn.Frame + best
+		next[name] = bestCallee
+		path = path[:len(path)-1]
+		state[name] = done
+	}
+
+	var roots []string
+	if _, ok := byName["main"]; ok {
+		roots = []string{"main"}
+	} else {
+		for _, fn := range r.Functions {
+			if !called[fn.Name] {
+				roots = append(roots, fn.Name)
+			}
+		}
+	}
+	sort.Strings(roots)
+
+	r.WorstStack, r.WorstPath = 0, nil
+	for _, root := range roots {
+		if state[root] == unvisited {
+			visit(root)
+		}
+		if worst[root] > r.WorstStack {
+			r.WorstStack = worst[root]
+			r.WorstPath = nil
+			for n := root; n != ""; n = next[n] {
+				r.WorstPath = append(r.WorstPath, n)
+			}
+		}
+	}
+
+	reached := make(map[string]bool, len(state))
+	for name := range state {
+		reached[name] = true
+	}
+	// Functions main never reaches can still recurse.
+	for _, fn := range r.Functions {
+		if state[fn.Name] == unvisited {
+			visit(fn.Name)
+		}
+	}
+
+	r.Recursive = nil
+	r.Bounded = true
+	for _, fn := range r.Functions {
+		if fn.Recursive {
+			r.Recursive = append(r.Recursive, fn.Name)
+		}
+		if reached[fn.Name] && (fn.Recursive || fn.Dynamic) {
+			r.Bounded = false
+		}
+	}
+}
+
+// WriteTable prints the report for people.
+func (r *MemReport) WriteTable(w io.Writer) {
+	fmt.Fprintf(w, "Memory report for %s (stack: %s)\n\n", r.Target, r.StackSource)
+
+	width := len("Function")
+	for _, fn := range r.Functions {
+		width = max(width, len(fn.Name))
+	}
+	fmt.Fprintf(w, "%-*s  %6s  %s\n", width, "Function", "Frame", "Source")
+	for _, fn := range r.Functions {
+		note := fn.Source
+		if fn.Recursive {
+			note += ", recursive"
+		}
+		if fn.Dynamic {
+			note += ", dynamic"
+		}
+		fmt.Fprintf(w, "%-*s  %6d  %s\n", width, fn.Name, fn.Frame, note)
+	}
+
+	worst := fmt.Sprintf("%d bytes", r.WorstStack)
+	if !r.Bounded {
+		worst = fmt.Sprintf("at least %d bytes (unbounded)", r.WorstStack)
+	}
+	fmt.Fprintf(w, "\nWorst-case stack: %s, depth %d (%s)\n", worst, len(r.WorstPath), strings.Join(r.WorstPath, " -> "))
+	if len(r.Recursive) > 0 {
+		fmt.Fprintf(w, "Recursion: %s\n", strings.Join(r.Recursive, ", "))
+	}
+
+	fmt.Fprintf(w, "\nStatic data: %d bytes\n", r.StaticTotal)
+	if len(r.Statics) > 0 {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for _, s := range r.Statics {
+			fmt.Fprintf(tw, "  %s\t%s\t%d\t%s\n", s.Name, s.Type, s.Size, s.Kind)
+		}
+		tw.Flush()
+	}
+	if len(r.Packed) > 0 {
+		fmt.Fprintln(w, "\nPacked classes:")
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for _, s := range r.Packed {
+			fmt.Fprintf(tw, "  %s\t%d\n", s.Name, s.Size)
+		}
+		tw.Flush()
+	}
+
+	switch {
+	case r.Arena.Growable:
+		fmt.Fprintf(w, "\nArena: grows from the heap in 1 MB blocks; %d allocation site(s)\n", r.Arena.Sites)
+	case r.Arena.Reserved == 0:
+		fmt.Fprintln(w, "\nArena: none")
+	default:
+		fmt.Fprintf(w, "\nArena: %d bytes reserved; %d allocation site(s)\n", r.Arena.Reserved, r.Arena.Sites)
+	}
+}
+
+// cFunction is a function definition in generated C.
+type cFunction struct {
+	name    string
+	params  []cDecl
+	locals  []cDecl
+	statics []cDecl
+	temps   []cDecl // compound literal arrays
+	body    string
+}
+
+// cDecl is a declared object: count elements of ctype.
+type cDecl struct {
+	name     string
+	ctype    string
+	count    int
+	readOnly bool
+}
+
+var (
+	cFuncHeader = regexp.MustCompile(`^[A-Za-z_][\w \*]*?\b([A-Za-z_]\w*)\((.*)\)\s*\{$`)
+	cDeclLine   = regexp.MustCompile(`^(static\s+)?(const\s+)?([A-Za-z_]\w*)((?:\s*\*)*)\s+(\**)([A-Za-z_]\w*)\s*(?:\[(\d*)\])?\s*[=;]`)
+	cArrayTemp  = regexp.MustCompile(`\(([A-Za-z_]\w*)\[\]\)\{`)
+	cIdent      = regexp.MustCompile(`[A-Za-z_]\w*`)
+)
+
+// cKeywords start statements that can look like declarations.
+var cKeywords = map[string]bool{
+	"return": true, "goto": true, "case": true, "else": true, "typedef": true,
+	"struct": true, "break": true, "continue": true, "default": true,
+}
+
+// parseCFunctions finds the function definitions in code. The generator
+// opens them at column 0 and closes them with a lone "}".
+func parseCFunctions(code string) []cFunction {
+	var funcs []cFunction
+	lines := strings.Split(code, "\n")
+	for i := 0; i < len(lines); i++ {
+		m := cFuncHeader.FindStringSubmatch(lines[i])
+		if m == nil || strings.HasPrefix(lines[i], "struct ") || strings.HasPrefix(lines[i], "typedef ") {
+			continue
+		}
+		fn := cFunction{name: m[1]}
+		for _, p := range strings.Split(m[2], ",") {
+			if d, ok := parseDecl(strings.TrimSpace(p) + ";"); ok {
+				fn.params = append(fn.params, d)
+			}
+		}
+		var body strings.Builder
+		for i++; i < len(lines) && lines[i] != "}"; i++ {
+			line := strings.TrimSpace(lines[i])
+			body.WriteString(line)
+			body.WriteByte('\n')
+			if d, ok := parseDecl(line); ok {
+				if strings.HasPrefix(line, "static ") {
+					fn.statics = append(fn.statics, d)
+				} else {
+					fn.locals = append(fn.locals, d)
+				}
+			}
+			fn.temps = append(fn.temps, arrayTemps(line)...)
+		}
+		fn.body = body.String()
+		funcs = append(funcs, fn)
+	}
+	return funcs
+}
+
+// parseFileStatics finds static objects declared outside any function.
+func parseFileStatics(code string) []cDecl {
+	var decls []cDecl
+	for _, line := range strings.Split(code, "\n") {
+		if !strings.HasPrefix(line, "static ") || strings.Contains(line, "(") {
+			continue
+		}
+		if d, ok := parseDecl(line); ok {
+			decls = append(decls, d)
+		}
+	}
+	return decls
+}
+
+func parseDecl(line string) (cDecl, bool) {
+	m := cDeclLine.FindStringSubmatch(line)
+	if m == nil || cKeywords[m[3]] {
+		return cDecl{}, false
+	}
+	d := cDecl{name: m[6], ctype: m[3] + strings.ReplaceAll(m[4]+m[5], " ", ""), count: 1, readOnly: m[2] != ""}
+	if m[7] != "" {
+		d.count, _ = strconv.Atoi(m[7])
+	}
+	return d, true
+}
+
+// arrayTemps returns the "(T[]){a, b, c}" array literals on line.
+func arrayTemps(line string) []cDecl {
+	var temps []cDecl
+	for _, loc := range cArrayTemp.FindAllStringSubmatchIndex(line, -1) {
+		elem := line[loc[2]:loc[3]]
+		depth, count, inString := 0, 1, false
+	scan:
+		for i := loc[1]; i < len(line); i++ {
+			switch c := line[i]; {
+			case inString:
+				if c == '\\' {
+					i++
+				} else if c == '"' {
+					inString = false
+				}
+			case c == '"':
+				inString = true
+			case c == '(' || c == '{' || c == '[':
+				depth++
+			case c == ')' || c == ']':
+				depth--
+			case c == '}':
+				if depth == 0 {
+					break scan
+				}
+				depth--
+			case c == ',' && depth == 0:
+				count++
+			}
+		}
+		temps = append(temps, cDecl{name: "(array literal)", ctype: elem, count: count})
+	}
+	return temps
+}
+
+// references returns the functions in names that fn's body mentions,
+// whether it calls them or takes their address.
+func (fn cFunction) references(names map[string]bool) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, id := range cIdent.FindAllString(fn.body, -1) {
+		if names[id] && !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// cLayout knows the size and alignment of C types for one target.
+type cLayout struct {
+	ptr     int
+	sizes   map[string]int
+	aligns  map[string]int
+	structs map[string][]string
+	packed  []string
+	isPack  map[string]bool
+}
+
+func newCLayout(intBytes, ptrBytes int) *cLayout {
+	l := &cLayout{
+		ptr:     ptrBytes,
+		structs: make(map[string][]string),
+		isPack:  make(map[string]bool),
+		sizes: map[string]int{
+			"carv_int": intBytes, "carv_float": 8, "carv_bool": 1, "bool": 1,
+			"char": 1, "int8_t": 1, "uint8_t": 1, "int16_t": 2, "uint16_t": 2,
+			"int": 4, "int32_t": 4, "uint32_t": 4, "float": 4,
+			"int64_t": 8, "uint64_t": 8, "double": 8, "long": ptrBytes,
+			"size_t": ptrBytes, "ptrdiff_t": ptrBytes, "intptr_t": ptrBytes, "uintptr_t": ptrBytes,
+		},
+	}
+	l.aligns = make(map[string]int, len(l.sizes))
+	for name, size := range l.sizes {
+		l.aligns[name] = size
+	}
+	return l
+}
+
+var (
+	cStructOpen    = regexp.MustCompile(`^struct ([A-Za-z_]\w*) \{$`)
+	cTypedefOpen   = regexp.MustCompile(`^typedef struct(?: [A-Za-z_]\w*)? \{$`)
+	cTypedefInline = regexp.MustCompile(`^typedef struct(?: [A-Za-z_]\w*)? \{(.*)\} ([A-Za-z_]\w*);$`)
+	cTypedefClose  = regexp.MustCompile(`^\} ([A-Za-z_]\w*);$`)
+)
+
+// parseStructs records the fields of every struct the generated C defines.
+func (l *cLayout) parseStructs(code string) {
+	lines := strings.Split(code, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if m := cTypedefInline.FindStringSubmatch(line); m != nil {
+			l.structs[m[2]] = splitFields(m[1])
+			continue
+		}
+		var name string
+		if m := cStructOpen.FindStringSubmatch(line); m != nil {
+			name = m[1]
+		} else if !cTypedefOpen.MatchString(line) {
+			continue
+		}
+		var fields []string
+		for i++; i < len(lines) && !strings.HasPrefix(lines[i], "}"); i++ {
+			fields = append(fields, splitFields(lines[i])...)
+		}
+		if i >= len(lines) {
+			break
+		}
+		if m := cTypedefClose.FindStringSubmatch(lines[i]); m != nil && name == "" {
+			name = m[1]
+		}
+		if name == "" {
+			continue
+		}
+		l.structs[name] = fields
+		if strings.Contains(lines[i], "packed") {
+			l.isPack[name] = true
+			l.packed = append(l.packed, name)
+		}
+	}
+}
+
+func splitFields(s string) []string {
+	var fields []string
+	for _, f := range strings.Split(s, ";") {
+		if f = strings.TrimSpace(f); f != "" && !strings.HasPrefix(f, "//") {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// fieldType returns the type of a field declaration and how many elements
+// it holds. Function pointers count as pointers.
+func fieldType(field string) (string, int) {
+	if strings.Contains(field, "(*") {
+		return "void*", 1
+	}
+	if d, ok := parseDecl(field + ";"); ok {
+		return d.ctype, d.count
+	}
+	return "void*", 1
+}
+
+func (l *cLayout) sizeOf(ctype string) int {
+	size, _ := l.layout(ctype, 0)
+	return size
+}
+
+func (l *cLayout) alignOf(ctype string) int {
+	_, align := l.layout(ctype, 0)
+	return align
+}
+
+// layout returns the size and alignment of ctype. Unknown types are taken
+// to be pointer-sized.
+func (l *cLayout) layout(ctype string, depth int) (int, int) {
+	if strings.HasSuffix(ctype, "*") {
+		return l.ptr, l.ptr
+	}
+	if size, ok := l.sizes[ctype]; ok {
+		return size, l.aligns[ctype]
+	}
+	fields, ok := l.structs[ctype]
+	if !ok || depth > 16 {
+		return l.ptr, l.ptr
+	}
+	size, align := 0, 1
+	for _, f := range fields {
+		ft, count := fieldType(f)
+		fs, fa := l.layout(ft, depth+1)
+		if l.isPack[ctype] {
+			fa = 1
+		}
+		size = alignUp(size, fa) + fs*count
+		if fa > align {
+			align = fa
+		}
+	}
+	size = alignUp(size, align)
+	l.sizes[ctype], l.aligns[ctype] = size, align
+	return size, align
+}
+
+func alignUp(n, align int) int {
+	if align <= 1 {
+		return n
+	}
+	return (n + align - 1) / align * align
+}
+
+// frameSize estimates a function's stack frame: its parameters, locals and
+// array literals laid out in order, plus a return address and saved frame
+// pointer, rounded to 8 bytes.
+func (l *cLayout) frameSize(fn cFunction) int {
+	size := 2 * l.ptr
+	for _, group := range [][]cDecl{fn.params, fn.locals, fn.temps} {
+		for _, d := range group {
+			size = alignUp(size, l.alignOf(d.ctype)) + l.sizeOf(d.ctype)*d.count
+		}
+	}
+	return alignUp(size, 8)
+}
@@ -0,0 +1,1047 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+)
+
+// hostedFeatures need an operating system and cannot be used freestanding.
+var hostedFeatures = []string{"fs", "tcp"}
+
+// use records that the program calls into the optional runtime feature
+// name, so emitRuntime includes it. Code generation calls it as it emits
+// each call; "arena" marks code that allocates.
+func (g *CGenerator) use(name string) {
+	g.uses[name] = true
+}
+
+// builtinFeature is the runtime feature behind the builtin module function
+// name, or "" for none.
+func builtinFeature(name string) string {
+	switch name {
+	case "read_file", "write_file", "file_exists", "append_file", "delete_file", "list_dir":
+		return "fs"
+	case "pin_mode", "digital_write", "digital_read", "analog_read", "analog_write":
+		return "gpio"
+	case "delay_ms", "delay_us":
+		return "timer"
+	}
+	for _, prefix := range []string{"tcp", "uart", "spi", "i2c", "timer"} {
+		if strings.HasPrefix(name, prefix+"_") {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// freestanding reports whether the program is built without a hosted C
+// library, as it is for every Cortex-M target.
+func (g *CGenerator) freestanding() bool {
+	return g.target != nil && !g.target.IsHost()
+}
+
+// emitRuntime writes the C runtime ahead of the program: the core every
+// program needs, then only the features in used. A freestanding runtime
+// includes no hosted headers and needs nothing from libc.
+func (g *CGenerator) emitRuntime(used map[string]bool) {
+	g.emitHeaders(used)
+	g.emitTargetConfig()
+	g.writeln("")
+	if g.freestanding() {
+		for _, name := range hostedFeatures {
+			if used[name] {
+				g.writeln(fmt.Sprintf("#error \"carv: %s is not available on target %s\"", name, g.target.Name))
+			}
+		}
+		g.emitFreestandingSupport()
+	}
+
+	g.emitCoreTypes()
+	g.emitOutputRuntime()
+	g.emitArenaRuntime(needsArena(used))
+	g.emitStringRuntime()
+	if used["assert"] {
+		g.emitAssertRuntime()
+	}
+	g.emitArrayRuntime()
+
+	emitters := []struct {
+		name string
+		emit func()
+	}{
+		{"print", g.emitPrintRuntime},
+		{"args", g.emitArgsRuntime},
+		{"fs", g.emitFSRuntime},
+		{"tcp", g.emitTCPRuntime},
+		{"strings", g.emitStringOpsRuntime},
+		{"gpio", g.emitGPIORuntime},
+		{"uart", g.emitUARTRuntime},
+		{"spi", g.emitSPIRuntime},
+		{"i2c", g.emitI2CRuntime},
+		{"timer", g.emitTimerRuntime},
+		{"result", g.emitResultRuntime},
+		{"map", g.emitMapRuntime},
+		{"interrupts", g.emitInterruptRuntime},
+	}
+	for _, e := range emitters {
+		if used[e.name] && !(g.freestanding() && isHostedFeature(e.name)) {
+			e.emit()
+		}
+	}
+
+	if g.hasAsync {
+		g.emitEventLoopRuntime()
+	}
+}
+
+func isHostedFeature(name string) bool {
+	for _, h := range hostedFeatures {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *CGenerator) emitHeaders(used map[string]bool) {
+	// Only the headers C guarantees without a hosted library.
+	headers := []string{"stdint.h", "stddef.h", "stdbool.h"}
+	if !g.freestanding() {
+		headers = []string{"stdio.h", "stdlib.h", "string.h", "stdint.h", "stddef.h", "stdbool.h", "inttypes.h"}
+		if used["assert"] {
+			headers = append(headers, "stdarg.h", "setjmp.h")
+		}
+		if used["tcp"] {
+			headers = append(headers, "unistd.h", "sys/types.h", "sys/socket.h", "netinet/in.h", "arpa/inet.h")
+		}
+		if used["fs"] {
+			headers = append(headers, "dirent.h")
+		}
+	}
+	for _, h := range headers {
+		g.writeln("#include <" + h + ">")
+	}
+}
+
+// emitFreestandingSupport provides the few libc routines the runtime relies
+// on, plus the hook called when the program cannot go on. The compiler may
+// emit calls to memcpy and memset by itself, so those keep their C names.
+func (g *CGenerator) emitFreestandingSupport() {
+	g.writeln("#if defined(__GNUC__) && !defined(__clang__)")
+	g.writeln("#define CARV_NO_LIBCALL __attribute__((optimize(\"no-tree-loop-distribute-patterns\")))")
+	g.writeln("#else")
+	g.writeln("#define CARV_NO_LIBCALL")
+	g.writeln("#endif")
+	g.writeln("")
+	g.writeln("CARV_NO_LIBCALL void* memcpy(void* dst, const void* src, size_t n) {")
+	g.writeln("    unsigned char* d = (unsigned char*)dst;")
+	g.writeln("    const unsigned char* s = (const unsigned char*)src;")
+	g.writeln("    while (n--) *d++ = *s++;")
+	g.writeln("    return dst;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("CARV_NO_LIBCALL void* memset(void* dst, int c, size_t n) {")
+	g.writeln("    unsigned char* d = (unsigned char*)dst;")
+	g.writeln("    while (n--) *d++ = (unsigned char)c;")
+	g.writeln("    return dst;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("int memcmp(const void* a, const void* b, size_t n) {")
+	g.writeln("    const unsigned char* x = (const unsigned char*)a;")
+	g.writeln("    const unsigned char* y = (const unsigned char*)b;")
+	g.writeln("    for (; n; n--, x++, y++) {")
+	g.writeln("        if (*x != *y) return *x - *y;")
+	g.writeln("    }")
+	g.writeln("    return 0;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("size_t strlen(const char* s) {")
+	g.writeln("    const char* p = s;")
+	g.writeln("    while (*p) p++;")
+	g.writeln("    return (size_t)(p - s);")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("char* strstr(const char* haystack, const char* needle) {")
+	g.writeln("    size_t n = strlen(needle);")
+	g.writeln("    if (n == 0) return (char*)haystack;")
+	g.writeln("    for (; *haystack; haystack++) {")
+	g.writeln("        if (memcmp(haystack, needle, n) == 0) return (char*)haystack;")
+	g.writeln("    }")
+	g.writeln("    return NULL;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("CARV_NO_LIBCALL char* strcat(char* dst, const char* src) {")
+	g.writeln("    char* d = dst + strlen(dst);")
+	g.writeln("    while ((*d++ = *src++) != '\\0') {}")
+	g.writeln("    return dst;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("// Called when the program cannot go on: a failed assertion or an exhausted")
+	g.writeln("// arena. The default spins; a board may override it to reset the chip.")
+	g.writeln("__attribute__((weak)) void carv_halt(void) {")
+	g.writeln("    for (;;) {}")
+	g.writeln("}")
+	g.writeln("")
+}
+
+func (g *CGenerator) emitCoreTypes() {
+	if g.targetIntBits() == 32 {
+		g.writeln("typedef int32_t carv_int;")
+		g.writeln("#define CARV_INT_FMT \"%\" PRId32")
+	} else {
+		g.writeln("typedef long long carv_int;")
+		g.writeln("#define CARV_INT_FMT \"%lld\"")
+	}
+	g.writeln("typedef double carv_float;")
+	g.writeln("typedef bool carv_bool;")
+	g.writeln("typedef struct { char* data; size_t len; bool owned; } carv_string;")
+	g.writeln("")
+}
+
+// emitOutputRuntime defines the sink that print and println write to, and
+// the formatting they share. Hosted builds write to stdout; freestanding ones
+// drop the bytes by default. Either way a program can link its own
+// carv_sink_write, e.g. one that writes to a UART.
+func (g *CGenerator) emitOutputRuntime() {
+	g.writeln("#define CARV_FMT_BUF 48")
+	g.writeln("")
+	g.writeln("__attribute__((weak)) void carv_sink_write(const char* data, size_t len) {")
+	if g.freestanding() {
+		g.writeln("    (void)data;")
+		g.writeln("    (void)len;")
+	} else {
+		g.writeln("    fwrite(data, 1, len, stdout);")
+	}
+	g.writeln("}")
+	g.writeln("")
+	if g.freestanding() {
+		g.emitNumberFormatting()
+	} else {
+		g.writeln("static size_t carv_fmt_int(char* buf, carv_int v) { return (size_t)snprintf(buf, CARV_FMT_BUF, CARV_INT_FMT, v); }")
+		g.writeln("static size_t carv_fmt_float(char* buf, carv_float v) { return (size_t)snprintf(buf, CARV_FMT_BUF, \"%g\", v); }")
+		g.writeln("")
+	}
+	// Every print lowering ends in carv_out_cstr, so it returns a value for
+	// prints used as expressions, as printf did.
+	g.writeln("static int carv_out_cstr(const char* s) { carv_sink_write(s, strlen(s)); return 0; }")
+	g.writeln("static void carv_out_str(carv_string s) { if (s.data) carv_sink_write(s.data, s.len); }")
+	g.writeln("static void carv_out_bool(carv_bool v) { carv_out_cstr(v ? \"true\" : \"false\"); }")
+	g.writeln("static void carv_out_int(carv_int v) { char buf[CARV_FMT_BUF]; carv_sink_write(buf, carv_fmt_int(buf, v)); }")
+	g.writeln("static void carv_out_float(carv_float v) { char buf[CARV_FMT_BUF]; carv_sink_write(buf, carv_fmt_float(buf, v)); }")
+	g.writeln("")
+}
+
+// emitNumberFormatting writes libc-free replacements for printf's integer
+// and %g conversions. Arithmetic stays within carv_int's width, so 32-bit
+// targets need no 64-bit division.
+func (g *CGenerator) emitNumberFormatting() {
+	uint, limit := "uint64_t", "1e15"
+	if g.targetIntBits() == 32 {
+		uint, limit = "uint32_t", "1e9"
+	}
+	g.writeln(fmt.Sprintf("static size_t carv_fmt_uint(char* buf, %s v) {", uint))
+	g.writeln("    char tmp[24];")
+	g.writeln("    size_t n = 0, len = 0;")
+	g.writeln("    do { tmp[n++] = (char)('0' + v % 10); v /= 10; } while (v);")
+	g.writeln("    while (n) buf[len++] = tmp[--n];")
+	g.writeln("    buf[len] = '\\0';")
+	g.writeln("    return len;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static size_t carv_fmt_int(char* buf, carv_int v) {")
+	g.writeln(fmt.Sprintf("    if (v >= 0) return carv_fmt_uint(buf, (%s)v);", uint))
+	g.writeln("    buf[0] = '-';")
+	g.writeln(fmt.Sprintf("    return 1 + carv_fmt_uint(buf + 1, (%s)0 - (%s)v);", uint, uint))
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("// Up to six decimals, with an exponent for large magnitudes.")
+	g.writeln("static size_t carv_fmt_float(char* buf, carv_float v) {")
+	g.writeln("    size_t len = 0;")
+	g.writeln("    int exp10 = 0;")
+	g.writeln("    if (v != v) { memcpy(buf, \"nan\", 4); return 3; }")
+	g.writeln("    if (v < 0) { buf[len++] = '-'; v = -v; }")
+	g.writeln("    if (v - v != 0) { memcpy(buf + len, \"inf\", 4); return len + 3; }")
+	g.writeln(fmt.Sprintf("    if (v >= %s) {", limit))
+	g.writeln("        while (v >= 10) { v /= 10; exp10++; }")
+	g.writeln("    }")
+	g.writeln(fmt.Sprintf("    %s whole = (%s)v;", uint, uint))
+	g.writeln(fmt.Sprintf("    %s frac = (%s)((v - (carv_float)whole) * 1000000.0 + 0.5);", uint, uint))
+	g.writeln("    if (frac >= 1000000) { whole++; frac -= 1000000; }")
+	g.writeln("    len += carv_fmt_uint(buf + len, whole);")
+	g.writeln("    if (frac) {")
+	g.writeln("        char digits[6];")
+	g.writeln("        int n = 6;")
+	g.writeln("        for (int i = 5; i >= 0; i--) { digits[i] = (char)('0' + frac % 10); frac /= 10; }")
+	g.writeln("        while (digits[n - 1] == '0') n--;")
+	g.writeln("        buf[len++] = '.';")
+	g.writeln("        for (int i = 0; i < n; i++) buf[len++] = digits[i];")
+	g.writeln("    }")
+	g.writeln("    if (exp10) {")
+	g.writeln("        buf[len++] = 'e';")
+	g.writeln("        buf[len++] = '+';")
+	g.writeln(fmt.Sprintf("        len += carv_fmt_uint(buf + len, (%s)exp10);", uint))
+	g.writeln("    }")
+	g.writeln("    buf[len] = '\\0';")
+	g.writeln("    return len;")
+	g.writeln("}")
+	g.writeln("")
+}
+
+// emitArenaRuntime writes the allocator everything goes through. Hosted
+// builds grow it in malloc'd blocks; freestanding ones have no heap and
+// carve it from a static buffer, sized with -DCARV_ARENA_SIZE=<bytes>.
+// Static-memory builds fix the size at compile time.
+func (g *CGenerator) emitArenaRuntime(needed bool) {
+	if g.staticMemory {
+		g.emitStaticArenaRuntime(needed)
+		return
+	}
+	if g.freestanding() {
+		g.writeln("#ifndef CARV_ARENA_SIZE")
+		g.writeln("#define CARV_ARENA_SIZE (16 * 1024)")
+		g.writeln("#endif")
+		g.emitFixedArena()
+		return
+	}
+	g.writeln("// Arena allocator for automatic memory management")
+	g.writeln("#define CARV_ARENA_BLOCK_SIZE (1024 * 1024)  // 1MB blocks")
+	g.writeln("typedef struct carv_arena_block {")
+	g.writeln("    char* data;")
+	g.writeln("    size_t used;")
+	g.writeln("    size_t capacity;")
+	g.writeln("    struct carv_arena_block* next;")
+	g.writeln("} carv_arena_block;")
+	g.writeln("")
+	g.writeln("typedef struct {")
+	g.writeln("    carv_arena_block* head;")
+	g.writeln("    carv_arena_block* current;")
+	g.writeln("} carv_arena;")
+	g.writeln("")
+	g.writeln("static carv_arena carv_global_arena = {NULL, NULL};")
+	g.writeln("")
+	g.writeln("static carv_arena_block* carv_arena_new_block(size_t min_size) {")
+	g.writeln("    size_t size = min_size > CARV_ARENA_BLOCK_SIZE ? min_size : CARV_ARENA_BLOCK_SIZE;")
+	g.writeln("    carv_arena_block* block = (carv_arena_block*)malloc(sizeof(carv_arena_block));")
+	g.writeln("    block->data = (char*)malloc(size);")
+	g.writeln("    block->used = 0;")
+	g.writeln("    block->capacity = size;")
+	g.writeln("    block->next = NULL;")
+	g.writeln("    return block;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void* carv_arena_alloc(size_t size) {")
+	g.writeln("    size = (size + 7) & ~7;  // 8-byte alignment")
+	g.writeln("    if (!carv_global_arena.current || carv_global_arena.current->used + size > carv_global_arena.current->capacity) {")
+	g.writeln("        carv_arena_block* block = carv_arena_new_block(size);")
+	g.writeln("        if (carv_global_arena.current) {")
+	g.writeln("            carv_global_arena.current->next = block;")
+	g.writeln("        } else {")
+	g.writeln("            carv_global_arena.head = block;")
+	g.writeln("        }")
+	g.writeln("        carv_global_arena.current = block;")
+	g.writeln("    }")
+	g.writeln("    void* ptr = carv_global_arena.current->data + carv_global_arena.current->used;")
+	g.writeln("    carv_global_arena.current->used += size;")
+	g.writeln("    return ptr;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_arena_free_all(void) {")
+	g.writeln("    carv_arena_block* block = carv_global_arena.head;")
+	g.writeln("    while (block) {")
+	g.writeln("        carv_arena_block* next = block->next;")
+	g.writeln("        free(block->data);")
+	g.writeln("        free(block);")
+	g.writeln("        block = next;")
+	g.writeln("    }")
+	g.writeln("    carv_global_arena.head = NULL;")
+	g.writeln("    carv_global_arena.current = NULL;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("// Give back an allocation of size bytes if it is the latest one; anything")
+	g.writeln("// else is reclaimed by carv_arena_free_all")
+	g.writeln("static void carv_arena_release(void* ptr, size_t size) {")
+	g.writeln("    carv_arena_block* block = carv_global_arena.current;")
+	g.writeln("    size = (size + 7) & ~7;")
+	g.writeln("    if (ptr && block && size <= block->used && (char*)ptr == block->data + block->used - size) {")
+	g.writeln("        block->used -= size;")
+	g.writeln("    }")
+	g.writeln("}")
+	g.writeln("")
+}
+
+// emitFixedArena carves allocations from a static buffer of CARV_ARENA_SIZE
+// bytes and halts when it runs out.
+func (g *CGenerator) emitFixedArena() {
+	g.writeln("static char carv_arena_buf[CARV_ARENA_SIZE] __attribute__((aligned(8)));")
+	g.writeln("static size_t carv_arena_used = 0;")
+	g.writeln("")
+	g.writeln("static void* carv_arena_alloc(size_t size) {")
+	g.writeln("    size = (size + 7) & ~(size_t)7;  // 8-byte alignment")
+	g.writeln("    if (size > CARV_ARENA_SIZE - carv_arena_used) {")
+	g.writeln("        carv_out_cstr(\"carv: out of memory\\n\");")
+	g.writeln("        carv_halt();")
+	g.writeln("    }")
+	g.writeln("    void* ptr = carv_arena_buf + carv_arena_used;")
+	g.writeln("    carv_arena_used += size;")
+	g.writeln("    return ptr;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_arena_free_all(void) {")
+	g.writeln("    carv_arena_used = 0;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("// Give back an allocation of size bytes if it is the latest one")
+	g.writeln("static void carv_arena_release(void* ptr, size_t size) {")
+	g.writeln("    size = (size + 7) & ~(size_t)7;")
+	g.writeln("    if (ptr && size <= carv_arena_used && (char*)ptr == carv_arena_buf + carv_arena_used - size) {")
+	g.writeln("        carv_arena_used -= size;")
+	g.writeln("    }")
+	g.writeln("}")
+	g.writeln("")
+}
+
+func (g *CGenerator) emitStringRuntime() {
+	g.writeln("// Create string from C string literal (NOT owned - never freed)")
+	g.writeln("static carv_string carv_string_lit(const char* s) {")
+	g.writeln("    return (carv_string){(char*)s, strlen(s), false};")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("// Create owned string from heap allocation")
+	g.writeln("static carv_string carv_string_own(char* data, size_t len) {")
+	g.writeln("    return (carv_string){data, len, true};")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("// Clone a string (always returns owned copy)")
+	g.writeln("static carv_string carv_string_clone(carv_string s) {")
+	g.writeln("    if (!s.data) return (carv_string){NULL, 0, false};")
+	g.writeln("    char* copy = (char*)carv_arena_alloc(s.len + 1);")
+	g.writeln("    memcpy(copy, s.data, s.len + 1);")
+	g.writeln("    return (carv_string){copy, s.len, true};")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("// Move ownership (source zeroed)")
+	g.writeln("static carv_string carv_string_move(carv_string* s) {")
+	g.writeln("    carv_string out = *s;")
+	g.writeln("    s->data = NULL;")
+	g.writeln("    s->len = 0;")
+	g.writeln("    s->owned = false;")
+	g.writeln("    return out;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("// Move any value out of a place, which is left zeroed so dropping it does nothing")
+	g.writeln("#define carv_move(place) ({ __typeof__(place) __carv_moved = (place); memset(&(place), 0, sizeof(place)); __carv_moved; })")
+	g.writeln("")
+	g.writeln("// Drop a string (give its storage back if owned)")
+	g.writeln("static void carv_string_drop(carv_string* s) {")
+	g.writeln("    if (s->owned) carv_arena_release(s->data, s->len + 1);")
+	g.writeln("    s->data = NULL;")
+	g.writeln("    s->len = 0;")
+	g.writeln("    s->owned = false;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static carv_string carv_strdup_str(const char* s) {")
+	g.writeln("    size_t len = strlen(s) + 1;")
+	g.writeln("    char* copy = (char*)carv_arena_alloc(len);")
+	g.writeln("    memcpy(copy, s, len);")
+	g.writeln("    return (carv_string){copy, len - 1, true};")
+	g.writeln("}")
+	g.writeln("")
+	if !g.freestanding() {
+		g.writeln("// Command-line arguments, without the program name, for args()")
+		g.writeln("static int carv_argc = 0;")
+		g.writeln("static char** carv_argv = NULL;")
+		g.writeln("")
+	}
+}
+
+func (g *CGenerator) emitArrayRuntime() {
+	g.writeln("typedef struct { carv_int* data; carv_int len; carv_int cap; } carv_int_array;")
+	g.writeln("typedef struct { carv_float* data; carv_int len; carv_int cap; } carv_float_array;")
+	g.writeln("typedef struct { carv_string* data; carv_int len; carv_int cap; } carv_string_array;")
+	g.writeln("typedef struct { carv_bool* data; carv_int len; carv_int cap; } carv_bool_array;")
+	g.writeln("")
+	g.writeln("carv_int_array carv_new_int_array(carv_int len) {")
+	g.writeln("    carv_int_array arr;")
+	g.writeln("    arr.data = (carv_int*)carv_arena_alloc(len * sizeof(carv_int));")
+	g.writeln("    arr.len = len;")
+	g.writeln("    arr.cap = len;")
+	g.writeln("    return arr;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("carv_float_array carv_new_float_array(carv_int len) {")
+	g.writeln("    carv_float_array arr;")
+	g.writeln("    arr.data = (carv_float*)carv_arena_alloc(len * sizeof(carv_float));")
+	g.writeln("    arr.len = len;")
+	g.writeln("    arr.cap = len;")
+	g.writeln("    return arr;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("carv_string_array carv_new_string_array(carv_int len) {")
+	g.writeln("    carv_string_array arr;")
+	g.writeln("    arr.data = (carv_string*)carv_arena_alloc(len * sizeof(carv_string));")
+	g.writeln("    arr.len = len;")
+	g.writeln("    arr.cap = len;")
+	g.writeln("    return arr;")
+	g.writeln("}")
+	g.writeln("")
+	for _, elem := range []string{"int", "float", "string", "bool"} {
+		g.writeln(fmt.Sprintf("static void carv_%s_array_drop(carv_%s_array* arr) {", elem, elem))
+		if elem == "string" {
+			g.writeln("    for (carv_int i = arr->len - 1; i >= 0; i--) carv_string_drop(&arr->data[i]);")
+		}
+		g.writeln(fmt.Sprintf("    carv_arena_release(arr->data, (size_t)arr->cap * sizeof(carv_%s));", elem))
+		g.writeln("    arr->data = NULL;")
+		g.writeln("    arr->len = 0;")
+		g.writeln("    arr->cap = 0;")
+		g.writeln("}")
+		g.writeln("")
+	}
+}
+
+func (g *CGenerator) emitPrintRuntime() {
+	g.writeln("void carv_print_int(carv_int x) { carv_out_int(x); carv_out_cstr(\"\\n\"); }")
+	g.writeln("void carv_print_float(carv_float x) { carv_out_float(x); carv_out_cstr(\"\\n\"); }")
+	g.writeln("void carv_print_bool(carv_bool x) { carv_out_bool(x); carv_out_cstr(\"\\n\"); }")
+	g.writeln("void carv_print_string(carv_string x) { carv_out_str(x); carv_out_cstr(\"\\n\"); }")
+	g.writeln("")
+	g.writeln("void carv_print_int_array(carv_int_array arr) {")
+	g.writeln("    carv_out_cstr(\"[\");")
+	g.writeln("    for (carv_int i = 0; i < arr.len; i++) {")
+	g.writeln("        if (i > 0) carv_out_cstr(\", \");")
+	g.writeln("        carv_out_int(arr.data[i]);")
+	g.writeln("    }")
+	g.writeln("    carv_out_cstr(\"]\");")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("void carv_print_float_array(carv_float_array arr) {")
+	g.writeln("    carv_out_cstr(\"[\");")
+	g.writeln("    for (carv_int i = 0; i < arr.len; i++) {")
+	g.writeln("        if (i > 0) carv_out_cstr(\", \");")
+	g.writeln("        carv_out_float(arr.data[i]);")
+	g.writeln("    }")
+	g.writeln("    carv_out_cstr(\"]\");")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("void carv_print_string_array(carv_string_array arr) {")
+	g.writeln("    carv_out_cstr(\"[\");")
+	g.writeln("    for (carv_int i = 0; i < arr.len; i++) {")
+	g.writeln("        if (i > 0) carv_out_cstr(\", \");")
+	g.writeln("        carv_out_str(arr.data[i]);")
+	g.writeln("    }")
+	g.writeln("    carv_out_cstr(\"]\");")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("void carv_print_bool_array(carv_bool_array arr) {")
+	g.writeln("    carv_out_cstr(\"[\");")
+	g.writeln("    for (carv_int i = 0; i < arr.len; i++) {")
+	g.writeln("        if (i > 0) carv_out_cstr(\", \");")
+	g.writeln("        carv_out_bool(arr.data[i]);")
+	g.writeln("    }")
+	g.writeln("    carv_out_cstr(\"]\");")
+	g.writeln("}")
+	g.writeln("")
+}
+
+// emitArgsRuntime backs args(). Freestanding programs have no command line,
+// so there it always returns an empty array.
+func (g *CGenerator) emitArgsRuntime() {
+	if g.freestanding() {
+		g.writeln("static carv_string_array carv_args(void) {")
+		g.writeln("    return carv_new_string_array(0);")
+		g.writeln("}")
+		g.writeln("")
+		return
+	}
+	g.writeln("static carv_string_array carv_args(void) {")
+	g.writeln("    carv_int n = carv_argc > 1 ? carv_argc - 1 : 0;")
+	g.writeln("    carv_string_array arr = carv_new_string_array(n);")
+	g.writeln("    for (carv_int i = 0; i < n; i++) arr.data[i] = carv_string_lit(carv_argv[i + 1]);")
+	g.writeln("    return arr;")
+	g.writeln("}")
+	g.writeln("")
+}
+
+func (g *CGenerator) emitFSRuntime() {
+	g.writeln("carv_string carv_read_file(carv_string path) {")
+	g.writeln("    FILE* f = fopen(path.data, \"rb\");")
+	g.writeln("    if (!f) return (carv_string){NULL, 0, false};")
+	g.writeln("    fseek(f, 0, SEEK_END);")
+	g.writeln("    long len = ftell(f);")
+	g.writeln("    fseek(f, 0, SEEK_SET);")
+	g.writeln("    char* buf = (char*)carv_arena_alloc(len + 1);")
+	g.writeln("    size_t rd = fread(buf, 1, len, f);")
+	g.writeln("    buf[rd] = '\\0';")
+	g.writeln("    fclose(f);")
+	g.writeln("    return carv_string_own(buf, rd);")
+	g.writeln("}")
+	g.writeln("")
+
+	g.writeln("carv_bool carv_write_file(carv_string path, carv_string content) {")
+	g.writeln("    FILE* f = fopen(path.data, \"wb\");")
+	g.writeln("    if (!f) return false;")
+	g.writeln("    size_t written = fwrite(content.data, 1, content.len, f);")
+	g.writeln("    fclose(f);")
+	g.writeln("    return written == content.len;")
+	g.writeln("}")
+	g.writeln("")
+
+	g.writeln("carv_bool carv_file_exists(carv_string path) {")
+	g.writeln("    FILE* f = fopen(path.data, \"r\");")
+	g.writeln("    if (f) { fclose(f); return true; }")
+	g.writeln("    return false;")
+	g.writeln("}")
+	g.writeln("")
+
+	g.writeln("carv_bool carv_append_file(carv_string path, carv_string content) {")
+	g.writeln("    FILE* f = fopen(path.data, \"ab\");")
+	g.writeln("    if (!f) return false;")
+	g.writeln("    size_t written = fwrite(content.data, 1, content.len, f);")
+	g.writeln("    fclose(f);")
+	g.writeln("    return written == content.len;")
+	g.writeln("}")
+	g.writeln("")
+
+	g.writeln("carv_bool carv_delete_file(carv_string path) {")
+	g.writeln("    return remove(path.data) == 0;")
+	g.writeln("}")
+	g.writeln("")
+
+	g.writeln("carv_string_array carv_list_dir(carv_string path) {")
+	g.writeln("    carv_string_array arr = {NULL, 0, 0};")
+	g.writeln("    DIR* d = opendir(path.data);")
+	g.writeln("    if (!d) return arr;")
+	g.writeln("    carv_int cap = 16;")
+	g.writeln("    arr.data = (carv_string*)carv_arena_alloc(cap * sizeof(carv_string));")
+	g.writeln("    arr.len = 0;")
+	g.writeln("    arr.cap = cap;")
+	g.writeln("    struct dirent* entry;")
+	g.writeln("    while ((entry = readdir(d)) != NULL) {")
+	g.writeln("        if (strcmp(entry->d_name, \".\") == 0 || strcmp(entry->d_name, \"..\") == 0) continue;")
+	g.writeln("        if (arr.len >= arr.cap) {")
+	g.writeln("            carv_int new_cap = arr.cap * 2;")
+	g.writeln("            carv_string* new_data = (carv_string*)carv_arena_alloc(new_cap * sizeof(carv_string));")
+	g.writeln("            memcpy(new_data, arr.data, arr.len * sizeof(carv_string));")
+	g.writeln("            arr.data = new_data;")
+	g.writeln("            arr.cap = new_cap;")
+	g.writeln("        }")
+	g.writeln("        arr.data[arr.len++] = carv_strdup_str(entry->d_name);")
+	g.writeln("    }")
+	g.writeln("    closedir(d);")
+	g.writeln("    return arr;")
+	g.writeln("}")
+	g.writeln("")
+}
+
+func (g *CGenerator) emitTCPRuntime() {
+	g.writeln("carv_int carv_tcp_listen(carv_string host, carv_int port) {")
+	g.writeln("    int fd = socket(AF_INET, SOCK_STREAM, 0);")
+	g.writeln("    if (fd < 0) return -1;")
+	g.writeln("    int opt = 1;")
+	g.writeln("    setsockopt(fd, SOL_SOCKET, SO_REUSEADDR, &opt, sizeof(opt));")
+	g.writeln("    struct sockaddr_in addr;")
+	g.writeln("    memset(&addr, 0, sizeof(addr));")
+	g.writeln("    addr.sin_family = AF_INET;")
+	g.writeln("    addr.sin_port = htons((uint16_t)port);")
+	g.writeln("    if (!host.data || host.len == 0 || strcmp(host.data, \"0.0.0.0\") == 0) {")
+	g.writeln("        addr.sin_addr.s_addr = INADDR_ANY;")
+	g.writeln("    } else if (inet_pton(AF_INET, host.data, &addr.sin_addr) <= 0) {")
+	g.writeln("        close(fd);")
+	g.writeln("        return -1;")
+	g.writeln("    }")
+	g.writeln("    if (bind(fd, (struct sockaddr*)&addr, sizeof(addr)) < 0) {")
+	g.writeln("        close(fd);")
+	g.writeln("        return -1;")
+	g.writeln("    }")
+	g.writeln("    if (listen(fd, 16) < 0) {")
+	g.writeln("        close(fd);")
+	g.writeln("        return -1;")
+	g.writeln("    }")
+	g.writeln("    return fd;")
+	g.writeln("}")
+	g.writeln("")
+
+	g.writeln("carv_int carv_tcp_accept(carv_int listener_fd) {")
+	g.writeln("    int conn_fd = accept((int)listener_fd, NULL, NULL);")
+	g.writeln("    if (conn_fd < 0) return -1;")
+	g.writeln("    return conn_fd;")
+	g.writeln("}")
+	g.writeln("")
+
+	g.writeln("carv_string carv_tcp_read(carv_int conn_fd, carv_int max_bytes) {")
+	g.writeln("    if (max_bytes <= 0) return carv_strdup_str(\"\");")
+	g.writeln("    char* buf = (char*)carv_arena_alloc((size_t)max_bytes + 1);")
+	g.writeln("    ssize_t n = recv((int)conn_fd, buf, (size_t)max_bytes, 0);")
+	g.writeln("    if (n <= 0) {")
+	g.writeln("        buf[0] = '\\0';")
+	g.writeln("        return carv_string_own(buf, 0);")
+	g.writeln("    }")
+	g.writeln("    buf[n] = '\\0';")
+	g.writeln("    return carv_string_own(buf, (size_t)n);")
+	g.writeln("}")
+	g.writeln("")
+
+	g.writeln("carv_int carv_tcp_write(carv_int conn_fd, carv_string data) {")
+	g.writeln("    if (!data.data || data.len == 0) return 0;")
+	g.writeln("    ssize_t n = send((int)conn_fd, data.data, data.len, 0);")
+	g.writeln("    if (n < 0) return -1;")
+	g.writeln("    return (carv_int)n;")
+	g.writeln("}")
+	g.writeln("")
+
+	g.writeln("carv_bool carv_tcp_close(carv_int fd) {")
+	g.writeln("    return close((int)fd) == 0;")
+	g.writeln("}")
+	g.writeln("")
+}
+
+func (g *CGenerator) emitStringOpsRuntime() {
+	g.writeln("carv_string_array carv_split(carv_string str, carv_string sep) {")
+	g.writeln("    carv_string_array arr = {NULL, 0, 0};")
+	g.writeln("    if (!str.data || !sep.data) return arr;")
+	g.writeln("    size_t sep_len = sep.len;")
+	g.writeln("    if (sep_len == 0) {")
+	g.writeln("        arr = carv_new_string_array(1);")
+	g.writeln("        arr.data[0] = carv_string_clone(str);")
+	g.writeln("        return arr;")
+	g.writeln("    }")
+	g.writeln("    // Count occurrences")
+	g.writeln("    carv_int count = 1;")
+	g.writeln("    char* p = str.data;")
+	g.writeln("    while ((p = strstr(p, sep.data)) != NULL) { count++; p += sep_len; }")
+	g.writeln("    arr = carv_new_string_array(count);")
+	g.writeln("    // Split")
+	g.writeln("    char* start = str.data;")
+	g.writeln("    carv_int idx = 0;")
+	g.writeln("    while ((p = strstr(start, sep.data)) != NULL) {")
+	g.writeln("        size_t part_len = p - start;")
+	g.writeln("        char* part = (char*)carv_arena_alloc(part_len + 1);")
+	g.writeln("        memcpy(part, start, part_len);")
+	g.writeln("        part[part_len] = '\\0';")
+	g.writeln("        arr.data[idx] = carv_string_own(part, part_len);")
+	g.writeln("        idx++;")
+	g.writeln("        start = p + sep_len;")
+	g.writeln("    }")
+	g.writeln("    size_t tail_len = (size_t)(str.data + str.len - start);")
+	g.writeln("    char* tail = (char*)carv_arena_alloc(tail_len + 1);")
+	g.writeln("    memcpy(tail, start, tail_len);")
+	g.writeln("    tail[tail_len] = '\\0';")
+	g.writeln("    arr.data[idx] = carv_string_own(tail, tail_len);")
+	g.writeln("    return arr;")
+	g.writeln("}")
+	g.writeln("")
+
+	g.writeln("carv_string carv_join(carv_string_array arr, carv_string sep) {")
+	g.writeln("    if (arr.len == 0) return carv_strdup_str(\"\");")
+	g.writeln("    size_t sep_len = sep.data ? sep.len : 0;")
+	g.writeln("    size_t total_len = 0;")
+	g.writeln("    for (carv_int i = 0; i < arr.len; i++) {")
+	g.writeln("        if (arr.data[i].data) total_len += arr.data[i].len;")
+	g.writeln("    }")
+	g.writeln("    if (arr.len > 0) total_len += sep_len * (size_t)(arr.len - 1);")
+	g.writeln("    char* result = (char*)carv_arena_alloc(total_len + 1);")
+	g.writeln("    result[0] = '\\0';")
+	g.writeln("    for (carv_int i = 0; i < arr.len; i++) {")
+	g.writeln("        if (i > 0 && sep.data) strcat(result, sep.data);")
+	g.writeln("        if (arr.data[i].data) strcat(result, arr.data[i].data);")
+	g.writeln("    }")
+	g.writeln("    return carv_string_own(result, total_len);")
+	g.writeln("}")
+	g.writeln("")
+
+	g.writeln("carv_string carv_trim(carv_string str) {")
+	g.writeln("    if (!str.data) return carv_strdup_str(\"\");")
+	g.writeln("    char* start = str.data;")
+	g.writeln("    char* end = str.data + str.len;")
+	g.writeln("    while (start < end && (*start == ' ' || *start == '\\t' || *start == '\\n' || *start == '\\r')) start++;")
+	g.writeln("    if (start == end) return carv_strdup_str(\"\");")
+	g.writeln("    char* last = end - 1;")
+	g.writeln("    while (last > start && (*last == ' ' || *last == '\\t' || *last == '\\n' || *last == '\\r')) last--;")
+	g.writeln("    size_t len = (size_t)(last - start + 1);")
+	g.writeln("    char* result = (char*)carv_arena_alloc(len + 1);")
+	g.writeln("    memcpy(result, start, len);")
+	g.writeln("    result[len] = '\\0';")
+	g.writeln("    return carv_string_own(result, len);")
+	g.writeln("}")
+	g.writeln("")
+
+	g.writeln("carv_string carv_substr(carv_string str, carv_int start, carv_int end) {")
+	g.writeln("    if (!str.data) return carv_strdup_str(\"\");")
+	g.writeln("    size_t str_len = str.len;")
+	g.writeln("    if (start < 0) start = 0;")
+	g.writeln("    if (end < 0) end = (carv_int)str_len;")
+	g.writeln("    if ((size_t)start >= str_len) return carv_strdup_str(\"\");")
+	g.writeln("    if ((size_t)end > str_len) end = (carv_int)str_len;")
+	g.writeln("    if (end <= start) return carv_strdup_str(\"\");")
+	g.writeln("    size_t len = (size_t)(end - start);")
+	g.writeln("    char* result = (char*)carv_arena_alloc(len + 1);")
+	g.writeln("    memcpy(result, str.data + start, len);")
+	g.writeln("    result[len] = '\\0';")
+	g.writeln("    return carv_string_own(result, len);")
+	g.writeln("}")
+	g.writeln("")
+
+	g.writeln("carv_string carv_int_to_string(carv_int val) {")
+	g.writeln("    char* buf = (char*)carv_arena_alloc(CARV_FMT_BUF);")
+	g.writeln("    return carv_string_own(buf, carv_fmt_int(buf, val));")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("carv_string carv_float_to_string(carv_float val) {")
+	g.writeln("    char* buf = (char*)carv_arena_alloc(CARV_FMT_BUF);")
+	g.writeln("    return carv_string_own(buf, carv_fmt_float(buf, val));")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("carv_string carv_bool_to_string(carv_bool val) {")
+	g.writeln("    return carv_strdup_str(val ? \"true\" : \"false\");")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("carv_string carv_concat(carv_string a, carv_string b) {")
+	g.writeln("    size_t total = a.len + b.len;")
+	g.writeln("    char* result = (char*)carv_arena_alloc(total + 1);")
+	g.writeln("    memcpy(result, a.data, a.len);")
+	g.writeln("    memcpy(result + a.len, b.data, b.len + 1);")
+	g.writeln("    return carv_string_own(result, total);")
+	g.writeln("}")
+	g.writeln("")
+}
+
+// emitGPIORuntime, like the other HAL emitters, declares functions the vendor
+// HAL provides at link time on ARM and stubs them on the host for testing.
+func (g *CGenerator) emitGPIORuntime() {
+	g.writeln("#ifdef CARV_TARGET_ARM")
+	g.writeln("// ARM implementations provided by vendor HAL at link time")
+	g.writeln("extern void carv_pin_mode(carv_int pin, carv_int mode);")
+	g.writeln("extern void carv_digital_write(carv_int pin, carv_bool value);")
+	g.writeln("extern carv_bool carv_digital_read(carv_int pin);")
+	g.writeln("extern carv_int carv_analog_read(carv_int pin);")
+	g.writeln("extern void carv_analog_write(carv_int pin, carv_int value);")
+	g.writeln("#else")
+	g.writeln("// Host stubs for testing")
+	g.writeln("static void carv_pin_mode(carv_int pin, carv_int mode) { (void)pin; (void)mode; }")
+	g.writeln("static void carv_digital_write(carv_int pin, carv_bool value) { (void)pin; (void)value; }")
+	g.writeln("static carv_bool carv_digital_read(carv_int pin) { (void)pin; return false; }")
+	g.writeln("static carv_int carv_analog_read(carv_int pin) { (void)pin; return 0; }")
+	g.writeln("static void carv_analog_write(carv_int pin, carv_int value) { (void)pin; (void)value; }")
+	g.writeln("#endif")
+	g.writeln("")
+}
+
+func (g *CGenerator) emitUARTRuntime() {
+	g.writeln("#ifdef CARV_TARGET_ARM")
+	g.writeln("extern carv_int carv_uart_init(carv_int port, carv_int baud);")
+	g.writeln("extern carv_int carv_uart_write(carv_int handle, carv_string data);")
+	g.writeln("extern carv_string carv_uart_read(carv_int handle, carv_int max_bytes);")
+	g.writeln("extern carv_int carv_uart_available(carv_int handle);")
+	g.writeln("#else")
+	g.writeln("static carv_int carv_uart_init(carv_int port, carv_int baud) { (void)port; (void)baud; return 0; }")
+	g.writeln("static carv_int carv_uart_write(carv_int handle, carv_string data) { (void)handle; (void)data; return 0; }")
+	g.writeln("static carv_string carv_uart_read(carv_int handle, carv_int max_bytes) { (void)handle; (void)max_bytes; return carv_string_lit(\"\"); }")
+	g.writeln("static carv_int carv_uart_available(carv_int handle) { (void)handle; return 0; }")
+	g.writeln("#endif")
+	g.writeln("")
+}
+
+func (g *CGenerator) emitSPIRuntime() {
+	g.writeln("#ifdef CARV_TARGET_ARM")
+	g.writeln("extern carv_int carv_spi_init(carv_int bus, carv_int speed);")
+	g.writeln("extern carv_string carv_spi_transfer(carv_int handle, carv_string data);")
+	g.writeln("extern carv_int carv_spi_write(carv_int handle, carv_string data);")
+	g.writeln("extern carv_string carv_spi_read(carv_int handle, carv_int len);")
+	g.writeln("#else")
+	g.writeln("static carv_int carv_spi_init(carv_int bus, carv_int speed) { (void)bus; (void)speed; return 0; }")
+	g.writeln("static carv_string carv_spi_transfer(carv_int handle, carv_string data) { (void)handle; (void)data; return carv_string_lit(\"\"); }")
+	g.writeln("static carv_int carv_spi_write(carv_int handle, carv_string data) { (void)handle; (void)data; return 0; }")
+	g.writeln("static carv_string carv_spi_read(carv_int handle, carv_int len) { (void)handle; (void)len; return carv_string_lit(\"\"); }")
+	g.writeln("#endif")
+	g.writeln("")
+}
+
+func (g *CGenerator) emitI2CRuntime() {
+	g.writeln("#ifdef CARV_TARGET_ARM")
+	g.writeln("extern carv_int carv_i2c_init(carv_int bus, carv_int addr);")
+	g.writeln("extern carv_int carv_i2c_write(carv_int handle, carv_string data);")
+	g.writeln("extern carv_string carv_i2c_read(carv_int handle, carv_int len);")
+	g.writeln("#else")
+	g.writeln("static carv_int carv_i2c_init(carv_int bus, carv_int addr) { (void)bus; (void)addr; return 0; }")
+	g.writeln("static carv_int carv_i2c_write(carv_int handle, carv_string data) { (void)handle; (void)data; return 0; }")
+	g.writeln("static carv_string carv_i2c_read(carv_int handle, carv_int len) { (void)handle; (void)len; return carv_string_lit(\"\"); }")
+	g.writeln("#endif")
+	g.writeln("")
+}
+
+func (g *CGenerator) emitTimerRuntime() {
+	g.writeln("#ifdef CARV_TARGET_ARM")
+	g.writeln("extern carv_int carv_timer_init(carv_int id, carv_int prescaler);")
+	g.writeln("extern void carv_timer_start(carv_int handle);")
+	g.writeln("extern void carv_timer_stop(carv_int handle);")
+	g.writeln("extern carv_int carv_timer_get_count(carv_int handle);")
+	g.writeln("extern void carv_delay_ms(carv_int ms);")
+	g.writeln("extern void carv_delay_us(carv_int us);")
+	g.writeln("#else")
+	g.writeln("static carv_int carv_timer_init(carv_int id, carv_int prescaler) { (void)id; (void)prescaler; return 0; }")
+	g.writeln("static void carv_timer_start(carv_int handle) { (void)handle; }")
+	g.writeln("static void carv_timer_stop(carv_int handle) { (void)handle; }")
+	g.writeln("static carv_int carv_timer_get_count(carv_int handle) { (void)handle; return 0; }")
+	g.writeln("static void carv_delay_ms(carv_int ms) { (void)ms; }")
+	g.writeln("static void carv_delay_us(carv_int us) { (void)us; }")
+	g.writeln("#endif")
+	g.writeln("")
+}
+
+func (g *CGenerator) emitResultRuntime() {
+	g.writeln("typedef enum { CARV_TYPE_INT, CARV_TYPE_FLOAT, CARV_TYPE_BOOL, CARV_TYPE_STRING } carv_type_tag;")
+	g.writeln("typedef struct { carv_bool is_ok; carv_type_tag ok_tag; carv_type_tag err_tag; union { carv_int ok_int; carv_float ok_float; carv_bool ok_bool; carv_string ok_str; void* ok_ptr; } ok; union { carv_string err_str; carv_int err_code; } err; } carv_result;")
+	g.writeln("")
+	g.writeln("static carv_result carv_ok_int(carv_int val) { carv_result r; memset(&r, 0, sizeof(r)); r.is_ok = true; r.ok_tag = CARV_TYPE_INT; r.ok.ok_int = val; return r; }")
+	g.writeln("static carv_result carv_ok_float(carv_float val) { carv_result r; memset(&r, 0, sizeof(r)); r.is_ok = true; r.ok_tag = CARV_TYPE_FLOAT; r.ok.ok_float = val; return r; }")
+	g.writeln("static carv_result carv_ok_bool(carv_bool val) { carv_result r; memset(&r, 0, sizeof(r)); r.is_ok = true; r.ok_tag = CARV_TYPE_BOOL; r.ok.ok_bool = val; return r; }")
+	g.writeln("static carv_result carv_ok_str(carv_string val) { carv_result r; memset(&r, 0, sizeof(r)); r.is_ok = true; r.ok_tag = CARV_TYPE_STRING; r.ok.ok_str = val; return r; }")
+	g.writeln("static carv_result carv_err_str(carv_string val) { carv_result r; memset(&r, 0, sizeof(r)); r.is_ok = false; r.err_tag = CARV_TYPE_STRING; r.err.err_str = val; return r; }")
+	g.writeln("static carv_result carv_err_code(carv_int val) { carv_result r; memset(&r, 0, sizeof(r)); r.is_ok = false; r.err_tag = CARV_TYPE_INT; r.err.err_code = val; return r; }")
+	g.writeln("")
+}
+
+// emitMapRuntime writes an open-addressing hash map with string keys.
+func (g *CGenerator) emitMapRuntime() {
+	g.writeln("// --- Map runtime ---")
+	g.writeln("typedef enum { CARV_MAP_VAL_INT, CARV_MAP_VAL_FLOAT, CARV_MAP_VAL_BOOL, CARV_MAP_VAL_STRING } carv_map_val_tag;")
+	g.writeln("typedef struct { carv_string key; carv_map_val_tag tag; union { carv_int i; carv_float f; carv_bool b; carv_string s; } val; bool occupied; } carv_map_entry;")
+	g.writeln("typedef struct { carv_map_entry* entries; carv_int cap; carv_int len; } carv_map;")
+	g.writeln("")
+	g.writeln("static uint64_t carv_map_hash(carv_string key) {")
+	g.writeln("    uint64_t h = 14695981039346656037ULL;")
+	g.writeln("    for (size_t i = 0; i < key.len; i++) {")
+	g.writeln("        h ^= (uint64_t)(unsigned char)key.data[i];")
+	g.writeln("        h *= 1099511628211ULL;")
+	g.writeln("    }")
+	g.writeln("    return h;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static carv_map carv_map_new(carv_int cap) {")
+	g.writeln("    carv_map m;")
+	g.writeln("    m.cap = cap < 8 ? 8 : cap;")
+	g.writeln("    m.len = 0;")
+	g.writeln("    m.entries = (carv_map_entry*)carv_arena_alloc(m.cap * sizeof(carv_map_entry));")
+	g.writeln("    memset(m.entries, 0, m.cap * sizeof(carv_map_entry));")
+	g.writeln("    return m;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static carv_map_entry* carv_map_find(carv_map* m, carv_string key) {")
+	g.writeln("    uint64_t h = carv_map_hash(key);")
+	g.writeln("    for (carv_int i = 0; i < m->cap; i++) {")
+	g.writeln("        carv_int idx = (carv_int)((h + (uint64_t)i) % (uint64_t)m->cap);")
+	g.writeln("        carv_map_entry* e = &m->entries[idx];")
+	g.writeln("        if (!e->occupied) return e;")
+	g.writeln("        if (e->key.len == key.len && memcmp(e->key.data, key.data, key.len) == 0) return e;")
+	g.writeln("    }")
+	g.writeln("    return NULL;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_map_grow(carv_map* m) {")
+	g.writeln("    carv_int old_cap = m->cap;")
+	g.writeln("    carv_map_entry* old = m->entries;")
+	g.writeln("    m->cap = old_cap * 2;")
+	g.writeln("    m->entries = (carv_map_entry*)carv_arena_alloc(m->cap * sizeof(carv_map_entry));")
+	g.writeln("    memset(m->entries, 0, m->cap * sizeof(carv_map_entry));")
+	g.writeln("    m->len = 0;")
+	g.writeln("    for (carv_int i = 0; i < old_cap; i++) {")
+	g.writeln("        if (old[i].occupied) {")
+	g.writeln("            carv_map_entry* e = carv_map_find(m, old[i].key);")
+	g.writeln("            *e = old[i];")
+	g.writeln("            m->len++;")
+	g.writeln("        }")
+	g.writeln("    }")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("// The entry for key, added with a copy of the key if it is new, and with")
+	g.writeln("// the string it held dropped if not")
+	g.writeln("static carv_map_entry* carv_map_slot(carv_map* m, carv_string key) {")
+	g.writeln("    if (m->len * 2 >= m->cap) carv_map_grow(m);")
+	g.writeln("    carv_map_entry* e = carv_map_find(m, key);")
+	g.writeln("    if (!e->occupied) {")
+	g.writeln("        m->len++;")
+	g.writeln("        e->occupied = true;")
+	g.writeln("        e->key = key.owned ? carv_string_clone(key) : key;")
+	g.writeln("    } else if (e->tag == CARV_MAP_VAL_STRING) {")
+	g.writeln("        carv_string_drop(&e->val.s);")
+	g.writeln("    }")
+	g.writeln("    return e;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_map_set_int(carv_map* m, carv_string key, carv_int val) {")
+	g.writeln("    carv_map_entry* e = carv_map_slot(m, key);")
+	g.writeln("    e->tag = CARV_MAP_VAL_INT; e->val.i = val;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_map_set_float(carv_map* m, carv_string key, carv_float val) {")
+	g.writeln("    carv_map_entry* e = carv_map_slot(m, key);")
+	g.writeln("    e->tag = CARV_MAP_VAL_FLOAT; e->val.f = val;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_map_set_bool(carv_map* m, carv_string key, carv_bool val) {")
+	g.writeln("    carv_map_entry* e = carv_map_slot(m, key);")
+	g.writeln("    e->tag = CARV_MAP_VAL_BOOL; e->val.b = val;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_map_set_str(carv_map* m, carv_string key, carv_string val) {")
+	g.writeln("    carv_map_entry* e = carv_map_slot(m, key);")
+	g.writeln("    e->tag = CARV_MAP_VAL_STRING; e->val.s = val;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static carv_int carv_map_get_int(carv_map* m, carv_string key) {")
+	g.writeln("    carv_map_entry* e = carv_map_find(m, key);")
+	g.writeln("    if (e && e->occupied) return e->val.i;")
+	g.writeln("    return 0;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static carv_float carv_map_get_float(carv_map* m, carv_string key) {")
+	g.writeln("    carv_map_entry* e = carv_map_find(m, key);")
+	g.writeln("    if (e && e->occupied) return e->val.f;")
+	g.writeln("    return 0.0;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static carv_bool carv_map_get_bool(carv_map* m, carv_string key) {")
+	g.writeln("    carv_map_entry* e = carv_map_find(m, key);")
+	g.writeln("    if (e && e->occupied) return e->val.b;")
+	g.writeln("    return false;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static carv_string carv_map_get_str(carv_map* m, carv_string key) {")
+	g.writeln("    carv_map_entry* e = carv_map_find(m, key);")
+	g.writeln("    if (e && e->occupied) return e->val.s;")
+	g.writeln("    return (carv_string){NULL, 0, false};")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_map_drop(carv_map* m) {")
+	g.writeln("    for (carv_int i = m->cap - 1; i >= 0; i--) {")
+	g.writeln("        carv_map_entry* e = &m->entries[i];")
+	g.writeln("        if (!e->occupied) continue;")
+	g.writeln("        if (e->tag == CARV_MAP_VAL_STRING) carv_string_drop(&e->val.s);")
+	g.writeln("        carv_string_drop(&e->key);")
+	g.writeln("    }")
+	g.writeln("    carv_arena_release(m->entries, (size_t)m->cap * sizeof(carv_map_entry));")
+	g.writeln("    m->entries = NULL;")
+	g.writeln("    m->cap = 0;")
+	g.writeln("    m->len = 0;")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_print_map(carv_map m) {")
+	g.writeln("    carv_out_cstr(\"{\");")
+	g.writeln("    int first = 1;")
+	g.writeln("    for (carv_int i = 0; i < m.cap; i++) {")
+	g.writeln("        if (!m.entries[i].occupied) continue;")
+	g.writeln("        if (!first) carv_out_cstr(\", \");")
+	g.writeln("        first = 0;")
+	g.writeln("        carv_out_cstr(\"\\\"\");")
+	g.writeln("        carv_out_str(m.entries[i].key);")
+	g.writeln("        carv_out_cstr(\"\\\": \");")
+	g.writeln("        switch (m.entries[i].tag) {")
+	g.writeln("        case CARV_MAP_VAL_INT: carv_out_int(m.entries[i].val.i); break;")
+	g.writeln("        case CARV_MAP_VAL_FLOAT: carv_out_float(m.entries[i].val.f); break;")
+	g.writeln("        case CARV_MAP_VAL_BOOL: carv_out_bool(m.entries[i].val.b); break;")
+	g.writeln("        case CARV_MAP_VAL_STRING: carv_out_cstr(\"\\\"\"); carv_out_str(m.entries[i].val.s); carv_out_cstr(\"\\\"\"); break;")
+	g.writeln("        }")
+	g.writeln("    }")
+	g.writeln("    carv_out_cstr(\"}\");")
+	g.writeln("}")
+	g.writeln("")
+}
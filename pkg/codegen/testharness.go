@@ -0,0 +1,235 @@
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/dev-dami/carv/pkg/ast"
+)
+
+// SetTestMode makes Generate emit a test harness instead of the program's
+// main: every test function runs in turn, with the arena reset between tests.
+// Outside test mode, test functions are left out of the output entirely.
+func (g *CGenerator) SetTestMode(on bool) {
+	g.testMode = on
+}
+
+// SetSourceFile names the file being compiled, for assertion locations.
+func (g *CGenerator) SetSourceFile(name string) {
+	g.sourceFile = name
+}
+
+// selectTests drops test functions from program unless generating tests.
+func (g *CGenerator) selectTests(program *ast.Program) *ast.Program {
+	if g.testMode {
+		return program
+	}
+	kept := make([]ast.Statement, 0, len(program.Statements))
+	for _, stmt := range program.Statements {
+		if fn, ok := stmt.(*ast.FunctionStatement); ok && fn.Test {
+			continue
+		}
+		kept = append(kept, stmt)
+	}
+	if len(kept) == len(program.Statements) {
+		return program
+	}
+	filtered := *program
+	filtered.Statements = kept
+	return &filtered
+}
+
+// TestNames returns the test functions of program in source order.
+func TestNames(program *ast.Program) []string {
+	var names []string
+	for _, stmt := range program.Statements {
+		if fn, ok := stmt.(*ast.FunctionStatement); ok && fn.Test {
+			names = append(names, fn.Name.Value)
+		}
+	}
+	return names
+}
+
+func (g *CGenerator) location(node ast.Node) string {
+	line, col := node.Pos()
+	if g.sourceFile == "" {
+		return fmt.Sprintf("%d:%d", line, col)
+	}
+	return fmt.Sprintf("%s:%d:%d", g.sourceFile, line, col)
+}
+
+func (g *CGenerator) emitAssertRuntime() {
+	if g.freestanding() {
+		g.emitFreestandingAssertRuntime()
+		return
+	}
+	g.writeln("// Assertions. Under the test harness a failure abandons the current test;")
+	g.writeln("// otherwise it reports and ends the program.")
+	g.writeln("static jmp_buf* carv_test_jmp = NULL;")
+	g.writeln("static char carv_test_msg[512];")
+	g.writeln("")
+	g.writeln("static void carv_assert_fail(const char* loc, const char* fmt, ...) {")
+	g.writeln("    va_list ap;")
+	g.writeln("    int n = snprintf(carv_test_msg, sizeof(carv_test_msg), \"%s: \", loc);")
+	g.writeln("    va_start(ap, fmt);")
+	g.writeln("    vsnprintf(carv_test_msg + n, sizeof(carv_test_msg) - n, fmt, ap);")
+	g.writeln("    va_end(ap);")
+	g.writeln("    if (carv_test_jmp) longjmp(*carv_test_jmp, 1);")
+	g.writeln("    fprintf(stderr, \"%s\\n\", carv_test_msg);")
+	g.writeln("    exit(1);")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_assert(carv_bool cond, const char* loc, const char* text) {")
+	g.writeln("    if (!cond) carv_assert_fail(loc, \"assertion failed: %s\", text);")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_assert_msg(carv_bool cond, const char* loc, carv_string msg) {")
+	g.writeln("    if (!cond) carv_assert_fail(loc, \"assertion failed: %.*s\", (int)msg.len, msg.data);")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_assert_eq_int(carv_int left, carv_int right, const char* loc, const char* text) {")
+	g.writeln("    if (left != right) carv_assert_fail(loc, \"%s: left = \" CARV_INT_FMT \", right = \" CARV_INT_FMT, text, left, right);")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_assert_eq_float(carv_float left, carv_float right, const char* loc, const char* text) {")
+	g.writeln("    if (left != right) carv_assert_fail(loc, \"%s: left = %g, right = %g\", text, left, right);")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_assert_eq_bool(carv_bool left, carv_bool right, const char* loc, const char* text) {")
+	g.writeln("    if (left != right) carv_assert_fail(loc, \"%s: left = %s, right = %s\", text, left ? \"true\" : \"false\", right ? \"true\" : \"false\");")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_assert_eq_str(carv_string left, carv_string right, const char* loc, const char* text) {")
+	g.writeln("    if (left.len != right.len || (left.len > 0 && memcmp(left.data, right.data, left.len) != 0)) {")
+	g.writeln("        carv_assert_fail(loc, \"%s: left = \\\"%.*s\\\", right = \\\"%.*s\\\"\", text, (int)left.len, left.data, (int)right.len, right.data);")
+	g.writeln("    }")
+	g.writeln("}")
+	g.writeln("")
+}
+
+// emitFreestandingAssertRuntime reports failures through the output sink
+// and then calls carv_halt, since there is no process to exit.
+func (g *CGenerator) emitFreestandingAssertRuntime() {
+	g.writeln("static void carv_assert_fail(const char* loc, const char* text) {")
+	g.writeln("    carv_out_cstr(loc);")
+	g.writeln("    carv_out_cstr(\": assertion failed: \");")
+	g.writeln("    carv_out_cstr(text);")
+	g.writeln("    carv_out_cstr(\"\\n\");")
+	g.writeln("    carv_halt();")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_assert(carv_bool cond, const char* loc, const char* text) {")
+	g.writeln("    if (!cond) carv_assert_fail(loc, text);")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("static void carv_assert_msg(carv_bool cond, const char* loc, carv_string msg) {")
+	g.writeln("    if (cond) return;")
+	g.writeln("    carv_out_cstr(loc);")
+	g.writeln("    carv_out_cstr(\": assertion failed: \");")
+	g.writeln("    carv_out_str(msg);")
+	g.writeln("    carv_out_cstr(\"\\n\");")
+	g.writeln("    carv_halt();")
+	g.writeln("}")
+	g.writeln("")
+	for _, kind := range []struct{ name, ctype, out string }{
+		{"int", "carv_int", "carv_out_int"},
+		{"float", "carv_float", "carv_out_float"},
+		{"bool", "carv_bool", "carv_out_bool"},
+		{"str", "carv_string", "carv_out_str"},
+	} {
+		cond := "left != right"
+		if kind.name == "str" {
+			cond = "left.len != right.len || (left.len > 0 && memcmp(left.data, right.data, left.len) != 0)"
+		}
+		g.writeln(fmt.Sprintf("static void carv_assert_eq_%s(%s left, %s right, const char* loc, const char* text) {", kind.name, kind.ctype, kind.ctype))
+		g.writeln(fmt.Sprintf("    if (!(%s)) return;", cond))
+		g.writeln("    carv_out_cstr(loc);")
+		g.writeln("    carv_out_cstr(\": \");")
+		g.writeln("    carv_out_cstr(text);")
+		g.writeln("    carv_out_cstr(\": left = \");")
+		g.writeln(fmt.Sprintf("    %s(left);", kind.out))
+		g.writeln("    carv_out_cstr(\", right = \");")
+		g.writeln(fmt.Sprintf("    %s(right);", kind.out))
+		g.writeln("    carv_out_cstr(\"\\n\");")
+		g.writeln("    carv_halt();")
+		g.writeln("}")
+		g.writeln("")
+	}
+}
+
+// generateAssertCall lowers assert and assert_eq. Failures report the call's
+// location and source text; assert_eq also prints both operands.
+func (g *CGenerator) generateAssertCall(fn string, e *ast.CallExpression) string {
+	g.use("assert")
+	loc := fmt.Sprintf("\"%s\"", g.escapeString(g.location(e.Function)))
+	text := e.TokenLiteral()
+	if g.program != nil && g.program.Text(e) != "" {
+		text = g.program.Text(e)
+	}
+	text = fmt.Sprintf("\"%s\"", g.escapeString(text))
+
+	if fn == "assert" {
+		cond := g.generateExpression(e.Arguments[0])
+		if len(e.Arguments) > 1 {
+			msg := g.generateExpression(e.Arguments[1])
+			return fmt.Sprintf("carv_assert_msg(%s, %s, %s)", cond, loc, msg)
+		}
+		return fmt.Sprintf("carv_assert(%s, %s, %s)", cond, loc, text)
+	}
+
+	left := g.generateExpression(e.Arguments[0])
+	right := g.generateExpression(e.Arguments[1])
+	switch ctype := g.resolveType(e.Arguments[0]); ctype {
+	case "carv_string":
+		return fmt.Sprintf("carv_assert_eq_str(%s, %s, %s, %s)", left, right, loc, text)
+	case "carv_float", "float", "double":
+		return fmt.Sprintf("carv_assert_eq_float(%s, %s, %s, %s)", left, right, loc, text)
+	case "carv_bool":
+		return fmt.Sprintf("carv_assert_eq_bool(%s, %s, %s, %s)", left, right, loc, text)
+	case "carv_int", "uint8_t", "uint16_t", "uint32_t", "uint64_t",
+		"int8_t", "int16_t", "int32_t", "int64_t", "size_t", "ptrdiff_t":
+		return fmt.Sprintf("carv_assert_eq_int((carv_int)(%s), (carv_int)(%s), %s, %s)", left, right, loc, text)
+	default:
+		return fmt.Sprintf("carv_assert((%s) == (%s), %s, %s)", left, right, loc, text)
+	}
+}
+
+// generateTestMain emits a main that runs each test function under setjmp,
+// so a failed assertion ends only that test. An optional argv[1] selects
+// tests whose name contains it. The exit status is non-zero if any failed.
+func (g *CGenerator) generateTestMain(program *ast.Program) {
+	g.writeln("")
+	g.writeln("static void carv_run_test(const char* name, const char* loc, void (*fn)(void), const char* filter, int* passed, int* failed) {")
+	g.writeln("    jmp_buf env;")
+	g.writeln("    if (filter && !strstr(name, filter)) return;")
+	g.writeln("    printf(\"test %s (%s) ... \", name, loc);")
+	g.writeln("    fflush(stdout);")
+	g.writeln("    carv_test_jmp = &env;")
+	g.writeln("    if (setjmp(env) == 0) {")
+	g.writeln("        fn();")
+	g.writeln("        printf(\"ok\\n\");")
+	g.writeln("        (*passed)++;")
+	g.writeln("    } else {")
+	g.writeln("        printf(\"FAILED\\n    %s\\n\", carv_test_msg);")
+	g.writeln("        (*failed)++;")
+	g.writeln("    }")
+	g.writeln("    carv_test_jmp = NULL;")
+	g.writeln("    carv_arena_free_all();")
+	g.writeln("}")
+	g.writeln("")
+	g.writeln("int main(int argc, char** argv) {")
+	g.indent++
+	g.writeln("const char* filter = argc > 1 ? argv[1] : NULL;")
+	g.writeln("int passed = 0, failed = 0;")
+	for _, stmt := range program.Statements {
+		fn, ok := stmt.(*ast.FunctionStatement)
+		if !ok || !fn.Test {
+			continue
+		}
+		g.writeln(fmt.Sprintf("carv_run_test(\"%s\", \"%s\", %s, filter, &passed, &failed);",
+			fn.Name.Value, g.escapeString(g.location(fn.Name)), g.safeName(fn.Name.Value)))
+	}
+	g.writeln("printf(\"\\n%d passed, %d failed\\n\", passed, failed);")
+	g.writeln("return failed > 0 ? 1 : 0;")
+	g.indent--
+	g.writeln("}")
+}
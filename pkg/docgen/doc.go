@@ -0,0 +1,12 @@
+// Package docgen renders API documentation for Carv modules.
+//
+// Design decisions:
+//   - Only pub declarations are documented, mirroring what a module exports.
+//   - Doc text comes from the /// comments the parser attaches to declarations.
+//   - Signatures are rebuilt from type expressions so named types can link to
+//     their own documentation, across modules.
+//
+// Usage pattern:
+// Call Extract for each parsed module, then Generate with the desired Format to
+// get one page per module plus an index page.
+package docgen
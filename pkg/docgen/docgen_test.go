@@ -0,0 +1,174 @@
+package docgen
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dev-dami/carv/pkg/lexer"
+	"github.com/dev-dami/carv/pkg/parser"
+)
+
+func extract(t *testing.T, name, src string) *Module {
+	t.Helper()
+	p := parser.New(lexer.New(src))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		t.Fatalf("parse errors: %v", errs)
+	}
+	return Extract(name, program)
+}
+
+const shapesSrc = `/// Something with an area.
+pub interface Shape {
+    /// Area in square units.
+    fn area(&self) -> int;
+}
+
+/// A rectangle anchored at the origin.
+pub class Rect {
+    /// Width in pixels.
+    pub w: int
+    h: int
+    pub fn scale(&mut self, by: int) -> Rect {
+        return new Rect;
+    }
+}
+
+impl Shape for Rect {
+    fn area(&self) -> int { return 0; }
+}
+
+fn helper() {}
+
+pub const MAX: int = 64;
+`
+
+func TestExtractPublicOnly(t *testing.T) {
+	mod := extract(t, "shapes", shapesSrc)
+
+	var names []string
+	for _, item := range mod.Items {
+		names = append(names, string(item.Kind)+" "+item.Name)
+	}
+	got := strings.Join(names, ", ")
+	if want := "interface Shape, class Rect, const MAX"; got != want {
+		t.Fatalf("items = %q, want %q", got, want)
+	}
+
+	rect := mod.Items[1]
+	if rect.Doc != "A rectangle anchored at the origin." {
+		t.Errorf("class doc = %q", rect.Doc)
+	}
+	// h is not pub, so it is not documented.
+	if len(rect.Members) != 2 || rect.Members[0].Doc != "Width in pixels." || rect.Members[1].Name != "scale" {
+		t.Errorf("unexpected members: %+v", rect.Members)
+	}
+	if len(rect.Implements) != 1 || rect.Implements[0] != "Shape" {
+		t.Errorf("implements = %v, want [Shape]", rect.Implements)
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	src := `pub class Buf {}
+pub unsafe fn poke(addr: &mut volatile<u32>, bufs: [4]Buf) -> &Buf {
+    return &bufs[0];
+}
+`
+	mod := extract(t, "io", src)
+	link := func(name string) string {
+		if name == "Buf" {
+			return "io.md#Buf"
+		}
+		return ""
+	}
+	got := mod.signature(mod.Items[1], link)
+	want := `pub unsafe fn poke(addr: &amp;mut volatile&lt;u32&gt;, bufs: [4]<a href="io.md#Buf">Buf</a>) -&gt; ` +
+		`&amp;<a href="io.md#Buf">Buf</a>`
+	if got != want {
+		t.Errorf("signature:\n got %s\nwant %s", got, want)
+	}
+
+	method := mod.signature(extract(t, "shapes", shapesSrc).Items[1].Members[1], link)
+	if !strings.HasPrefix(method, "pub fn scale(&amp;mut self, by: int)") {
+		t.Errorf("method signature = %s", method)
+	}
+}
+
+func TestGenerateCrossLinks(t *testing.T) {
+	shapes := extract(t, "geo/shapes", shapesSrc)
+	canvas := extract(t, "canvas", `/// Draws a [Rect] on screen.
+pub fn draw(r: &Rect) {}
+`)
+
+	pages := Generate([]*Module{shapes, canvas}, Markdown)
+	byPath := make(map[string]string)
+	for _, page := range pages {
+		byPath[page.Path] = page.Content
+	}
+
+	index, ok := byPath["index.md"]
+	if !ok || !strings.Contains(index, "[geo/shapes](geo.shapes.md)") {
+		t.Fatalf("index missing module link:\n%s", index)
+	}
+	md := byPath["canvas.md"]
+	if !strings.Contains(md, `<a href="geo.shapes.md#Rect">Rect</a>`) {
+		t.Errorf("signature does not link Rect:\n%s", md)
+	}
+	if !strings.Contains(md, "Draws a [Rect](geo.shapes.md#Rect) on screen.") {
+		t.Errorf("doc text does not link Rect:\n%s", md)
+	}
+	if !strings.Contains(byPath["geo.shapes.md"], "Implements: [Shape](geo.shapes.md#Shape)") {
+		t.Errorf("class page does not link its interface:\n%s", byPath["geo.shapes.md"])
+	}
+
+	htmlPages := Generate([]*Module{shapes, canvas}, HTML)
+	for _, page := range htmlPages {
+		if page.Path == "canvas.html" && !strings.Contains(page.Content, `<p>Draws a <a href="geo.shapes.html#Rect">Rect</a> on screen.</p>`) {
+			t.Errorf("html doc text not linked:\n%s", page.Content)
+		}
+	}
+}
+
+func TestGenerateLinksSameNamedTypesPerModule(t *testing.T) {
+	a := extract(t, "a", "pub class Pin {}\n")
+	b := extract(t, "b", "pub class Pin {}\n/// Wraps a [Pin].\npub fn wrap(p: &Pin) {}\n")
+	c := extract(t, "c", "/// Takes a [Pin].\npub fn take(p: &Pin) {}\n")
+	c.Imports = []string{"b"}
+	d := extract(t, "d", "/// Takes a [Pin].\npub fn take(p: &Pin) {}\n")
+
+	byPath := make(map[string]string)
+	for _, page := range Generate([]*Module{a, b, c, d}, Markdown) {
+		byPath[page.Path] = page.Content
+	}
+	if !strings.Contains(byPath["b.md"], "Wraps a [Pin](b.md#Pin).") {
+		t.Errorf("b does not link its own Pin:\n%s", byPath["b.md"])
+	}
+	if !strings.Contains(byPath["c.md"], "Takes a [Pin](b.md#Pin).") {
+		t.Errorf("c does not link the Pin of the module it requires:\n%s", byPath["c.md"])
+	}
+	// Two modules define Pin and d requires neither, so it is not linked.
+	if strings.Contains(byPath["d.md"], "#Pin") {
+		t.Errorf("d links an ambiguous Pin:\n%s", byPath["d.md"])
+	}
+}
+
+func TestGenerateKeepsIndexPage(t *testing.T) {
+	index := extract(t, "index", "pub class Board {}\n")
+	under := extract(t, "index_", "pub fn reset() {}\n")
+
+	byPath := make(map[string]string)
+	for _, page := range Generate([]*Module{index, under}, Markdown) {
+		byPath[page.Path] = page.Content
+	}
+	if !strings.Contains(byPath["index.md"], "# Modules") ||
+		!strings.Contains(byPath["index.md"], "[index](index_.md)") ||
+		!strings.Contains(byPath["index.md"], "[index_](index__.md)") {
+		t.Errorf("index page:\n%s", byPath["index.md"])
+	}
+	if !strings.Contains(byPath["index_.md"], "# Module `index`") || !strings.Contains(byPath["index_.md"], "Board") {
+		t.Errorf("module index page:\n%s", byPath["index_.md"])
+	}
+	if !strings.Contains(byPath["index__.md"], "reset") {
+		t.Errorf("module index_ page:\n%s", byPath["index__.md"])
+	}
+}
@@ -0,0 +1,113 @@
+package docgen
+
+import (
+	"github.com/dev-dami/carv/pkg/ast"
+)
+
+// Kind identifies what sort of declaration an Item documents.
+type Kind string
+
+const (
+	KindFunction  Kind = "fn"
+	KindClass     Kind = "class"
+	KindInterface Kind = "interface"
+	KindConst     Kind = "const"
+	KindLet       Kind = "let"
+	KindField     Kind = "field"
+	KindMethod    Kind = "method"
+)
+
+// Module is the documented surface of one source file. Imports names the
+// modules it requires, whose types its pages link to ahead of same-named
+// types elsewhere.
+type Module struct {
+	Name    string
+	Items   []*Item
+	Imports []string
+	program *ast.Program
+}
+
+// Item is one documented declaration. Classes carry their fields and methods
+// as Members; interfaces carry their method signatures.
+type Item struct {
+	Kind       Kind
+	Name       string
+	Doc        string
+	Members    []*Item
+	Implements []string
+	decl       ast.Node
+}
+
+// Extract collects the public declarations of program under the module name.
+func Extract(name string, program *ast.Program) *Module {
+	mod := &Module{Name: name, program: program}
+	classes := make(map[string]*Item)
+
+	for _, stmt := range program.Statements {
+		switch s := stmt.(type) {
+		case *ast.FunctionStatement:
+			if s.Public {
+				mod.Items = append(mod.Items, &Item{Kind: KindFunction, Name: s.Name.Value, Doc: s.Doc, decl: s})
+			}
+		case *ast.ClassStatement:
+			if !s.Public {
+				continue
+			}
+			item := &Item{Kind: KindClass, Name: s.Name.Value, Doc: s.Doc, decl: s}
+			for _, f := range s.Fields {
+				if f.Public {
+					item.Members = append(item.Members, &Item{Kind: KindField, Name: f.Name.Value, Doc: f.Doc, decl: f})
+				}
+			}
+			for _, m := range s.Methods {
+				if m.Public {
+					item.Members = append(item.Members, &Item{Kind: KindMethod, Name: m.Name.Value, Doc: m.Doc, decl: m})
+				}
+			}
+			for _, iface := range s.Implements {
+				item.Implements = append(item.Implements, iface.Value)
+			}
+			classes[item.Name] = item
+			mod.Items = append(mod.Items, item)
+		case *ast.InterfaceStatement:
+			if !s.Public {
+				continue
+			}
+			item := &Item{Kind: KindInterface, Name: s.Name.Value, Doc: s.Doc, decl: s}
+			for _, m := range s.Methods {
+				item.Members = append(item.Members, &Item{Kind: KindMethod, Name: m.Name.Value, Doc: m.Doc, decl: m})
+			}
+			mod.Items = append(mod.Items, item)
+		case *ast.ConstStatement:
+			if s.Public {
+				mod.Items = append(mod.Items, &Item{Kind: KindConst, Name: s.Name.Value, decl: s})
+			}
+		case *ast.LetStatement:
+			if s.Public {
+				mod.Items = append(mod.Items, &Item{Kind: KindLet, Name: s.Name.Value, decl: s})
+			}
+		}
+	}
+
+	// impl blocks may appear anywhere in the file, so attach them last.
+	for _, stmt := range program.Statements {
+		impl, ok := stmt.(*ast.ImplStatement)
+		if !ok || impl.Type == nil || impl.Interface == nil {
+			continue
+		}
+		if item, ok := classes[impl.Type.Value]; ok && !contains(item.Implements, impl.Interface.Value) {
+			item.Implements = append(item.Implements, impl.Interface.Value)
+		}
+	}
+
+	return mod
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,252 @@
+package docgen
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Format selects the output flavour of Generate.
+type Format string
+
+const (
+	Markdown Format = "md"
+	HTML     Format = "html"
+)
+
+// ParseFormat accepts the names used on the command line.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "md", "markdown":
+		return Markdown, nil
+	case "html":
+		return HTML, nil
+	}
+	return "", fmt.Errorf("unknown doc format %q (expected md or html)", s)
+}
+
+// Page is one generated output file, relative to the output directory.
+type Page struct {
+	Path    string
+	Content string
+}
+
+// Generate renders one page per module plus an index page. Modules are
+// emitted in name order so output is stable between runs.
+func Generate(mods []*Module, format Format) []Page {
+	mods = append([]*Module(nil), mods...)
+	sort.Slice(mods, func(i, j int) bool { return mods[i].Name < mods[j].Name })
+
+	g := &generator{format: format, targets: make(map[string]map[string]string)}
+	for _, m := range mods {
+		for _, item := range m.Items {
+			if item.Kind != KindClass && item.Kind != KindInterface {
+				continue
+			}
+			if g.targets[m.Name] == nil {
+				g.targets[m.Name] = make(map[string]string)
+			}
+			g.targets[m.Name][item.Name] = g.modulePage(m.Name) + "#" + item.Name
+		}
+	}
+
+	pages := []Page{{Path: g.pageName("index"), Content: g.index(mods)}}
+	for _, m := range mods {
+		pages = append(pages, Page{Path: g.modulePage(m.Name), Content: g.module(m)})
+	}
+	return pages
+}
+
+type generator struct {
+	format  Format
+	targets map[string]map[string]string // module -> documented type name -> href
+	current *Module                      // the module whose page is being written
+}
+
+// link returns the href of the type name as the current module sees it: its
+// own type, else one from a module it requires, else the only documented
+// type of that name. A name several other modules define is left unlinked.
+func (g *generator) link(name string) string {
+	if m := g.current; m != nil {
+		if href, ok := g.targets[m.Name][name]; ok {
+			return href
+		}
+		for _, imp := range m.Imports {
+			if href, ok := g.targets[imp][name]; ok {
+				return href
+			}
+		}
+	}
+	found := ""
+	for _, defs := range g.targets {
+		if href, ok := defs[name]; ok {
+			if found != "" {
+				return ""
+			}
+			found = href
+		}
+	}
+	return found
+}
+
+// pageName flattens a module path such as "drivers/uart" into "drivers.uart.md".
+func (g *generator) pageName(module string) string {
+	return strings.ReplaceAll(module, "/", ".") + "." + string(g.format)
+}
+
+// modulePage is the page of a module. One whose page would be named index,
+// or index followed by underscores, gets another underscore, so the index
+// page keeps its name.
+func (g *generator) modulePage(module string) string {
+	flat := strings.ReplaceAll(module, "/", ".")
+	if strings.TrimRight(flat, "_") == "index" {
+		module += "_"
+	}
+	return g.pageName(module)
+}
+
+func (g *generator) index(mods []*Module) string {
+	var b strings.Builder
+	if g.format == HTML {
+		b.WriteString(htmlHeader("Modules"))
+		b.WriteString("<h1>Modules</h1>\n<ul>\n")
+		for _, m := range mods {
+			fmt.Fprintf(&b, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(g.modulePage(m.Name)), html.EscapeString(m.Name))
+		}
+		b.WriteString("</ul>\n")
+		b.WriteString(htmlFooter)
+		return b.String()
+	}
+	b.WriteString("# Modules\n\n")
+	for _, m := range mods {
+		fmt.Fprintf(&b, "- [%s](%s)\n", m.Name, g.modulePage(m.Name))
+	}
+	return b.String()
+}
+
+func (g *generator) module(m *Module) string {
+	g.current = m
+	defer func() { g.current = nil }()
+	var b strings.Builder
+	if g.format == HTML {
+		b.WriteString(htmlHeader(m.Name))
+		fmt.Fprintf(&b, "<h1>Module <code>%s</code></h1>\n", html.EscapeString(m.Name))
+		if len(m.Items) == 0 {
+			b.WriteString("<p>No public declarations.</p>\n")
+		}
+	} else {
+		fmt.Fprintf(&b, "# Module `%s`\n", m.Name)
+		if len(m.Items) == 0 {
+			b.WriteString("\nNo public declarations.\n")
+		}
+	}
+
+	for _, item := range m.Items {
+		g.item(&b, m, item, item.Name, 2)
+		for _, member := range item.Members {
+			g.item(&b, m, member, item.Name+"."+member.Name, 3)
+		}
+	}
+
+	if g.format == HTML {
+		b.WriteString(htmlFooter)
+	}
+	return b.String()
+}
+
+// item writes one declaration: an anchor, a heading, the signature and its
+// doc text. Members use a deeper heading level than top-level items.
+func (g *generator) item(b *strings.Builder, m *Module, item *Item, anchor string, level int) {
+	sig := m.signature(item, g.link)
+	heading := string(item.Kind) + " " + item.Name
+
+	if g.format == HTML {
+		fmt.Fprintf(b, "<h%d id=\"%s\">%s</h%d>\n", level, html.EscapeString(anchor), html.EscapeString(heading), level)
+		fmt.Fprintf(b, "<pre><code>%s</code></pre>\n", sig)
+		b.WriteString(g.htmlDoc(item.Doc))
+		if len(item.Implements) > 0 {
+			b.WriteString("<p>Implements: " + g.implements(item) + "</p>\n")
+		}
+		return
+	}
+
+	fmt.Fprintf(b, "\n<a id=\"%s\"></a>\n%s %s\n\n", anchor, strings.Repeat("#", level), heading)
+	fmt.Fprintf(b, "<pre><code>%s</code></pre>\n", sig)
+	if item.Doc != "" {
+		b.WriteString("\n" + g.markdownDoc(item.Doc) + "\n")
+	}
+	if len(item.Implements) > 0 {
+		b.WriteString("\nImplements: " + g.implements(item) + "\n")
+	}
+}
+
+func (g *generator) implements(item *Item) string {
+	parts := make([]string, len(item.Implements))
+	for i, name := range item.Implements {
+		href := g.link(name)
+		switch {
+		case href == "":
+			parts[i] = name
+		case g.format == HTML:
+			parts[i] = `<a href="` + html.EscapeString(href) + `">` + html.EscapeString(name) + `</a>`
+		default:
+			parts[i] = "[" + name + "](" + href + ")"
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// docLink matches [Name] references in doc text that are not already the
+// text of a Markdown link.
+var docLink = regexp.MustCompile(`\[([A-Za-z_][A-Za-z0-9_]*)\](\()?`)
+
+func (g *generator) markdownDoc(doc string) string {
+	return docLink.ReplaceAllStringFunc(doc, func(match string) string {
+		sub := docLink.FindStringSubmatch(match)
+		href := g.link(sub[1])
+		if sub[2] != "" || href == "" {
+			return match
+		}
+		return "[" + sub[1] + "](" + href + ")"
+	})
+}
+
+var codeSpan = regexp.MustCompile("`([^`]+)`")
+
+// htmlDoc renders doc text as paragraphs, turning `code` spans and [Type]
+// references into markup. Everything else is escaped verbatim.
+func (g *generator) htmlDoc(doc string) string {
+	if doc == "" {
+		return ""
+	}
+	var b strings.Builder
+	for _, para := range strings.Split(doc, "\n\n") {
+		para = strings.TrimSpace(para)
+		if para == "" {
+			continue
+		}
+		text := html.EscapeString(para)
+		text = codeSpan.ReplaceAllString(text, "<code>$1</code>")
+		text = docLink.ReplaceAllStringFunc(text, func(match string) string {
+			sub := docLink.FindStringSubmatch(match)
+			href := g.link(sub[1])
+			if sub[2] != "" || href == "" {
+				return match
+			}
+			return `<a href="` + html.EscapeString(href) + `">` + sub[1] + "</a>"
+		})
+		b.WriteString("<p>" + text + "</p>\n")
+	}
+	return b.String()
+}
+
+func htmlHeader(title string) string {
+	return "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>" + html.EscapeString(title) + "</title>\n" +
+		"<style>body{font-family:sans-serif;max-width:52em;margin:2em auto;padding:0 1em}" +
+		"pre{background:#f4f4f4;padding:.6em;overflow-x:auto}h3{margin-left:1em}</style>\n" +
+		"</head>\n<body>\n<p><a href=\"index.html\">Index</a></p>\n"
+}
+
+const htmlFooter = "</body>\n</html>\n"
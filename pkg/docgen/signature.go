@@ -0,0 +1,225 @@
+package docgen
+
+import (
+	"html"
+	"strings"
+
+	"github.com/dev-dami/carv/pkg/ast"
+)
+
+// linker maps a type name to the href of its documentation, or "" when the
+// type is not documented.
+type linker func(name string) string
+
+// signature renders the declaration of item as HTML-escaped text, with named
+// types wrapped in links where the linker knows them.
+func (m *Module) signature(item *Item, link linker) string {
+	var b strings.Builder
+	w := &sigWriter{b: &b, link: link, mod: m}
+
+	switch d := item.decl.(type) {
+	case *ast.FunctionStatement:
+		if d.Public {
+			w.text("pub ")
+		}
+		if d.Unsafe {
+			w.text("unsafe ")
+		}
+		if d.Async {
+			w.text("async ")
+		}
+		w.text("fn " + d.Name.Value)
+		w.params(ast.RecvNone, d.Parameters)
+		w.result(d.ReturnType)
+	case *ast.ClassStatement:
+		w.text("pub class " + d.Name.Value)
+		if d.Lifetime != "" {
+			w.text("<" + d.Lifetime + ">")
+		}
+	case *ast.InterfaceStatement:
+		w.text("pub interface " + d.Name.Value)
+	case *ast.FieldDecl:
+		if d.Public {
+			w.text("pub ")
+		}
+		if d.Static {
+			w.text("static ")
+		}
+		w.text(d.Name.Value + ": ")
+		w.typ(d.Type)
+	case *ast.MethodDecl:
+		if d.Public {
+			w.text("pub ")
+		}
+		if d.Static {
+			w.text("static ")
+		}
+		if d.Async {
+			w.text("async ")
+		}
+		w.text("fn " + d.Name.Value)
+		w.params(d.Receiver, d.Parameters)
+		w.result(d.ReturnType)
+	case *ast.MethodSignature:
+		w.text("fn " + d.Name.Value)
+		w.params(d.Receiver, d.Parameters)
+		w.result(d.ReturnType)
+	case *ast.ConstStatement:
+		w.text("pub const " + d.Name.Value)
+		if d.Type != nil {
+			w.text(": ")
+			w.typ(d.Type)
+		}
+		if d.Value != nil {
+			w.text(" = " + m.source(d.Value))
+		}
+	case *ast.LetStatement:
+		w.text("pub let ")
+		if d.Mutable {
+			w.text("mut ")
+		}
+		w.text(d.Name.Value)
+		if d.Type != nil {
+			w.text(": ")
+			w.typ(d.Type)
+		}
+	}
+	return b.String()
+}
+
+// source returns the original text of n, falling back to its token.
+func (m *Module) source(n ast.Node) string {
+	if m.program != nil {
+		if text := m.program.Text(n); text != "" {
+			return text
+		}
+	}
+	return n.TokenLiteral()
+}
+
+type sigWriter struct {
+	b    *strings.Builder
+	link linker
+	mod  *Module
+}
+
+func (w *sigWriter) text(s string) {
+	w.b.WriteString(html.EscapeString(s))
+}
+
+func (w *sigWriter) name(name string) {
+	if href := w.link(name); href != "" {
+		w.b.WriteString(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(name) + `</a>`)
+		return
+	}
+	w.text(name)
+}
+
+func (w *sigWriter) params(recv ast.ReceiverKind, params []*ast.Parameter) {
+	w.text("(")
+	first := true
+	switch recv {
+	case ast.RecvValue:
+		w.text("self")
+		first = false
+	case ast.RecvRef:
+		w.text("&self")
+		first = false
+	case ast.RecvMutRef:
+		w.text("&mut self")
+		first = false
+	}
+	for _, p := range params {
+		if !first {
+			w.text(", ")
+		}
+		first = false
+		if p.Mutable {
+			w.text("mut ")
+		}
+		w.text(p.Name.Value)
+		if p.Type != nil {
+			w.text(": ")
+			w.typ(p.Type)
+		}
+	}
+	w.text(")")
+}
+
+func (w *sigWriter) result(t ast.TypeExpr) {
+	if t == nil {
+		return
+	}
+	w.text(" -> ")
+	w.typ(t)
+}
+
+func (w *sigWriter) typ(t ast.TypeExpr) {
+	switch t := t.(type) {
+	case *ast.BasicType:
+		w.text(t.Name)
+	case *ast.NamedType:
+		w.name(t.Name.Value)
+		if t.Lifetime != "" {
+			w.text("<" + t.Lifetime + ">")
+		}
+	case *ast.ArrayType:
+		w.text("[")
+		if t.Size != nil {
+			w.text(w.mod.source(t.Size))
+		}
+		w.text("]")
+		w.typ(t.ElementType)
+	case *ast.MapType:
+		w.text("{")
+		w.typ(t.KeyType)
+		w.text(": ")
+		w.typ(t.ValueType)
+		w.text("}")
+	case *ast.FunctionType:
+		w.text("fn(")
+		for i, p := range t.Parameters {
+			if i > 0 {
+				w.text(", ")
+			}
+			w.typ(p)
+		}
+		w.text(")")
+		w.result(t.ReturnType)
+	case *ast.ChannelType:
+		switch {
+		case t.SendOnly:
+			w.text("chan<- ")
+		case t.RecvOnly:
+			w.text("<-chan ")
+		default:
+			w.text("chan ")
+		}
+		w.typ(t.ElementType)
+	case *ast.OptionalType:
+		w.typ(t.Inner)
+		w.text("?")
+	case *ast.RefType:
+		w.text("&")
+		if t.Lifetime != "" {
+			w.text(t.Lifetime + " ")
+		}
+		if t.Mutable {
+			w.text("mut ")
+		}
+		w.typ(t.Inner)
+	case *ast.ResultType:
+		w.text("Result<")
+		w.typ(t.OkType)
+		w.text(", ")
+		w.typ(t.ErrType)
+		w.text(">")
+	case *ast.VolatileType:
+		w.text("volatile<")
+		w.typ(t.Inner)
+		w.text(">")
+	case nil:
+	default:
+		w.text(t.TokenLiteral())
+	}
+}
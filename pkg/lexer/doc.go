@@ -3,6 +3,8 @@
 // Design decisions:
 //   - Lexer output is line/column aware for precise parser and checker errors.
 //   - Keywords and operators are normalized into TokenType constants in token.go.
+//   - Tokens record their byte range and carry preceding whitespace as leading
+//     trivia, so the token stream reproduces the source byte for byte.
 //
 // Usage pattern:
 //
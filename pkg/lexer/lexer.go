@@ -7,6 +7,7 @@ type Lexer struct {
 	ch           byte
 	line         int
 	column       int
+	base         int
 }
 
 func New(input string) *Lexer {
@@ -15,6 +16,14 @@ func New(input string) *Lexer {
 	return l
 }
 
+// NewAt creates a lexer for a fragment that starts at byte offset base of a
+// larger file, so token offsets point into the enclosing source.
+func NewAt(input string, base int) *Lexer {
+	l := New(input)
+	l.base = base
+	return l
+}
+
 func (l *Lexer) readChar() {
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
@@ -37,10 +46,27 @@ func (l *Lexer) peekChar() byte {
 	return l.input[l.readPosition]
 }
 
+// Input returns the source text the lexer was created with.
+func (l *Lexer) Input() string {
+	return l.input
+}
+
+// NextToken scans the next token. Whitespace preceding the token is kept as
+// leading trivia and the token's byte range is recorded, so the original
+// source can be rebuilt exactly from the token stream.
 func (l *Lexer) NextToken() Token {
-	var tok Token
+	leading := l.skipWhitespace()
+	start := min(l.position, len(l.input))
 
-	l.skipWhitespace()
+	tok := l.scanToken()
+	tok.Offset = l.base + start
+	tok.End = l.base + min(l.position, len(l.input))
+	tok.Leading = leading
+	return tok
+}
+
+func (l *Lexer) scanToken() Token {
+	var tok Token
 
 	tok.Line = l.line
 	tok.Column = l.column
@@ -74,9 +100,11 @@ func (l *Lexer) NextToken() Token {
 		if l.peekChar() == '/' {
 			tok.Type = TOKEN_COMMENT
 			tok.Literal = l.readLineComment()
+			return tok
 		} else if l.peekChar() == '*' {
 			tok.Type = TOKEN_COMMENT
 			tok.Literal = l.readBlockComment()
+			return tok
 		} else if l.peekChar() == '=' {
 			l.readChar()
 			tok = Token{Type: TOKEN_SLASH_EQ, Literal: "/=", Line: tok.Line, Column: tok.Column}
@@ -173,12 +201,20 @@ func (l *Lexer) NextToken() Token {
 		tok = l.newToken(TOKEN_DOT, l.ch)
 	case ':':
 		tok = l.newToken(TOKEN_COLON, l.ch)
+	case '#':
+		tok = l.newToken(TOKEN_HASH, l.ch)
 	case ';':
 		tok = l.newToken(TOKEN_SEMI, l.ch)
 	case '"':
 		tok.Type = TOKEN_STRING
 		tok.Literal = l.readString()
 	case '\'':
+		if l.isLifetime() {
+			l.readChar()
+			tok.Type = TOKEN_LIFETIME
+			tok.Literal = "'" + l.readIdentifier()
+			return tok
+		}
 		tok.Type = TOKEN_CHAR
 		tok.Literal = l.readCharLiteral()
 	case 0:
@@ -209,10 +245,16 @@ func (l *Lexer) newToken(tokenType TokenType, ch byte) Token {
 	return Token{Type: tokenType, Literal: string(ch), Line: l.line, Column: l.column}
 }
 
-func (l *Lexer) skipWhitespace() {
+func (l *Lexer) skipWhitespace() []Trivia {
+	position := l.position
 	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
 		l.readChar()
 	}
+	if l.position == position || position >= len(l.input) {
+		return nil
+	}
+	end := min(l.position, len(l.input))
+	return []Trivia{{Kind: TriviaWhitespace, Text: l.input[position:end], Offset: l.base + position}}
 }
 
 func (l *Lexer) readIdentifier() string {
@@ -267,6 +309,16 @@ func (l *Lexer) readString() string {
 	return l.input[position:l.position]
 }
 
+// isLifetime reports whether the ' at the current position starts a
+// lifetime, like 'a, rather than a character literal, like 'a'.
+func (l *Lexer) isLifetime() bool {
+	if !isLetter(l.peekChar()) {
+		return false
+	}
+	next := l.readPosition + 1
+	return next >= len(l.input) || l.input[next] != '\''
+}
+
 func (l *Lexer) readCharLiteral() string {
 	position := l.position + 1
 	l.readChar()
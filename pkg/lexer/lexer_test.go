@@ -236,6 +236,24 @@ func TestCharLiteral(t *testing.T) {
 	}
 }
 
+func TestLifetime(t *testing.T) {
+	l := New(`&'a string 'b'`)
+	for _, want := range []struct {
+		typ     TokenType
+		literal string
+	}{
+		{TOKEN_AMPERSAND, "&"},
+		{TOKEN_LIFETIME, "'a"},
+		{TOKEN_STRING_TYPE, "string"},
+		{TOKEN_CHAR, "b"},
+	} {
+		tok := l.NextToken()
+		if tok.Type != want.typ || tok.Literal != want.literal {
+			t.Fatalf("expected %q %q, got %q %q", want.typ, want.literal, tok.Type, tok.Literal)
+		}
+	}
+}
+
 func TestLineComment(t *testing.T) {
 	input := "// this is a comment\nlet x = 5"
 	l := New(input)
@@ -428,6 +446,17 @@ func TestIllegalToken(t *testing.T) {
 	}
 }
 
+func TestAttributeTokens(t *testing.T) {
+	l := New("#[test]")
+	want := []TokenType{TOKEN_HASH, TOKEN_LBRACKET, TOKEN_IDENT, TOKEN_RBRACKET, TOKEN_EOF}
+	for i, tt := range want {
+		tok := l.NextToken()
+		if tok.Type != tt {
+			t.Fatalf("token %d: expected %q, got %q", i, tt, tok.Type)
+		}
+	}
+}
+
 func TestPeekCharAtEOF(t *testing.T) {
 	l := New("a")
 	tok := l.NextToken()
@@ -494,3 +523,38 @@ func TestMiscKeywords(t *testing.T) {
 		}
 	}
 }
+
+func TestTokenOffsetsAndTrivia(t *testing.T) {
+	input := "let  x /* c */= \"hi\"; // end\n"
+	l := New(input)
+
+	var rebuilt string
+	for {
+		tok := l.NextToken()
+		for _, tr := range tok.Leading {
+			rebuilt += tr.Text
+		}
+		rebuilt += input[tok.Offset:tok.End]
+		if tok.Type == TOKEN_IDENT && (tok.Offset != 5 || tok.End != 6) {
+			t.Fatalf("expected ident at [5,6), got [%d,%d)", tok.Offset, tok.End)
+		}
+		if tok.Type == TOKEN_STRING && input[tok.Offset:tok.End] != `"hi"` {
+			t.Fatalf("expected string span to include quotes, got %q", input[tok.Offset:tok.End])
+		}
+		if tok.Type == TOKEN_EOF {
+			break
+		}
+	}
+	if rebuilt != input {
+		t.Fatalf("token stream is not lossless: got %q, want %q", rebuilt, input)
+	}
+}
+
+func TestBlockCommentKeepsFollowingChar(t *testing.T) {
+	l := New("/*c*/x")
+	l.NextToken()
+	tok := l.NextToken()
+	if tok.Type != TOKEN_IDENT || tok.Literal != "x" {
+		t.Fatalf("expected ident x after block comment, got %s %q", tok.Type, tok.Literal)
+	}
+}
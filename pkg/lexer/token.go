@@ -1,6 +1,9 @@
 package lexer
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type TokenType int
 
@@ -12,14 +15,15 @@ const (
 	TOKEN_COMMENT
 
 	// Identifiers and literals
-	TOKEN_IDENT  // variable, function, class names
-	TOKEN_INT    // 123
-	TOKEN_FLOAT  // 123.45
-	TOKEN_STRING // "hello"
-	TOKEN_CHAR   // 'c'
-	TOKEN_TRUE   // true
-	TOKEN_FALSE  // false
-	TOKEN_NIL    // nil
+	TOKEN_IDENT    // variable, function, class names
+	TOKEN_INT      // 123
+	TOKEN_FLOAT    // 123.45
+	TOKEN_STRING   // "hello"
+	TOKEN_CHAR     // 'c'
+	TOKEN_LIFETIME // 'a
+	TOKEN_TRUE     // true
+	TOKEN_FALSE    // false
+	TOKEN_NIL      // nil
 
 	// Operators
 	TOKEN_PLUS      // +
@@ -68,6 +72,7 @@ const (
 	TOKEN_SEMI      // ;
 	TOKEN_ARROW     // ->
 	TOKEN_FAT_ARROW // =>
+	TOKEN_HASH      // #  (starts an #[attribute])
 
 	// Concurrency
 	TOKEN_LARROW // <-
@@ -77,6 +82,7 @@ const (
 	TOKEN_FN        // fn
 	TOKEN_LET       // let
 	TOKEN_MUT       // mut
+	TOKEN_MOVE      // move
 	TOKEN_CONST     // const
 	TOKEN_IF        // if
 	TOKEN_ELSE      // else
@@ -160,14 +166,15 @@ var tokenNames = map[TokenType]string{
 	TOKEN_NEWLINE: "NEWLINE",
 	TOKEN_COMMENT: "COMMENT",
 
-	TOKEN_IDENT:  "IDENT",
-	TOKEN_INT:    "INT",
-	TOKEN_FLOAT:  "FLOAT",
-	TOKEN_STRING: "STRING",
-	TOKEN_CHAR:   "CHAR",
-	TOKEN_TRUE:   "true",
-	TOKEN_FALSE:  "false",
-	TOKEN_NIL:    "nil",
+	TOKEN_IDENT:    "IDENT",
+	TOKEN_INT:      "INT",
+	TOKEN_FLOAT:    "FLOAT",
+	TOKEN_STRING:   "STRING",
+	TOKEN_CHAR:     "CHAR",
+	TOKEN_LIFETIME: "LIFETIME",
+	TOKEN_TRUE:     "true",
+	TOKEN_FALSE:    "false",
+	TOKEN_NIL:      "nil",
 
 	TOKEN_PLUS:      "+",
 	TOKEN_MINUS:     "-",
@@ -209,6 +216,7 @@ var tokenNames = map[TokenType]string{
 	TOKEN_COMMA:     ",",
 	TOKEN_DOT:       ".",
 	TOKEN_COLON:     ":",
+	TOKEN_HASH:      "#",
 	TOKEN_SEMI:      ";",
 	TOKEN_ARROW:     "->",
 	TOKEN_FAT_ARROW: "=>",
@@ -218,6 +226,7 @@ var tokenNames = map[TokenType]string{
 	TOKEN_FN:        "fn",
 	TOKEN_LET:       "let",
 	TOKEN_MUT:       "mut",
+	TOKEN_MOVE:      "move",
 	TOKEN_CONST:     "const",
 	TOKEN_IF:        "if",
 	TOKEN_ELSE:      "else",
@@ -298,6 +307,7 @@ var keywords = map[string]TokenType{
 	"fn":        TOKEN_FN,
 	"let":       TOKEN_LET,
 	"mut":       TOKEN_MUT,
+	"move":      TOKEN_MOVE,
 	"const":     TOKEN_CONST,
 	"if":        TOKEN_IF,
 	"else":      TOKEN_ELSE,
@@ -376,6 +386,40 @@ type Token struct {
 	Literal string
 	Line    int
 	Column  int
+
+	// Offset and End are the byte range [Offset, End) of the token in the source.
+	Offset int
+	End    int
+	// Leading holds the whitespace and comments between the previous token and this one.
+	Leading []Trivia
+}
+
+// TriviaKind classifies source text that carries no syntax.
+type TriviaKind int
+
+const (
+	TriviaWhitespace TriviaKind = iota
+	TriviaLineComment
+	TriviaBlockComment
+)
+
+// Trivia is a run of whitespace or a comment attached to the token that follows it.
+type Trivia struct {
+	Kind   TriviaKind
+	Text   string
+	Offset int
+}
+
+// AsTrivia converts a comment token into trivia, keeping the comment's own
+// leading whitespace in front of it.
+func (t Token) AsTrivia() []Trivia {
+	kind := TriviaBlockComment
+	if strings.HasPrefix(t.Literal, "//") {
+		kind = TriviaLineComment
+	}
+	out := make([]Trivia, 0, len(t.Leading)+1)
+	out = append(out, t.Leading...)
+	return append(out, Trivia{Kind: kind, Text: t.Literal, Offset: t.Offset})
 }
 
 func (t Token) Pos() string {
@@ -0,0 +1,90 @@
+package module
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// DefaultBuild is the [build] table used when there is no carv.toml.
+func DefaultBuild() BuildConfig {
+	return DefaultConfig("").Build
+}
+
+// CompilerCommand returns the C compiler and its arguments for building
+// cFile into outFile for target. Relative include directories and library
+// paths are taken relative to root.
+func (b BuildConfig) CompilerCommand(target *Target, root, cFile, outFile string) (string, []string) {
+	args := b.compileFlags(target, root)
+	args = append(args, "-o", outFile, cFile)
+	for _, lib := range b.Libraries {
+		args = append(args, libraryArg(root, lib))
+	}
+	args = append(args, target.LDFlags...)
+	if !target.IsHost() {
+		// The runtime needs no libc, but soft-float and 64-bit arithmetic
+		// still come from libgcc.
+		args = append(args, "-lgcc")
+	}
+	return target.Compiler, args
+}
+
+// StackUsageCommand returns the compiler invocation that compiles cFile to
+// objFile with -fstack-usage, which leaves a .su file beside objFile. It
+// uses the same code generation flags as CompilerCommand, so the reported
+// frames match the real build.
+func (b BuildConfig) StackUsageCommand(target *Target, root, cFile, objFile string) (string, []string) {
+	args := b.compileFlags(target, root)
+	args = append(args, "-fstack-usage", "-c", "-o", objFile, cFile)
+	return target.Compiler, args
+}
+
+func (b BuildConfig) compileFlags(target *Target, root string) []string {
+	args := target.machineFlags()
+	switch {
+	case !b.Optimize:
+		args = append(args, "-O0")
+	case target.IsHost():
+		args = append(args, "-O2")
+	default:
+		args = append(args, "-Os")
+	}
+	if !target.IsHost() {
+		args = append(args, "-ffreestanding", "-nostdlib")
+	}
+	args = append(args, target.CFlags...)
+
+	if b.Debug {
+		args = append(args, "-g")
+	}
+	for _, inc := range b.Includes {
+		args = append(args, "-I"+joinRoot(root, inc))
+	}
+	return args
+}
+
+// libraryArg turns a [build].libraries entry into a linker argument. Bare
+// names such as "m" become -lm; anything that looks like a file is linked
+// directly.
+func libraryArg(root, lib string) string {
+	if strings.HasPrefix(lib, "-") {
+		return lib
+	}
+	if IsLibraryFile(lib) {
+		return joinRoot(root, lib)
+	}
+	return "-l" + lib
+}
+
+// IsLibraryFile reports whether the libraries entry lib names a file to
+// link, rather than a library to find with -l.
+func IsLibraryFile(lib string) bool {
+	return !strings.HasPrefix(lib, "-") && (strings.ContainsRune(lib, '/') ||
+		strings.HasSuffix(lib, ".a") || strings.HasSuffix(lib, ".o") || strings.HasSuffix(lib, ".so"))
+}
+
+func joinRoot(root, path string) string {
+	if root == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(root, path)
+}
@@ -0,0 +1,126 @@
+package module
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Cache is the package cache shared by every project on the machine.
+// Package trees are stored under pkgs/<checksum>, so identical trees are
+// kept once and never change, and git/<revision> records the checksum of
+// the tree each fetched commit produced. The files of a stored tree are
+// read-only, since carv_modules links to them rather than copying them.
+type Cache struct {
+	Dir string
+}
+
+// DefaultCache returns the cache in $CARV_CACHE, or in carv under the user
+// cache directory (usually ~/.cache/carv).
+func DefaultCache() *Cache {
+	if dir := os.Getenv("CARV_CACHE"); dir != "" {
+		return &Cache{Dir: dir}
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return &Cache{Dir: filepath.Join(dir, "carv")}
+}
+
+// PackageDir returns the cached tree with the given checksum, or "" if it
+// is not in the cache.
+func (c *Cache) PackageDir(checksum string) string {
+	hex, ok := strings.CutPrefix(checksum, "sha256:")
+	if !ok || hex == "" || strings.ContainsAny(hex, `/\.`) {
+		return ""
+	}
+	dir := filepath.Join(c.Dir, "pkgs", hex)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return ""
+	}
+	return dir
+}
+
+// Revision returns the cached tree of a git commit and its full hash. rev
+// may be abbreviated as long as it names one cached commit.
+func (c *Cache) Revision(rev string) (dir, full string) {
+	if rev == "" || strings.ContainsAny(rev, `/\.*?[`) {
+		return "", ""
+	}
+	matches, _ := filepath.Glob(filepath.Join(c.Dir, "git", rev+"*"))
+	if len(matches) != 1 {
+		return "", ""
+	}
+	sum, err := os.ReadFile(matches[0])
+	if err != nil {
+		return "", ""
+	}
+	dir = c.PackageDir(strings.TrimSpace(string(sum)))
+	if dir == "" {
+		return "", ""
+	}
+	return dir, filepath.Base(matches[0])
+}
+
+// TempDir creates a directory inside the cache in which to fetch a tree
+// for Store.
+func (c *Cache) TempDir() (string, error) {
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(c.Dir, ".fetch-")
+}
+
+// Store moves the tree at dir, made by TempDir, into the cache, records it
+// as the tree of git commit rev if rev is not empty, and returns where it
+// now lives.
+func (c *Cache) Store(dir, rev string) (string, error) {
+	defer os.RemoveAll(dir)
+
+	sum, err := HashDir(dir)
+	if err != nil {
+		return "", err
+	}
+	dest := c.PackageDir(sum)
+	if dest == "" {
+		dest = filepath.Join(c.Dir, "pkgs", strings.TrimPrefix(sum, "sha256:"))
+		if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+			return "", err
+		}
+		if err := os.Rename(dir, dest); err != nil {
+			return "", fmt.Errorf("storing package in cache: %w", err)
+		}
+		if err := readOnly(dest); err != nil {
+			return "", fmt.Errorf("storing package in cache: %w", err)
+		}
+	}
+
+	if rev != "" {
+		index := filepath.Join(c.Dir, "git", rev)
+		if err := os.MkdirAll(filepath.Dir(index), 0o755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(index, []byte(sum+"\n"), 0o644); err != nil {
+			return "", err
+		}
+	}
+	return dest, nil
+}
+
+// readOnly takes write permission off the files under dir, so that editing
+// a package through its link in one project cannot change it for every
+// other. Directories stay writable, so the cache can still be cleared.
+func readOnly(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return os.Chmod(path, info.Mode().Perm()&^0o222)
+	})
+}
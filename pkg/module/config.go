@@ -1,6 +1,7 @@
 package module
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 
@@ -13,6 +14,9 @@ type Config struct {
 	DevDeps      map[string]Dependency `toml:"dev-dependencies"`
 	Build        BuildConfig           `toml:"build"`
 	Scripts      map[string]string     `toml:"scripts"`
+	Targets      map[string]Target     `toml:"targets"`
+	Lints        map[string]string     `toml:"lints,omitempty"` // lint name to "allow", "warn" or "deny"
+	Workspace    *WorkspaceConfig      `toml:"workspace,omitempty"`
 }
 
 type PackageInfo struct {
@@ -32,16 +36,43 @@ type Dependency struct {
 	Git     string `toml:"git"`
 	Branch  string `toml:"branch"`
 	Tag     string `toml:"tag"`
+	Rev     string `toml:"rev"` // a commit to pin, full or abbreviated
 	Path    string `toml:"path"`
 }
 
 type BuildConfig struct {
 	Output    string   `toml:"output"`
-	Target    string   `toml:"target"`
+	Target    string   `toml:"target"` // a built-in profile or a [targets] entry
 	Optimize  bool     `toml:"optimize"`
 	Debug     bool     `toml:"debug"`
 	Includes  []string `toml:"includes"`
 	Libraries []string `toml:"libraries"`
+	Memory    string   `toml:"memory,omitempty"`     // "heap" (default) or "static"
+	ArenaSize int      `toml:"arena-size,omitempty"` // bytes reserved for the arena in static mode
+}
+
+// DefaultArenaSize is the static arena reserved when [build] arena-size is
+// not set.
+const DefaultArenaSize = 4096
+
+// StaticMemory reports whether the build is in static memory mode, where
+// nothing is allocated at run time beyond a fixed-size arena.
+func (b BuildConfig) StaticMemory() (bool, error) {
+	switch b.Memory {
+	case "", "heap":
+		return false, nil
+	case "static":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown [build] memory %q (want \"heap\" or \"static\")", b.Memory)
+}
+
+// StaticArenaSize returns the size of the static arena in bytes.
+func (b BuildConfig) StaticArenaSize() int {
+	if b.ArenaSize > 0 {
+		return b.ArenaSize
+	}
+	return DefaultArenaSize
 }
 
 func LoadConfig(dir string) (*Config, error) {
@@ -55,10 +86,24 @@ func LoadConfig(dir string) (*Config, error) {
 		return nil, err
 	}
 
-	var cfg Config
+	// Keys missing from [build] keep their defaults.
+	cfg := Config{Build: DefaultBuild()}
 	if err := toml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	if _, err := cfg.Build.StaticMemory(); err != nil {
+		return nil, err
+	}
+	if cfg.Build.ArenaSize < 0 {
+		return nil, fmt.Errorf("[build] arena-size must not be negative, got %d", cfg.Build.ArenaSize)
+	}
+	for name, level := range cfg.Lints {
+		switch level {
+		case "allow", "warn", "deny":
+		default:
+			return nil, fmt.Errorf("[lints] %s = %q: want \"allow\", \"warn\" or \"deny\"", name, level)
+		}
+	}
 
 	return &cfg, nil
 }
@@ -0,0 +1,184 @@
+package module
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// gitCheckout fetches a single commit of a git repository into destDir and
+// checks it out. rev is a full commit hash or, failing a shallow fetch of
+// it, anything git can find after fetching every branch and tag, such as an
+// abbreviated hash.
+func gitCheckout(url, rev, destDir string, log io.Writer) error {
+	if _, err := exec.LookPath("git"); err != nil {
+		return fmt.Errorf("git is not installed or not in PATH")
+	}
+
+	command := func(args ...string) *exec.Cmd {
+		return exec.Command("git", append([]string{"-C", destDir, "-c", "advice.detachedHead=false"}, args...)...)
+	}
+	git := func(args ...string) error {
+		cmd := command(args...)
+		cmd.Stdout = log
+		cmd.Stderr = log
+		return cmd.Run()
+	}
+
+	if err := os.MkdirAll(destDir, 0o755); err != nil {
+		return err
+	}
+	if err := git("init", "--quiet"); err != nil {
+		return err
+	}
+	if err := git("remote", "add", "origin", url); err != nil {
+		return err
+	}
+	// Servers refuse a shallow fetch of an abbreviated hash, so its failure
+	// is not worth reporting.
+	if err := command("fetch", "--quiet", "--depth", "1", "origin", rev).Run(); err != nil {
+		if err := git("fetch", "--quiet", "--tags", "origin", "+refs/heads/*:refs/remotes/origin/*"); err != nil {
+			return err
+		}
+	} else {
+		rev = "FETCH_HEAD"
+	}
+	if err := git("checkout", "--quiet", "--detach", rev); err != nil {
+		return fmt.Errorf("revision %s not found in %s", rev, url)
+	}
+	return nil
+}
+
+// gitRevision returns the HEAD commit hash for a git repo directory.
+func gitRevision(dir string) string {
+	cmd := exec.Command("git", "-C", dir, "rev-parse", "HEAD")
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// remoteRefs lists the refs of a remote repository as a map from ref name
+// (HEAD, refs/heads/..., refs/tags/...) to commit hash. Annotated tags map
+// to the commit they point at.
+func remoteRefs(url string) (map[string]string, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("git is not installed or not in PATH")
+	}
+	out, err := exec.Command("git", "ls-remote", url).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			return nil, fmt.Errorf("git ls-remote %s: %s", url, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("git ls-remote %s: %w", url, err)
+	}
+
+	refs := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		hash, name := fields[0], fields[1]
+		if peeled, ok := strings.CutSuffix(name, "^{}"); ok {
+			refs[peeled] = hash
+			continue
+		}
+		if _, seen := refs[name]; !seen {
+			refs[name] = hash
+		}
+	}
+	return refs, nil
+}
+
+// copyDir recursively copies a directory tree.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		targetPath := filepath.Join(dst, relPath)
+
+		if d.IsDir() {
+			return os.MkdirAll(targetPath, 0o755)
+		}
+
+		return copyFile(path, targetPath)
+	})
+}
+
+// copyFile copies a single file.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// HashDir returns a checksum of the files under dir, in the form
+// "sha256:<hex>". It covers each file's path relative to dir and its
+// contents, so it is the same wherever the tree is installed. Version
+// control metadata and nested carv_modules directories are left out.
+func HashDir(dir string) (string, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var files []string
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root && (d.Name() == ".git" || d.Name() == "carv_modules") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, rel := range files {
+		data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", rel, len(data))
+		h.Write(data)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -14,6 +14,8 @@ type Loader struct {
 	basePath    string
 	loadedFiles map[string]*Module
 	config      *Config
+	lock        *LockFile // carv.lock, read on first use
+	depsRoot    string    // where vendor/, carv_modules/ and carv.lock live
 }
 
 type Module struct {
@@ -21,6 +23,30 @@ type Module struct {
 	Program   *ast.Program
 	Exports   map[string]bool
 	IsBuiltin bool
+
+	// Where it was loaded from: the package it belongs to, or "" for the
+	// project, and that package's or the project's directory.
+	Package string
+	Dir     string
+}
+
+// Name names the module by its path under Dir, without .carv, after the
+// name of its package if it is in one: src/main, or hal/mod.
+func (m *Module) Name() string {
+	name := m.Path
+	if rel, err := filepath.Rel(m.Dir, m.Path); err == nil {
+		name = rel
+	}
+	name = filepath.ToSlash(strings.TrimSuffix(name, ".carv"))
+	if m.Package != "" {
+		name = m.Package + "/" + name
+	}
+	return name
+}
+
+// origin is where a module is loaded from, as Module records it.
+type origin struct {
+	pkg, dir string
 }
 
 func NewLoader(basePath string) *Loader {
@@ -53,7 +79,22 @@ func (l *Loader) Load(importPath string, fromFile string) (*Module, error) {
 		return mod, nil
 	}
 
-	resolved, err := l.resolvePath(importPath, fromFile)
+	resolved, from, err := l.resolvePath(importPath, fromFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.loadFile(resolved, from)
+}
+
+// LoadFile loads the module at path directly, without import resolution.
+// It is how tools load an entry file before following its requires.
+func (l *Loader) LoadFile(path string) (*Module, error) {
+	return l.loadFile(path, origin{dir: l.basePath})
+}
+
+func (l *Loader) loadFile(path string, from origin) (*Module, error) {
+	resolved, err := filepath.Abs(path)
 	if err != nil {
 		return nil, err
 	}
@@ -79,13 +120,18 @@ func (l *Loader) Load(importPath string, fromFile string) (*Module, error) {
 		Path:    resolved,
 		Program: program,
 		Exports: l.extractExports(program),
+		Package: from.pkg,
+		Dir:     from.dir,
 	}
 
 	l.loadedFiles[resolved] = mod
 	return mod, nil
 }
 
-func (l *Loader) resolvePath(importPath string, fromFile string) (string, error) {
+// resolvePath finds the file importPath names from fromFile, and where it
+// is loaded from: a relative import from where fromFile was.
+func (l *Loader) resolvePath(importPath string, fromFile string) (string, origin, error) {
+	project := origin{dir: l.basePath}
 	if strings.HasPrefix(importPath, "./") || strings.HasPrefix(importPath, "../") {
 		baseDir := filepath.Dir(fromFile)
 		if baseDir == "" {
@@ -95,7 +141,14 @@ func (l *Loader) resolvePath(importPath string, fromFile string) (string, error)
 		if !strings.HasSuffix(resolved, ".carv") {
 			resolved += ".carv"
 		}
-		return filepath.Abs(resolved)
+		from := project
+		if abs, err := filepath.Abs(fromFile); err == nil {
+			if m := l.loadedFiles[abs]; m != nil {
+				from = origin{pkg: m.Package, dir: m.Dir}
+			}
+		}
+		resolved, err := filepath.Abs(resolved)
+		return resolved, from, err
 	}
 
 	if l.config != nil && l.config.Dependencies != nil {
@@ -109,38 +162,87 @@ func (l *Loader) resolvePath(importPath string, fromFile string) (string, error)
 		projectPath += ".carv"
 	}
 	if _, err := os.Stat(projectPath); err == nil {
-		return projectPath, nil
+		return projectPath, project, nil
+	}
+
+	// Dependencies of dependencies are installed alongside the direct ones.
+	if _, ok := l.packageDir(importPath); ok {
+		return l.resolvePackage(importPath, Dependency{})
 	}
 
 	modPath := filepath.Join(l.basePath, importPath)
 	if !strings.HasSuffix(modPath, ".carv") {
 		modPath += ".carv"
 	}
-	return modPath, nil
+	return modPath, project, nil
 }
 
-func (l *Loader) resolvePackage(name string, dep Dependency) (string, error) {
-	pkgDir := filepath.Join(l.basePath, "carv_modules", name)
+func (l *Loader) resolvePackage(name string, dep Dependency) (string, origin, error) {
+	pkgDir, found := l.packageDir(name)
 
-	if dep.Path != "" {
+	// A path dependency is read in place unless it has been vendored.
+	if dep.Path != "" && pkgDir != filepath.Join(l.dependencyRoot(), "vendor", name) {
 		pkgDir = dep.Path
 		if !filepath.IsAbs(pkgDir) {
 			pkgDir = filepath.Join(l.basePath, pkgDir)
 		}
+	} else if !found {
+		pkgDir = filepath.Join(l.dependencyRoot(), "carv_modules", name)
 	}
 
+	from := origin{pkg: name, dir: pkgDir}
 	modFile := filepath.Join(pkgDir, "mod.carv")
 	if _, err := os.Stat(modFile); err == nil {
-		return modFile, nil
+		return modFile, from, nil
 	}
 
 	indexFile := filepath.Join(pkgDir, "index.carv")
 	if _, err := os.Stat(indexFile); err == nil {
-		return indexFile, nil
+		return indexFile, from, nil
 	}
 
 	mainFile := filepath.Join(pkgDir, name+".carv")
-	return mainFile, nil
+	return mainFile, from, nil
+}
+
+// dependencyRoot is the project directory, or the workspace root when the
+// project is a workspace member.
+func (l *Loader) dependencyRoot() string {
+	if l.depsRoot == "" {
+		l.depsRoot = l.basePath
+		if ws, err := FindWorkspace(l.basePath); err == nil && ws != nil {
+			l.depsRoot = ws.Root
+		}
+	}
+	return l.depsRoot
+}
+
+// packageDir finds an installed package: in vendor/ if carv vendor copied
+// it there, else in carv_modules/, else in the package cache under the
+// checksum carv.lock records for it.
+func (l *Loader) packageDir(name string) (string, bool) {
+	root := l.dependencyRoot()
+	for _, dir := range []string{
+		filepath.Join(root, "vendor", name),
+		filepath.Join(root, "carv_modules", name),
+	} {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir, true
+		}
+	}
+
+	if l.lock == nil {
+		l.lock, _ = LoadLock(root)
+		if l.lock == nil {
+			l.lock = &LockFile{}
+		}
+	}
+	if locked := l.lock.Find(name); locked != nil {
+		if dir := DefaultCache().PackageDir(locked.Checksum); dir != "" {
+			return dir, true
+		}
+	}
+	return "", false
 }
 
 func (l *Loader) extractExports(program *ast.Program) map[string]bool {
@@ -156,6 +258,10 @@ func (l *Loader) extractExports(program *ast.Program) map[string]bool {
 			if s.Public {
 				exports[s.Name.Value] = true
 			}
+		case *ast.InterfaceStatement:
+			if s.Public {
+				exports[s.Name.Value] = true
+			}
 		case *ast.ConstStatement:
 			if s.Public {
 				exports[s.Name.Value] = true
@@ -170,6 +276,11 @@ func (l *Loader) extractExports(program *ast.Program) map[string]bool {
 	return exports
 }
 
+// BasePath returns the absolute project directory the loader resolves from.
+func (l *Loader) BasePath() string {
+	return l.basePath
+}
+
 func (l *Loader) GetLoadedModules() map[string]*Module {
 	return l.loadedFiles
 }
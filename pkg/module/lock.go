@@ -1,8 +1,10 @@
 package module
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
@@ -14,10 +16,55 @@ type LockFile struct {
 
 // LockedPackage represents a single locked dependency.
 type LockedPackage struct {
-	Name     string `toml:"name"`
-	Version  string `toml:"version"`
-	Source   string `toml:"source"`
-	Revision string `toml:"revision"`
+	Name         string   `toml:"name"`
+	Version      string   `toml:"version"`
+	Source       string   `toml:"source"`
+	Revision     string   `toml:"revision,omitempty"`
+	Checksum     string   `toml:"checksum,omitempty"`     // HashDir of the installed files; none for a workspace member
+	Dependencies []string `toml:"dependencies,omitempty"` // names of the packages it requires
+	Dev          bool     `toml:"dev,omitempty"`          // needed only by [dev-dependencies]
+}
+
+// Find returns the locked package with the given name, or nil.
+func (lf *LockFile) Find(name string) *LockedPackage {
+	for i := range lf.Packages {
+		if lf.Packages[i].Name == name {
+			return &lf.Packages[i]
+		}
+	}
+	return nil
+}
+
+// Diff lists how resolved differs from lf, one line per difference, in
+// package order. An empty result means the lock file is up to date.
+func (lf *LockFile) Diff(resolved *LockFile) []string {
+	var diffs []string
+	for _, want := range resolved.Packages {
+		have := lf.Find(want.Name)
+		if have == nil {
+			diffs = append(diffs, fmt.Sprintf("%s: missing from carv.lock", want.Name))
+			continue
+		}
+		field := func(what, locked, now string) {
+			if locked != now {
+				diffs = append(diffs, fmt.Sprintf("%s: %s is %q in carv.lock, resolved %q", want.Name, what, locked, now))
+			}
+		}
+		field("version", have.Version, want.Version)
+		field("source", have.Source, want.Source)
+		field("revision", have.Revision, want.Revision)
+		field("checksum", have.Checksum, want.Checksum)
+		field("dependencies", strings.Join(have.Dependencies, ", "), strings.Join(want.Dependencies, ", "))
+		if have.Dev != want.Dev {
+			diffs = append(diffs, fmt.Sprintf("%s: dev is %t in carv.lock, resolved %t", want.Name, have.Dev, want.Dev))
+		}
+	}
+	for _, have := range lf.Packages {
+		if resolved.Find(have.Name) == nil {
+			diffs = append(diffs, fmt.Sprintf("%s: in carv.lock but no longer required", have.Name))
+		}
+	}
+	return diffs
 }
 
 // LoadLock reads carv.lock from the given project directory.
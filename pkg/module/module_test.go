@@ -2,8 +2,12 @@ package module
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -1086,3 +1090,953 @@ func TestLoaderLoadAllBuiltinModules(t *testing.T) {
 		}
 	}
 }
+
+func TestLoadConfigBuildDefaults(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := "[package]\nname = \"p\"\n\n[build]\ndebug = true\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, "carv.toml"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(tmpDir)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if !cfg.Build.Debug || !cfg.Build.Optimize || cfg.Build.Output != "build" {
+		t.Errorf("expected debug plus default optimize and output, got %+v", cfg.Build)
+	}
+
+	if err := os.WriteFile(filepath.Join(tmpDir, "carv.toml"), []byte("[build]\noptimize = false\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = LoadConfig(tmpDir)
+	if err != nil {
+		t.Fatalf("LoadConfig error: %v", err)
+	}
+	if cfg.Build.Optimize {
+		t.Error("explicit optimize = false should override the default")
+	}
+}
+
+func TestBuildCompilerCommand(t *testing.T) {
+	host, err := ResolveTarget("host", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := BuildConfig{
+		Optimize:  true,
+		Debug:     true,
+		Includes:  []string{"include", "/opt/sdk/include"},
+		Libraries: []string{"m", "vendor/libdrv.a"},
+	}
+	compiler, args := build.CompilerCommand(host, "/proj", "out/main.c", "out/main")
+	got := compiler + " " + strings.Join(args, " ")
+	want := "gcc -O2 -g -I/proj/include -I/opt/sdk/include -o out/main out/main.c -lm /proj/vendor/libdrv.a"
+	if got != want {
+		t.Errorf("host command:\n got %s\nwant %s", got, want)
+	}
+
+	arm, err := ResolveTarget("arm", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compiler, args = BuildConfig{}.CompilerCommand(arm, "", "main.c", arm.BinaryName("main"))
+	got = compiler + " " + strings.Join(args, " ")
+	want = "arm-none-eabi-gcc -mcpu=cortex-m4 -mthumb -mfloat-abi=soft -O0 -ffreestanding -nostdlib -o main.elf main.c -lgcc"
+	if got != want {
+		t.Errorf("arm command:\n got %s\nwant %s", got, want)
+	}
+
+	compiler, args = BuildConfig{Optimize: true}.StackUsageCommand(arm, "", "main.c", "/tmp/su/out.o")
+	got = compiler + " " + strings.Join(args, " ")
+	want = "arm-none-eabi-gcc -mcpu=cortex-m4 -mthumb -mfloat-abi=soft -Os -ffreestanding -nostdlib -fstack-usage -c -o /tmp/su/out.o main.c"
+	if got != want {
+		t.Errorf("stack usage command:\n got %s\nwant %s", got, want)
+	}
+
+	m7, err := ResolveTarget("cortex-m7", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, args = BuildConfig{Optimize: true}.CompilerCommand(m7, "", "main.c", "main.elf")
+	got = strings.Join(args, " ")
+	want = "-mcpu=cortex-m7 -mthumb -mfpu=fpv5-d16 -mfloat-abi=hard -Os -ffreestanding -nostdlib -o main.elf main.c -lgcc"
+	if got != want {
+		t.Errorf("cortex-m7 command:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	m0, err := ResolveTarget("cortex-m0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m0.IntBits != 32 || m0.PointerBits != 32 || m0.IsHost() {
+		t.Errorf("cortex-m0 = %+v", m0)
+	}
+
+	custom := map[string]Target{
+		"board": {
+			Base:    "cortex-m4f",
+			CFlags:  []string{"-DBOARD_REV=2"},
+			LDFlags: []string{"-Tboard.ld"},
+		},
+		"board-debug": {Base: "board", CFlags: []string{"-DDEBUG"}},
+		"clang-host":  {Compiler: "clang"},
+		"loop-a":      {Base: "loop-b"},
+		"loop-b":      {Base: "loop-a"},
+	}
+
+	dbg, err := ResolveTarget("board-debug", custom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbg.Name != "board-debug" || dbg.CPU != "cortex-m4" || dbg.FPU != "fpv4-sp-d16" {
+		t.Errorf("board-debug = %+v", dbg)
+	}
+	_, args := BuildConfig{}.CompilerCommand(dbg, "", "main.c", "main.elf")
+	got := strings.Join(args, " ")
+	if !strings.Contains(got, "-DBOARD_REV=2 -DDEBUG") || !strings.HasSuffix(got, "main.c -Tboard.ld -lgcc") {
+		t.Errorf("board-debug args = %s", got)
+	}
+
+	clang, err := ResolveTarget("clang-host", custom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clang.Compiler != "clang" || !clang.IsHost() || clang.IntBits != 64 {
+		t.Errorf("clang-host = %+v", clang)
+	}
+
+	if _, err := ResolveTarget("loop-a", custom); err == nil || !strings.Contains(err.Error(), "inherits from itself") {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+	if _, err := ResolveTarget("riscv", custom); err == nil {
+		t.Error("expected an error for an unknown target")
+	}
+}
+
+func TestLoadConfigTargets(t *testing.T) {
+	dir := t.TempDir()
+	data := `[package]
+name = "fw"
+
+[build]
+target = "board"
+
+[targets.board]
+base = "cortex-m0plus"
+compiler = "/opt/arm/bin/arm-none-eabi-gcc"
+ldflags = ["-Tlink.ld"]
+interrupts = ["USART1_IRQHandler", "TIM2_IRQHandler"]
+`
+	if err := os.WriteFile(filepath.Join(dir, "carv.toml"), []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := ResolveTarget(cfg.Build.Target, cfg.Targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Compiler != "/opt/arm/bin/arm-none-eabi-gcc" || target.CPU != "cortex-m0plus" || target.IntBits != 32 {
+		t.Errorf("board = %+v", target)
+	}
+
+	core, device := target.VectorTable()
+	if got := strings.Join(core, " "); got != "Reset_Handler NMI_Handler HardFault_Handler SVC_Handler PendSV_Handler SysTick_Handler" {
+		t.Errorf("cortex-m0plus core vectors = %s", got)
+	}
+	if len(device) != 2 || device[0] != "USART1_IRQHandler" {
+		t.Errorf("device vectors = %v", device)
+	}
+	m4, err := ResolveTarget("cortex-m4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if core, device := m4.VectorTable(); len(core) != 10 || device != nil {
+		t.Errorf("cortex-m4 vectors = %v, %v", core, device)
+	}
+	host, err := ResolveTarget("host", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if core, _ := host.VectorTable(); core != nil {
+		t.Errorf("host vectors = %v", core)
+	}
+}
+
+func TestLoadConfigMemory(t *testing.T) {
+	dir := t.TempDir()
+	write := func(build string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, "carv.toml"), []byte("[build]\n"+build), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("memory = \"static\"\narena-size = 2048\n")
+	cfg, err := LoadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if static, _ := cfg.Build.StaticMemory(); !static || cfg.Build.StaticArenaSize() != 2048 {
+		t.Errorf("build = %+v, want static memory with a 2048-byte arena", cfg.Build)
+	}
+
+	write("memory = \"static\"\n")
+	if cfg, err = LoadConfig(dir); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Build.StaticArenaSize() != DefaultArenaSize {
+		t.Errorf("StaticArenaSize() = %d, want %d", cfg.Build.StaticArenaSize(), DefaultArenaSize)
+	}
+	if static, _ := DefaultBuild().StaticMemory(); static {
+		t.Error("default build should use the heap")
+	}
+
+	write("memory = \"pool\"\n")
+	if _, err := LoadConfig(dir); err == nil || !strings.Contains(err.Error(), `unknown [build] memory "pool"`) {
+		t.Errorf("expected an unknown memory error, got %v", err)
+	}
+	write("arena-size = -1\n")
+	if _, err := LoadConfig(dir); err == nil {
+		t.Error("expected an error for a negative arena-size")
+	}
+}
+
+func TestLoadConfigLints(t *testing.T) {
+	dir := t.TempDir()
+	write := func(lints string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, "carv.toml"), []byte("[lints]\n"+lints), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("unused = \"allow\"\nuse_after_move = \"warn\"\n")
+	cfg, err := LoadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Lints["unused"] != "allow" || cfg.Lints["use_after_move"] != "warn" {
+		t.Errorf("lints = %v", cfg.Lints)
+	}
+
+	write("unused = \"quiet\"\n")
+	if _, err := LoadConfig(dir); err == nil || !strings.Contains(err.Error(), `[lints] unused = "quiet"`) {
+		t.Errorf("expected a bad level error, got %v", err)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	v, err := ParseVersion("v1.4.2-rc.1+build.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != (Version{Major: 1, Minor: 4, Patch: 2, Pre: "rc.1"}) || v.String() != "1.4.2-rc.1" {
+		t.Errorf("ParseVersion = %+v (%s)", v, v)
+	}
+	for _, bad := range []string{"", "1.2", "1.2.3.4", "1.a.3", "1.2.3-"} {
+		if _, err := ParseVersion(bad); err == nil {
+			t.Errorf("ParseVersion(%q) should fail", bad)
+		}
+	}
+
+	ordered := []string{"0.9.9", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0", "1.0.1", "1.10.0"}
+	for i := 1; i < len(ordered); i++ {
+		a, _ := ParseVersion(ordered[i-1])
+		b, _ := ParseVersion(ordered[i])
+		if a.Compare(b) >= 0 || b.Compare(a) <= 0 {
+			t.Errorf("expected %s < %s", a, b)
+		}
+	}
+}
+
+func TestConstraintMatches(t *testing.T) {
+	tests := []struct {
+		constraint string
+		yes, no    []string
+	}{
+		{"1.2", []string{"1.2.0", "1.9.3"}, []string{"1.1.9", "2.0.0", "1.3.0-beta"}},
+		{"^1.2.3", []string{"1.2.3", "1.5.0"}, []string{"1.2.2", "2.0.0"}},
+		{"^0.2.1", []string{"0.2.1", "0.2.9"}, []string{"0.3.0", "0.2.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"~1.2.3", []string{"1.2.3", "1.2.9"}, []string{"1.3.0"}},
+		{"~1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{"=1.2.3", []string{"1.2.3"}, []string{"1.2.4"}},
+		{">=1.0, <2.0", []string{"1.0.0", "1.99.0"}, []string{"0.9.0", "2.0.0"}},
+		{">= 1.2, < 1.5", []string{"1.2.0", "1.4.9"}, []string{"1.1.0", "1.5.0"}},
+		{">1.2", []string{"1.3.0"}, []string{"1.2.5"}},
+		{"<=1.2", []string{"1.2.7"}, []string{"1.3.0"}},
+		{"1.x", []string{"1.0.0", "1.4.0"}, []string{"2.0.0"}},
+		{"*", []string{"0.0.1", "7.0.0"}, []string{"1.0.0-rc.1"}},
+		{"^1.0 || ^3.0", []string{"1.2.0", "3.1.0"}, []string{"2.0.0"}},
+		{">=1.0.0-rc.1", []string{"1.0.0-rc.2", "1.0.0"}, []string{"1.1.0-rc.1"}},
+	}
+	for _, tt := range tests {
+		c, err := ParseConstraint(tt.constraint)
+		if err != nil {
+			t.Errorf("ParseConstraint(%q): %v", tt.constraint, err)
+			continue
+		}
+		for _, s := range tt.yes {
+			if v, _ := ParseVersion(s); !c.Matches(v) {
+				t.Errorf("%q should match %s", tt.constraint, s)
+			}
+		}
+		for _, s := range tt.no {
+			if v, _ := ParseVersion(s); c.Matches(v) {
+				t.Errorf("%q should not match %s", tt.constraint, s)
+			}
+		}
+	}
+
+	for _, bad := range []string{"", "^", "1.2.z", ">=*", "1.2-rc", "1.0,", ">=1.0 <2.0"} {
+		if _, err := ParseConstraint(bad); err == nil {
+			t.Errorf("ParseConstraint(%q) should fail", bad)
+		}
+	}
+}
+
+// writePackage creates a package directory with a carv.toml and a mod.carv.
+func writePackage(t *testing.T, dir, toml string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "carv.toml"), []byte(toml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "mod.carv"), []byte("pub fn hello() -> int { return 1; }\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolvePathDependencies(t *testing.T) {
+	t.Setenv("CARV_CACHE", t.TempDir())
+	base := t.TempDir()
+	root := filepath.Join(base, "app")
+	writePackage(t, filepath.Join(base, "http"), `[package]
+name = "http"
+version = "1.3.0"
+
+[dependencies]
+strings = { path = "../strings", version = "^0.2" }
+`)
+	writePackage(t, filepath.Join(base, "strings"), "[package]\nname = \"strings\"\nversion = \"0.2.4\"\n")
+	writePackage(t, root, "[package]\nname = \"app\"\n\n[dependencies]\nhttp = { path = \"../http\", version = \"1.2\" }\n")
+
+	cfg, err := LoadConfig(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A dry run resolves the same packages without installing any.
+	dry := NewResolver(root)
+	dry.DryRun = true
+	planned, err := dry.Resolve(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "carv_modules")); !os.IsNotExist(err) {
+		t.Errorf("dry run created carv_modules: %v", err)
+	}
+
+	lf, err := NewResolver(root).Resolve(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := planned.Diff(lf); len(diffs) != 0 {
+		t.Errorf("dry run differs: %v", diffs)
+	}
+	if len(lf.Packages) != 2 {
+		t.Fatalf("expected 2 locked packages, got %+v", lf.Packages)
+	}
+	http, strs := lf.Packages[0], lf.Packages[1]
+	if http.Name != "http" || http.Version != "1.3.0" || http.Source != "path+../http" ||
+		len(http.Dependencies) != 1 || http.Dependencies[0] != "strings" {
+		t.Errorf("http = %+v", http)
+	}
+	if strs.Name != "strings" || strs.Version != "0.2.4" || strs.Source != "path+../strings" {
+		t.Errorf("strings = %+v", strs)
+	}
+	if !strings.HasPrefix(strs.Checksum, "sha256:") {
+		t.Errorf("checksum = %q", strs.Checksum)
+	}
+	if _, err := os.Stat(filepath.Join(root, "carv_modules", "strings", "mod.carv")); err != nil {
+		t.Errorf("transitive dependency not installed: %v", err)
+	}
+
+	// A transitive package is importable without being listed by the project.
+	loader := NewLoader(root)
+	loader.SetConfig(cfg)
+	if _, err := loader.Load("strings", filepath.Join(root, "mod.carv")); err != nil {
+		t.Errorf("Load(strings): %v", err)
+	}
+
+	// Resolving again is stable, and a changed file shows up in the diff.
+	again, err := NewResolver(root).Resolve(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := lf.Diff(again); len(diffs) != 0 {
+		t.Errorf("unexpected diffs: %v", diffs)
+	}
+	if err := os.WriteFile(filepath.Join(base, "strings", "mod.carv"), []byte("pub fn hello() -> int { return 2; }\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := NewResolver(root).Resolve(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffs := lf.Diff(changed)
+	if len(diffs) != 1 || !strings.Contains(diffs[0], "strings: checksum") {
+		t.Errorf("diffs = %v, want a strings checksum change", diffs)
+	}
+
+	// The project now asks for a strings version that http's copy cannot satisfy.
+	cfg.Dependencies["strings"] = Dependency{Path: "../strings", Version: "^0.3"}
+	_, err = NewResolver(root).Resolve(cfg)
+	if err == nil || !strings.Contains(err.Error(), "strings 0.2.4 does not satisfy ^0.3 (required by the project)") {
+		t.Errorf("expected a version mismatch error, got %v", err)
+	}
+}
+
+func TestLockFileDiff(t *testing.T) {
+	locked := &LockFile{Packages: []LockedPackage{
+		{Name: "a", Version: "1.0.0", Source: "git+x", Checksum: "sha256:1"},
+		{Name: "gone", Version: "0.1.0", Source: "path+gone"},
+	}}
+	resolved := &LockFile{Packages: []LockedPackage{
+		{Name: "a", Version: "1.1.0", Source: "git+x", Checksum: "sha256:1"},
+		{Name: "new", Version: "2.0.0", Source: "path+new"},
+	}}
+	want := []string{
+		`a: version is "1.0.0" in carv.lock, resolved "1.1.0"`,
+		"new: missing from carv.lock",
+		"gone: in carv.lock but no longer required",
+	}
+	diffs := locked.Diff(resolved)
+	if strings.Join(diffs, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Diff =\n%s\nwant\n%s", strings.Join(diffs, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// gitRepo creates a repository at dir with one commit per tag, each
+// setting the package version to the tag.
+func gitRepo(t *testing.T, dir string, tags ...string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	run := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=carv", "-c", "user.email=carv@example.com"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	run("init", "--quiet")
+	for _, tag := range tags {
+		writePackage(t, dir, "[package]\nname = \"lib\"\nversion = \""+strings.TrimPrefix(tag, "v")+"\"\n")
+		run("add", "-A")
+		run("commit", "--quiet", "-m", tag)
+		run("tag", tag)
+	}
+}
+
+func TestResolveGitTags(t *testing.T) {
+	t.Setenv("CARV_CACHE", t.TempDir())
+	base := t.TempDir()
+	repo := filepath.Join(base, "lib")
+	gitRepo(t, repo, "v1.0.0", "v1.1.0", "v2.0.0")
+	url := "file://" + filepath.ToSlash(repo)
+
+	root := filepath.Join(base, "app")
+	cfg := &Config{Dependencies: map[string]Dependency{"lib": {Git: url, Version: "^1.0"}}}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := NewResolver(root).Resolve(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lf.Packages) != 1 {
+		t.Fatalf("expected 1 locked package, got %+v", lf.Packages)
+	}
+	lib := lf.Packages[0]
+	if lib.Version != "1.1.0" || lib.Source != "git+"+url || len(lib.Revision) != 40 {
+		t.Errorf("lib = %+v, want 1.1.0 at a full revision", lib)
+	}
+	installed, err := LoadConfig(filepath.Join(root, "carv_modules", "lib"))
+	if err != nil || installed == nil || installed.Package.Version != "1.1.0" {
+		t.Errorf("installed carv.toml = %+v, %v", installed, err)
+	}
+
+	cfg.Dependencies["lib"] = Dependency{Git: url, Version: ">=3"}
+	_, err = NewResolver(root).Resolve(cfg)
+	if err == nil || !strings.Contains(err.Error(), "no version of lib matches >=3 (required by the project) (available: 1.0.0, 1.1.0, 2.0.0)") {
+		t.Errorf("expected a no-match error, got %v", err)
+	}
+
+	cfg.Dependencies["lib"] = Dependency{Git: url}
+	if lf, err = NewResolver(root).Resolve(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if lf.Packages[0].Version != "2.0.0" {
+		t.Errorf("unconstrained lib = %+v, want the highest tag", lf.Packages[0])
+	}
+}
+
+// gitOutput runs git in dir and returns its trimmed output.
+func gitOutput(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).Output()
+	if err != nil {
+		t.Fatalf("git %v: %v", args, err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestResolveKeepsLockedRevisions(t *testing.T) {
+	t.Setenv("CARV_CACHE", t.TempDir())
+	base := t.TempDir()
+	repo := filepath.Join(base, "lib")
+	gitRepo(t, repo, "v1.0.0")
+	url := "file://" + filepath.ToSlash(repo)
+	v100 := gitOutput(t, repo, "rev-parse", "HEAD")
+	branch := gitOutput(t, repo, "symbolic-ref", "--short", "HEAD")
+
+	root := filepath.Join(base, "app")
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Dependencies: map[string]Dependency{"lib": {Git: url, Version: "^1"}}}
+	resolve := func(lock *LockFile, update ...string) LockedPackage {
+		t.Helper()
+		r := NewResolver(root)
+		r.Lock = lock
+		r.Update = make(map[string]bool)
+		for _, name := range update {
+			r.Update[name] = true
+		}
+		lf, err := r.Resolve(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lf.Packages[0]
+	}
+	locked := func(pkg LockedPackage) *LockFile { return &LockFile{Packages: []LockedPackage{pkg}} }
+
+	first := resolve(nil)
+	if first.Version != "1.0.0" || first.Revision != v100 {
+		t.Fatalf("first resolve = %+v", first)
+	}
+
+	gitRepo(t, repo, "v1.1.0")
+	if kept := resolve(locked(first)); kept.Version != "1.0.0" || kept.Revision != v100 {
+		t.Errorf("with the lock = %+v, want 1.0.0 kept", kept)
+	}
+	if installed, err := LoadConfig(filepath.Join(root, "carv_modules", "lib")); err != nil || installed.Package.Version != "1.0.0" {
+		t.Errorf("installed package is not the locked one: %+v, %v", installed, err)
+	}
+	updated := resolve(locked(first), "lib")
+	if updated.Version != "1.1.0" || updated.Revision == v100 {
+		t.Errorf("updated = %+v, want 1.1.0", updated)
+	}
+
+	// A requirement the locked version no longer meets is resolved afresh.
+	cfg.Dependencies["lib"] = Dependency{Git: url, Version: ">=1.1"}
+	if moved := resolve(locked(first)); moved.Version != "1.1.0" {
+		t.Errorf("after raising the requirement = %+v, want 1.1.0", moved)
+	}
+
+	// A tag is checked out as a tag, and a rev may be abbreviated.
+	cfg.Dependencies["lib"] = Dependency{Git: url, Tag: "v1.0.0"}
+	if tagged := resolve(nil); tagged.Revision != v100 || tagged.Source != "git+"+url+"?tag=v1.0.0" {
+		t.Errorf("tagged = %+v", tagged)
+	}
+	cfg.Dependencies["lib"] = Dependency{Git: url, Rev: v100[:10]}
+	if pinned := resolve(nil); pinned.Revision != v100 || pinned.Version != "1.0.0" || pinned.Source != "git+"+url+"?rev="+v100[:10] {
+		t.Errorf("pinned = %+v", pinned)
+	}
+
+	// A branch stays at its locked commit until updated.
+	cfg.Dependencies["lib"] = Dependency{Git: url, Branch: branch}
+	onBranch := resolve(nil)
+	gitRepo(t, repo, "v1.2.0")
+	if kept := resolve(locked(onBranch)); kept.Revision != onBranch.Revision {
+		t.Errorf("branch moved with the lock: %+v", kept)
+	}
+	if moved := resolve(locked(onBranch), "lib"); moved.Version != "1.2.0" {
+		t.Errorf("updated branch = %+v, want 1.2.0", moved)
+	}
+}
+
+func TestPackageCacheAndVendor(t *testing.T) {
+	cacheDir := t.TempDir()
+	t.Setenv("CARV_CACHE", cacheDir)
+	base := t.TempDir()
+	repo := filepath.Join(base, "lib")
+	gitRepo(t, repo, "v1.0.0")
+	url := "file://" + filepath.ToSlash(repo)
+
+	root := filepath.Join(base, "app")
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Dependencies: map[string]Dependency{"lib": {Git: url, Version: "^1"}}}
+	lf, err := NewResolver(root).Resolve(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveLock(root, lf); err != nil {
+		t.Fatal(err)
+	}
+	cached := DefaultCache().PackageDir(lf.Packages[0].Checksum)
+	if cached == "" || !strings.HasPrefix(cached, cacheDir) {
+		t.Fatalf("package not cached under %s: %q", cacheDir, cached)
+	}
+	// carv_modules links to the cached tree, which is read-only.
+	if info, err := os.Stat(filepath.Join(cached, "mod.carv")); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm()&0o222 != 0 {
+		t.Errorf("cached file mode = %v, want read-only", info.Mode())
+	}
+
+	// With the repository gone, a locked install works offline from the cache.
+	if err := os.RemoveAll(repo); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "carv_modules")); err != nil {
+		t.Fatal(err)
+	}
+	r := NewResolver(root)
+	r.Lock, r.Offline = lf, true
+	again, err := r.Resolve(cfg)
+	if err != nil {
+		t.Fatalf("offline install: %v", err)
+	}
+	if diffs := lf.Diff(again); len(diffs) != 0 {
+		t.Errorf("offline install differs from the lock: %v", diffs)
+	}
+	r = NewResolver(root)
+	r.Offline = true
+	if _, err := r.Resolve(cfg); err == nil || !strings.Contains(err.Error(), "--offline") {
+		t.Errorf("expected an offline error without a lock, got %v", err)
+	}
+
+	// The loader falls back to the cache when carv_modules is missing.
+	if err := os.RemoveAll(filepath.Join(root, "carv_modules")); err != nil {
+		t.Fatal(err)
+	}
+	loader := NewLoader(root)
+	loader.SetConfig(cfg)
+	mod, err := loader.Load("lib", filepath.Join(root, "main.carv"))
+	if err != nil || !strings.HasPrefix(mod.Path, cached) {
+		t.Errorf("Load(lib) = %v, %v; want the cached copy", mod, err)
+	} else if mod.Name() != "lib/mod" {
+		t.Errorf("cached module name = %q, want lib/mod", mod.Name())
+	}
+
+	// Vendored packages need neither carv_modules nor the cache.
+	if err := Vendor(root, lf, DefaultCache()); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(root, "vendor")); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0o755 {
+		t.Errorf("vendor mode = %v, want 0755", info.Mode())
+	}
+	if err := os.RemoveAll(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	loader = NewLoader(root)
+	loader.SetConfig(cfg)
+	mod, err = loader.Load("lib", filepath.Join(root, "main.carv"))
+	if err != nil || mod.Path != filepath.Join(root, "vendor", "lib", "mod.carv") {
+		t.Errorf("Load(lib) = %v, %v; want the vendored copy", mod, err)
+	}
+
+	// A copy that no longer matches carv.lock is not vendored.
+	modDir := filepath.Join(root, "carv_modules", "lib")
+	if err := copyTree(filepath.Join(root, "vendor", "lib"), modDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(modDir, "extra.carv"), []byte("\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Vendor(root, lf, DefaultCache()); err == nil || !strings.Contains(err.Error(), "lib does not match carv.lock") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+}
+
+func TestResolveDevDependencies(t *testing.T) {
+	t.Setenv("CARV_CACHE", t.TempDir())
+	base := t.TempDir()
+	root := filepath.Join(base, "app")
+	writePackage(t, filepath.Join(base, "fmt"), "[package]\nname = \"fmt\"\nversion = \"1.0.0\"\n")
+	writePackage(t, filepath.Join(base, "check"), "[package]\nname = \"check\"\nversion = \"0.3.0\"\n\n[dependencies]\nfmt = { path = \"../fmt\" }\ndiff = { path = \"../diff\" }\n")
+	writePackage(t, filepath.Join(base, "diff"), "[package]\nname = \"diff\"\nversion = \"0.1.0\"\n")
+	writePackage(t, root, `[package]
+name = "app"
+
+[dependencies]
+fmt = { path = "../fmt" }
+
+[dev-dependencies]
+check = { path = "../check" }
+`)
+	cfg, err := LoadConfig(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lf, err := NewResolver(root).Resolve(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lf.Packages) != 1 || lf.Packages[0].Name != "fmt" {
+		t.Fatalf("without dev = %+v, want only fmt", lf.Packages)
+	}
+	if _, err := os.Stat(filepath.Join(root, "carv_modules", "check")); err == nil {
+		t.Error("dev-dependency installed without Dev")
+	}
+
+	r := NewResolver(root)
+	r.Dev = true
+	dev, err := r.Resolve(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, pkg := range dev.Packages {
+		got = append(got, fmt.Sprintf("%s:%t", pkg.Name, pkg.Dev))
+	}
+	if strings.Join(got, " ") != "check:true diff:true fmt:false" {
+		t.Errorf("with dev = %v", got)
+	}
+
+	// A plain install keeps the dev entries it did not resolve.
+	r = NewResolver(root)
+	r.Lock = dev
+	plain, err := r.Resolve(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := dev.Diff(plain); len(diffs) != 0 {
+		t.Errorf("plain install changed the lock: %v", diffs)
+	}
+}
+
+func TestScriptEnv(t *testing.T) {
+	target, err := ResolveTarget("cortex-m4f", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := ScriptEnv{
+		Root:   "/work/app",
+		Config: &Config{Package: PackageInfo{Name: "app", Version: "0.2.0"}},
+		Build:  BuildConfig{Optimize: true, Memory: "static"},
+		Target: target,
+		CFile:  "/work/app/build/main.c",
+		Binary: "/work/app/build/main.elf",
+	}
+	vars := make(map[string]string)
+	for _, kv := range env.Environ([]string{"PATH=/bin", "CARV_TARGET=stale"}) {
+		name, value, _ := strings.Cut(kv, "=")
+		if _, dup := vars[name]; dup {
+			t.Errorf("%s set twice", name)
+		}
+		vars[name] = value
+	}
+	want := map[string]string{
+		"PATH":            "/bin",
+		"CARV_TARGET":     "cortex-m4f",
+		"CARV_ARCH":       "arm",
+		"CARV_CPU":        "cortex-m4",
+		"CARV_OBJCOPY":    "arm-none-eabi-objcopy",
+		"CARV_BINARY":     "/work/app/build/main.elf",
+		"CARV_OUTPUT_DIR": "/work/app/build",
+		"CARV_OPTIMIZE":   "1",
+		"CARV_DEBUG":      "0",
+		"CARV_MEMORY":     "static",
+		"CARV_PACKAGE":    "app",
+		"CARV_VERSION":    "0.2.0",
+	}
+	for name, value := range want {
+		if vars[name] != value {
+			t.Errorf("%s = %q, want %q", name, vars[name], value)
+		}
+	}
+}
+
+func TestScriptCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	dir := t.TempDir()
+	cmd := ScriptCommand(`printf '%s|' "$CARV_PACKAGE" "$PWD"`, []string{"a b", "it's"}, dir)
+	cmd.Env = ScriptEnv{Root: dir, Config: &Config{Package: PackageInfo{Name: "app"}}, Target: &Target{Name: "host"}}.Environ(nil)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "app|" + dir + "|a b|it's|"; string(out) != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestLoadWorkspace(t *testing.T) {
+	root := t.TempDir()
+	writePackage(t, root, "[workspace]\nmembers = [\"apps/*\", \"libs/hal\"]\n")
+	writePackage(t, filepath.Join(root, "apps", "blink"), "[package]\nname = \"blink\"\nentry = \"src/main.carv\"\n")
+	writePackage(t, filepath.Join(root, "apps", "uart"), "[package]\nname = \"uart\"\n")
+	writePackage(t, filepath.Join(root, "libs", "hal"), "[package]\nname = \"hal\"\n")
+	// Directories a glob matches that hold no package are skipped.
+	if err := os.MkdirAll(filepath.Join(root, "apps", "notes"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	ws, err := LoadWorkspace(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, m := range ws.Members {
+		names = append(names, m.Name)
+	}
+	if strings.Join(names, ",") != "blink,uart,hal" {
+		t.Errorf("members = %v", names)
+	}
+	if m := ws.Member("hal"); m == nil || m.Dir != filepath.Join(root, "libs", "hal") {
+		t.Errorf("Member(hal) = %+v", m)
+	}
+
+	// Inside a member, the workspace is found from any subdirectory.
+	sub := filepath.Join(root, "apps", "blink", "src")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	found, err := FindWorkspace(sub)
+	if err != nil || found == nil || found.Root != root {
+		t.Errorf("FindWorkspace(member) = %+v, %v", found, err)
+	}
+	found, err = FindWorkspace(filepath.Join(root, "apps", "notes"))
+	if err != nil || found != nil {
+		t.Errorf("FindWorkspace(non-member) = %+v, %v", found, err)
+	}
+
+	writePackage(t, root, "[workspace]\nmembers = [\"libs/missing\"]\n")
+	if _, err := LoadWorkspace(root); err == nil || !strings.Contains(err.Error(), "matches no directory") {
+		t.Errorf("expected a missing member error, got %v", err)
+	}
+	writePackage(t, root, "[workspace]\nmembers = [\"../elsewhere\"]\n")
+	if _, err := LoadWorkspace(root); err == nil || !strings.Contains(err.Error(), "inside the workspace") {
+		t.Errorf("expected an outside member error, got %v", err)
+	}
+}
+
+func TestResolveWorkspace(t *testing.T) {
+	t.Setenv("CARV_CACHE", t.TempDir())
+	base := t.TempDir()
+	root := filepath.Join(base, "ws")
+	writePackage(t, root, "[workspace]\nmembers = [\"app\", \"hal\"]\n")
+	writePackage(t, filepath.Join(root, "app"), `[package]
+name = "app"
+
+[dependencies]
+hal = { version = "^0.2" }
+fmt = { path = "../../fmt" }
+`)
+	writePackage(t, filepath.Join(root, "hal"), "[package]\nname = \"hal\"\nversion = \"0.2.1\"\n")
+	writePackage(t, filepath.Join(base, "fmt"), "[package]\nname = \"fmt\"\nversion = \"1.0.0\"\n")
+
+	ws, err := LoadWorkspace(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf, err := NewResolver(root).ResolveWorkspace(ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lf.Packages) != 2 {
+		t.Fatalf("expected 2 locked packages, got %+v", lf.Packages)
+	}
+	if p := lf.Find("hal"); p == nil || p.Source != "path+hal" || p.Version != "0.2.1" || p.Checksum != "" {
+		t.Errorf("hal = %+v", p)
+	}
+	if p := lf.Find("fmt"); p == nil || p.Source != "path+../fmt" || p.Checksum == "" {
+		t.Errorf("fmt = %+v", p)
+	}
+	if _, err := os.Stat(filepath.Join(root, "carv_modules", "hal", "mod.carv")); err != nil {
+		t.Errorf("hal not installed at the workspace root: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "app", "carv_modules")); err == nil {
+		t.Error("member got its own carv_modules")
+	}
+
+	// A member imports its sibling from the shared carv_modules.
+	app := ws.Member("app")
+	loader := NewLoader(app.Dir)
+	loader.SetConfig(app.Config)
+	mod, err := loader.Load("hal", filepath.Join(app.Dir, "mod.carv"))
+	if err != nil {
+		t.Fatalf("Load(hal): %v", err)
+	}
+	if !mod.Exports["hello"] {
+		t.Errorf("hal exports = %v", mod.Exports)
+	}
+	// Modules are named within their package, not by where it is.
+	if err := os.WriteFile(filepath.Join(root, "hal", "gpio.carv"), []byte("pub fn pin() {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	gpio, err := loader.Load("./gpio", mod.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := loader.LoadFile(filepath.Join(app.Dir, "mod.carv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mod.Name() != "hal/mod" || gpio.Name() != "hal/gpio" || entry.Name() != "mod" {
+		t.Errorf("names = %q, %q, %q; want hal/mod, hal/gpio, mod", mod.Name(), gpio.Name(), entry.Name())
+	}
+
+	// Editing a member leaves the lock up to date; editing an outside
+	// path dependency does not.
+	if err := os.WriteFile(filepath.Join(root, "hal", "extra.carv"), []byte("pub fn more() {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r := NewResolver(root)
+	r.DryRun = true
+	again, err := r.ResolveWorkspace(ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := lf.Diff(again); len(diffs) != 0 {
+		t.Errorf("editing a member changed the lock: %v", diffs)
+	}
+	if err := os.WriteFile(filepath.Join(base, "fmt", "extra.carv"), []byte("pub fn more() {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	again, err = r.ResolveWorkspace(ws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffs := lf.Diff(again); len(diffs) != 1 || !strings.HasPrefix(diffs[0], "fmt: checksum") {
+		t.Errorf("diffs = %v, want fmt's checksum", diffs)
+	}
+
+	// A member's requirement still constrains its sibling's version.
+	writePackage(t, filepath.Join(root, "hal"), "[package]\nname = \"hal\"\nversion = \"0.3.0\"\n")
+	if _, err := NewResolver(root).ResolveWorkspace(ws); err == nil || !strings.Contains(err.Error(), "required by app") {
+		t.Errorf("expected a version error, got %v", err)
+	}
+}
@@ -0,0 +1,640 @@
+package module
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxResolveRounds bounds how often the dependency graph is re-resolved
+// after a newly installed package adds requirements of its own.
+const maxResolveRounds = 16
+
+// Resolver installs a project's dependencies into carv_modules, following
+// the [dependencies] of each installed package's own carv.toml, and
+// describes the result as a lock file.
+type Resolver struct {
+	Root    string          // project directory
+	Log     io.Writer       // progress messages
+	Lock    *LockFile       // previous carv.lock, whose revisions are kept
+	Update  map[string]bool // packages to resolve afresh despite Lock
+	Cache   *Cache          // where fetched git packages are kept
+	Offline bool            // use only the cache; never contact a remote
+	Dev     bool            // include the project's [dev-dependencies]
+	DryRun  bool            // resolve without linking anything into carv_modules
+
+	remotes map[string]map[string]string // ls-remote results by URL
+	members map[string]string            // workspace member directories by name
+}
+
+// rootConfig is a carv.toml whose own dependencies are installed: the
+// project's, or one of a workspace's.
+type rootConfig struct {
+	name string // "" for the project itself, else the workspace member
+	dir  string
+	cfg  *Config
+}
+
+// NewResolver returns a resolver for the project at root that uses the
+// default cache and reports nothing.
+func NewResolver(root string) *Resolver {
+	return &Resolver{
+		Root:    root,
+		Log:     io.Discard,
+		Cache:   DefaultCache(),
+		remotes: make(map[string]map[string]string),
+	}
+}
+
+// requirement is one package's demand on a dependency.
+type requirement struct {
+	from string // requiring package, or "" for the project itself
+	dep  Dependency
+	dir  string // directory a relative path is resolved from
+}
+
+func (q requirement) requirer() string {
+	if q.from == "" {
+		return "the project"
+	}
+	return q.from
+}
+
+// resolvedPackage is the version of a dependency chosen for the build.
+type resolvedPackage struct {
+	name     string
+	git      string // repository URL, for git packages
+	path     string // absolute directory, for path packages
+	refKind  string // "branch", "tag" or "rev" when one was requested
+	ref      string // the requested branch, tag or commit
+	revision string
+	version  string
+	config   *Config // the package's own carv.toml, if it has one
+	src      string  // where its files are: its path, or its cached tree
+}
+
+// same reports whether o, freshly chosen, is what p already installed. o
+// may name its revision by an abbreviated hash.
+func (p *resolvedPackage) same(o *resolvedPackage) bool {
+	return p.git == o.git && p.path == o.path && p.refKind == o.refKind && p.ref == o.ref &&
+		strings.HasPrefix(p.revision, o.revision)
+}
+
+// dir is where the package's files live once installed.
+func (p *resolvedPackage) dir(modsDir string) string {
+	if p.path != "" {
+		return p.path
+	}
+	return filepath.Join(modsDir, p.name)
+}
+
+// Resolve chooses a version of every direct and transitive dependency of
+// cfg, installs each into carv_modules and returns the matching lock file.
+// A git dependency locked to a revision stays there as long as its source
+// and requirements allow; otherwise one without a branch, tag or rev gets
+// its highest semver tag that satisfies every requirement on it.
+func (r *Resolver) Resolve(cfg *Config) (*LockFile, error) {
+	return r.resolve([]rootConfig{{dir: r.Root, cfg: cfg}})
+}
+
+// ResolveWorkspace resolves the dependencies of the workspace root and of
+// every member together, into the carv_modules and lock file of ws.Root,
+// which should be r.Root. A dependency with no git or path source that
+// names a member is that member's directory.
+func (r *Resolver) ResolveWorkspace(ws *Workspace) (*LockFile, error) {
+	r.members = ws.memberDirs()
+	roots := []rootConfig{{dir: ws.Root, cfg: ws.Config}}
+	for _, m := range ws.Members {
+		if m.Dir != ws.Root {
+			roots = append(roots, rootConfig{name: m.Name, dir: m.Dir, cfg: m.Config})
+		}
+	}
+	return r.resolve(roots)
+}
+
+func (r *Resolver) resolve(roots []rootConfig) (*LockFile, error) {
+	modsDir := filepath.Join(r.Root, "carv_modules")
+
+	picks := make(map[string]*resolvedPackage)
+	for round := 0; round < maxResolveRounds; round++ {
+		reqs := r.requirements(roots, picks, modsDir)
+		changed := false
+
+		for _, name := range sortedNames(reqs) {
+			p, err := r.choose(name, reqs[name])
+			if err != nil {
+				return nil, err
+			}
+			if prev := picks[name]; prev == nil || !prev.same(p) {
+				if err := r.locate(p, modsDir); err != nil {
+					return nil, fmt.Errorf("installing %s: %w", name, err)
+				}
+				picks[name] = p
+				changed = true
+			}
+			if err := checkVersion(picks[name], reqs[name]); err != nil {
+				return nil, err
+			}
+		}
+		for name := range picks {
+			if _, ok := reqs[name]; !ok {
+				delete(picks, name)
+				changed = true
+			}
+		}
+
+		if !changed {
+			if !r.DryRun {
+				if err := r.install(picks, modsDir); err != nil {
+					return nil, err
+				}
+			}
+			return r.lock(roots, picks)
+		}
+	}
+	return nil, fmt.Errorf("dependency resolution did not settle after %d rounds", maxResolveRounds)
+}
+
+// requirements gathers what the roots and every chosen package ask for,
+// by dependency name.
+func (r *Resolver) requirements(roots []rootConfig, picks map[string]*resolvedPackage, modsDir string) map[string][]requirement {
+	reqs := make(map[string][]requirement)
+	for _, root := range roots {
+		for name, dep := range root.cfg.Dependencies {
+			reqs[name] = append(reqs[name], requirement{from: root.name, dep: dep, dir: root.dir})
+		}
+		if r.Dev {
+			for name, dep := range root.cfg.DevDeps {
+				reqs[name] = append(reqs[name], requirement{from: root.name, dep: dep, dir: root.dir})
+			}
+		}
+	}
+	for _, pick := range sortedNames(picks) {
+		p := picks[pick]
+		if p.config == nil {
+			continue
+		}
+		for name, dep := range p.config.Dependencies {
+			reqs[name] = append(reqs[name], requirement{from: p.name, dep: dep, dir: p.dir(modsDir)})
+		}
+	}
+	return reqs
+}
+
+// choose settles where a dependency comes from and which revision to use.
+func (r *Resolver) choose(name string, reqs []requirement) (*resolvedPackage, error) {
+	p := &resolvedPackage{name: name}
+	var source requirement
+	found := false
+	for _, q := range reqs {
+		git, path := q.dep.Git, ""
+		if git == "" && q.dep.Path != "" {
+			path = q.dep.Path
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(q.dir, path)
+			}
+			path = filepath.Clean(path)
+		}
+		if git == "" && path == "" {
+			if path = r.members[name]; path == "" {
+				continue
+			}
+		}
+		kind, ref := gitRef(q.dep)
+
+		if !found {
+			found, source = true, q
+			p.git, p.path, p.refKind, p.ref = git, path, kind, ref
+			continue
+		}
+		if git != p.git || path != p.path {
+			return nil, fmt.Errorf("conflicting sources for %s: %s uses %s, %s uses %s",
+				name, source.requirer(), sourceOf(p.git, p.path), q.requirer(), sourceOf(git, path))
+		}
+		if ref != "" && p.ref != "" && (kind != p.refKind || ref != p.ref) {
+			return nil, fmt.Errorf("conflicting refs for %s: %s wants %s %s, %s wants %s %s",
+				name, source.requirer(), p.refKind, p.ref, q.requirer(), kind, ref)
+		}
+		if p.ref == "" && ref != "" {
+			source, p.refKind, p.ref = q, kind, ref
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s has no git or path source (required by %s)", name, requirers(reqs))
+	}
+	if p.path != "" {
+		return p, nil
+	}
+
+	if locked := r.locked(name, r.source(p)); locked != nil && lockSatisfies(p, locked, reqs) {
+		p.revision, p.version = locked.Revision, locked.Version
+		return p, nil
+	}
+	if p.refKind == "rev" {
+		p.revision = p.ref
+		return p, nil
+	}
+
+	refs, err := r.remoteRefs(p.git)
+	if err != nil {
+		return nil, err
+	}
+	switch p.refKind {
+	case "branch":
+		p.revision = refs["refs/heads/"+p.ref]
+		if p.revision == "" {
+			return nil, fmt.Errorf("%s: branch %q not found in %s", name, p.ref, p.git)
+		}
+	case "tag":
+		p.revision = refs["refs/tags/"+p.ref]
+		if p.revision == "" {
+			return nil, fmt.Errorf("%s: tag %q not found in %s", name, p.ref, p.git)
+		}
+		if v, err := ParseVersion(p.ref); err == nil {
+			p.version = v.String()
+		}
+	default:
+		return p, r.chooseTag(p, refs, reqs)
+	}
+	return p, nil
+}
+
+// chooseTag picks the highest semver tag that satisfies every requirement,
+// or the default branch when the repository has no version tags.
+func (r *Resolver) chooseTag(p *resolvedPackage, refs map[string]string, reqs []requirement) error {
+	constraints, err := parseConstraints(p.name, reqs)
+	if err != nil {
+		return err
+	}
+
+	var best *Version
+	var bestTag string
+	var available []Version
+	for ref := range refs {
+		tag, ok := strings.CutPrefix(ref, "refs/tags/")
+		if !ok {
+			continue
+		}
+		v, err := ParseVersion(tag)
+		if err != nil {
+			continue
+		}
+		available = append(available, v)
+		if v.Pre != "" && len(constraints) == 0 {
+			continue
+		}
+		if !matchesAll(constraints, v) {
+			continue
+		}
+		if best == nil || v.Compare(*best) > 0 || (v.Compare(*best) == 0 && tag < bestTag) {
+			best, bestTag = &v, tag
+		}
+	}
+
+	if best != nil {
+		p.version, p.revision = best.String(), refs["refs/tags/"+bestTag]
+		return nil
+	}
+	if len(available) > 0 && len(constraints) > 0 {
+		sort.Slice(available, func(i, j int) bool { return available[i].Compare(available[j]) < 0 })
+		var names []string
+		for _, v := range available {
+			names = append(names, v.String())
+		}
+		return fmt.Errorf("no version of %s matches %s (available: %s)",
+			p.name, describeConstraints(reqs), strings.Join(names, ", "))
+	}
+	p.revision = refs["HEAD"]
+	if p.revision == "" {
+		return fmt.Errorf("%s: %s has no commits", p.name, p.git)
+	}
+	return nil
+}
+
+// gitRef returns the kind and name of the branch, tag or commit a git
+// dependency asks for. A rev takes precedence over a branch, and a branch
+// over a tag.
+func gitRef(dep Dependency) (kind, ref string) {
+	switch {
+	case dep.Rev != "":
+		return "rev", dep.Rev
+	case dep.Branch != "":
+		return "branch", dep.Branch
+	case dep.Tag != "":
+		return "tag", dep.Tag
+	}
+	return "", ""
+}
+
+// locked returns the carv.lock entry for a package, unless it is being
+// updated or its source has changed since.
+func (r *Resolver) locked(name, source string) *LockedPackage {
+	if r.Lock == nil || r.Update[name] {
+		return nil
+	}
+	lp := r.Lock.Find(name)
+	if lp == nil || lp.Source != source || lp.Revision == "" {
+		return nil
+	}
+	return lp
+}
+
+// lockSatisfies reports whether a locked revision can be kept. One chosen
+// by version must still satisfy every requirement; a requested branch,
+// tag or rev is part of the source and so already matches.
+func lockSatisfies(p *resolvedPackage, locked *LockedPackage, reqs []requirement) bool {
+	if p.refKind != "" {
+		return true
+	}
+	constraints, err := parseConstraints(p.name, reqs)
+	if err != nil || len(constraints) == 0 {
+		return err == nil
+	}
+	v, err := ParseVersion(locked.Version)
+	return err == nil && matchesAll(constraints, v)
+}
+
+func (r *Resolver) remoteRefs(url string) (map[string]string, error) {
+	if refs, ok := r.remotes[url]; ok {
+		return refs, nil
+	}
+	if r.Offline {
+		return nil, fmt.Errorf("%s must be contacted to choose a version, and fetching is disabled (--offline); run carv install online first to lock it", url)
+	}
+	refs, err := remoteRefs(url)
+	if err != nil {
+		return nil, err
+	}
+	r.remotes[url] = refs
+	return refs, nil
+}
+
+// locate finds the package's files, fetching them into the cache if they
+// are not there, and reads its carv.toml. Nothing is placed in carv_modules
+// yet, though a checkout there already at the chosen revision is used.
+func (r *Resolver) locate(p *resolvedPackage, modsDir string) error {
+	dest := filepath.Join(modsDir, p.name)
+
+	if p.path != "" {
+		p.src = p.path
+	} else if full := gitRevision(dest); full != "" && strings.HasPrefix(full, p.revision) {
+		// A checkout made before packages were cached.
+		p.revision, p.src = full, dest
+	} else {
+		dir, full := r.Cache.Revision(p.revision)
+		if dir == "" {
+			var err error
+			if dir, full, err = r.fetch(p); err != nil {
+				return err
+			}
+		}
+		// A rev may be abbreviated; the lock records the full hash.
+		p.revision, p.src = full, dir
+	}
+
+	cfg, err := LoadConfig(p.src)
+	if err != nil {
+		return fmt.Errorf("reading its carv.toml: %w", err)
+	}
+	p.config = cfg
+	if p.version == "" && cfg != nil {
+		p.version = cfg.Package.Version
+	}
+	return nil
+}
+
+// fetch checks out a git package's revision into the cache and returns the
+// cached tree and the full commit hash.
+func (r *Resolver) fetch(p *resolvedPackage) (dir, rev string, err error) {
+	if r.Offline {
+		return "", "", fmt.Errorf("%s at %s is not in the package cache, and fetching is disabled (--offline)", p.git, p.revision)
+	}
+	tmp, err := r.Cache.TempDir()
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	fmt.Fprintf(r.Log, "  Fetching %s%s from %s...\n", p.name, versionSuffix(p.version), p.git)
+	if err := gitCheckout(p.git, p.revision, tmp, r.Log); err != nil {
+		return "", "", err
+	}
+	rev = gitRevision(tmp)
+	if err := os.RemoveAll(filepath.Join(tmp, ".git")); err != nil {
+		return "", "", err
+	}
+	dir, err = r.Cache.Store(tmp, rev)
+	return dir, rev, err
+}
+
+// install places the chosen packages in carv_modules. A checkout already
+// at the chosen revision, or a link already pointing at the chosen
+// directory, is left alone.
+func (r *Resolver) install(picks map[string]*resolvedPackage, modsDir string) error {
+	if err := os.MkdirAll(modsDir, 0o755); err != nil {
+		return err
+	}
+	for _, name := range sortedNames(picks) {
+		p := picks[name]
+		dest := filepath.Join(modsDir, name)
+		if p.src == dest {
+			continue
+		}
+		if err := r.link(name, p.src, dest); err != nil {
+			return fmt.Errorf("installing %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// link points carv_modules/<name> at dir, copying it where symlinks are
+// not available.
+func (r *Resolver) link(name, dir, dest string) error {
+	if target, err := os.Readlink(dest); err == nil && target == dir {
+		return nil
+	}
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	fmt.Fprintf(r.Log, "  Linking %s from %s...\n", name, dir)
+	if err := os.Symlink(dir, dest); err != nil {
+		fmt.Fprintf(r.Log, "  Symlink failed, copying instead...\n")
+		return copyDir(dir, dest)
+	}
+	return nil
+}
+
+// checkVersion reports a requirement the chosen package does not satisfy.
+func checkVersion(p *resolvedPackage, reqs []requirement) error {
+	for _, q := range reqs {
+		if q.dep.Version == "" {
+			continue
+		}
+		c, err := ParseConstraint(q.dep.Version)
+		if err != nil {
+			return fmt.Errorf("%s (required by %s): %w", p.name, q.requirer(), err)
+		}
+		if p.version == "" {
+			return fmt.Errorf("%s has no version to check against %s (required by %s)", p.name, c, q.requirer())
+		}
+		v, err := ParseVersion(p.version)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.name, err)
+		}
+		if !c.Matches(v) {
+			return fmt.Errorf("%s %s does not satisfy %s (required by %s)", p.name, v, c, q.requirer())
+		}
+	}
+	return nil
+}
+
+// lock describes the installed packages, sorted by name. Packages only
+// [dev-dependencies] need are marked as such. Without Dev, the dev entries
+// of the previous lock are kept, since they were not resolved again.
+func (r *Resolver) lock(roots []rootConfig, picks map[string]*resolvedPackage) (*LockFile, error) {
+	// Everything reachable from [dependencies] is needed to build.
+	needed := make(map[string]bool)
+	var queue []string
+	hasDev := false
+	for _, root := range roots {
+		queue = append(queue, sortedNames(root.cfg.Dependencies)...)
+		hasDev = hasDev || len(root.cfg.DevDeps) > 0
+	}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if needed[name] {
+			continue
+		}
+		needed[name] = true
+		if p := picks[name]; p != nil && p.config != nil {
+			queue = append(queue, sortedNames(p.config.Dependencies)...)
+		}
+	}
+
+	lf := &LockFile{}
+	for _, name := range sortedNames(picks) {
+		p := picks[name]
+		lp := LockedPackage{
+			Name:     name,
+			Version:  p.version,
+			Revision: p.revision,
+			Dev:      !needed[name],
+		}
+		// A workspace member is part of the project, edited along with it,
+		// so --locked does not hold it to a checksum.
+		if p.path == "" || r.members[name] != p.path {
+			sum, err := HashDir(p.src)
+			if err != nil {
+				return nil, fmt.Errorf("hashing %s: %w", name, err)
+			}
+			lp.Checksum = sum
+		}
+		lp.Source = r.source(p)
+		if p.config != nil {
+			lp.Dependencies = sortedNames(p.config.Dependencies)
+		}
+		lf.Packages = append(lf.Packages, lp)
+	}
+
+	if !r.Dev && r.Lock != nil && hasDev {
+		for _, lp := range r.Lock.Packages {
+			if lp.Dev && picks[lp.Name] == nil {
+				lf.Packages = append(lf.Packages, lp)
+			}
+		}
+		sort.Slice(lf.Packages, func(i, j int) bool { return lf.Packages[i].Name < lf.Packages[j].Name })
+	}
+	return lf, nil
+}
+
+// source describes where a package comes from in carv.lock: its path, or
+// its repository with any requested branch, tag or rev, for example
+// "git+https://example.com/lib?tag=v1.2.0".
+func (r *Resolver) source(p *resolvedPackage) string {
+	if p.path != "" {
+		return "path+" + r.relPath(p.path)
+	}
+	if p.refKind != "" {
+		return "git+" + p.git + "?" + p.refKind + "=" + p.ref
+	}
+	return "git+" + p.git
+}
+
+// relPath shows a path dependency relative to the project when it can, so
+// the lock file does not depend on where the project is checked out.
+func (r *Resolver) relPath(path string) string {
+	rel, err := filepath.Rel(r.Root, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+func parseConstraints(name string, reqs []requirement) ([]Constraint, error) {
+	var cs []Constraint
+	for _, q := range reqs {
+		if q.dep.Version == "" {
+			continue
+		}
+		c, err := ParseConstraint(q.dep.Version)
+		if err != nil {
+			return nil, fmt.Errorf("%s (required by %s): %w", name, q.requirer(), err)
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+func matchesAll(cs []Constraint, v Version) bool {
+	for _, c := range cs {
+		if !c.Matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func describeConstraints(reqs []requirement) string {
+	var parts []string
+	for _, q := range reqs {
+		if q.dep.Version != "" {
+			parts = append(parts, fmt.Sprintf("%s (required by %s)", q.dep.Version, q.requirer()))
+		}
+	}
+	return strings.Join(parts, " and ")
+}
+
+func requirers(reqs []requirement) string {
+	var names []string
+	for _, q := range reqs {
+		names = append(names, q.requirer())
+	}
+	return strings.Join(names, ", ")
+}
+
+func sourceOf(git, path string) string {
+	if git != "" {
+		return git
+	}
+	return path
+}
+
+func versionSuffix(version string) string {
+	if version == "" {
+		return ""
+	}
+	return " " + version
+}
+
+func sortedNames[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,116 @@
+package module
+
+import (
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Hooks are [scripts] entries carv build runs on its own: prebuild before
+// the source is compiled, so it can generate code, and postbuild after the
+// binary is linked, for steps such as objcopy to .bin or .hex.
+const (
+	PreBuildScript  = "prebuild"
+	PostBuildScript = "postbuild"
+)
+
+// ScriptEnv describes a project and its build to [scripts] entries through
+// CARV_* environment variables.
+type ScriptEnv struct {
+	Root   string // project directory
+	Config *Config
+	Build  BuildConfig
+	Target *Target
+	Source string // the .carv file being built
+	CFile  string // the generated C file
+	Binary string // the linked output
+}
+
+// Environ returns base with the CARV_* variables added.
+func (e ScriptEnv) Environ(base []string) []string {
+	arch := e.Target.Arch
+	if arch == "" {
+		arch = "host"
+	}
+	memory := "heap"
+	if static, _ := e.Build.StaticMemory(); static {
+		memory = "static"
+	}
+	vars := map[string]string{
+		"CARV_ROOT":       e.Root,
+		"CARV_TARGET":     e.Target.Name,
+		"CARV_ARCH":       arch,
+		"CARV_CPU":        e.Target.CPU,
+		"CARV_FPU":        e.Target.FPU,
+		"CARV_FLOAT_ABI":  e.Target.FloatABI,
+		"CARV_CC":         e.Target.Compiler,
+		"CARV_OBJCOPY":    objcopyFor(e.Target.Compiler),
+		"CARV_SOURCE":     e.Source,
+		"CARV_C_FILE":     e.CFile,
+		"CARV_BINARY":     e.Binary,
+		"CARV_OUTPUT_DIR": filepath.Dir(e.Binary),
+		"CARV_OPTIMIZE":   boolVar(e.Build.Optimize),
+		"CARV_DEBUG":      boolVar(e.Build.Debug),
+		"CARV_MEMORY":     memory,
+	}
+	if e.Config != nil {
+		vars["CARV_PACKAGE"] = e.Config.Package.Name
+		vars["CARV_VERSION"] = e.Config.Package.Version
+	}
+
+	env := make([]string, 0, len(base)+len(vars))
+	for _, kv := range base {
+		name, _, _ := strings.Cut(kv, "=")
+		if _, set := vars[name]; !set {
+			env = append(env, kv)
+		}
+	}
+	for _, name := range sortedNames(vars) {
+		env = append(env, name+"="+vars[name])
+	}
+	return env
+}
+
+// ScriptCommand returns the command that runs a [scripts] entry through
+// the shell in root, with args appended to it.
+func ScriptCommand(script string, args []string, root string) *exec.Cmd {
+	line := script
+	for _, arg := range args {
+		line += " " + shellQuote(arg)
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", line)
+	} else {
+		cmd = exec.Command("sh", "-c", line)
+	}
+	cmd.Dir = root
+	return cmd
+}
+
+// objcopyFor names the objcopy of the toolchain a compiler belongs to,
+// such as arm-none-eabi-objcopy for arm-none-eabi-gcc.
+func objcopyFor(compiler string) string {
+	if prefix, ok := strings.CutSuffix(compiler, "gcc"); ok {
+		return prefix + "objcopy"
+	}
+	return "objcopy"
+}
+
+func boolVar(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func shellQuote(s string) string {
+	if runtime.GOOS == "windows" {
+		return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+	}
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,303 @@
+package module
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version: MAJOR.MINOR.PATCH with an optional
+// pre-release suffix. Build metadata is accepted and ignored.
+type Version struct {
+	Major, Minor, Patch int
+	Pre                 string
+}
+
+// ParseVersion parses a full version such as "1.4.2", "v2.0.0" or
+// "1.0.0-rc.1".
+func ParseVersion(s string) (Version, error) {
+	parts, pre, err := splitVersion(s)
+	if err != nil {
+		return Version{}, err
+	}
+	if len(parts) != 3 {
+		return Version{}, fmt.Errorf("invalid version %q: want MAJOR.MINOR.PATCH", s)
+	}
+	v := Version{Pre: pre}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("invalid version %q", s)
+		}
+		switch i {
+		case 0:
+			v.Major = n
+		case 1:
+			v.Minor = n
+		case 2:
+			v.Patch = n
+		}
+	}
+	return v, nil
+}
+
+func splitVersion(s string) ([]string, string, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	pre := ""
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		s, pre = s[:i], s[i+1:]
+		if pre == "" {
+			return nil, "", fmt.Errorf("invalid version %q: empty pre-release", s)
+		}
+	}
+	if s == "" {
+		return nil, "", fmt.Errorf("empty version")
+	}
+	return strings.Split(s, "."), pre, nil
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 as v sorts before, with or after o. A
+// pre-release sorts before the release it precedes.
+func (v Version) Compare(o Version) int {
+	for _, d := range [][2]int{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		if d[0] != d[1] {
+			if d[0] < d[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case v.Pre == o.Pre:
+		return 0
+	case v.Pre == "":
+		return 1
+	case o.Pre == "":
+		return -1
+	}
+	return comparePre(v.Pre, o.Pre)
+}
+
+// comparePre orders dot-separated pre-release identifiers: numeric ones
+// numerically and before alphanumeric ones.
+func comparePre(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		case as[i] != bs[i]:
+			if as[i] < bs[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+// Constraint is a version requirement from carv.toml. A bare version means
+// a compatible one, as with ^: "1.2" accepts 1.2.0 up to but not including
+// 2.0.0. Also understood are ~1.2 (patch updates only), =, >, >=, <, <=,
+// wildcards such as 1.x or *, comma-separated conditions that must all
+// hold, and alternatives separated by ||.
+type Constraint struct {
+	raw  string
+	alts [][]comparator
+}
+
+type comparator struct {
+	op string // "=", ">", ">=", "<", "<="
+	v  Version
+}
+
+// ParseConstraint parses a version requirement.
+func ParseConstraint(s string) (Constraint, error) {
+	c := Constraint{raw: strings.TrimSpace(s)}
+	if c.raw == "" {
+		return Constraint{}, fmt.Errorf("empty version requirement")
+	}
+	for _, alt := range strings.Split(c.raw, "||") {
+		var set []comparator
+		for _, term := range strings.Split(alt, ",") {
+			cmps, err := parseTerm(strings.TrimSpace(term))
+			if err != nil {
+				return Constraint{}, fmt.Errorf("invalid version requirement %q: %w", s, err)
+			}
+			set = append(set, cmps...)
+		}
+		if len(set) == 0 {
+			return Constraint{}, fmt.Errorf("invalid version requirement %q", s)
+		}
+		c.alts = append(c.alts, set)
+	}
+	return c, nil
+}
+
+// parseTerm expands one condition into the comparators it stands for.
+func parseTerm(term string) ([]comparator, error) {
+	op := ""
+	for _, candidate := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(term, candidate) {
+			op, term = candidate, strings.TrimSpace(term[len(candidate):])
+			break
+		}
+	}
+	if term == "*" || term == "x" || term == "X" {
+		if op != "" && op != "=" {
+			return nil, fmt.Errorf("%s cannot apply to a wildcard", op)
+		}
+		return []comparator{{">=", Version{}}}, nil
+	}
+
+	parts, pre, err := splitVersion(term)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("%q has too many components", term)
+	}
+	// A wildcard component ends the version: 1.x is the same as 1.
+	var nums []int
+	for _, p := range parts {
+		if p == "*" || p == "x" || p == "X" {
+			break
+		}
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%q is not a version", term)
+		}
+		nums = append(nums, n)
+	}
+	if pre != "" && len(nums) < 3 {
+		return nil, fmt.Errorf("%q: a pre-release needs a full version", term)
+	}
+	given := len(nums)
+	for len(nums) < 3 {
+		nums = append(nums, 0)
+	}
+	low := Version{Major: nums[0], Minor: nums[1], Patch: nums[2], Pre: pre}
+	if given == 0 {
+		return []comparator{{">=", Version{}}}, nil
+	}
+
+	// next bumps the component at index i and clears the rest.
+	next := func(i int) Version {
+		v := Version{Major: low.Major, Minor: low.Minor, Patch: low.Patch}
+		switch i {
+		case 0:
+			v = Version{Major: v.Major + 1}
+		case 1:
+			v = Version{Major: v.Major, Minor: v.Minor + 1}
+		default:
+			v = Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+		}
+		return v
+	}
+
+	switch op {
+	case "", "^":
+		// Compatible: the first non-zero component given may not change.
+		i := 0
+		for i < given-1 && nums[i] == 0 {
+			i++
+		}
+		return []comparator{{">=", low}, {"<", next(i)}}, nil
+	case "~":
+		if given == 1 {
+			return []comparator{{">=", low}, {"<", next(0)}}, nil
+		}
+		return []comparator{{">=", low}, {"<", next(1)}}, nil
+	case "=":
+		if given == 3 {
+			return []comparator{{"=", low}}, nil
+		}
+		return []comparator{{">=", low}, {"<", next(given - 1)}}, nil
+	case ">":
+		if given == 3 {
+			return []comparator{{">", low}}, nil
+		}
+		return []comparator{{">=", next(given - 1)}}, nil
+	case "<=":
+		if given == 3 {
+			return []comparator{{"<=", low}}, nil
+		}
+		return []comparator{{"<", next(given - 1)}}, nil
+	}
+	return []comparator{{op, low}}, nil
+}
+
+// Matches reports whether v satisfies the constraint. Pre-releases only
+// match a condition that names a pre-release of the same version, so
+// "^1.0" never picks 1.1.0-beta.
+func (c Constraint) Matches(v Version) bool {
+	for _, set := range c.alts {
+		if matchSet(set, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSet(set []comparator, v Version) bool {
+	for _, cmp := range set {
+		d := v.Compare(cmp.v)
+		ok := false
+		switch cmp.op {
+		case "=":
+			ok = d == 0
+		case ">":
+			ok = d > 0
+		case ">=":
+			ok = d >= 0
+		case "<":
+			ok = d < 0
+		case "<=":
+			ok = d <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	if v.Pre == "" {
+		return true
+	}
+	for _, cmp := range set {
+		if cmp.v.Pre != "" && cmp.v.Major == v.Major && cmp.v.Minor == v.Minor && cmp.v.Patch == v.Patch {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Constraint) String() string {
+	return c.raw
+}
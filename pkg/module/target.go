@@ -0,0 +1,202 @@
+package module
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Target describes a compilation target: the toolchain to invoke, the CPU
+// and floating-point setup, and the integer widths the generated runtime
+// uses. Custom targets live under [targets.<name>] in carv.toml and may start
+// from a built-in profile with `base`.
+type Target struct {
+	Name        string   `toml:"-"`
+	Base        string   `toml:"base"`
+	Arch        string   `toml:"arch"` // "arm" for Cortex-M; empty for the host
+	Compiler    string   `toml:"compiler"`
+	CPU         string   `toml:"cpu"`
+	FPU         string   `toml:"fpu"`
+	FloatABI    string   `toml:"float-abi"`
+	IntBits     int      `toml:"int-bits"`     // width of carv_int
+	PointerBits int      `toml:"pointer-bits"` // 0 means native
+	CFlags      []string `toml:"cflags"`
+	LDFlags     []string `toml:"ldflags"`
+	Interrupts  []string `toml:"interrupts"` // the device's handlers in its vector table, like USART1_IRQHandler
+}
+
+func cortexM(cpu string, intBits int, fpu, floatABI string) Target {
+	return Target{
+		Arch:        "arm",
+		Compiler:    "arm-none-eabi-gcc",
+		CPU:         cpu,
+		FPU:         fpu,
+		FloatABI:    floatABI,
+		IntBits:     intBits,
+		PointerBits: 32,
+	}
+}
+
+// builtinTargets are the profiles every project can name. The M0 family has
+// no 64-bit multiply, so carv_int is 32 bits there.
+var builtinTargets = map[string]Target{
+	"host":          {Compiler: "gcc", IntBits: 64},
+	"cortex-m0":     cortexM("cortex-m0", 32, "", "soft"),
+	"cortex-m0plus": cortexM("cortex-m0plus", 32, "", "soft"),
+	"cortex-m3":     cortexM("cortex-m3", 64, "", "soft"),
+	"cortex-m4":     cortexM("cortex-m4", 64, "", "soft"),
+	"cortex-m4f":    cortexM("cortex-m4", 64, "fpv4-sp-d16", "hard"),
+	"cortex-m7":     cortexM("cortex-m7", 64, "fpv5-d16", "hard"),
+}
+
+// targetAliases keeps older target names working.
+var targetAliases = map[string]string{
+	"":    "host",
+	"arm": "cortex-m4",
+}
+
+// BuiltinTargetNames lists the built-in profiles in name order.
+func BuiltinTargetNames() []string {
+	names := make([]string, 0, len(builtinTargets))
+	for name := range builtinTargets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResolveTarget looks name up among the custom targets, then the built-in
+// profiles, and applies any `base` chain.
+func ResolveTarget(name string, custom map[string]Target) (*Target, error) {
+	return resolveTarget(name, custom, nil)
+}
+
+func resolveTarget(name string, custom map[string]Target, seen []string) (*Target, error) {
+	for _, s := range seen {
+		if s == name {
+			return nil, fmt.Errorf("target %q inherits from itself (%s)", name, strings.Join(append(seen, name), " -> "))
+		}
+	}
+
+	if t, ok := custom[name]; ok {
+		if t.Base == "" {
+			t.Name = name
+			if t.Compiler == "" {
+				t.Compiler = "gcc"
+				if t.Arch == "arm" {
+					t.Compiler = "arm-none-eabi-gcc"
+				}
+			}
+			if t.IntBits == 0 {
+				t.IntBits = 64
+			}
+			return &t, nil
+		}
+		base, err := resolveTarget(t.Base, custom, append(seen, name))
+		if err != nil {
+			return nil, err
+		}
+		merged := base.extend(t)
+		merged.Name = name
+		return merged, nil
+	}
+
+	if alias, ok := targetAliases[name]; ok {
+		name = alias
+	}
+	t, ok := builtinTargets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown target %q (built-in targets: %s)", name, strings.Join(BuiltinTargetNames(), ", "))
+	}
+	t.Name = name
+	return &t, nil
+}
+
+// extend returns t with every field set in over replacing its own. Flags
+// are appended rather than replaced.
+func (t *Target) extend(over Target) *Target {
+	out := *t
+	if over.Arch != "" {
+		out.Arch = over.Arch
+	}
+	if over.Compiler != "" {
+		out.Compiler = over.Compiler
+	}
+	if over.CPU != "" {
+		out.CPU = over.CPU
+	}
+	if over.FPU != "" {
+		out.FPU = over.FPU
+	}
+	if over.FloatABI != "" {
+		out.FloatABI = over.FloatABI
+	}
+	if over.IntBits != 0 {
+		out.IntBits = over.IntBits
+	}
+	if over.PointerBits != 0 {
+		out.PointerBits = over.PointerBits
+	}
+	if over.Interrupts != nil {
+		out.Interrupts = over.Interrupts
+	}
+	out.CFlags = append(append([]string(nil), t.CFlags...), over.CFlags...)
+	out.LDFlags = append(append([]string(nil), t.LDFlags...), over.LDFlags...)
+	return &out
+}
+
+// IsHost reports whether the target runs on the machine doing the build.
+func (t *Target) IsHost() bool {
+	return t.Arch == ""
+}
+
+// armv6m are the Cortex-M cores without the configurable fault handlers and
+// the debug monitor.
+var armv6m = map[string]bool{"cortex-m0": true, "cortex-m0plus": true, "cortex-m1": true}
+
+// VectorTable returns the handler names of the target's vector table: the
+// core exceptions of its CPU, and the device interrupts the target lists,
+// or nil if it lists none. It returns nil, nil for the host, where nothing
+// runs handlers.
+func (t *Target) VectorTable() (core, device []string) {
+	if t.Arch != "arm" {
+		return nil, nil
+	}
+	core = []string{"Reset_Handler", "NMI_Handler", "HardFault_Handler"}
+	if !armv6m[t.CPU] {
+		core = append(core, "MemManage_Handler", "BusFault_Handler", "UsageFault_Handler")
+	}
+	core = append(core, "SVC_Handler")
+	if !armv6m[t.CPU] {
+		core = append(core, "DebugMon_Handler")
+	}
+	core = append(core, "PendSV_Handler", "SysTick_Handler")
+	return core, t.Interrupts
+}
+
+// BinaryName returns the file name of the executable built from base.
+func (t *Target) BinaryName(base string) string {
+	if t.IsHost() {
+		return base
+	}
+	return base + ".elf"
+}
+
+// machineFlags returns the CPU, FPU and float-ABI flags for an ARM target.
+func (t *Target) machineFlags() []string {
+	if t.Arch != "arm" {
+		return nil
+	}
+	var flags []string
+	if t.CPU != "" {
+		flags = append(flags, "-mcpu="+t.CPU)
+	}
+	flags = append(flags, "-mthumb")
+	if t.FPU != "" && t.FPU != "none" {
+		flags = append(flags, "-mfpu="+t.FPU)
+	}
+	if t.FloatABI != "" {
+		flags = append(flags, "-mfloat-abi="+t.FloatABI)
+	}
+	return flags
+}
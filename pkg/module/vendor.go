@@ -0,0 +1,94 @@
+package module
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Vendor copies every package in lf into the project's vendor directory,
+// replacing what was there, so the project builds with neither network
+// access nor a package cache. Each copy must match its carv.lock checksum,
+// if it has one.
+func Vendor(root string, lf *LockFile, cache *Cache) error {
+	tmp, err := os.MkdirTemp(root, ".vendor-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, pkg := range lf.Packages {
+		src := lockedDir(root, pkg, cache)
+		if src == "" {
+			return fmt.Errorf("%s is not installed; run carv install", pkg.Name)
+		}
+		if pkg.Checksum != "" {
+			sum, err := HashDir(src)
+			if err != nil {
+				return fmt.Errorf("%s: %w", pkg.Name, err)
+			}
+			if sum != pkg.Checksum {
+				return fmt.Errorf("%s does not match carv.lock (checksum %s, locked %s); run carv install", pkg.Name, sum, pkg.Checksum)
+			}
+		}
+		if err := copyTree(src, filepath.Join(tmp, pkg.Name)); err != nil {
+			return fmt.Errorf("%s: %w", pkg.Name, err)
+		}
+	}
+
+	// MkdirTemp made tmp private to its owner.
+	if err := os.Chmod(tmp, 0o755); err != nil {
+		return err
+	}
+	dest := filepath.Join(root, "vendor")
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// lockedDir finds the files of a locked package: a path dependency in its
+// directory, a git one in the cache or in carv_modules.
+func lockedDir(root string, pkg LockedPackage, cache *Cache) string {
+	if path, ok := strings.CutPrefix(pkg.Source, "path+"); ok {
+		path = filepath.FromSlash(path)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, path)
+		}
+		return path
+	}
+	if dir := cache.PackageDir(pkg.Checksum); dir != "" {
+		return dir
+	}
+	dir := filepath.Join(root, "carv_modules", pkg.Name)
+	if _, err := os.Stat(dir); err != nil {
+		return ""
+	}
+	return dir
+}
+
+// copyTree copies a package's files, leaving out what HashDir leaves out.
+func copyTree(src, dst string) error {
+	src, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			if path != src && (d.Name() == ".git" || d.Name() == "carv_modules") {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(target, 0o755)
+		}
+		return copyFile(path, target)
+	})
+}
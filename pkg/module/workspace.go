@@ -0,0 +1,140 @@
+package module
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// WorkspaceConfig is the [workspace] table of a carv.toml that groups
+// several packages in one repository. Members are directories relative to
+// the workspace root and may be glob patterns such as "apps/*".
+type WorkspaceConfig struct {
+	Members []string `toml:"members"`
+}
+
+// Workspace is a set of packages sharing one carv.lock and carv_modules
+// at the workspace root. Members depend on each other by package name.
+type Workspace struct {
+	Root    string
+	Config  *Config // the root carv.toml
+	Members []Member
+}
+
+// Member is one package of a workspace.
+type Member struct {
+	Name   string // [package] name, or the directory name if it has none
+	Dir    string
+	Config *Config
+}
+
+// LoadWorkspace reads the workspace whose carv.toml is in root. It returns
+// nil if that carv.toml has no [workspace] table.
+func LoadWorkspace(root string) (*Workspace, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := LoadConfig(root)
+	if err != nil || cfg == nil || cfg.Workspace == nil {
+		return nil, err
+	}
+
+	ws := &Workspace{Root: root, Config: cfg}
+	seen := make(map[string]string)
+	for _, pattern := range cfg.Workspace.Members {
+		if filepath.IsAbs(pattern) || strings.HasPrefix(filepath.Clean(pattern), "..") {
+			return nil, fmt.Errorf("[workspace] member %q must be inside the workspace", pattern)
+		}
+		dirs, err := filepath.Glob(filepath.Join(root, filepath.FromSlash(pattern)))
+		if err != nil {
+			return nil, fmt.Errorf("[workspace] member %q: %w", pattern, err)
+		}
+		if len(dirs) == 0 {
+			return nil, fmt.Errorf("[workspace] member %q matches no directory", pattern)
+		}
+		sort.Strings(dirs)
+		for _, dir := range dirs {
+			mcfg, err := LoadConfig(dir)
+			if err != nil {
+				return nil, fmt.Errorf("workspace member %s: %w", dir, err)
+			}
+			if mcfg == nil {
+				if !strings.ContainsAny(pattern, "*?[") {
+					return nil, fmt.Errorf("[workspace] member %q has no carv.toml", pattern)
+				}
+				continue
+			}
+			m := Member{Name: mcfg.Package.Name, Dir: dir, Config: mcfg}
+			if m.Name == "" {
+				m.Name = filepath.Base(dir)
+			}
+			if other, dup := seen[m.Name]; dup {
+				if other == dir {
+					continue
+				}
+				return nil, fmt.Errorf("workspace members %s and %s are both named %q", other, dir, m.Name)
+			}
+			seen[m.Name] = dir
+			ws.Members = append(ws.Members, m)
+		}
+	}
+	return ws, nil
+}
+
+// FindWorkspace returns the workspace that dir belongs to, as its root or
+// as one of its members, or nil if there is none.
+func FindWorkspace(dir string) (*Workspace, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, "carv.toml")); err == nil {
+			ws, err := LoadWorkspace(d)
+			if err != nil {
+				return nil, err
+			}
+			if ws != nil && (d == dir || ws.memberAt(dir) != nil) {
+				return ws, nil
+			}
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return nil, nil
+		}
+		d = parent
+	}
+}
+
+// Member returns the member with the given package or directory name.
+func (ws *Workspace) Member(name string) *Member {
+	for i := range ws.Members {
+		if ws.Members[i].Name == name || filepath.Base(ws.Members[i].Dir) == name {
+			return &ws.Members[i]
+		}
+	}
+	return nil
+}
+
+// memberAt returns the member whose directory is dir or contains it.
+func (ws *Workspace) memberAt(dir string) *Member {
+	for i := range ws.Members {
+		rel, err := filepath.Rel(ws.Members[i].Dir, dir)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return &ws.Members[i]
+		}
+	}
+	return nil
+}
+
+// memberDirs maps each member's package name to its directory.
+func (ws *Workspace) memberDirs() map[string]string {
+	dirs := make(map[string]string, len(ws.Members))
+	for _, m := range ws.Members {
+		dirs[m.Name] = m.Dir
+	}
+	return dirs
+}
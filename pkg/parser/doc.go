@@ -3,6 +3,9 @@
 // Design decisions:
 //   - Pratt parsing is used for expressions (operator precedence and associativity).
 //   - Recursive-descent parsing is used for declarations and statements for clarity.
+//   - Errors never stop the parse. Broken statements become ast.BadStmt and broken
+//     expressions ast.BadExpr; recovery resumes at the next statement, class member,
+//     or match arm, and only the first error at a given token is reported.
 //
 // Usage pattern:
 //
@@ -10,6 +13,6 @@
 //	p := parser.New(l)
 //	prog := p.ParseProgram()
 //	if len(p.Errors()) > 0 {
-//	    // handle syntax errors
+//	    // handle syntax errors; prog is still usable for checking
 //	}
 package parser
@@ -2,6 +2,7 @@ package parser
 
 import (
 	"fmt"
+	"reflect"
 
 	"github.com/dev-dami/carv/pkg/ast"
 	"github.com/dev-dami/carv/pkg/lexer"
@@ -12,6 +13,13 @@ type Parser struct {
 	curToken  lexer.Token
 	peekToken lexer.Token
 	errors    []string
+	tokens    []lexer.Token
+
+	// lastErr is the offset of the token the most recent error was reported
+	// at; closedBlock is set when recovery stopped on the `}` that closes the
+	// enclosing block, class, or match.
+	lastErr     int
+	closedBlock bool
 
 	prefixParseFns map[lexer.TokenType]prefixParseFn
 	infixParseFns  map[lexer.TokenType]infixParseFn
@@ -21,7 +29,7 @@ type prefixParseFn func() ast.Expression
 type infixParseFn func(ast.Expression) ast.Expression
 
 func New(l *lexer.Lexer) *Parser {
-	p := &Parser{l: l, errors: []string{}}
+	p := &Parser{l: l, errors: []string{}, lastErr: -1}
 
 	p.prefixParseFns = make(map[lexer.TokenType]prefixParseFn)
 	p.registerPrefix(lexer.TOKEN_IDENT, p.parseIdentifier)
@@ -41,6 +49,7 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(lexer.TOKEN_LBRACKET, p.parseArrayLiteral)
 	p.registerPrefix(lexer.TOKEN_IF, p.parseIfExpression)
 	p.registerPrefix(lexer.TOKEN_FN, p.parseFunctionLiteral)
+	p.registerPrefix(lexer.TOKEN_MOVE, p.parseMoveClosure)
 	p.registerPrefix(lexer.TOKEN_SPAWN, p.parseSpawnExpression)
 	p.registerPrefix(lexer.TOKEN_NEW, p.parseNewExpression)
 	p.registerPrefix(lexer.TOKEN_OK, p.parseOkExpression)
@@ -50,6 +59,7 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(lexer.TOKEN_LBRACE, p.parseMapLiteral)
 	p.registerPrefix(lexer.TOKEN_INTERP_STRING, p.parseInterpolatedString)
 	p.registerPrefix(lexer.TOKEN_AWAIT, p.parseAwaitExpression)
+	p.registerPrefix(lexer.TOKEN_ASM, p.parseAsmExpression)
 	p.registerPrefix(lexer.TOKEN_INT_TYPE, p.parseTypeAsIdentifier)
 	p.registerPrefix(lexer.TOKEN_FLOAT_TYPE, p.parseTypeAsIdentifier)
 	p.registerPrefix(lexer.TOKEN_BOOL_TYPE, p.parseTypeAsIdentifier)
@@ -118,12 +128,49 @@ func (p *Parser) Errors() []string {
 	return p.errors
 }
 
+// nextToken advances the token window. Comments never reach the grammar:
+// they are folded into the leading trivia of the next real token so the
+// recorded token stream stays lossless.
 func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
 	p.peekToken = p.l.NextToken()
+	var comments []lexer.Trivia
 	for p.peekToken.Type == lexer.TOKEN_COMMENT {
+		comments = append(comments, p.peekToken.AsTrivia()...)
 		p.peekToken = p.l.NextToken()
 	}
+	if len(comments) > 0 {
+		p.peekToken.Leading = append(comments, p.peekToken.Leading...)
+	}
+	p.tokens = append(p.tokens, p.peekToken)
+}
+
+// finishNode records n's span from start to the end of the current token.
+// Spans already set by an inner parse are kept, so a parenthesized
+// expression keeps the span of its contents.
+func (p *Parser) finishNode(n ast.Node, start int) {
+	if isNilNode(n) || !n.Range().IsZero() {
+		return
+	}
+	if s, ok := n.(interface{ SetRange(start, end int) }); ok {
+		s.SetRange(start, max(start, p.curToken.End))
+	}
+}
+
+// isNilNode reports whether n is nil or a typed nil pointer, which statement
+// parsers return on failure.
+func isNilNode(n ast.Node) bool {
+	if n == nil {
+		return true
+	}
+	v := reflect.ValueOf(n)
+	return v.Kind() == reflect.Pointer && v.IsNil()
+}
+
+func (p *Parser) curIdentifier() *ast.Identifier {
+	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	ident.SetRange(p.curToken.Offset, p.curToken.End)
+	return ident
 }
 
 func (p *Parser) curTokenIs(t lexer.TokenType) bool {
@@ -139,16 +186,46 @@ func (p *Parser) expectPeek(t lexer.TokenType) bool {
 		p.nextToken()
 		return true
 	}
+	// A nested expression that failed on the very token we expect has
+	// already been reported; accept it rather than erroring twice.
+	if p.curTokenIs(t) && p.curToken.Offset == p.lastErr {
+		return true
+	}
 	p.peekError(t)
 	return false
 }
 
 func (p *Parser) peekError(t lexer.TokenType) {
-	msg := fmt.Sprintf("line %d:%d: expected %s, got %s",
-		p.peekToken.Line, p.peekToken.Column, t, p.peekToken.Type)
+	p.errorAt(p.peekToken, "expected %s, got %s", t, p.peekToken.Type)
+}
+
+// errorAt records a syntax error at tok. Only the first error at a given
+// token is kept; anything after it is fallout from the same mistake.
+func (p *Parser) errorAt(tok lexer.Token, format string, args ...interface{}) {
+	if tok.Offset == p.lastErr {
+		return
+	}
+	p.lastErr = tok.Offset
+	msg := fmt.Sprintf("line %d:%d: ", tok.Line, tok.Column) + fmt.Sprintf(format, args...)
 	p.errors = append(p.errors, msg)
 }
 
+// expectSemi consumes the `;` that ends a simple statement. A missing
+// semicolon is reported but the statement is kept: when the next token is on
+// a new line the parser carries on from there, otherwise it skips the rest
+// of the statement.
+func (p *Parser) expectSemi() {
+	if p.closedBlock {
+		return
+	}
+	if p.expectPeek(lexer.TOKEN_SEMI) {
+		return
+	}
+	if p.peekToken.Line == p.curToken.Line {
+		p.synchronize(p.mark(), p.atStatementBoundary)
+	}
+}
+
 func (p *Parser) ParseProgram() *ast.Program {
 	program := &ast.Program{Statements: []ast.Statement{}}
 
@@ -157,13 +234,22 @@ func (p *Parser) ParseProgram() *ast.Program {
 		if stmt != nil {
 			program.Statements = append(program.Statements, stmt)
 		}
+		p.closedBlock = false
 		p.nextToken()
 	}
 
+	program.Source = p.l.Input()
+	program.Tokens = p.tokens
+	program.SetRange(0, len(program.Source))
 	return program
 }
 
+// parseStatement parses one statement. A statement that fails to parse is
+// replaced by an ast.BadStmt covering the tokens skipped during recovery, so
+// callers always get a node back.
 func (p *Parser) parseStatement() ast.Statement {
+	startTok, mark := p.curToken, p.mark()
+	start := startTok.Offset
 	var stmt ast.Statement
 	switch p.curToken.Type {
 	case lexer.TOKEN_PUB:
@@ -181,8 +267,8 @@ func (p *Parser) parseStatement() ast.Statement {
 	case lexer.TOKEN_ASYNC:
 		p.nextToken()
 		if !p.curTokenIs(lexer.TOKEN_FN) {
-			p.peekError(lexer.TOKEN_FN)
-			return nil
+			p.errorAt(p.curToken, "expected %s, got %s", lexer.TOKEN_FN, p.curToken.Type)
+			break
 		}
 		fnStmt := p.parseFunctionStatement()
 		if fnStmt != nil {
@@ -200,9 +286,7 @@ func (p *Parser) parseStatement() ast.Statement {
 			}
 			stmt = classStmt
 		} else {
-			p.errors = append(p.errors, fmt.Sprintf("line %d:%d: expected class after packed",
-				p.curToken.Line, p.curToken.Column))
-			return nil
+			p.errorAt(p.curToken, "expected class after packed")
 		}
 	case lexer.TOKEN_CLASS:
 		stmt = p.parseClassStatement()
@@ -226,9 +310,7 @@ func (p *Parser) parseStatement() ast.Statement {
 			}
 			stmt = constStmt
 		default:
-			p.errors = append(p.errors, fmt.Sprintf("line %d:%d: expected let, mut, or const after static",
-				p.curToken.Line, p.curToken.Column))
-			return nil
+			p.errorAt(p.curToken, "expected let, mut, or const after static")
 		}
 	case lexer.TOKEN_FOR:
 		stmt = p.parseForStatement()
@@ -243,25 +325,141 @@ func (p *Parser) parseStatement() ast.Statement {
 	case lexer.TOKEN_IF:
 		expr := p.parseIfExpression()
 		if expr != nil {
+			p.finishNode(expr, start)
 			stmt = &ast.ExpressionStatement{Token: p.curToken, Expression: expr}
 			break
 		}
 		stmt = nil
+	case lexer.TOKEN_HASH:
+		stmt = p.parseAttributedStatement()
 	default:
+		if p.curToken.Literal == "test" && p.curTokenIs(lexer.TOKEN_IDENT) && p.peekTokenIs(lexer.TOKEN_FN) {
+			p.nextToken()
+			fnStmt := p.parseFunctionStatement()
+			if fnStmt != nil {
+				fnStmt.Test = true
+			}
+			stmt = fnStmt
+			break
+		}
+		if p.curToken.Literal == "interrupt" && p.curTokenIs(lexer.TOKEN_IDENT) && p.peekTokenIs(lexer.TOKEN_FN) {
+			p.nextToken()
+			fnStmt := p.parseFunctionStatement()
+			if fnStmt != nil {
+				fnStmt.Interrupt = true
+			}
+			stmt = fnStmt
+			break
+		}
+		if p.curToken.Literal == "critical" && p.curTokenIs(lexer.TOKEN_IDENT) && p.peekTokenIs(lexer.TOKEN_LBRACE) {
+			stmt = p.parseCriticalStatement()
+			break
+		}
 		stmt = p.parseExpressionStatement()
 	}
 
-	if stmt == nil {
-		p.synchronize()
+	if isNilNode(stmt) {
+		p.synchronize(mark, p.atStatementBoundary)
+		stmt = &ast.BadStmt{Token: startTok}
 	}
 
+	if doc := docComment(startTok); doc != "" {
+		switch s := stmt.(type) {
+		case *ast.FunctionStatement:
+			s.Doc = doc
+		case *ast.ClassStatement:
+			s.Doc = doc
+		case *ast.InterfaceStatement:
+			s.Doc = doc
+		}
+	}
+
+	p.finishNode(stmt, start)
 	return stmt
 }
 
-func (p *Parser) synchronize() {
-	for !p.curTokenIs(lexer.TOKEN_SEMI) && !p.curTokenIs(lexer.TOKEN_RBRACE) && !p.curTokenIs(lexer.TOKEN_EOF) {
+// mark returns the index of the current token in the recorded token stream.
+func (p *Parser) mark() int {
+	return len(p.tokens) - 2
+}
+
+// braceDepthSince counts unclosed braces from token index mark through the
+// current token. A negative result means the current token is a `}` closing
+// a block that was opened before mark.
+func (p *Parser) braceDepthSince(mark int) int {
+	depth := 0
+	for _, tok := range p.tokens[max(mark, 0) : len(p.tokens)-1] {
+		switch tok.Type {
+		case lexer.TOKEN_LBRACE:
+			depth++
+		case lexer.TOKEN_RBRACE:
+			depth--
+		}
+	}
+	return depth
+}
+
+// synchronize skips the rest of a construct that failed to parse, starting
+// from token index mark. Braces opened inside the construct are skipped as a
+// unit. It stops on a `;` or a `}` that closes such a brace, or just before a
+// `}` closing the enclosing block, EOF, or a token for which atBoundary
+// reports the start of the next construct. The current token is left on the
+// last skipped token, as after any successful parse.
+func (p *Parser) synchronize(mark int, atBoundary func() bool) {
+	if p.closedBlock {
+		return
+	}
+	depth := p.braceDepthSince(mark)
+	if depth < 0 {
+		p.closedBlock = true
+		return
+	}
+	for !p.curTokenIs(lexer.TOKEN_EOF) {
+		if depth == 0 {
+			if p.curTokenIs(lexer.TOKEN_SEMI) || p.curTokenIs(lexer.TOKEN_RBRACE) {
+				return
+			}
+			if p.peekTokenIs(lexer.TOKEN_RBRACE) || p.peekTokenIs(lexer.TOKEN_EOF) || atBoundary() {
+				return
+			}
+		}
 		p.nextToken()
+		switch p.curToken.Type {
+		case lexer.TOKEN_LBRACE:
+			depth++
+		case lexer.TOKEN_RBRACE:
+			depth--
+		}
+	}
+}
+
+// atStatementBoundary reports whether the next token starts a new statement.
+// `fn` only counts on a fresh line since it also starts function literals.
+func (p *Parser) atStatementBoundary() bool {
+	switch p.peekToken.Type {
+	case lexer.TOKEN_LET, lexer.TOKEN_MUT, lexer.TOKEN_CONST, lexer.TOKEN_RETURN,
+		lexer.TOKEN_CLASS, lexer.TOKEN_INTERFACE, lexer.TOKEN_IMPL, lexer.TOKEN_PUB,
+		lexer.TOKEN_FOR, lexer.TOKEN_WHILE, lexer.TOKEN_STATIC, lexer.TOKEN_REQUIRE,
+		lexer.TOKEN_BREAK, lexer.TOKEN_CONTINUE, lexer.TOKEN_ASYNC, lexer.TOKEN_PACKED,
+		lexer.TOKEN_HASH:
+		return true
+	case lexer.TOKEN_FN:
+		return p.peekToken.Line > p.curToken.Line
 	}
+	return false
+}
+
+// atMemberBoundary reports whether the next token starts a new class,
+// interface, or impl member on a fresh line.
+func (p *Parser) atMemberBoundary() bool {
+	if p.peekToken.Line <= p.curToken.Line {
+		return false
+	}
+	switch p.peekToken.Type {
+	case lexer.TOKEN_FN, lexer.TOKEN_ASYNC, lexer.TOKEN_PUB, lexer.TOKEN_IDENT:
+		return true
+	}
+	return false
 }
 
 func (p *Parser) parsePublicStatement() ast.Statement {
@@ -276,8 +474,7 @@ func (p *Parser) parsePublicStatement() ast.Statement {
 	case lexer.TOKEN_UNSAFE:
 		p.nextToken()
 		if !p.curTokenIs(lexer.TOKEN_FN) {
-			p.errors = append(p.errors, fmt.Sprintf("line %d:%d: expected fn after pub unsafe",
-				p.curToken.Line, p.curToken.Column))
+			p.errorAt(p.curToken, "expected fn after pub unsafe")
 			return nil
 		}
 		stmt := p.parseFunctionStatement()
@@ -323,8 +520,7 @@ func (p *Parser) parsePublicStatement() ast.Statement {
 		}
 		return stmt
 	default:
-		p.errors = append(p.errors, fmt.Sprintf("line %d:%d: expected fn, class, const, or let after pub",
-			p.curToken.Line, p.curToken.Column))
+		p.errorAt(p.curToken, "expected fn, class, const, or let after pub")
 		return nil
 	}
 }
@@ -343,7 +539,7 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 		}
 	}
 
-	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	stmt.Name = p.curIdentifier()
 
 	if p.peekTokenIs(lexer.TOKEN_COLON) {
 		p.nextToken()
@@ -358,9 +554,7 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 	p.nextToken()
 	stmt.Value = p.parseExpression(LOWEST)
 
-	if !p.expectPeek(lexer.TOKEN_SEMI) {
-		return nil
-	}
+	p.expectSemi()
 
 	return stmt
 }
@@ -372,7 +566,7 @@ func (p *Parser) parseConstStatement() *ast.ConstStatement {
 		return nil
 	}
 
-	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	stmt.Name = p.curIdentifier()
 
 	if p.peekTokenIs(lexer.TOKEN_COLON) {
 		p.nextToken()
@@ -387,9 +581,7 @@ func (p *Parser) parseConstStatement() *ast.ConstStatement {
 	p.nextToken()
 	stmt.Value = p.parseExpression(LOWEST)
 
-	if !p.expectPeek(lexer.TOKEN_SEMI) {
-		return nil
-	}
+	p.expectSemi()
 
 	return stmt
 }
@@ -405,9 +597,7 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	p.nextToken()
 	stmt.ReturnValue = p.parseExpression(LOWEST)
 
-	if !p.expectPeek(lexer.TOKEN_SEMI) {
-		return nil
-	}
+	p.expectSemi()
 
 	return stmt
 }
@@ -416,9 +606,7 @@ func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 	stmt := &ast.ExpressionStatement{Token: p.curToken}
 	stmt.Expression = p.parseExpression(LOWEST)
 
-	if !p.expectPeek(lexer.TOKEN_SEMI) {
-		return nil
-	}
+	p.expectSemi()
 
 	return stmt
 }
@@ -429,7 +617,7 @@ func (p *Parser) parseFunctionStatement() *ast.FunctionStatement {
 	if !p.expectPeek(lexer.TOKEN_IDENT) {
 		return nil
 	}
-	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	stmt.Name = p.curIdentifier()
 
 	if !p.expectPeek(lexer.TOKEN_LPAREN) {
 		return nil
@@ -468,7 +656,7 @@ func (p *Parser) parseForStatement() ast.Statement {
 
 func (p *Parser) parseForInStatement(token lexer.Token) *ast.ForInStatement {
 	stmt := &ast.ForInStatement{Token: token}
-	stmt.Value = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	stmt.Value = p.curIdentifier()
 
 	if !p.expectPeek(lexer.TOKEN_IN) {
 		return nil
@@ -489,7 +677,7 @@ func (p *Parser) parseCStyleFor(token lexer.Token) *ast.ForStatement {
 	stmt := &ast.ForStatement{Token: token}
 
 	if !p.curTokenIs(lexer.TOKEN_LPAREN) {
-		p.errors = append(p.errors, fmt.Sprintf("line %d:%d: expected ( in for loop", p.curToken.Line, p.curToken.Column))
+		p.errorAt(p.curToken, "expected ( in for loop")
 		return nil
 	}
 	p.nextToken()
@@ -497,9 +685,10 @@ func (p *Parser) parseCStyleFor(token lexer.Token) *ast.ForStatement {
 	if !p.curTokenIs(lexer.TOKEN_SEMI) {
 		if p.curTokenIs(lexer.TOKEN_LET) || p.curTokenIs(lexer.TOKEN_MUT) {
 			letStmt := p.parseLetStatement()
-			if letStmt != nil {
-				letStmt.Mutable = true
+			if letStmt == nil {
+				return nil
 			}
+			letStmt.Mutable = true
 			stmt.Init = letStmt
 		} else {
 			stmt.Init = p.parseExpressionStatement()
@@ -549,17 +738,13 @@ func (p *Parser) parseWhileStatement() *ast.WhileStatement {
 
 func (p *Parser) parseBreakStatement() *ast.BreakStatement {
 	stmt := &ast.BreakStatement{Token: p.curToken}
-	if !p.expectPeek(lexer.TOKEN_SEMI) {
-		return nil
-	}
+	p.expectSemi()
 	return stmt
 }
 
 func (p *Parser) parseContinueStatement() *ast.ContinueStatement {
 	stmt := &ast.ContinueStatement{Token: p.curToken}
-	if !p.expectPeek(lexer.TOKEN_SEMI) {
-		return nil
-	}
+	p.expectSemi()
 	return stmt
 }
 
@@ -575,7 +760,7 @@ func (p *Parser) parseRequireStatement() *ast.RequireStatement {
 			if !p.expectPeek(lexer.TOKEN_IDENT) {
 				return nil
 			}
-			stmt.Alias = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+			stmt.Alias = p.curIdentifier()
 		}
 
 		if !p.expectPeek(lexer.TOKEN_SEMI) {
@@ -592,14 +777,14 @@ func (p *Parser) parseRequireStatement() *ast.RequireStatement {
 			if !p.expectPeek(lexer.TOKEN_IDENT) {
 				return nil
 			}
-			stmt.Names = append(stmt.Names, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+			stmt.Names = append(stmt.Names, p.curIdentifier())
 
 			for p.peekTokenIs(lexer.TOKEN_COMMA) {
 				p.nextToken()
 				if !p.expectPeek(lexer.TOKEN_IDENT) {
 					return nil
 				}
-				stmt.Names = append(stmt.Names, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+				stmt.Names = append(stmt.Names, p.curIdentifier())
 			}
 		}
 
@@ -641,13 +826,13 @@ func (p *Parser) parseRequireStatement() *ast.RequireStatement {
 		return stmt
 	}
 
-	p.errors = append(p.errors, fmt.Sprintf("line %d:%d: expected string, { or * after require",
-		p.peekToken.Line, p.peekToken.Column))
+	p.errorAt(p.peekToken, "expected string, { or * after require")
 	return nil
 }
 
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	block := &ast.BlockStatement{Token: p.curToken, Statements: []ast.Statement{}}
+	start := p.curToken.Offset
 
 	p.nextToken()
 
@@ -656,8 +841,13 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 		if stmt != nil {
 			block.Statements = append(block.Statements, stmt)
 		}
+		if p.closedBlock {
+			p.closedBlock = false
+			break
+		}
 		p.nextToken()
 	}
 
+	p.finishNode(block, start)
 	return block
 }
@@ -1,7 +1,7 @@
 package parser
 
 import (
-	"fmt"
+	"strings"
 
 	"github.com/dev-dami/carv/pkg/ast"
 	"github.com/dev-dami/carv/pkg/lexer"
@@ -13,7 +13,14 @@ func (p *Parser) parseClassStatement() *ast.ClassStatement {
 	if !p.expectPeek(lexer.TOKEN_IDENT) {
 		return nil
 	}
-	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	stmt.Name = p.curIdentifier()
+
+	if p.peekTokenIs(lexer.TOKEN_LT) {
+		p.nextToken()
+		if stmt.Lifetime = p.parseLifetimeParam(); stmt.Lifetime == "" {
+			return nil
+		}
+	}
 
 	if !p.expectPeek(lexer.TOKEN_LBRACE) {
 		return nil
@@ -24,23 +31,42 @@ func (p *Parser) parseClassStatement() *ast.ClassStatement {
 
 	p.nextToken()
 	for !p.curTokenIs(lexer.TOKEN_RBRACE) && !p.curTokenIs(lexer.TOKEN_EOF) {
+		start, mark := p.curToken.Offset, p.mark()
+		doc, public := docComment(p.curToken), false
+		if p.curTokenIs(lexer.TOKEN_PUB) && !p.peekTokenIs(lexer.TOKEN_RBRACE) {
+			public = true
+			p.nextToken()
+		}
+		ok := true
 		if p.curTokenIs(lexer.TOKEN_FN) {
 			method := p.parseMethodDecl()
-			if method != nil {
+			if ok = method != nil; ok {
+				method.Public, method.Doc = public, doc
+				p.finishNode(method, start)
 				stmt.Methods = append(stmt.Methods, method)
 			}
 		} else if p.curTokenIs(lexer.TOKEN_ASYNC) && p.peekTokenIs(lexer.TOKEN_FN) {
 			p.nextToken()
 			method := p.parseMethodDecl()
-			if method != nil {
+			if ok = method != nil; ok {
 				method.Async = true
+				method.Public, method.Doc = public, doc
+				p.finishNode(method, start)
 				stmt.Methods = append(stmt.Methods, method)
 			}
 		} else if p.curTokenIs(lexer.TOKEN_IDENT) {
 			field := p.parseFieldDecl()
-			if field != nil {
+			if ok = field != nil; ok {
+				field.Public, field.Doc = public, doc
+				p.finishNode(field, start)
 				stmt.Fields = append(stmt.Fields, field)
 			}
+		} else if !p.isMemberSeparator() {
+			p.errorAt(p.curToken, "unexpected %s in class body", p.curToken.Type)
+			ok = false
+		}
+		if p.recoverMember(ok, mark) {
+			break
 		}
 		p.nextToken()
 	}
@@ -48,9 +74,122 @@ func (p *Parser) parseClassStatement() *ast.ClassStatement {
 	return stmt
 }
 
+// parseAttributedStatement parses one or more #[...] attributes and the
+// declaration they annotate. Only functions take attributes.
+func (p *Parser) parseAttributedStatement() ast.Statement {
+	var attrs []*ast.Attribute
+	for p.curTokenIs(lexer.TOKEN_HASH) {
+		attr := p.parseAttribute()
+		if attr == nil {
+			return nil
+		}
+		attrs = append(attrs, attr)
+		p.nextToken()
+	}
+
+	stmt := p.parseStatement()
+	fn, ok := stmt.(*ast.FunctionStatement)
+	if !ok {
+		if _, bad := stmt.(*ast.BadStmt); !bad {
+			p.errorAt(attrs[0].Token, "attributes are only allowed on functions")
+		}
+		return stmt
+	}
+	fn.Attributes = append(attrs, fn.Attributes...)
+	for _, attr := range attrs {
+		if attr.Name.Value == "test" {
+			fn.Test = true
+		}
+	}
+	fn.Start = attrs[0].Start
+	return fn
+}
+
+// parseAttribute parses #[name] or #[name(arg, ...)] with the current token
+// on the '#'.
+func (p *Parser) parseAttribute() *ast.Attribute {
+	attr := &ast.Attribute{Token: p.curToken}
+	start := p.curToken.Offset
+	if !p.expectPeek(lexer.TOKEN_LBRACKET) || !p.expectPeek(lexer.TOKEN_IDENT) {
+		return nil
+	}
+	attr.Name = p.curIdentifier()
+	if p.peekTokenIs(lexer.TOKEN_LPAREN) {
+		p.nextToken()
+		for !p.peekTokenIs(lexer.TOKEN_RPAREN) {
+			if !p.expectPeek(lexer.TOKEN_IDENT) {
+				return nil
+			}
+			attr.Args = append(attr.Args, p.curIdentifier())
+			if !p.peekTokenIs(lexer.TOKEN_COMMA) {
+				break
+			}
+			p.nextToken()
+		}
+		if !p.expectPeek(lexer.TOKEN_RPAREN) {
+			return nil
+		}
+	}
+	if !p.expectPeek(lexer.TOKEN_RBRACKET) {
+		return nil
+	}
+	p.finishNode(attr, start)
+	return attr
+}
+
+// docComment returns the text of the `///` comments directly above tok,
+// with the markers and one following space stripped. A blank line ends the
+// block, as does any other kind of comment.
+func docComment(tok lexer.Token) string {
+	var lines []string
+	for i := len(tok.Leading) - 1; i >= 0; i-- {
+		tr := tok.Leading[i]
+		if tr.Kind == lexer.TriviaWhitespace {
+			if len(lines) > 0 && strings.Count(tr.Text, "\n") > 1 {
+				break
+			}
+			continue
+		}
+		if tr.Kind != lexer.TriviaLineComment || !strings.HasPrefix(tr.Text, "///") || strings.HasPrefix(tr.Text, "////") {
+			break
+		}
+		line := strings.TrimPrefix(tr.Text, "///")
+		line = strings.TrimPrefix(line, " ")
+		lines = append(lines, strings.TrimRight(line, " \t\r"))
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// recoverMember skips the rest of a class, interface, or impl member that
+// failed to parse. It reports whether parsing ran into the closing `}` of the
+// body, in which case the caller must stop without advancing.
+func (p *Parser) recoverMember(ok bool, mark int) bool {
+	if !ok {
+		p.synchronize(mark, p.atMemberBoundary)
+	}
+	if p.closedBlock {
+		p.closedBlock = false
+		return true
+	}
+	return false
+}
+
+// isMemberSeparator reports whether the current token may sit between
+// members without meaning anything: stray separators and a `pub` marker.
+func (p *Parser) isMemberSeparator() bool {
+	switch p.curToken.Type {
+	case lexer.TOKEN_SEMI, lexer.TOKEN_COMMA, lexer.TOKEN_PUB:
+		return true
+	}
+	return false
+}
+
 func (p *Parser) parseFieldDecl() *ast.FieldDecl {
 	field := &ast.FieldDecl{Token: p.curToken}
-	field.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	field.Name = p.curIdentifier()
 
 	if !p.expectPeek(lexer.TOKEN_COLON) {
 		return nil
@@ -73,7 +212,7 @@ func (p *Parser) parseMethodDecl() *ast.MethodDecl {
 	if !p.expectPeek(lexer.TOKEN_IDENT) {
 		return nil
 	}
-	method.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	method.Name = p.curIdentifier()
 
 	if !p.expectPeek(lexer.TOKEN_LPAREN) {
 		return nil
@@ -104,7 +243,7 @@ func (p *Parser) parseInterfaceStatement() *ast.InterfaceStatement {
 	if !p.expectPeek(lexer.TOKEN_IDENT) {
 		return nil
 	}
-	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	stmt.Name = p.curIdentifier()
 
 	if !p.expectPeek(lexer.TOKEN_LBRACE) {
 		return nil
@@ -114,11 +253,23 @@ func (p *Parser) parseInterfaceStatement() *ast.InterfaceStatement {
 	p.nextToken()
 
 	for !p.curTokenIs(lexer.TOKEN_RBRACE) && !p.curTokenIs(lexer.TOKEN_EOF) {
+		start, mark := p.curToken.Offset, p.mark()
 		if p.curTokenIs(lexer.TOKEN_FN) {
+			doc := docComment(p.curToken)
 			sig := p.parseMethodSignature()
 			if sig != nil {
+				sig.Doc = doc
+				p.finishNode(sig, start)
 				stmt.Methods = append(stmt.Methods, sig)
+			} else {
+				p.synchronize(mark, p.atMemberBoundary)
 			}
+		} else if !p.isMemberSeparator() {
+			p.errorAt(p.curToken, "unexpected %s in interface body", p.curToken.Type)
+			p.synchronize(mark, p.atMemberBoundary)
+		}
+		if p.recoverMember(true, mark) {
+			break
 		}
 		p.nextToken()
 	}
@@ -132,7 +283,7 @@ func (p *Parser) parseMethodSignature() *ast.MethodSignature {
 	if !p.expectPeek(lexer.TOKEN_IDENT) {
 		return nil
 	}
-	sig.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	sig.Name = p.curIdentifier()
 
 	if !p.expectPeek(lexer.TOKEN_LPAREN) {
 		return nil
@@ -241,7 +392,7 @@ func (p *Parser) parseImplStatement() *ast.ImplStatement {
 	if !p.expectPeek(lexer.TOKEN_IDENT) {
 		return nil
 	}
-	ifaceName := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	ifaceName := p.curIdentifier()
 
 	if !p.expectPeek(lexer.TOKEN_FOR) {
 		return nil
@@ -250,7 +401,7 @@ func (p *Parser) parseImplStatement() *ast.ImplStatement {
 	if !p.expectPeek(lexer.TOKEN_IDENT) {
 		return nil
 	}
-	stmt.Type = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	stmt.Type = p.curIdentifier()
 	stmt.Interface = ifaceName
 
 	if !p.expectPeek(lexer.TOKEN_LBRACE) {
@@ -261,18 +412,31 @@ func (p *Parser) parseImplStatement() *ast.ImplStatement {
 	p.nextToken()
 
 	for !p.curTokenIs(lexer.TOKEN_RBRACE) && !p.curTokenIs(lexer.TOKEN_EOF) {
+		start, mark := p.curToken.Offset, p.mark()
+		doc := docComment(p.curToken)
+		ok := true
 		if p.curTokenIs(lexer.TOKEN_FN) {
 			method := p.parseImplMethodDecl()
-			if method != nil {
+			if ok = method != nil; ok {
+				method.Doc = doc
+				p.finishNode(method, start)
 				stmt.Methods = append(stmt.Methods, method)
 			}
 		} else if p.curTokenIs(lexer.TOKEN_ASYNC) && p.peekTokenIs(lexer.TOKEN_FN) {
 			p.nextToken()
 			method := p.parseImplMethodDecl()
-			if method != nil {
+			if ok = method != nil; ok {
 				method.Async = true
+				method.Doc = doc
+				p.finishNode(method, start)
 				stmt.Methods = append(stmt.Methods, method)
 			}
+		} else if !p.isMemberSeparator() {
+			p.errorAt(p.curToken, "unexpected %s in impl body", p.curToken.Type)
+			ok = false
+		}
+		if p.recoverMember(ok, mark) {
+			break
 		}
 		p.nextToken()
 	}
@@ -286,7 +450,7 @@ func (p *Parser) parseImplMethodDecl() *ast.MethodDecl {
 	if !p.expectPeek(lexer.TOKEN_IDENT) {
 		return nil
 	}
-	method.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	method.Name = p.curIdentifier()
 
 	if !p.expectPeek(lexer.TOKEN_LPAREN) {
 		return nil
@@ -331,6 +495,15 @@ func (p *Parser) parseUnsafeStatement() ast.Statement {
 	return stmt
 }
 
+// parseCriticalStatement parses `critical { ... }`, with the current token
+// on critical.
+func (p *Parser) parseCriticalStatement() ast.Statement {
+	stmt := &ast.CriticalStatement{Token: p.curToken}
+	p.nextToken()
+	stmt.Body = p.parseBlockStatement()
+	return stmt
+}
+
 // parseAsmExpression parses `asm("template")`.
 // It is used inside unsafe blocks/functions to emit inline assembly.
 func (p *Parser) parseAsmExpression() ast.Expression {
@@ -342,8 +515,7 @@ func (p *Parser) parseAsmExpression() ast.Expression {
 
 	p.nextToken()
 	if !p.curTokenIs(lexer.TOKEN_STRING) {
-		p.errors = append(p.errors, fmt.Sprintf("line %d:%d: asm() requires a string literal template",
-			p.curToken.Line, p.curToken.Column))
+		p.errorAt(p.curToken, "asm() requires a string literal template")
 		return nil
 	}
 	stringExpr := p.parseStringLiteral()
@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/dev-dami/carv/pkg/ast"
@@ -1358,6 +1359,34 @@ func TestNamedFunctionLiteral(t *testing.T) {
 	}
 }
 
+func TestMoveClosure(t *testing.T) {
+	input := `let f = move fn() -> int { return x; }; let g = fn() {};`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	for i, want := range []bool{true, false} {
+		letStmt := program.Statements[i].(*ast.LetStatement)
+		fnLit, ok := letStmt.Value.(*ast.FunctionLiteral)
+		if !ok {
+			t.Fatalf("expected FunctionLiteral, got %T", letStmt.Value)
+		}
+		if fnLit.Move != want {
+			t.Errorf("statement %d: Move = %v, want %v", i, fnLit.Move, want)
+		}
+	}
+}
+
+func TestMoveWithoutFn(t *testing.T) {
+	l := lexer.New(`let f = move x;`)
+	p := New(l)
+	_ = p.ParseProgram()
+	if len(p.Errors()) == 0 {
+		t.Fatal("expected error for move not followed by fn")
+	}
+}
+
 // --- Index expression ---
 
 func TestIndexExpression(t *testing.T) {
@@ -1777,6 +1806,62 @@ func TestTypeExprMutRefType(t *testing.T) {
 	}
 }
 
+func TestTypeExprLifetimes(t *testing.T) {
+	input := `class View<'a> {
+	data: &'a string
+}
+fn first(v: &View<'a>, s: &'a mut string) -> &'a string { return s; }`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	cls := program.Statements[0].(*ast.ClassStatement)
+	if cls.Lifetime != "'a" {
+		t.Errorf("class lifetime = %q, want 'a", cls.Lifetime)
+	}
+	if rt := cls.Fields[0].Type.(*ast.RefType); rt.Lifetime != "'a" {
+		t.Errorf("field lifetime = %q, want 'a", rt.Lifetime)
+	}
+	fs := program.Statements[1].(*ast.FunctionStatement)
+	view := fs.Parameters[0].Type.(*ast.RefType).Inner.(*ast.NamedType)
+	if view.Lifetime != "'a" {
+		t.Errorf("View lifetime = %q, want 'a", view.Lifetime)
+	}
+	if rt := fs.Parameters[1].Type.(*ast.RefType); rt.Lifetime != "'a" || !rt.Mutable {
+		t.Errorf("got lifetime %q mutable %v, want 'a and mutable", rt.Lifetime, rt.Mutable)
+	}
+}
+
+func TestTypeExprFunctionType(t *testing.T) {
+	input := `fn apply(f: fn(int, &string) -> int, done: fn()) -> fn(int) -> bool { return nil; }`
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	fs := program.Statements[0].(*ast.FunctionStatement)
+	f, ok := fs.Parameters[0].Type.(*ast.FunctionType)
+	if !ok {
+		t.Fatalf("expected FunctionType, got %T", fs.Parameters[0].Type)
+	}
+	if len(f.Parameters) != 2 || f.ReturnType == nil {
+		t.Fatalf("f = %d parameters, return %v; want 2 and int", len(f.Parameters), f.ReturnType)
+	}
+	if _, ok := f.Parameters[1].(*ast.RefType); !ok {
+		t.Errorf("second parameter = %T, want RefType", f.Parameters[1])
+	}
+	done := fs.Parameters[1].Type.(*ast.FunctionType)
+	if len(done.Parameters) != 0 || done.ReturnType != nil {
+		t.Errorf("done = %d parameters, return %v; want none", len(done.Parameters), done.ReturnType)
+	}
+	ret, ok := fs.ReturnType.(*ast.FunctionType)
+	if !ok {
+		t.Fatalf("expected FunctionType return, got %T", fs.ReturnType)
+	}
+	if bt, ok := ret.ReturnType.(*ast.BasicType); !ok || bt.Name != "bool" {
+		t.Errorf("returned function returns %v, want bool", ret.ReturnType)
+	}
+}
+
 func TestTypeExprVolatile(t *testing.T) {
 	input := `let x: volatile<int> = v;`
 	l := lexer.New(input)
@@ -2962,3 +3047,340 @@ func TestAsmExpression(t *testing.T) {
 		t.Fatalf("expected asm template 'nop', got %q", asmExpr.Template.Value)
 	}
 }
+
+func TestProgramRenderRoundTrip(t *testing.T) {
+	input := `// leading comment
+fn add(a: int, b: int) -> int {   /* inline */
+	return a + b; // trailing
+}
+
+class Point {
+	x: int
+	fn len(&self) -> int { return self.x; }
+}
+let s = f"sum {add(1, 2)}!";
+/* end */
+`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if got := program.Render(); got != input {
+		t.Fatalf("render mismatch:\n got: %q\nwant: %q", got, input)
+	}
+
+	fn := program.Statements[0].(*ast.FunctionStatement)
+	if got := program.Text(fn); !strings.HasPrefix(got, "fn add(") || !strings.HasSuffix(got, "}") {
+		t.Fatalf("unexpected function text %q", got)
+	}
+	if got := program.Text(fn.Parameters[1]); got != "b: int" {
+		t.Fatalf("expected parameter text %q, got %q", "b: int", got)
+	}
+	ret := fn.Body.Statements[0].(*ast.ReturnStatement)
+	if got := program.Text(ret); got != "return a + b;" {
+		t.Fatalf("expected return text %q, got %q", "return a + b;", got)
+	}
+	if got := program.Text(ret.ReturnValue); got != "a + b" {
+		t.Fatalf("expected expression text %q, got %q", "a + b", got)
+	}
+
+	class := program.Statements[1].(*ast.ClassStatement)
+	if got := program.Text(class.Methods[0]); got != "fn len(&self) -> int { return self.x; }" {
+		t.Fatalf("unexpected method text %q", got)
+	}
+
+	let := program.Statements[2].(*ast.LetStatement)
+	interp := let.Value.(*ast.InterpolatedString)
+	if got := program.Text(interp.Parts[1]); got != "add(1, 2)" {
+		t.Fatalf("expected interpolated part text %q, got %q", "add(1, 2)", got)
+	}
+}
+
+func TestCommentTrivia(t *testing.T) {
+	input := "/// doc\nfn f() {}"
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	first := program.Tokens[0]
+	if first.Type != lexer.TOKEN_FN {
+		t.Fatalf("expected first token fn, got %s", first.Type)
+	}
+	if len(first.Leading) != 2 || first.Leading[0].Kind != lexer.TriviaLineComment || first.Leading[0].Text != "/// doc" {
+		t.Fatalf("expected comment trivia before fn, got %+v", first.Leading)
+	}
+}
+
+func TestRecoveryReportsOneErrorPerMistake(t *testing.T) {
+	input := `fn f() {
+	let a = ;
+	let b = 2;
+	let c = foo(1, );
+	let d = 4
+	return b;
+}
+fn g() -> int { return 1; }`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 3 {
+		t.Fatalf("expected 3 errors, got %d: %v", len(p.Errors()), p.Errors())
+	}
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(program.Statements))
+	}
+	fn := program.Statements[0].(*ast.FunctionStatement)
+	if len(fn.Body.Statements) != 5 {
+		t.Fatalf("expected 5 statements in body, got %d", len(fn.Body.Statements))
+	}
+	let := fn.Body.Statements[0].(*ast.LetStatement)
+	if _, ok := let.Value.(*ast.BadExpr); !ok {
+		t.Fatalf("expected BadExpr value, got %T", let.Value)
+	}
+	if _, ok := program.Statements[1].(*ast.FunctionStatement); !ok {
+		t.Fatalf("expected g to survive, got %T", program.Statements[1])
+	}
+}
+
+func TestRecoveryBadStatementKeepsBlock(t *testing.T) {
+	input := `fn f() {
+	static fn nope() {}
+	let x = 1;
+}
+fn g() {}`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 1 {
+		t.Fatalf("expected 1 error, got %v", p.Errors())
+	}
+	fn := program.Statements[0].(*ast.FunctionStatement)
+	if _, ok := fn.Body.Statements[0].(*ast.BadStmt); !ok {
+		t.Fatalf("expected BadStmt, got %T", fn.Body.Statements[0])
+	}
+	if _, ok := fn.Body.Statements[len(fn.Body.Statements)-1].(*ast.LetStatement); !ok {
+		t.Fatal("expected let statement after BadStmt")
+	}
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 top-level statements, got %d", len(program.Statements))
+	}
+}
+
+func TestRecoveryUnclosedExpressionAtBlockEnd(t *testing.T) {
+	input := `fn f() {
+	let x = }
+fn g() {}`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 1 {
+		t.Fatalf("expected 1 error, got %v", p.Errors())
+	}
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected f and g, got %d statements", len(program.Statements))
+	}
+}
+
+func TestRecoveryClassMember(t *testing.T) {
+	input := `class P {
+	x: int
+	fn bad( { return 1; }
+	: int
+	y: int
+	fn ok() -> int { return self.x; }
+}
+fn after() {}`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 2 {
+		t.Fatalf("expected 2 errors, got %v", p.Errors())
+	}
+	cls := program.Statements[0].(*ast.ClassStatement)
+	if len(cls.Fields) != 2 || cls.Fields[1].Name.Value != "y" {
+		t.Fatalf("expected fields x and y, got %d", len(cls.Fields))
+	}
+	if len(cls.Methods) != 1 || cls.Methods[0].Name.Value != "ok" {
+		t.Fatalf("expected method ok to survive, got %d methods", len(cls.Methods))
+	}
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(program.Statements))
+	}
+}
+
+func TestRecoveryMatchArm(t *testing.T) {
+	input := `fn m(v: int) -> int {
+	return match v {
+		1 => 2,
+		2 3,
+		_ => 4,
+	};
+}`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+
+	if len(p.Errors()) != 1 {
+		t.Fatalf("expected 1 error, got %v", p.Errors())
+	}
+	fn := program.Statements[0].(*ast.FunctionStatement)
+	ret := fn.Body.Statements[0].(*ast.ReturnStatement)
+	match := ret.ReturnValue.(*ast.MatchExpression)
+	if len(match.Arms) != 2 {
+		t.Fatalf("expected 2 surviving arms, got %d", len(match.Arms))
+	}
+}
+
+func TestDocComments(t *testing.T) {
+	input := `// not a doc comment
+/// Adds two numbers.
+///
+/// Wraps on overflow.
+pub fn add(a: int, b: int) -> int { return a + b; }
+
+/// A 2D point.
+class Point {
+	/// Horizontal position.
+	pub x: int
+	// plain comment
+	y: int
+	/// Length from the origin.
+	fn len(&self) -> int { return self.x; }
+}
+
+/// Something drawable.
+interface Drawable {
+	/// Draws the shape.
+	fn draw(&self);
+}
+
+/// Detached by a blank line, still attached.
+
+fn f() {}
+
+/// first block
+
+/// second block
+fn g() {}`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	fn := program.Statements[0].(*ast.FunctionStatement)
+	if fn.Doc != "Adds two numbers.\n\nWraps on overflow." {
+		t.Fatalf("unexpected fn doc %q", fn.Doc)
+	}
+	cls := program.Statements[1].(*ast.ClassStatement)
+	if cls.Doc != "A 2D point." {
+		t.Fatalf("unexpected class doc %q", cls.Doc)
+	}
+	if cls.Fields[0].Doc != "Horizontal position." || !cls.Fields[0].Public {
+		t.Fatalf("unexpected field doc %q (public=%v)", cls.Fields[0].Doc, cls.Fields[0].Public)
+	}
+	if cls.Fields[1].Doc != "" {
+		t.Fatalf("expected plain comment to be ignored, got %q", cls.Fields[1].Doc)
+	}
+	if cls.Methods[0].Doc != "Length from the origin." {
+		t.Fatalf("unexpected method doc %q", cls.Methods[0].Doc)
+	}
+	iface := program.Statements[2].(*ast.InterfaceStatement)
+	if iface.Doc != "Something drawable." || iface.Methods[0].Doc != "Draws the shape." {
+		t.Fatalf("unexpected interface docs %q / %q", iface.Doc, iface.Methods[0].Doc)
+	}
+	if f := program.Statements[3].(*ast.FunctionStatement); f.Doc != "Detached by a blank line, still attached." {
+		t.Fatalf("unexpected doc %q", f.Doc)
+	}
+	if g := program.Statements[4].(*ast.FunctionStatement); g.Doc != "second block" {
+		t.Fatalf("expected only the nearest block, got %q", g.Doc)
+	}
+}
+
+func TestTestFunctions(t *testing.T) {
+	input := `test fn adds() { assert(1 + 1 == 2); }
+
+/// Checks subtraction.
+#[test]
+fn subtracts() {}
+
+#[inline] #[allow(unused, shadowing)]
+pub fn helper() {}
+
+let test = 1;`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 4 {
+		t.Fatalf("expected 4 statements, got %d", len(program.Statements))
+	}
+	adds := program.Statements[0].(*ast.FunctionStatement)
+	if !adds.Test || adds.Name.Value != "adds" {
+		t.Errorf("expected test fn adds, got %q (test=%v)", adds.Name.Value, adds.Test)
+	}
+	sub := program.Statements[1].(*ast.FunctionStatement)
+	if !sub.Test || sub.Doc != "Checks subtraction." {
+		t.Errorf("expected documented #[test] fn, got test=%v doc=%q", sub.Test, sub.Doc)
+	}
+	if got := program.Text(sub); !strings.HasPrefix(got, "#[test]") {
+		t.Errorf("expected span to include the attribute, got %q", got)
+	}
+	helper := program.Statements[2].(*ast.FunctionStatement)
+	if helper.Test || !helper.Public || len(helper.Attributes) != 2 {
+		t.Fatalf("unexpected helper: test=%v pub=%v attrs=%d", helper.Test, helper.Public, len(helper.Attributes))
+	}
+	allow := helper.Attributes[1]
+	if allow.Name.Value != "allow" || len(allow.Args) != 2 || allow.Args[1].Value != "shadowing" {
+		t.Errorf("unexpected attribute %q with %d args", allow.Name.Value, len(allow.Args))
+	}
+}
+
+func TestInterruptFunctions(t *testing.T) {
+	input := `static let ticks: Atomic<u32> = Atomic(0);
+interrupt fn SysTick_Handler() { ticks.store(ticks.load() + 1); }
+critical { count = count + 1; }
+let interrupt = 1;`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 4 {
+		t.Fatalf("expected 4 statements, got %d", len(program.Statements))
+	}
+	let := program.Statements[0].(*ast.LetStatement)
+	named, ok := let.Type.(*ast.NamedType)
+	if !ok || named.Name.Value != "Atomic" || len(named.Args) != 1 {
+		t.Fatalf("expected Atomic with one type argument, got %#v", let.Type)
+	}
+	if arg, ok := named.Args[0].(*ast.BasicType); !ok || arg.Name != "u32" {
+		t.Errorf("expected type argument u32, got %#v", named.Args[0])
+	}
+	handler := program.Statements[1].(*ast.FunctionStatement)
+	if !handler.Interrupt || handler.Name.Value != "SysTick_Handler" {
+		t.Errorf("expected interrupt fn SysTick_Handler, got %q (interrupt=%v)", handler.Name.Value, handler.Interrupt)
+	}
+	crit, ok := program.Statements[2].(*ast.CriticalStatement)
+	if !ok {
+		t.Fatalf("expected CriticalStatement, got %T", program.Statements[2])
+	}
+	if len(crit.Body.Statements) != 1 {
+		t.Errorf("expected 1 statement in critical body, got %d", len(crit.Body.Statements))
+	}
+}
+
+func TestAttributeOnNonFunction(t *testing.T) {
+	p := New(lexer.New("#[test]\nlet x = 1;"))
+	p.ParseProgram()
+	errs := p.Errors()
+	if len(errs) != 1 || !strings.Contains(errs[0], "only allowed on functions") {
+		t.Fatalf("expected one attribute placement error, got %v", errs)
+	}
+}
@@ -6,9 +6,20 @@ import (
 )
 
 func (p *Parser) parseTypeExpr() ast.TypeExpr {
+	start := p.curToken.Offset
+	t := p.parseTypeKind()
+	p.finishNode(t, start)
+	return t
+}
+
+func (p *Parser) parseTypeKind() ast.TypeExpr {
 	if p.curTokenIs(lexer.TOKEN_AMPERSAND) {
 		ref := &ast.RefType{Token: p.curToken}
 		p.nextToken()
+		if p.curTokenIs(lexer.TOKEN_LIFETIME) {
+			ref.Lifetime = p.curToken.Literal
+			p.nextToken()
+		}
 		if p.curTokenIs(lexer.TOKEN_MUT) {
 			ref.Mutable = true
 			p.nextToken()
@@ -67,14 +78,99 @@ func (p *Parser) parseTypeExpr() ast.TypeExpr {
 	case lexer.TOKEN_ISIZE_TYPE:
 		return &ast.BasicType{Token: p.curToken, Name: "isize"}
 	case lexer.TOKEN_IDENT:
-		return &ast.NamedType{Token: p.curToken, Name: &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}}
+		named := &ast.NamedType{Token: p.curToken, Name: p.curIdentifier()}
+		if p.peekTokenIs(lexer.TOKEN_LT) {
+			p.nextToken()
+			if !p.peekTokenIs(lexer.TOKEN_LIFETIME) {
+				if named.Args = p.parseTypeArgs(); named.Args == nil {
+					return nil
+				}
+				return named
+			}
+			if named.Lifetime = p.parseLifetimeParam(); named.Lifetime == "" {
+				return nil
+			}
+		}
+		return named
 	case lexer.TOKEN_LBRACKET:
 		return p.parseArrayType()
+	case lexer.TOKEN_FN:
+		return p.parseFunctionType()
 	default:
 		return nil
 	}
 }
 
+// parseLifetimeParam parses the 'a> of <'a>, with the current token on
+// the <, and returns the lifetime, or "" after reporting an error.
+func (p *Parser) parseLifetimeParam() string {
+	if !p.expectPeek(lexer.TOKEN_LIFETIME) {
+		return ""
+	}
+	lifetime := p.curToken.Literal
+	if !p.expectPeek(lexer.TOKEN_GT) {
+		return ""
+	}
+	return lifetime
+}
+
+// parseTypeArgs parses the T, U> of <T, U>, with the current token on the
+// <, and returns the types, or nil after reporting an error.
+func (p *Parser) parseTypeArgs() []ast.TypeExpr {
+	var args []ast.TypeExpr
+	for {
+		p.nextToken()
+		arg := p.parseTypeExpr()
+		if arg == nil {
+			p.errorAt(p.curToken, "expected type argument, got %s", p.curToken.Type)
+			return nil
+		}
+		args = append(args, arg)
+		if !p.peekTokenIs(lexer.TOKEN_COMMA) {
+			break
+		}
+		p.nextToken()
+	}
+	if !p.expectPeek(lexer.TOKEN_GT) {
+		return nil
+	}
+	return args
+}
+
+// parseFunctionType parses fn(T, U) -> R, the type of functions and
+// closures taking a T and a U and returning an R; without -> R they return
+// nothing.
+func (p *Parser) parseFunctionType() ast.TypeExpr {
+	ft := &ast.FunctionType{Token: p.curToken}
+	if !p.expectPeek(lexer.TOKEN_LPAREN) {
+		return nil
+	}
+	for !p.peekTokenIs(lexer.TOKEN_RPAREN) {
+		p.nextToken()
+		param := p.parseTypeExpr()
+		if param == nil {
+			p.errorAt(p.curToken, "expected parameter type, got %s", p.curToken.Type)
+			return nil
+		}
+		ft.Parameters = append(ft.Parameters, param)
+		if !p.peekTokenIs(lexer.TOKEN_COMMA) {
+			break
+		}
+		p.nextToken()
+	}
+	if !p.expectPeek(lexer.TOKEN_RPAREN) {
+		return nil
+	}
+	if p.peekTokenIs(lexer.TOKEN_ARROW) {
+		p.nextToken()
+		p.nextToken()
+		if ft.ReturnType = p.parseTypeExpr(); ft.ReturnType == nil {
+			return nil
+		}
+	}
+	return ft
+}
+
 func (p *Parser) parseArrayType() ast.TypeExpr {
 	arr := &ast.ArrayType{Token: p.curToken}
 	p.nextToken()
@@ -1,7 +1,6 @@
 package parser
 
 import (
-	"fmt"
 	"strconv"
 	"strings"
 
@@ -82,10 +81,19 @@ func (p *Parser) peekPrecedence() precedence {
 func (p *Parser) parseExpression(prec precedence) ast.Expression {
 	prefix := p.prefixParseFns[p.curToken.Type]
 	if prefix == nil {
-		p.errors = append(p.errors, fmt.Sprintf("no prefix parse function for %s", p.curToken.Type))
-		return nil
+		p.errorAt(p.curToken, "unexpected %s in expression", p.curToken.Type)
+		if p.curTokenIs(lexer.TOKEN_RBRACE) {
+			// Nothing inside an expression opened this brace, so it closes
+			// the enclosing block; let that block's loop see it.
+			p.closedBlock = true
+		}
+		bad := &ast.BadExpr{Token: p.curToken}
+		bad.SetRange(p.curToken.Offset, p.curToken.End)
+		return bad
 	}
-	leftExp := prefix()
+	start := p.curToken.Offset
+	leftExp := p.orBadExpr(prefix())
+	p.finishNode(leftExp, start)
 
 	for !p.peekTokenIs(lexer.TOKEN_SEMI) && prec < p.peekPrecedence() {
 		infix := p.infixParseFns[p.peekToken.Type]
@@ -93,14 +101,24 @@ func (p *Parser) parseExpression(prec precedence) ast.Expression {
 			return leftExp
 		}
 		p.nextToken()
-		leftExp = infix(leftExp)
+		leftExp = p.orBadExpr(infix(leftExp))
+		p.finishNode(leftExp, start)
 	}
 
 	return leftExp
 }
 
+// orBadExpr replaces a failed parse with a BadExpr so enclosing nodes never
+// hold nil children. The failing parser has already reported the error.
+func (p *Parser) orBadExpr(expr ast.Expression) ast.Expression {
+	if expr != nil {
+		return expr
+	}
+	return &ast.BadExpr{Token: p.curToken}
+}
+
 func (p *Parser) parseIdentifier() ast.Expression {
-	return &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	return p.curIdentifier()
 }
 
 func (p *Parser) parseTypeAsIdentifier() ast.Expression {
@@ -113,7 +131,7 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	lit := &ast.IntegerLiteral{Token: p.curToken}
 	value, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
 	if err != nil {
-		p.errors = append(p.errors, "line "+strconv.Itoa(p.curToken.Line)+":"+strconv.Itoa(p.curToken.Column)+": could not parse \""+p.curToken.Literal+"\" as integer")
+		p.errorAt(p.curToken, "could not parse %q as integer", p.curToken.Literal)
 		return nil
 	}
 	lit.Value = value
@@ -124,7 +142,7 @@ func (p *Parser) parseFloatLiteral() ast.Expression {
 	lit := &ast.FloatLiteral{Token: p.curToken}
 	value, err := strconv.ParseFloat(p.curToken.Literal, 64)
 	if err != nil {
-		p.errors = append(p.errors, "line "+strconv.Itoa(p.curToken.Line)+":"+strconv.Itoa(p.curToken.Column)+": could not parse \""+p.curToken.Literal+"\" as float")
+		p.errorAt(p.curToken, "could not parse %q as float", p.curToken.Literal)
 		return nil
 	}
 	lit.Value = value
@@ -287,10 +305,14 @@ func (p *Parser) parseIfExpression() ast.Expression {
 		p.nextToken()
 		if p.peekTokenIs(lexer.TOKEN_IF) {
 			p.nextToken()
+			start := p.curToken.Offset
 			nested := p.parseIfExpression()
 			if nested != nil {
+				p.finishNode(nested, start)
 				nestedStmt := &ast.ExpressionStatement{Token: p.curToken, Expression: nested}
+				p.finishNode(nestedStmt, start)
 				expr.Alternative = &ast.BlockStatement{Token: p.curToken, Statements: []ast.Statement{nestedStmt}}
+				p.finishNode(expr.Alternative, start)
 			}
 		} else {
 			if !p.expectPeek(lexer.TOKEN_LBRACE) {
@@ -308,7 +330,7 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 
 	if p.peekTokenIs(lexer.TOKEN_IDENT) {
 		p.nextToken()
-		lit.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		lit.Name = p.curIdentifier()
 	}
 
 	if !p.expectPeek(lexer.TOKEN_LPAREN) {
@@ -330,6 +352,20 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 	return lit
 }
 
+// parseMoveClosure parses move fn(...) { ... }, a closure that takes what
+// it captures by value.
+func (p *Parser) parseMoveClosure() ast.Expression {
+	if !p.expectPeek(lexer.TOKEN_FN) {
+		return nil
+	}
+	lit, ok := p.parseFunctionLiteral().(*ast.FunctionLiteral)
+	if !ok {
+		return nil
+	}
+	lit.Move = true
+	return lit
+}
+
 func (p *Parser) parseFunctionParameters() []*ast.Parameter {
 	params := []*ast.Parameter{}
 
@@ -362,6 +398,7 @@ func (p *Parser) parseFunctionParameters() []*ast.Parameter {
 
 func (p *Parser) parseParameter() *ast.Parameter {
 	param := &ast.Parameter{Token: p.curToken}
+	start := p.curToken.Offset
 
 	if p.curTokenIs(lexer.TOKEN_MUT) {
 		param.Mutable = true
@@ -372,7 +409,7 @@ func (p *Parser) parseParameter() *ast.Parameter {
 	if !p.curTokenIs(lexer.TOKEN_IDENT) {
 		return nil
 	}
-	param.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	param.Name = p.curIdentifier()
 
 	if p.peekTokenIs(lexer.TOKEN_COLON) {
 		p.nextToken()
@@ -380,6 +417,7 @@ func (p *Parser) parseParameter() *ast.Parameter {
 		param.Type = p.parseTypeExpr()
 	}
 
+	p.finishNode(param, start)
 	return param
 }
 
@@ -404,7 +442,7 @@ func (p *Parser) parseMemberExpression(left ast.Expression) ast.Expression {
 	if !p.expectPeek(lexer.TOKEN_IDENT) {
 		return nil
 	}
-	exp.Member = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	exp.Member = p.curIdentifier()
 	return exp
 }
 
@@ -489,11 +527,18 @@ func (p *Parser) parseMatchExpression() ast.Expression {
 	}
 
 	expr.Arms = []*ast.MatchArm{}
-	for !p.peekTokenIs(lexer.TOKEN_RBRACE) {
+	for !p.peekTokenIs(lexer.TOKEN_RBRACE) && !p.peekTokenIs(lexer.TOKEN_EOF) {
 		p.nextToken()
+		mark := p.mark()
 		arm := p.parseMatchArm()
 		if arm != nil {
 			expr.Arms = append(expr.Arms, arm)
+		} else {
+			p.synchronize(mark, p.atMatchArmBoundary)
+		}
+		if p.closedBlock {
+			p.closedBlock = false
+			return expr
 		}
 	}
 
@@ -504,8 +549,15 @@ func (p *Parser) parseMatchExpression() ast.Expression {
 	return expr
 }
 
+// atMatchArmBoundary reports whether recovery inside a match has reached the
+// comma that separates arms.
+func (p *Parser) atMatchArmBoundary() bool {
+	return p.curTokenIs(lexer.TOKEN_COMMA)
+}
+
 func (p *Parser) parseMatchArm() *ast.MatchArm {
 	arm := &ast.MatchArm{Token: p.curToken}
+	start := p.curToken.Offset
 	arm.Pattern = p.parseExpression(LOWEST)
 
 	if !p.expectPeek(lexer.TOKEN_FAT_ARROW) {
@@ -515,7 +567,9 @@ func (p *Parser) parseMatchArm() *ast.MatchArm {
 	p.nextToken()
 	if p.curTokenIs(lexer.TOKEN_LBRACE) {
 		block := p.parseBlockStatement()
-		arm.Body = &ast.BlockExpression{Token: p.curToken, Block: block}
+		body := &ast.BlockExpression{Token: p.curToken, Block: block}
+		body.SetRange(block.Start, block.End)
+		arm.Body = body
 	} else {
 		arm.Body = p.parseExpression(LOWEST)
 	}
@@ -524,6 +578,7 @@ func (p *Parser) parseMatchArm() *ast.MatchArm {
 		p.nextToken()
 	}
 
+	p.finishNode(arm, start)
 	return arm
 }
 
@@ -536,16 +591,17 @@ func (p *Parser) parseInterpolatedString() ast.Expression {
 	expr.Parts = []ast.Expression{}
 
 	str := p.curToken.Literal
+	base := p.curToken.Offset + len(`f"`)
 	var current strings.Builder
+	chunkStart := 0
 	i := 0
 
 	for i < len(str) {
 		if str[i] == '{' && i+1 < len(str) && str[i+1] != '{' {
 			if current.Len() > 0 {
-				expr.Parts = append(expr.Parts, &ast.StringLiteral{
-					Token: p.curToken,
-					Value: current.String(),
-				})
+				part := &ast.StringLiteral{Token: p.curToken, Value: current.String()}
+				part.SetRange(base+chunkStart, base+i)
+				expr.Parts = append(expr.Parts, part)
 				current.Reset()
 			}
 
@@ -561,7 +617,7 @@ func (p *Parser) parseInterpolatedString() ast.Expression {
 			}
 
 			exprStr := str[i+1 : end-1]
-			exprLexer := lexer.New(exprStr)
+			exprLexer := lexer.NewAt(exprStr, base+i+1)
 			exprParser := New(exprLexer)
 			parsedExpr := exprParser.parseExpression(LOWEST)
 
@@ -574,6 +630,7 @@ func (p *Parser) parseInterpolatedString() ast.Expression {
 			}
 
 			i = end
+			chunkStart = i
 		} else if str[i] == '{' && i+1 < len(str) && str[i+1] == '{' {
 			current.WriteByte('{')
 			i += 2
@@ -587,10 +644,9 @@ func (p *Parser) parseInterpolatedString() ast.Expression {
 	}
 
 	if current.Len() > 0 {
-		expr.Parts = append(expr.Parts, &ast.StringLiteral{
-			Token: p.curToken,
-			Value: current.String(),
-		})
+		part := &ast.StringLiteral{Token: p.curToken, Value: current.String()}
+		part.SetRange(base+chunkStart, base+len(str))
+		expr.Parts = append(expr.Parts, part)
 	}
 
 	return expr
@@ -3,25 +3,28 @@ package types
 import "github.com/dev-dami/carv/pkg/ast"
 
 func (c *Checker) checkAwaitExpression(e *ast.AwaitExpression) Type {
+	if c.interrupt != "" || c.critical > 0 {
+		line, col := e.Pos()
+		if c.interrupt != "" {
+			c.error(line, col, "interrupt handler %s cannot await", c.interrupt)
+		} else {
+			c.error(line, col, "cannot await inside a critical block, which would hold interrupts off until it resumes")
+		}
+		return Any
+	}
 	if !c.inAsyncFn {
 		line, col := e.Pos()
 		c.error(line, col, "await can only be used inside async functions")
 		return Any
 	}
 
-	for name, info := range c.borrows {
-		if info.ImmutableCount > 0 || info.MutableActive {
-			line, col := e.Pos()
-			c.error(line, col, "borrow of '%s' cannot be held across await point", name)
-		}
-	}
-
 	innerType := c.checkExpression(e.Value)
+	line, col := e.Pos()
+	c.noteAwait(line, col)
 	if ft, ok := innerType.(*FutureType); ok {
 		return ft.Inner
 	}
 
-	line, col := e.Pos()
 	c.error(line, col, "await requires Future type, got %s", innerType.String())
 	return Any
 }
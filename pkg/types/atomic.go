@@ -0,0 +1,275 @@
+package types
+
+import "github.com/dev-dami/carv/pkg/ast"
+
+// An atomic<T>, which may also be spelled Atomic<T>, holds an integer or a
+// bool that is only read and written whole: load, store, fetch_add,
+// fetch_sub and compare_exchange. Each takes an optional memory ordering,
+// written out as Ordering.Relaxed, Acquire, Release, AcqRel or SeqCst, and
+// SeqCst when left out; compare_exchange takes one for success and one for
+// failure. fence(order) orders memory accesses without an atomic, and
+// compiler_barrier() only keeps the compiler from moving them.
+//
+// Integer literals take the sized integer type they are stored in, so an
+// atomic<u32> can start at 0 and fetch_add(1).
+
+var (
+	fenceBuiltin           = &FunctionType{Params: []Type{Any}, Return: Void}
+	compilerBarrierBuiltin = &FunctionType{Return: Void}
+)
+
+// Orderings are the memory orderings, weakest first, by their names in
+// Ordering.
+var Orderings = []string{"Relaxed", "Acquire", "Release", "AcqRel", "SeqCst"}
+
+// atomicMethod describes a method of an atomic: the values it takes, which
+// have the atomic's type, and how many orderings may follow them.
+type atomicMethod struct {
+	values, orderings int
+	integer           bool // only for integers
+}
+
+var atomicMethods = map[string]atomicMethod{
+	"load":             {0, 1, false},
+	"store":            {1, 1, false},
+	"fetch_add":        {1, 1, true},
+	"fetch_sub":        {1, 1, true},
+	"compare_exchange": {2, 2, false},
+}
+
+// atomicMember returns the type of the method member of the atomic t.
+func (c *Checker) atomicMember(e *ast.MemberExpression, t *AtomicType) Type {
+	m, ok := atomicMethods[e.Member.Value]
+	if !ok {
+		return nil
+	}
+	if m.integer && !IsInteger(t.Inner) {
+		line, col := e.Member.Pos()
+		c.error(line, col, "%s needs an integer atomic, got %s", e.Member.Value, t.String())
+		return Invalid
+	}
+	params := make([]Type, m.values)
+	for i := range params {
+		params[i] = t.Inner
+	}
+	switch e.Member.Value {
+	case "store":
+		return &FunctionType{Params: params, Return: Void}
+	case "compare_exchange":
+		return &FunctionType{Params: params, Return: Bool}
+	}
+	return &FunctionType{Params: params, Return: t.Inner}
+}
+
+// atomicReceiver returns the atomic whose method e calls, if it calls one.
+func (c *Checker) atomicReceiver(e *ast.CallExpression) *AtomicType {
+	member, ok := e.Function.(*ast.MemberExpression)
+	if !ok {
+		return nil
+	}
+	t := c.nodeTypes[member.Object]
+	if ref, ok := t.(*RefType); ok {
+		t = ref.Inner
+	}
+	if at, ok := t.(*AtomicType); ok {
+		if _, ok := atomicMethods[member.Member.Value]; ok {
+			return at
+		}
+	}
+	return nil
+}
+
+// checkAtomicCall checks a call of a method of an atomic, whose type
+// without orderings is ft.
+func (c *Checker) checkAtomicCall(e *ast.CallExpression, ft *FunctionType) Type {
+	method := e.Function.(*ast.MemberExpression).Member.Value
+	m := atomicMethods[method]
+	if n := len(e.Arguments); n < m.values || n > m.values+m.orderings {
+		line, col := e.Pos()
+		c.error(line, col, "%s expects %d to %d arguments, got %d", method, m.values, m.values+m.orderings, n)
+		return ft.Return
+	}
+	for i, arg := range e.Arguments[:m.values] {
+		argType := c.checkExpression(arg)
+		if !c.isAssignableValue(ft.Params[i], arg, argType) {
+			line, col := arg.Pos()
+			c.error(line, col, "argument %d: cannot pass %s as %s", i+1, argType.String(), ft.Params[i].String())
+		}
+	}
+
+	orders := e.Arguments[m.values:]
+	if len(orders) > 0 {
+		success := c.checkOrdering(orders[0])
+		switch {
+		case method == "load" && (success == "Release" || success == "AcqRel"),
+			method == "store" && (success == "Acquire" || success == "AcqRel"):
+			line, col := orders[0].Pos()
+			c.error(line, col, "%s cannot be Ordering.%s", method, success)
+		}
+	}
+	if len(orders) > 1 {
+		if failure := c.checkOrdering(orders[1]); failure == "Release" || failure == "AcqRel" {
+			// A failed compare_exchange only loads.
+			line, col := orders[1].Pos()
+			c.error(line, col, "the failure ordering of compare_exchange cannot be Ordering.%s", failure)
+		}
+	}
+	return ft.Return
+}
+
+// checkFenceCall checks fence(order?), which needs an ordering that
+// orders something.
+func (c *Checker) checkFenceCall(e *ast.CallExpression) Type {
+	if len(e.Arguments) > 1 {
+		line, col := e.Pos()
+		c.error(line, col, "fence expects 0 to 1 arguments, got %d", len(e.Arguments))
+		return Void
+	}
+	if len(e.Arguments) == 1 {
+		if order := c.checkOrdering(e.Arguments[0]); order == "Relaxed" {
+			line, col := e.Arguments[0].Pos()
+			c.error(line, col, "fence cannot be Ordering.Relaxed")
+		}
+	}
+	return Void
+}
+
+// OrderingOf returns the name of the ordering expr writes out, or "" if
+// it does not write one out.
+func OrderingOf(expr ast.Expression) string {
+	member, ok := expr.(*ast.MemberExpression)
+	if !ok {
+		return ""
+	}
+	if ident, ok := member.Object.(*ast.Identifier); !ok || ident.Value != "Ordering" {
+		return ""
+	}
+	for _, name := range Orderings {
+		if member.Member.Value == name {
+			return name
+		}
+	}
+	return ""
+}
+
+// checkOrdering returns the name of the ordering expr writes out; an
+// ordering is not a value, so it can only be written out where it is used.
+func (c *Checker) checkOrdering(expr ast.Expression) string {
+	if member, ok := expr.(*ast.MemberExpression); ok {
+		if ident, ok := member.Object.(*ast.Identifier); ok && ident.Value == "Ordering" && c.isGlobal("Ordering") {
+			name := OrderingOf(member)
+			if name == "" {
+				line, col := member.Member.Pos()
+				c.error(line, col, "undefined member %s on Ordering", member.Member.Value)
+			}
+			return name
+		}
+	}
+	c.checkExpression(expr)
+	line, col := expr.Pos()
+	c.error(line, col, "expected an ordering, like Ordering.Acquire")
+	return ""
+}
+
+// checkOrderingMember reports a use of Ordering.X anywhere but where an
+// ordering is expected.
+func (c *Checker) checkOrderingMember(e *ast.MemberExpression) Type {
+	line, col := e.Member.Pos()
+	if OrderingOf(e) == "" {
+		c.error(line, col, "undefined member %s on Ordering", e.Member.Value)
+	} else {
+		c.error(line, col, "Ordering.%s can only be passed to an atomic method or fence", e.Member.Value)
+	}
+	return Invalid
+}
+
+// isIntegerLiteral reports whether expr is an integer literal, or one
+// negated, and its value.
+func isIntegerLiteral(expr ast.Expression) (int64, bool) {
+	switch e := expr.(type) {
+	case *ast.IntegerLiteral:
+		return e.Value, true
+	case *ast.PrefixExpression:
+		if lit, ok := e.Right.(*ast.IntegerLiteral); ok && e.Operator == "-" {
+			return -lit.Value, true
+		}
+	}
+	return 0, false
+}
+
+// integerBits returns the width of the sized integer type t and whether it
+// is signed, or 0 for int and the pointer-sized types, whose width depends
+// on the target.
+func integerBits(t Type) (int, bool) {
+	switch {
+	case t.Equals(U8):
+		return 8, false
+	case t.Equals(U16):
+		return 16, false
+	case t.Equals(U32):
+		return 32, false
+	case t.Equals(U64):
+		return 64, false
+	case t.Equals(I8):
+		return 8, true
+	case t.Equals(I16):
+		return 16, true
+	case t.Equals(I32):
+		return 32, true
+	case t.Equals(I64):
+		return 64, true
+	}
+	return 0, true
+}
+
+// literalFits reports whether the integer literal v can be stored in the
+// integer type t.
+func literalFits(t Type, v int64) bool {
+	bits, signed := integerBits(t)
+	switch {
+	case bits == 0 || bits == 64 && signed:
+		return true
+	case !signed:
+		return v >= 0 && (bits == 64 || v < 1<<bits)
+	}
+	return v >= -(1<<(bits-1)) && v < 1<<(bits-1)
+}
+
+// isAssignableValue reports whether expr, of type source, can be stored
+// in a target of type target: an integer literal can be stored in any
+// integer type it fits in, and a volatile is stored as what it holds.
+func (c *Checker) isAssignableValue(target Type, expr ast.Expression, source Type) bool {
+	if c.isAssignable(target, source) {
+		return true
+	}
+	if v, ok := target.(*VolatileType); ok {
+		target = v.Inner
+		if c.isAssignable(target, source) {
+			return true
+		}
+	}
+	if v, ok := isIntegerLiteral(expr); ok && source.Equals(Int) && IsInteger(target) {
+		if !literalFits(target, v) {
+			line, col := expr.Pos()
+			c.error(line, col, "%d does not fit in %s", v, target.String())
+		}
+		return true
+	}
+	return false
+}
+
+// sizedArithmetic returns the sized integer type that an arithmetic
+// operator on left and right keeps, when both have it or one is an integer
+// literal, or nil.
+func sizedArithmetic(e *ast.InfixExpression, left, right Type) Type {
+	sized := func(t Type) bool { return IsInteger(t) && !t.Equals(Int) }
+	_, leftLit := isIntegerLiteral(e.Left)
+	_, rightLit := isIntegerLiteral(e.Right)
+	switch {
+	case sized(left) && (right.Equals(left) || rightLit):
+		return left
+	case sized(right) && leftLit:
+		return right
+	}
+	return nil
+}
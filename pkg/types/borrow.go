@@ -1,76 +1,494 @@
 package types
 
-import "github.com/dev-dami/carv/pkg/ast"
+import (
+	"fmt"
+	"sort"
 
-type BorrowInfo struct {
-	ImmutableCount int
-	MutableActive  bool
+	"github.com/dev-dami/carv/pkg/ast"
+)
+
+// Borrows are checked on the same control-flow graph as moves. Every &x or
+// &mut x is a loan of x. A loan bound to a reference variable lasts while
+// that variable may still be read, up to its last use on each path rather
+// than to the end of its scope; one that is not bound ends with the call or
+// statement that made it. Writing to, moving out of or conflictingly
+// borrowing x while a loan of it is live is reported together with where
+// the loan was made and where it is used later.
+
+// loan is one borrow of a local.
+type loan struct {
+	place     *local
+	mutable   bool
+	line, col int
+	seq       int
+	bound     bool // held by a reference variable
+	until     int  // otherwise the last event it is live through
+	through   bool // of a field behind place, a reference: a loan of what place borrows
+	origin    bool // what parameter place borrows from its caller, not a borrow made here
+	closure   bool // a closure's capture of place by reference
 }
 
-func (c *Checker) pushBorrows() map[string]*BorrowInfo {
-	prev := c.borrows
-	next := make(map[string]*BorrowInfo, len(prev))
-	for name, info := range prev {
-		cp := *info
-		next[name] = &cp
-	}
-	c.borrows = next
-	return prev
+// pendingMark is a point in the pending loans and reads of a graph, for
+// endTemporaries.
+type pendingMark struct {
+	loans, reads int
 }
 
-func (c *Checker) popBorrows(prev map[string]*BorrowInfo) {
-	c.borrows = prev
+func (g *flowGraph) mark() pendingMark {
+	return pendingMark{len(g.pendingLoans), len(g.pendingReads)}
 }
 
-func (c *Checker) checkBorrowExpression(e *ast.BorrowExpression) Type {
-	innerType := c.checkExpression(e.Value)
+// endTemporaries ends the loans made since m, which nothing holds once the
+// expression that made them is done.
+func (g *flowGraph) endTemporaries(m pendingMark) {
+	g.endBetween(m, g.mark())
+}
 
-	varName := ""
-	if ident, ok := e.Value.(*ast.Identifier); ok {
-		varName = ident.Value
+// endBetween ends the loans made from one mark to another, and forgets the
+// references read there.
+func (g *flowGraph) endBetween(from, to pendingMark) {
+	for _, ln := range g.pendingLoans[from.loans:to.loans] {
+		ln.until = g.seq
 	}
+	g.pendingLoans = append(g.pendingLoans[:from.loans], g.pendingLoans[to.loans:]...)
+	g.pendingReads = append(g.pendingReads[:from.reads], g.pendingReads[to.reads:]...)
+}
 
-	if varName != "" {
-		if own, exists := c.ownership[varName]; exists && own.State == Moved {
-			line, col := e.Pos()
-			c.warning(line, col, "cannot borrow moved value '%s' (moved at line %d)", varName, own.MovedAt)
-			return &RefType{Inner: innerType, Mutable: e.Mutable}
-		}
+// bindPending hands the pending loans and reads to a reference being
+// defined.
+func (g *flowGraph) bindPending() ([]*loan, []*local) {
+	loans, reads := g.pendingLoans, g.pendingReads
+	for _, ln := range loans {
+		ln.bound = true
+	}
+	g.pendingLoans, g.pendingReads = nil, nil
+	return loans, reads
+}
 
-		info := c.borrows[varName]
-		if info == nil {
-			info = &BorrowInfo{}
-			c.borrows[varName] = info
-		}
+// beginStatement starts a statement with nothing pending; endStatement ends
+// what it left unbound and restores what the enclosing one had.
+func (g *flowGraph) beginStatement() (loans []*loan, reads []*local) {
+	loans, reads = g.pendingLoans, g.pendingReads
+	g.pendingLoans, g.pendingReads = nil, nil
+	return loans, reads
+}
 
-		if e.Mutable {
-			if info.ImmutableCount > 0 {
-				line, col := e.Pos()
-				c.warning(line, col, "cannot mutably borrow '%s': already immutably borrowed", varName)
-			}
-			if info.MutableActive {
-				line, col := e.Pos()
-				c.warning(line, col, "cannot mutably borrow '%s': already mutably borrowed", varName)
-			}
-			info.MutableActive = true
+func (g *flowGraph) endStatement(loans []*loan, reads []*local) {
+	g.endTemporaries(pendingMark{})
+	g.pendingLoans, g.pendingReads = loans, reads
+}
+
+func (c *Checker) checkBorrowExpression(e *ast.BorrowExpression) Type {
+	innerType := c.checkExpression(e.Value)
+	if e.Mutable {
+		c.noteStaticWrite(e.Value)
+	}
+
+	// Borrowing a field or element of x is a loan of all of x.
+	if p, l := c.placeOf(e.Value); l != nil {
+		line, col := e.Pos()
+		ln := &loan{place: l, mutable: e.Mutable, line: line, col: col}
+		ln.through = (p.path != "" || p.indexed) && c.behindReference(p.root)
+		markOperand(l, p.root)
+		ln.seq = c.flow.record(flowEvent{kind: flowBorrow, local: l, path: p.path, line: line, col: col, loan: ln})
+		if l.graph == c.flow {
+			c.flow.pendingLoans = append(c.flow.pendingLoans, ln)
 		} else {
-			if info.MutableActive {
-				line, col := e.Pos()
-				c.warning(line, col, "cannot immutably borrow '%s': already mutably borrowed", varName)
-			}
-			info.ImmutableCount++
+			// A closure's borrow of a captured variable is only checked
+			// where the closure is made.
+			ln.until = ln.seq
 		}
+		l.graph.loans = append(l.graph.loans, ln)
 	}
 
 	return &RefType{Inner: innerType, Mutable: e.Mutable}
 }
 
+// markOperand marks the read of root, just recorded for l, as the operand
+// of a borrow: any loan it conflicts with, the borrow conflicts with too,
+// so only the borrow is reported.
+func markOperand(l *local, root *ast.Identifier) {
+	line, col := root.Pos()
+	events := l.graph.cur.events
+	for i := len(events) - 1; i >= 0; i-- {
+		if ev := &events[i]; ev.kind == flowUse && ev.local == l && ev.line == line && ev.col == col {
+			ev.operand = true
+			return
+		}
+	}
+}
+
 func (c *Checker) checkDerefExpression(e *ast.DerefExpression) Type {
 	innerType := c.checkExpression(e.Value)
 	if ref, ok := innerType.(*RefType); ok {
 		return ref.Inner
 	}
 	line, col := e.Pos()
-	c.warning(line, col, "dereference of non-reference type %s", innerType.String())
+	c.lint(lintNonReferenceDeref, line, col, "dereference of non-reference type %s", innerType.String())
 	return innerType
 }
+
+// noteAwait records a suspension point, across which no loan may be held.
+func (c *Checker) noteAwait(line, col int) {
+	c.flow.record(flowEvent{kind: flowAwait, line: line, col: col})
+}
+
+// containsRef reports whether values of t can hold references.
+func containsRef(t Type) bool {
+	switch t := t.(type) {
+	case *RefType:
+		return true
+	case *ArrayType:
+		return containsRef(t.Element)
+	case *MapType:
+		return containsRef(t.Key) || containsRef(t.Value)
+	case *VolatileType:
+		return containsRef(t.Inner)
+	case *MutexType:
+		return containsRef(t.Inner)
+	case *ClassType:
+		return t.Lifetime != ""
+	}
+	return false
+}
+
+// useSet is the reads of a reference that may come next.
+type useSet map[*flowEvent]bool
+
+// liveRefs maps each reference that may still be read to those reads.
+type liveRefs map[*local]useSet
+
+// loanSet maps each reference to the loans it may hold.
+type loanSet map[*local]map[*loan]bool
+
+// reportBorrows finds the conflicts between live loans and what is done to
+// the borrowed locals. Only reachable code is checked.
+func (c *Checker) reportBorrows(g *flowGraph) {
+	if len(g.loans) == 0 {
+		return
+	}
+	g.markLive()
+	liveOut := g.analyseLiveness()
+	holdsIn := g.analyseHolds()
+
+	for _, b := range g.blocks {
+		if !b.live {
+			continue
+		}
+		// Which references are read later, after each event.
+		after := make([]liveRefs, len(b.events))
+		live := copyLive(liveOut[b])
+		for i := len(b.events) - 1; i >= 0; i-- {
+			after[i] = copyLive(live)
+			live.apply(&b.events[i])
+		}
+
+		holds := copyHolds(holdsIn[b])
+		for i := range b.events {
+			ev := &b.events[i]
+			holds.apply(ev)
+			c.checkLoans(g, ev, after[i], holds)
+		}
+	}
+}
+
+// liveLoan is a loan that is still needed, and the read that needs it.
+type liveLoan struct {
+	*loan
+	use *flowEvent // nil for a temporary
+}
+
+// liveLoans lists the loans still needed after ev, earliest first.
+func (g *flowGraph) liveLoans(ev *flowEvent, live liveRefs, holds loanSet) []liveLoan {
+	found := make(map[*loan]*flowEvent)
+	for ref, uses := range live {
+		next := firstUse(uses)
+		for ln := range holds[ref] {
+			if prev, ok := found[ln]; !ok || next.line < prev.line {
+				found[ln] = next
+			}
+		}
+	}
+	var out []liveLoan
+	for ln, use := range found {
+		if !ln.origin {
+			out = append(out, liveLoan{ln, use})
+		}
+	}
+	for _, ln := range g.loans {
+		if !ln.bound && ln.seq < ev.seq && ev.seq <= ln.until {
+			out = append(out, liveLoan{ln, nil})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].seq < out[j].seq })
+	return out
+}
+
+func (c *Checker) checkLoans(g *flowGraph, ev *flowEvent, live liveRefs, holds loanSet) {
+	switch ev.kind {
+	case flowUse, flowBorrow, flowDef, flowMove, flowAwait:
+	default:
+		return
+	}
+	for _, ll := range g.liveLoans(ev, live, holds) {
+		if ll.loan == ev.loan || (ev.kind != flowAwait && ll.place != ev.local) {
+			continue
+		}
+		name := ll.place.name
+		switch ev.kind {
+		case flowUse:
+			if !ll.mutable || ev.operand {
+				continue
+			}
+			c.lint(lintUseWhileBorrowed, ev.line, ev.col, "cannot use '%s' while it is mutably borrowed (%s)", name, ll.describe())
+		case flowBorrow:
+			if !ll.mutable && !ev.loan.mutable {
+				continue
+			}
+			how, held := "immutably", "mutably"
+			if ev.loan.mutable {
+				how = "mutably"
+			}
+			if !ll.mutable {
+				held = "immutably"
+			}
+			c.lint(lintBorrowConflict, ev.line, ev.col, "cannot %s borrow '%s': already %s %s%s",
+				how, name, held, ll.made(), ll.laterUse())
+		case flowDef:
+			c.lint(lintAssignWhileBorrow, ev.line, ev.col, "cannot assign to '%s' while it is borrowed (%s)", name, ll.describe())
+		case flowMove:
+			c.lint(lintMoveWhileBorrowed, ev.line, ev.col, "cannot move out of '%s' while it is borrowed (%s)", name, ll.describe())
+		case flowAwait:
+			if ll.use == nil {
+				continue
+			}
+			c.lint(lintBorrowAcrossAwait, ev.line, ev.col, "borrow of '%s' cannot be held across await point (%s)", name, ll.describe())
+		}
+		return
+	}
+}
+
+func (ll liveLoan) laterUse() string {
+	if ll.use == nil {
+		return ""
+	}
+	return fmt.Sprintf(" (used later at line %d)", ll.use.line)
+}
+
+func (ll liveLoan) describe() string {
+	if ll.use == nil {
+		return ll.made()
+	}
+	return fmt.Sprintf("%s, used later at line %d", ll.made(), ll.use.line)
+}
+
+// made says where the loan was made.
+func (ll liveLoan) made() string {
+	if ll.closure {
+		return fmt.Sprintf("captured by the closure at line %d", ll.line)
+	}
+	return fmt.Sprintf("borrowed at line %d", ll.line)
+}
+
+func firstUse(uses useSet) *flowEvent {
+	var first *flowEvent
+	for ev := range uses {
+		if first == nil || ev.line < first.line || (ev.line == first.line && ev.col < first.col) {
+			first = ev
+		}
+	}
+	return first
+}
+
+// analyseLiveness computes, backwards, which references may be read after
+// each live block, and by which reads.
+func (g *flowGraph) analyseLiveness() map[*flowBlock]liveRefs {
+	succs := g.liveSuccessors()
+	in := make(map[*flowBlock]liveRefs)
+	out := make(map[*flowBlock]liveRefs)
+	for changed := true; changed; {
+		changed = false
+		for i := len(g.blocks) - 1; i >= 0; i-- {
+			b := g.blocks[i]
+			if !b.live {
+				continue
+			}
+			live := make(liveRefs)
+			for _, s := range succs[b] {
+				live.union(in[s])
+			}
+			out[b] = live
+			next := copyLive(live)
+			for j := len(b.events) - 1; j >= 0; j-- {
+				next.apply(&b.events[j])
+			}
+			if !next.equal(in[b]) {
+				in[b] = next
+				changed = true
+			}
+		}
+	}
+	return out
+}
+
+// analyseHolds computes, forwards, which loans each reference may hold at
+// the start of each live block.
+func (g *flowGraph) analyseHolds() map[*flowBlock]loanSet {
+	in := make(map[*flowBlock]loanSet)
+	out := make(map[*flowBlock]loanSet)
+	for changed := true; changed; {
+		changed = false
+		for _, b := range g.blocks {
+			if !b.live {
+				continue
+			}
+			holds := make(loanSet)
+			for _, e := range b.preds {
+				if e.from.live {
+					holds.union(out[e.from])
+				}
+			}
+			in[b] = holds
+			next := copyHolds(holds)
+			for i := range b.events {
+				next.apply(&b.events[i])
+			}
+			if prev, ok := out[b]; !ok || !next.equal(prev) {
+				out[b] = next
+				changed = true
+			}
+		}
+	}
+	return in
+}
+
+func (g *flowGraph) liveSuccessors() map[*flowBlock][]*flowBlock {
+	succs := make(map[*flowBlock][]*flowBlock)
+	for _, b := range g.blocks {
+		for _, e := range b.preds {
+			if !e.dead && e.from.live {
+				succs[e.from] = append(succs[e.from], b)
+			}
+		}
+	}
+	return succs
+}
+
+// apply steps backwards over ev.
+func (l liveRefs) apply(ev *flowEvent) {
+	if ev.local == nil || !ev.local.ref {
+		return
+	}
+	switch ev.kind {
+	case flowDef:
+		if ev.path == "" {
+			delete(l, ev.local)
+		}
+	case flowUse:
+		l[ev.local] = useSet{ev: true}
+	}
+}
+
+func (l liveRefs) union(o liveRefs) {
+	for ref, uses := range o {
+		if l[ref] == nil {
+			l[ref] = make(useSet)
+		}
+		for ev := range uses {
+			l[ref][ev] = true
+		}
+	}
+}
+
+func (l liveRefs) equal(o liveRefs) bool {
+	if o == nil || len(l) != len(o) {
+		return false
+	}
+	for ref, uses := range l {
+		if len(uses) != len(o[ref]) {
+			return false
+		}
+		for ev := range uses {
+			if !o[ref][ev] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func copyLive(l liveRefs) liveRefs {
+	c := make(liveRefs, len(l))
+	c.union(l)
+	return c
+}
+
+// apply steps forwards over ev.
+func (h loanSet) apply(ev *flowEvent) {
+	if ev.kind != flowDef || !ev.local.ref {
+		return
+	}
+	next := h.resolve(ev.loans, ev.copies)
+	if ev.path != "" {
+		// Only a field is given a value; the rest still holds its loans.
+		for ln := range h[ev.local] {
+			next[ln] = true
+		}
+	}
+	h[ev.local] = next
+}
+
+// resolve returns the loans a value holds that was made with loans and
+// from the references copies: a loan of a field behind a reference holds
+// what that reference does as well.
+func (h loanSet) resolve(loans []*loan, copies []*local) map[*loan]bool {
+	held := make(map[*loan]bool)
+	for _, ln := range loans {
+		held[ln] = true
+		if ln.through {
+			for inner := range h[ln.place] {
+				held[inner] = true
+			}
+		}
+	}
+	for _, ref := range copies {
+		for ln := range h[ref] {
+			held[ln] = true
+		}
+	}
+	return held
+}
+
+func (h loanSet) union(o loanSet) {
+	for ref, loans := range o {
+		if h[ref] == nil {
+			h[ref] = make(map[*loan]bool)
+		}
+		for ln := range loans {
+			h[ref][ln] = true
+		}
+	}
+}
+
+func (h loanSet) equal(o loanSet) bool {
+	if len(h) != len(o) {
+		return false
+	}
+	for ref, loans := range h {
+		if len(loans) != len(o[ref]) {
+			return false
+		}
+		for ln := range loans {
+			if !o[ref][ln] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func copyHolds(h loanSet) loanSet {
+	c := make(loanSet, len(h))
+	c.union(h)
+	return c
+}
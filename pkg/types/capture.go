@@ -0,0 +1,129 @@
+package types
+
+import "github.com/dev-dami/carv/pkg/ast"
+
+// A closure captures the variables of enclosing functions that its body
+// uses, and how is worked out from the body: a variable it only reads is
+// captured by reference, one it assigns to, or borrows mutably, by mutable
+// reference, and one it moves out of is moved into the closure. A move
+// closure, move fn, takes everything it captures by value.
+//
+// A capture by reference is a loan of the variable, made where the
+// closure is and held by it, like a reference it holds, for as long as
+// the closure may still be called. Until then the enclosing function may
+// not assign to or move the variable, nor, if the capture is mutable, read
+// it, and the closure cannot be returned or stored where it outlives it.
+
+// CaptureMode is how a closure holds a variable it captures.
+type CaptureMode int
+
+const (
+	CaptureRef    CaptureMode = iota // a shared reference to the variable
+	CaptureMutRef                    // a mutable reference to the variable
+	CaptureMove                      // the value, moved or copied in
+)
+
+func (m CaptureMode) String() string {
+	switch m {
+	case CaptureRef:
+		return "ref"
+	case CaptureMutRef:
+		return "mut ref"
+	}
+	return "move"
+}
+
+// Capture is a variable captured by a closure.
+type Capture struct {
+	Name string
+	Mode CaptureMode
+}
+
+// capturedLocal is a variable of an enclosing function that the body of a
+// graph uses, and what the body needs of it.
+type capturedLocal struct {
+	local *local
+	mode  CaptureMode
+}
+
+// Captures returns what each closure captures, in the order its body first
+// uses them. Code generation stores a pointer in the closure for a capture
+// by reference, and the value for one by move.
+func (c *Checker) Captures() map[*ast.FunctionLiteral][]Capture {
+	return c.captures
+}
+
+// capture notes that the body whose graph g is uses l, a variable of an
+// enclosing function, in a way that needs mode.
+func (g *flowGraph) capture(l *local, mode CaptureMode) {
+	for i := range g.captures {
+		if g.captures[i].local == l {
+			if mode > g.captures[i].mode {
+				g.captures[i].mode = mode
+			}
+			return
+		}
+	}
+	g.captures = append(g.captures, capturedLocal{local: l, mode: mode})
+}
+
+// captureMode is what a closure doing ev to a variable it captures needs
+// of it.
+func captureMode(ev *flowEvent) CaptureMode {
+	switch ev.kind {
+	case flowDef:
+		return CaptureMutRef
+	case flowMove:
+		return CaptureMove
+	case flowBorrow:
+		if ev.loan.mutable {
+			return CaptureMutRef
+		}
+	}
+	return CaptureRef
+}
+
+// captureMutation notes an assignment to a field or element of target,
+// which a closure needs a mutable reference for.
+func (c *Checker) captureMutation(target ast.Expression) {
+	if _, l := c.placeOf(target); l != nil && l.graph != c.flow {
+		c.flow.capture(l, CaptureMutRef)
+	}
+}
+
+// bindCaptures makes the closure e, whose body captured captured, hold
+// what it captures, in the function it is made in.
+func (c *Checker) bindCaptures(e *ast.FunctionLiteral, captured []capturedLocal) {
+	line, col := e.Pos()
+	captures := make([]Capture, 0, len(captured))
+	for _, cl := range captured {
+		l, mode := cl.local, cl.mode
+		if e.Move {
+			mode = CaptureMove
+		}
+		captures = append(captures, Capture{Name: l.name, Mode: mode})
+		if l.graph != c.flow {
+			// The closure this one is made in captures it as well.
+			c.flow.capture(l, mode)
+		}
+
+		switch mode {
+		case CaptureMove:
+			// A move out of the body was recorded where the body was; a
+			// move closure moves the rest in here.
+			if t, _ := c.scope.Lookup(l.name); e.Move && cl.mode != CaptureMove && IsMoveType(t) {
+				c.flow.record(flowEvent{kind: flowMove, local: l, line: line, col: col, movedTo: "closure"})
+			}
+		default:
+			ln := &loan{place: l, mutable: mode == CaptureMutRef, line: line, col: col, closure: true}
+			ln.seq = c.flow.record(flowEvent{kind: flowBorrow, local: l, line: line, col: col, loan: ln})
+			if l.graph == c.flow {
+				c.flow.pendingLoans = append(c.flow.pendingLoans, ln)
+			} else {
+				ln.until = ln.seq
+			}
+			l.graph.loans = append(l.graph.loans, ln)
+		}
+	}
+	c.captures[e] = captures
+}
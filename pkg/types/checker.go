@@ -2,6 +2,7 @@ package types
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/dev-dami/carv/pkg/ast"
 )
@@ -10,28 +11,66 @@ type CheckIssue struct {
 	Line    int
 	Column  int
 	Kind    string
+	Lint    string // the lint that reported it, if any
+	Code    string // the lint's stable code, if it has one
 	Message string
 }
 
 type Checker struct {
 	errors         []CheckIssue
 	warnings       []CheckIssue
-	ownership      map[string]*VarOwnership
-	borrows        map[string]*BorrowInfo
+	flow           *flowGraph
+	lintLevels     map[string]LintLevel   // set for the whole program
+	lintScopes     []map[string]LintLevel // set by attributes, innermost last
 	scope          *Scope
 	nodeTypes      map[ast.Expression]Type
+	moves          map[ast.Expression]bool
+	captures       map[*ast.FunctionLiteral][]Capture
 	impls          map[string]map[string]bool
 	ifaceReceivers map[string]map[string]ast.ReceiverKind
 	inAsyncFn      bool
+	fnName         string
+
+	interrupt   string          // the handler being checked, or ""
+	critical    int             // critical blocks around what is checked
+	section     *local          // what lock borrows: the innermost critical block, or the handler
+	interrupts  map[string]bool // handlers declared so far
+	vectors     map[string]bool // entries of the target's vector table, or nil if not known
+	vectorIRQs  bool            // whether vectors lists the device interrupts
+	statics     map[string]bool // top-level statics a handler could share
+	staticUses  []staticUse
+	staticCalls []staticCall
+	unsafeUses  []unsafeUse
+
+	staticMemory bool
+	freestanding string // the target, when it has no operating system
 }
 
 type Scope struct {
 	symbols map[string]Type
+	locals  map[string]*local        // move-type variables, for ownership analysis
+	objects map[string]int           // variables holding a stack object, to its block's depth
+	results map[string]resultPayload // what Results that names return or hold carry
 	parent  *Scope
+	depth   int // how many scopes enclose this one
 }
 
 func NewScope(parent *Scope) *Scope {
-	return &Scope{symbols: make(map[string]Type), parent: parent}
+	s := &Scope{symbols: make(map[string]Type), parent: parent}
+	if parent != nil {
+		s.depth = parent.depth + 1
+	}
+	return s
+}
+
+// defining returns the scope that defines name, or nil.
+func (s *Scope) defining(name string) *Scope {
+	for sc := s; sc != nil; sc = sc.parent {
+		if _, ok := sc.symbols[name]; ok {
+			return sc
+		}
+	}
+	return nil
 }
 
 func (s *Scope) Define(name string, t Type) {
@@ -48,18 +87,29 @@ func (s *Scope) Lookup(name string) (Type, bool) {
 	return nil, false
 }
 
+// lookupLocal returns the move-type local that name refers to, or nil if
+// name is not one.
+func (s *Scope) lookupLocal(name string) *local {
+	if sc := s.defining(name); sc != nil {
+		return sc.locals[name]
+	}
+	return nil
+}
+
 func NewChecker() *Checker {
 	c := &Checker{
 		errors:         []CheckIssue{},
 		warnings:       []CheckIssue{},
-		ownership:      make(map[string]*VarOwnership),
-		borrows:        make(map[string]*BorrowInfo),
 		scope:          NewScope(nil),
 		nodeTypes:      make(map[ast.Expression]Type),
+		moves:          make(map[ast.Expression]bool),
+		captures:       make(map[*ast.FunctionLiteral][]Capture),
 		impls:          make(map[string]map[string]bool),
 		ifaceReceivers: make(map[string]map[string]ast.ReceiverKind),
+		flow:           newFlowGraph(),
 	}
 	c.defineBuiltins()
+	c.defineDropInterface()
 	return c
 }
 
@@ -67,6 +117,13 @@ func (c *Checker) TypeInfo() map[ast.Expression]Type {
 	return c.nodeTypes
 }
 
+// Moves returns the expressions whose value is moved out of the place they
+// name. Code generation empties those places, so that what was in them is
+// dropped once, by its new owner.
+func (c *Checker) Moves() map[ast.Expression]bool {
+	return c.moves
+}
+
 func (c *Checker) recordType(expr ast.Expression, t Type) Type {
 	if expr != nil && t != nil {
 		c.nodeTypes[expr] = t
@@ -100,11 +157,20 @@ func (c *Checker) defineBuiltins() {
 	c.scope.Define("starts_with", &FunctionType{Params: []Type{String, String}, Return: Bool})
 	c.scope.Define("ends_with", &FunctionType{Params: []Type{String, String}, Return: Bool})
 	c.scope.Define("replace", &FunctionType{Params: []Type{String, String, String}, Return: String})
+	c.scope.Define("take", takeBuiltin)
+	c.scope.Define("exchange", exchangeBuiltin)
+	c.scope.Define("Atomic", atomicBuiltin)
+	c.scope.Define("Mutex", mutexBuiltin)
+	c.scope.Define("Ordering", &ModuleType{Name: "Ordering"})
+	c.scope.Define("fence", fenceBuiltin)
+	c.scope.Define("compiler_barrier", compilerBarrierBuiltin)
 	c.scope.Define("index_of", &FunctionType{Params: []Type{String, String}, Return: Int})
 	c.scope.Define("to_upper", &FunctionType{Params: []Type{String}, Return: String})
 	c.scope.Define("to_lower", &FunctionType{Params: []Type{String}, Return: String})
 	c.scope.Define("exit", &FunctionType{Params: []Type{Int}, Return: Void})
 	c.scope.Define("panic", &FunctionType{Params: []Type{Any}, Return: Void})
+	c.scope.Define("assert", &FunctionType{Params: []Type{Bool, String}, Return: Void})
+	c.scope.Define("assert_eq", &FunctionType{Params: []Type{Any, Any}, Return: Void})
 	c.scope.Define("type_of", &FunctionType{Params: []Type{Any}, Return: String})
 	c.scope.Define("keys", &FunctionType{Params: []Type{Any}, Return: &ArrayType{Element: Any}})
 	c.scope.Define("values", &FunctionType{Params: []Type{Any}, Return: &ArrayType{Element: Any}})
@@ -184,6 +250,10 @@ func builtinModuleMemberTypes(moduleName string) map[string]Type {
 func (c *Checker) Errors() []string {
 	out := make([]string, len(c.errors))
 	for i, issue := range c.errors {
+		if issue.Lint != "" {
+			out[i] = fmt.Sprintf("error%s at %d:%d: %s", issue.tag(), issue.Line, issue.Column, issue.Message)
+			continue
+		}
 		out[i] = fmt.Sprintf("type error at %d:%d: %s", issue.Line, issue.Column, issue.Message)
 	}
 	return out
@@ -192,7 +262,7 @@ func (c *Checker) Errors() []string {
 func (c *Checker) Warnings() []string {
 	out := make([]string, len(c.warnings))
 	for i, issue := range c.warnings {
-		out[i] = fmt.Sprintf("warning at line %d, col %d: %s", issue.Line, issue.Column, issue.Message)
+		out[i] = fmt.Sprintf("warning%s at line %d, col %d: %s", issue.tag(), issue.Line, issue.Column, issue.Message)
 	}
 	return out
 }
@@ -224,13 +294,36 @@ func (c *Checker) warning(line, col int, format string, args ...interface{}) {
 }
 
 func (c *Checker) Check(program *ast.Program) bool {
+	prevFlow := c.beginFlow()
+	c.flow.top = true
 	for _, stmt := range program.Statements {
 		c.checkStatement(stmt)
+		if s, ok := stmt.(*ast.LetStatement); ok && s.Static {
+			c.declareStatic(s)
+		}
 	}
+	c.endFlow(prevFlow)
+	c.checkSharedStatics()
+	c.checkInterruptCalls()
+
+	// Ownership is reported per function, after its body; keep the
+	// diagnostics in source order.
+	sortIssues(c.errors)
+	sortIssues(c.warnings)
 	return len(c.errors) == 0
 }
 
+func sortIssues(issues []CheckIssue) {
+	sort.SliceStable(issues, func(i, j int) bool {
+		a, b := issues[i], issues[j]
+		return a.Line < b.Line || (a.Line == b.Line && a.Column < b.Column)
+	})
+}
+
 func (c *Checker) checkStatement(stmt ast.Statement) {
+	loans, reads := c.flow.beginStatement()
+	defer c.flow.endStatement(loans, reads)
+
 	switch s := stmt.(type) {
 	case *ast.LetStatement:
 		c.checkLetStatement(s)
@@ -252,6 +345,10 @@ func (c *Checker) checkStatement(stmt ast.Statement) {
 		c.checkLoopStatement(s)
 	case *ast.BlockStatement:
 		c.checkBlockStatement(s)
+	case *ast.BreakStatement:
+		c.flow.breakLoop()
+	case *ast.ContinueStatement:
+		c.flow.continueLoop()
 	case *ast.RequireStatement:
 		c.checkRequireStatement(s)
 	case *ast.ClassStatement:
@@ -260,14 +357,26 @@ func (c *Checker) checkStatement(stmt ast.Statement) {
 		c.checkInterfaceStatement(s)
 	case *ast.ImplStatement:
 		c.checkImplStatement(s)
+	case *ast.CriticalStatement:
+		c.checkCriticalStatement(s)
+	case *ast.BadStmt:
+		// Already reported by the parser.
 	}
 }
 
-func (c *Checker) bindCheckedValue(name string, declared ast.TypeExpr, valueType Type, line, col int) Type {
+func (c *Checker) bindCheckedValue(ident *ast.Identifier, declared ast.TypeExpr, value ast.Expression, valueType Type, line, col int) Type {
+	name := ident.Value
 	boundType := valueType
 	if declared != nil {
 		declType := c.resolveTypeExpr(declared)
-		if declType != nil && !c.isAssignable(declType, valueType) {
+		target := declType
+		if at, ok := declType.(*AtomicType); ok {
+			// An atomic starts out holding its initializer.
+			if _, isAtomic := valueType.(*AtomicType); !isAtomic {
+				target = at.Inner
+			}
+		}
+		if declType != nil && !c.isAssignableValue(target, value, valueType) {
 			c.error(line, col, "cannot assign %s to %s", valueType.String(), declType.String())
 		}
 		c.scope.Define(name, declType)
@@ -275,7 +384,8 @@ func (c *Checker) bindCheckedValue(name string, declared ast.TypeExpr, valueType
 	} else {
 		c.scope.Define(name, valueType)
 	}
-	c.trackOwnership(name, boundType)
+	nameLine, nameCol := ident.Pos()
+	c.trackOwnership(name, boundType, nameLine, nameCol)
 	return boundType
 }
 
@@ -295,8 +405,10 @@ func (c *Checker) checkConditionIsBool(expr ast.Expression, context string) {
 	if expr == nil {
 		return
 	}
+	mark := c.flow.mark()
 	condType := c.checkExpression(expr)
-	if condType != nil && !condType.Equals(Bool) {
+	c.flow.endTemporaries(mark)
+	if condType != nil && !condType.Equals(Bool) && !IsInvalid(condType) {
 		line, col := expr.Pos()
 		c.error(line, col, "%s condition must be bool, got %s", context, condType.String())
 	}
@@ -309,7 +421,9 @@ func (c *Checker) checkLetStatement(s *ast.LetStatement) {
 	}
 
 	line, col := s.Pos()
-	c.bindCheckedValue(s.Name.Value, s.Type, valType, line, col)
+	c.bindCheckedValue(s.Name, s.Type, s.Value, valType, line, col)
+	c.trackStackObject(s.Name.Value, s.Value)
+	c.recordResult(s.Name.Value, s.Value)
 
 	if IsMoveType(valType) {
 		c.markMoveFromExpression(s.Value, line, s.Name.Value)
@@ -323,7 +437,7 @@ func (c *Checker) checkConstStatement(s *ast.ConstStatement) {
 	}
 
 	line, col := s.Pos()
-	c.bindCheckedValue(s.Name.Value, s.Type, valType, line, col)
+	c.bindCheckedValue(s.Name, s.Type, s.Value, valType, line, col)
 
 	if IsMoveType(valType) {
 		c.markMoveFromExpression(s.Value, line, s.Name.Value)
@@ -343,26 +457,74 @@ func (c *Checker) checkFunctionStatement(s *ast.FunctionStatement) {
 		fnRetType = &FutureType{Inner: retType}
 	}
 
-	fnType := &FunctionType{Params: paramTypes, Return: fnRetType}
-	c.scope.Define(s.Name.Value, fnType)
+	c.checkAttributes(s)
+	if s.Interrupt {
+		c.checkInterruptFunction(s, retType)
+	}
+
+	borrows := c.returnBorrows(s.Parameters, paramTypes, s.ReturnType, retType, nil)
+	fnType := &FunctionType{Params: paramTypes, Return: fnRetType, Borrows: borrows}
+	if s.Async {
+		fnType.Borrows = futureBorrows(paramTypes)
+	}
+	if s.Test {
+		// Test functions only exist in `carv test` builds, so nothing may call them.
+		if len(s.Parameters) > 0 || !retType.Equals(Void) || s.Async {
+			line, col := s.Pos()
+			c.error(line, col, "test function %s must take no parameters and return nothing", s.Name.Value)
+		}
+	} else {
+		c.scope.Define(s.Name.Value, fnType)
+	}
+
+	c.pushLintAttributes(s.Attributes)
+	defer c.popLintAttributes()
 
 	prevScope := c.scope
-	prevOwnership := c.pushOwnership()
-	prevBorrows := c.pushBorrows()
+	prevFlow := c.beginFlow()
 	prevAsync := c.inAsyncFn
+	prevFn := c.fnName
+	prevInterrupt, prevCritical, prevSection := c.interrupt, c.critical, c.section
 	c.scope = NewScope(prevScope)
 	c.inAsyncFn = s.Async
+	c.fnName = s.Name.Value
+	c.interrupt, c.critical, c.section = "", 0, nil
+	if s.Interrupt {
+		c.interrupt = s.Name.Value
+		c.section = c.newSection("interrupt handler", c.scope.depth)
+	}
 
 	for i, p := range s.Parameters {
 		c.scope.Define(p.Name.Value, paramTypes[i])
-		c.trackOwnership(p.Name.Value, paramTypes[i])
+		c.trackParameter(p.Name, paramTypes[i])
 	}
+	c.enterSignature(s.Parameters, nil, retType, borrows)
 
-	c.checkBlockStatement(s.Body)
+	c.checkFunctionBody(s.Body)
 	c.scope = prevScope
 	c.inAsyncFn = prevAsync
-	c.popOwnership(prevOwnership)
-	c.popBorrows(prevBorrows)
+	c.fnName = prevFn
+	c.interrupt, c.critical, c.section = prevInterrupt, prevCritical, prevSection
+	c.endFlow(prevFlow)
+}
+
+// knownAttributes lists the #[...] attributes the compiler understands.
+var knownAttributes = map[string]bool{
+	"test":  true,
+	"allow": true,
+	"warn":  true,
+	"deny":  true,
+}
+
+func (c *Checker) checkAttributes(s *ast.FunctionStatement) {
+	for _, attr := range s.Attributes {
+		if _, ok := lintAttributes[attr.Name.Value]; ok {
+			c.checkLintAttribute(attr)
+		} else if !knownAttributes[attr.Name.Value] {
+			line, col := attr.Pos()
+			c.error(line, col, "unknown attribute #[%s]", attr.Name.Value)
+		}
+	}
 }
 
 func (c *Checker) checkReturnStatement(s *ast.ReturnStatement) {
@@ -372,71 +534,101 @@ func (c *Checker) checkReturnStatement(s *ast.ReturnStatement) {
 			line, _ := s.ReturnValue.Pos()
 			c.markMoveFromExpression(s.ReturnValue, line, "return")
 		}
-		if _, isRef := retType.(*RefType); isRef {
-			line, col := s.ReturnValue.Pos()
-			c.warning(line, col, "reference cannot escape function scope")
-		}
+		c.checkReturnedBorrows(s.ReturnValue, retType)
+		c.checkStaticReturn(s)
+		c.recordResult(c.fnName, s.ReturnValue)
 	}
+	c.flow.terminate()
 }
 
+// The loops below check the condition in the loop's header block, so that
+// what the body moves reaches it, and the next iteration, through the edge
+// back to the header.
+
 func (c *Checker) checkForStatement(s *ast.ForStatement) {
 	prevScope := c.scope
-	prevOwnership := c.pushOwnership()
-	prevBorrows := c.pushBorrows()
 	c.scope = NewScope(prevScope)
 
 	if s.Init != nil {
 		c.checkStatement(s.Init)
 	}
+	loop := c.flow.loop()
 	c.checkConditionIsBool(s.Condition, "for")
+	if s.Condition != nil {
+		loop.exit(c.flow)
+	}
+	c.flow.branch()
+
+	// The post statement runs after the body, and continue goes to it.
+	loop.cont = c.flow.newBlock()
+	c.checkBlockStatement(s.Body)
+	c.flow.enter(loop.cont)
 	if s.Post != nil {
 		c.checkStatement(s.Post)
 	}
-	c.checkBlockStatement(s.Body)
+	c.flow.endLoop()
 
 	c.scope = prevScope
-	c.popOwnership(prevOwnership)
-	c.popBorrows(prevBorrows)
 }
 
 func (c *Checker) checkForInStatement(s *ast.ForInStatement) {
 	iterType := c.checkExpression(s.Iterable)
 
 	prevScope := c.scope
-	prevOwnership := c.pushOwnership()
-	prevBorrows := c.pushBorrows()
 	c.scope = NewScope(prevScope)
 
+	loop := c.flow.loop()
+	loop.exit(c.flow)
+	c.flow.branch()
 	if arr, ok := iterType.(*ArrayType); ok {
 		c.scope.Define(s.Value.Value, arr.Element)
-		c.trackOwnership(s.Value.Value, arr.Element)
+		c.trackParameter(s.Value, arr.Element)
 	} else {
 		c.scope.Define(s.Value.Value, Any)
-		c.trackOwnership(s.Value.Value, Any)
+		c.trackParameter(s.Value, Any)
 	}
 
 	c.checkBlockStatement(s.Body)
+	c.flow.endLoop()
 	c.scope = prevScope
-	c.popOwnership(prevOwnership)
-	c.popBorrows(prevBorrows)
 }
 
 func (c *Checker) checkWhileStatement(s *ast.WhileStatement) {
+	loop := c.flow.loop()
 	c.checkConditionIsBool(s.Condition, "while")
+	loop.exit(c.flow)
+	c.flow.branch()
 	c.checkBlockStatement(s.Body)
+	c.flow.endLoop()
 }
 
 func (c *Checker) checkLoopStatement(s *ast.LoopStatement) {
+	c.flow.loop()
 	c.checkBlockStatement(s.Body)
+	c.flow.endLoop()
 }
 
+// checkBlockStatement checks a block, whose locals are only visible, and
+// only live, until it ends.
 func (c *Checker) checkBlockStatement(s *ast.BlockStatement) {
+	prevScope := c.scope
+	c.scope = NewScope(prevScope)
+	for _, stmt := range s.Statements {
+		c.checkStatement(stmt)
+	}
+	c.scope = prevScope
+}
+
+// checkFunctionBody checks the body of a function in the scope that holds
+// its parameters, which live exactly as long as its locals.
+func (c *Checker) checkFunctionBody(s *ast.BlockStatement) {
 	for _, stmt := range s.Statements {
 		c.checkStatement(stmt)
 	}
 }
 
 func (c *Checker) checkRequireStatement(s *ast.RequireStatement) {
+	c.checkHostedRequire(s)
 	if s.Alias != nil {
 		c.scope.Define(s.Alias.Value, &ModuleType{Name: s.Path.Value})
 	} else if len(s.Names) > 0 {
@@ -473,6 +665,8 @@ func (c *Checker) checkExpression(expr ast.Expression) Type {
 
 	var t Type
 	switch e := expr.(type) {
+	case *ast.BadExpr:
+		t = Invalid
 	case *ast.IntegerLiteral:
 		t = Int
 	case *ast.FloatLiteral:
@@ -494,7 +688,13 @@ func (c *Checker) checkExpression(expr ast.Expression) Type {
 	case *ast.AssignExpression:
 		t = c.checkAssignExpression(e)
 	case *ast.CallExpression:
+		// Loans passed to a call end with it unless what it returns may
+		// hold them.
+		mark := c.flow.mark()
 		t = c.checkCallExpression(e)
+		if !holdsBorrows(t) {
+			c.flow.endTemporaries(mark)
+		}
 	case *ast.ArrayLiteral:
 		t = c.checkArrayLiteral(e)
 	case *ast.MapLiteral:
@@ -503,12 +703,20 @@ func (c *Checker) checkExpression(expr ast.Expression) Type {
 		t = c.checkIndexExpression(e)
 	case *ast.IfExpression:
 		t = c.checkIfExpression(e)
+	case *ast.MatchExpression:
+		t = c.checkMatchExpression(e)
+	case *ast.OkExpression:
+		t = c.checkResultValue(e.Value)
+	case *ast.ErrExpression:
+		t = c.checkResultValue(e.Value)
 	case *ast.FunctionLiteral:
 		t = c.checkFunctionLiteral(e)
 	case *ast.MemberExpression:
 		t = c.checkMemberExpression(e)
 	case *ast.SpawnExpression:
 		t = c.checkSpawnExpression(e)
+	case *ast.NewExpression:
+		t = c.checkNewExpression(e)
 	case *ast.InterpolatedString:
 		t = c.checkInterpolatedString(e)
 	case *ast.BorrowExpression:
@@ -519,10 +727,13 @@ func (c *Checker) checkExpression(expr ast.Expression) Type {
 		t = c.checkCastExpression(e)
 	case *ast.AwaitExpression:
 		t = c.checkAwaitExpression(e)
+	case *ast.TryExpression:
+		t = c.checkTryExpression(e)
 	default:
 		t = Any
 	}
 
+	c.checkInterruptSafe(expr, t)
 	return c.recordType(expr, t)
 }
 
@@ -533,15 +744,17 @@ func (c *Checker) checkIdentifier(e *ast.Identifier) Type {
 		c.error(line, col, "undefined: %s", e.Value)
 		return Any
 	}
-	if own, exists := c.ownership[e.Value]; exists && own.State == Moved {
-		line, col := e.Pos()
-		c.warning(line, col, "use of moved value '%s' (moved at line %d)", e.Value, own.MovedAt)
-	}
+	line, col := e.Pos()
+	c.noteOwnership(flowUse, e.Value, line, col, "")
+	c.noteStaticUse(e, false)
 	return t
 }
 
 func (c *Checker) checkPrefixExpression(e *ast.PrefixExpression) Type {
 	rightType := c.checkExpression(e.Right)
+	if IsInvalid(rightType) {
+		return Invalid
+	}
 
 	switch e.Operator {
 	case "-":
@@ -565,7 +778,18 @@ func (c *Checker) checkPrefixExpression(e *ast.PrefixExpression) Type {
 
 func (c *Checker) checkInfixExpression(e *ast.InfixExpression) Type {
 	leftType := c.checkExpression(e.Left)
-	rightType := c.checkExpression(e.Right)
+	var rightType Type
+	if e.Operator == "&&" || e.Operator == "||" {
+		// The right operand may not run.
+		from := c.flow.branch()
+		rightType = c.checkExpression(e.Right)
+		c.flow.join(from)
+	} else {
+		rightType = c.checkExpression(e.Right)
+	}
+	if IsInvalid(leftType) || IsInvalid(rightType) {
+		return Invalid
+	}
 
 	switch e.Operator {
 	case "+", "-", "*", "/", "%":
@@ -580,6 +804,9 @@ func (c *Checker) checkInfixExpression(e *ast.InfixExpression) Type {
 		if leftType.Equals(Float) || rightType.Equals(Float) {
 			return Float
 		}
+		if t := sizedArithmetic(e, leftType, rightType); t != nil {
+			return t
+		}
 		return Int
 
 	case "<", ">", "<=", ">=":
@@ -622,16 +849,23 @@ func (c *Checker) checkAssignExpression(e *ast.AssignExpression) Type {
 			return Any
 		}
 
+		line, col := ident.Pos()
 		if e.Operator == "=" {
-			if !c.isAssignable(leftType, rightType) {
+			if !c.isAssignableValue(leftType, e.Right, rightType) {
 				line, col := e.Pos()
 				c.error(line, col, "cannot assign %s to %s", rightType.String(), leftType.String())
 			}
+			c.checkStaticStore(ident, e.Right)
+			if IsMoveType(rightType) {
+				c.markMoveFromExpression(e.Right, line, ident.Value)
+			}
+		} else {
+			c.noteOwnership(flowUse, ident.Value, line, col, "")
 		}
-		if bi, exists := c.borrows[ident.Value]; exists && (bi.ImmutableCount > 0 || bi.MutableActive) {
-			line, col := e.Pos()
-			c.warning(line, col, "cannot assign to '%s' while it is borrowed", ident.Value)
-		}
+		// Assigning gives a moved variable a value again, and may not
+		// happen while it is borrowed.
+		c.noteOwnership(flowDef, ident.Value, line, col, "")
+		c.noteStaticUse(ident, true)
 		return leftType
 	}
 
@@ -640,16 +874,47 @@ func (c *Checker) checkAssignExpression(e *ast.AssignExpression) Type {
 			if selfType, exists := c.scope.Lookup("self"); exists {
 				if ref, ok := selfType.(*RefType); ok && !ref.Mutable {
 					line, col := e.Pos()
-					c.warning(line, col, "cannot assign to field through immutable receiver (&self)")
+					c.lint(lintSharedMutation, line, col, "cannot assign to field through immutable receiver (&self)")
 				}
 			}
 		}
+		mark := c.flow.mark()
 		leftType := c.checkExpression(member)
+		// What the value borrows is what the right side does.
+		c.flow.endTemporaries(mark)
+		c.captureMutation(member)
+		c.noteStaticWrite(member)
 		if e.Operator == "=" {
-			if !c.isAssignable(leftType, rightType) {
+			if !c.isAssignableValue(leftType, e.Right, rightType) {
 				line, col := e.Pos()
 				c.error(line, col, "cannot assign %s to %s", rightType.String(), leftType.String())
 			}
+			c.checkStoredBorrows(member, rightType)
+			c.checkStaticStore(member, e.Right)
+			c.defineField(member)
+			if IsMoveType(rightType) {
+				line, _ := e.Pos()
+				c.markMoveFromExpression(e.Right, line, member.Member.Value)
+			}
+		}
+		return leftType
+	}
+
+	if index, ok := e.Left.(*ast.IndexExpression); ok {
+		leftType := c.checkExpression(index)
+		c.captureMutation(index)
+		c.noteStaticWrite(index)
+		if e.Operator == "=" {
+			c.moveIntoContainer(e.Right, rightType)
+			c.checkStaticStore(index, e.Right)
+		}
+		return leftType
+	}
+
+	if deref, ok := e.Left.(*ast.DerefExpression); ok {
+		leftType := c.checkExpression(deref)
+		if e.Operator == "=" {
+			c.checkStaticStore(deref, e.Right)
 		}
 		return leftType
 	}
@@ -659,13 +924,49 @@ func (c *Checker) checkAssignExpression(e *ast.AssignExpression) Type {
 
 func (c *Checker) checkCallExpression(e *ast.CallExpression) Type {
 	fnType := c.checkExpression(e.Function)
+	if member, ok := e.Function.(*ast.MemberExpression); ok && member.Member.Value == "drop" {
+		c.checkExplicitDrop(member)
+	}
 
 	ft, ok := fnType.(*FunctionType)
 	if !ok {
+		for _, arg := range e.Arguments {
+			c.checkExpression(arg)
+		}
+		if IsInvalid(fnType) {
+			return Invalid
+		}
 		return Any
 	}
 
 	isVariadic := c.isVariadicFunction(e)
+	c.noteCall(e)
+	c.checkStaticCall(e)
+	c.checkHostedCall(e)
+	c.checkStaticAsyncCall(e, ft)
+
+	if ident, ok := e.Function.(*ast.Identifier); ok && ident.Value == "assert" {
+		if len(e.Arguments) < 1 || len(e.Arguments) > 2 {
+			line, col := e.Pos()
+			c.error(line, col, "assert expects a condition and an optional message, got %d arguments", len(e.Arguments))
+		}
+	}
+
+	if ft == takeBuiltin {
+		return c.checkTakeCall(e, "take")
+	}
+	if ft == exchangeBuiltin {
+		return c.checkTakeCall(e, "exchange")
+	}
+	if ft == atomicBuiltin || ft == mutexBuiltin {
+		return c.checkSyncConstructor(e, ft)
+	}
+	if ft == fenceBuiltin {
+		return c.checkFenceCall(e)
+	}
+	if c.atomicReceiver(e) != nil {
+		return c.checkAtomicCall(e, ft)
+	}
 
 	if !isVariadic && len(e.Arguments) != len(ft.Params) {
 		line, col := e.Pos()
@@ -677,16 +978,28 @@ func (c *Checker) checkCallExpression(e *ast.CallExpression) Type {
 	borrowOnly := false
 	if ident, ok := e.Function.(*ast.Identifier); ok {
 		switch ident.Value {
-		case "print", "println", "len", "type_of", "clone":
+		case "print", "println", "len", "type_of", "clone", "assert", "assert_eq":
 			borrowOnly = true
 		}
 	}
 
+	if ident, ok := e.Function.(*ast.Identifier); ok && ident.Value == "assert_eq" {
+		left := c.checkExpression(e.Arguments[0])
+		right := c.checkExpression(e.Arguments[1])
+		if !c.isAssignable(left, right) && !c.isAssignable(right, left) {
+			line, col := e.Pos()
+			c.error(line, col, "assert_eq: cannot compare %s with %s", left.String(), right.String())
+		}
+		return Void
+	}
+
+	marks := make([]pendingMark, len(e.Arguments)+1)
 	for i, arg := range e.Arguments {
+		marks[i] = c.flow.mark()
 		argType := c.checkExpression(arg)
 		if i < len(ft.Params) {
 			paramType := ft.Params[i]
-			if !paramType.Equals(Any) && !c.isAssignable(paramType, argType) {
+			if !paramType.Equals(Any) && !c.isAssignableValue(paramType, arg, argType) {
 				line, col := arg.Pos()
 				c.error(line, col, "argument %d: cannot pass %s as %s", i+1, argType.String(), paramType.String())
 			}
@@ -697,6 +1010,8 @@ func (c *Checker) checkCallExpression(e *ast.CallExpression) Type {
 			c.markMoveFromExpression(arg, line, "function call")
 		}
 	}
+	marks[len(e.Arguments)] = c.flow.mark()
+	c.endUnborrowedArguments(ft, marks)
 
 	return ft.Return
 }
@@ -704,7 +1019,7 @@ func (c *Checker) checkCallExpression(e *ast.CallExpression) Type {
 func (c *Checker) isVariadicFunction(e *ast.CallExpression) bool {
 	if ident, ok := e.Function.(*ast.Identifier); ok {
 		switch ident.Value {
-		case "print", "println", "exec", "exec_output", "substr", "exit", "panic":
+		case "print", "println", "exec", "exec_output", "substr", "exit", "panic", "assert":
 			return true
 		}
 	}
@@ -716,37 +1031,52 @@ func (c *Checker) checkArrayLiteral(e *ast.ArrayLiteral) Type {
 		return &ArrayType{Element: Any}
 	}
 
-	elemType := c.checkExpression(e.Elements[0])
-	for _, el := range e.Elements[1:] {
-		c.checkExpression(el)
+	var elemType Type
+	for i, el := range e.Elements {
+		t := c.checkExpression(el)
+		if i == 0 {
+			elemType = t
+		}
+		c.moveIntoContainer(el, t)
 	}
 
 	return &ArrayType{Element: elemType}
 }
 
 func (c *Checker) checkMapLiteral(e *ast.MapLiteral) Type {
+	c.checkStaticMapLiteral(e)
 	if len(e.Pairs) == 0 {
 		return &MapType{Key: Any, Value: Any}
 	}
 
 	var keyType, valueType Type
 	for k, v := range e.Pairs {
-		keyType = c.checkExpression(k)
-		valueType = c.checkExpression(v)
-		break
-	}
-
-	for k, v := range e.Pairs {
-		c.checkExpression(k)
-		c.checkExpression(v)
+		kt := c.checkExpression(k)
+		vt := c.checkExpression(v)
+		if keyType == nil {
+			keyType, valueType = kt, vt
+		}
+		c.moveIntoContainer(v, vt)
 	}
 
 	return &MapType{Key: keyType, Value: valueType}
 }
 
+// moveIntoContainer moves the value of expr, of type t, into an array or
+// map, which owns it from then on. A map copies the keys it keeps.
+func (c *Checker) moveIntoContainer(expr ast.Expression, t Type) {
+	if IsMoveType(t) {
+		line, _ := expr.Pos()
+		c.markMoveFromExpression(expr, line, "element")
+	}
+}
+
 func (c *Checker) checkIndexExpression(e *ast.IndexExpression) Type {
 	leftType := c.checkExpression(e.Left)
 	indexType := c.checkExpression(e.Index)
+	if IsInvalid(leftType) || IsInvalid(indexType) {
+		return Invalid
+	}
 
 	if arr, ok := leftType.(*ArrayType); ok {
 		if !indexType.Equals(Int) {
@@ -772,9 +1102,16 @@ func (c *Checker) checkIndexExpression(e *ast.IndexExpression) Type {
 func (c *Checker) checkIfExpression(e *ast.IfExpression) Type {
 	c.checkConditionIsBool(e.Condition, "if")
 
+	from := c.flow.branch()
 	c.checkBlockStatement(e.Consequence)
 	if e.Alternative != nil {
+		then := c.flow.cur
+		c.flow.cur = from
+		c.flow.branch()
 		c.checkBlockStatement(e.Alternative)
+		c.flow.join(then)
+	} else {
+		c.flow.join(from)
 	}
 
 	return Void
@@ -789,24 +1126,30 @@ func (c *Checker) checkFunctionLiteral(e *ast.FunctionLiteral) Type {
 	}
 
 	prevScope := c.scope
-	prevOwnership := c.pushOwnership()
-	prevBorrows := c.pushBorrows()
+	prevFlow := c.beginFlow()
+	prevCritical, prevSection := c.critical, c.section
 	c.scope = NewScope(prevScope)
+	// A closure made in a critical block may run after it.
+	c.critical, c.section = 0, nil
 
+	borrows := c.returnBorrows(e.Parameters, paramTypes, e.ReturnType, retType, nil)
 	for i, p := range e.Parameters {
 		c.scope.Define(p.Name.Value, paramTypes[i])
-		c.trackOwnership(p.Name.Value, paramTypes[i])
+		c.trackParameter(p.Name, paramTypes[i])
 	}
+	c.enterSignature(e.Parameters, nil, retType, borrows)
 
 	if e.Body != nil {
-		c.checkBlockStatement(e.Body)
+		c.checkFunctionBody(e.Body)
 	}
 
 	c.scope = prevScope
-	c.popOwnership(prevOwnership)
-	c.popBorrows(prevBorrows)
+	c.critical, c.section = prevCritical, prevSection
+	captured := c.flow.captures
+	c.endFlow(prevFlow)
+	c.bindCaptures(e, captured)
 
-	return &FunctionType{Params: paramTypes, Return: retType}
+	return &FunctionType{Params: paramTypes, Return: retType, Borrows: borrows}
 }
 
 func (c *Checker) checkMemberExpression(e *ast.MemberExpression) Type {
@@ -817,6 +1160,9 @@ func (c *Checker) checkMemberExpression(e *ast.MemberExpression) Type {
 	}
 
 	if mod, ok := objType.(*ModuleType); ok {
+		if mod.Name == "Ordering" {
+			return c.checkOrderingMember(e)
+		}
 		if members := builtinModuleMemberTypes(mod.Name); members != nil {
 			if t, exists := members[e.Member.Value]; exists {
 				return t
@@ -828,8 +1174,15 @@ func (c *Checker) checkMemberExpression(e *ast.MemberExpression) Type {
 		return Any
 	}
 
+	if ref, ok := objType.(*RefType); ok {
+		objType = ref.Inner
+	}
+	if t := c.syncMember(e, objType); t != nil {
+		return t
+	}
 	if cls, ok := objType.(*ClassType); ok {
 		if fieldType, exists := cls.Fields[e.Member.Value]; exists {
+			c.narrowUse(e.Object, e.Member.Value)
 			return fieldType
 		}
 	}
@@ -837,6 +1190,16 @@ func (c *Checker) checkMemberExpression(e *ast.MemberExpression) Type {
 	return Any
 }
 
+func (c *Checker) checkNewExpression(e *ast.NewExpression) Type {
+	for _, arg := range e.Arguments {
+		c.checkExpression(arg)
+	}
+	if cls, ok := c.resolveTypeExpr(e.Type).(*ClassType); ok {
+		return cls
+	}
+	return Any
+}
+
 func (c *Checker) checkSpawnExpression(e *ast.SpawnExpression) Type {
 	c.checkBlockStatement(e.Body)
 	return Void
@@ -910,22 +1273,44 @@ func (c *Checker) resolveTypeExpr(typeExpr ast.TypeExpr) Type {
 		elemType := c.resolveTypeExpr(t.ElementType)
 		return &ArrayType{Element: elemType}
 	case *ast.NamedType:
-		if typ, ok := c.scope.Lookup(t.Name.Value); ok {
-			return typ
+		if t.Name.Value == "Atomic" || t.Name.Value == "atomic" || t.Name.Value == "Mutex" {
+			return c.resolveSyncType(t)
 		}
-		return Any
+		if len(t.Args) > 0 {
+			line, col := t.Pos()
+			c.error(line, col, "%s takes no type arguments", t.Name.Value)
+		}
+		typ, ok := c.scope.Lookup(t.Name.Value)
+		if !ok {
+			return Any
+		}
+		if cls, isClass := typ.(*ClassType); t.Lifetime != "" && (!isClass || cls.Lifetime == "") {
+			line, col := t.Pos()
+			c.error(line, col, "%s has no lifetime parameter", t.Name.Value)
+		}
+		return typ
 	case *ast.RefType:
 		inner := c.resolveTypeExpr(t.Inner)
-		return &RefType{Inner: inner, Mutable: t.Mutable}
+		return &RefType{Inner: inner, Mutable: t.Mutable, Lifetime: t.Lifetime}
 	case *ast.VolatileType:
 		inner := c.resolveTypeExpr(t.Inner)
 		return &VolatileType{Inner: inner}
+	case *ast.FunctionType:
+		params := make([]Type, len(t.Parameters))
+		for i, p := range t.Parameters {
+			params[i] = c.resolveTypeExpr(p)
+		}
+		var ret Type = Void
+		if t.ReturnType != nil {
+			ret = c.resolveTypeExpr(t.ReturnType)
+		}
+		return &FunctionType{Params: params, Return: ret}
 	}
 	return Any
 }
 
 func (c *Checker) isAssignable(target, source Type) bool {
-	if target.Equals(Any) || source.Equals(Any) {
+	if target.Equals(Any) || source.Equals(Any) || IsInvalid(target) || IsInvalid(source) {
 		return true
 	}
 	if target.Equals(source) {
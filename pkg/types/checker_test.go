@@ -1,6 +1,7 @@
 package types
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 
@@ -201,7 +202,7 @@ let z = x;
 	}
 }
 
-func TestTypeCheckerMoveAssignmentWarnsOnReuse(t *testing.T) {
+func TestTypeCheckerMoveAssignmentErrorsOnReuse(t *testing.T) {
 	input := `
 let s = "hi";
 let t = s;
@@ -214,19 +215,19 @@ let u = s;
 	checker := NewChecker()
 	ok := checker.Check(program)
 
-	if !ok {
-		t.Fatalf("unexpected errors: %v", checker.Errors())
+	if ok {
+		t.Fatal("expected an error, got none")
 	}
-	warnings := checker.Warnings()
-	if len(warnings) != 1 {
-		t.Fatalf("expected 1 warning, got %v", warnings)
+	errs := checker.Errors()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
 	}
-	if !strings.Contains(warnings[0], "use of moved value 's'") {
-		t.Fatalf("unexpected warning: %s", warnings[0])
+	if !strings.Contains(errs[0], "use of moved value 's'") {
+		t.Fatalf("unexpected error: %s", errs[0])
 	}
 }
 
-func TestTypeCheckerMoveArgWarnsOnReuse(t *testing.T) {
+func TestTypeCheckerMoveArgErrorsOnReuse(t *testing.T) {
 	input := `
 fn take(a: string) {
     print(a);
@@ -242,19 +243,19 @@ let t = s;
 	checker := NewChecker()
 	ok := checker.Check(program)
 
-	if !ok {
-		t.Fatalf("unexpected errors: %v", checker.Errors())
+	if ok {
+		t.Fatal("expected an error, got none")
 	}
-	warnings := checker.Warnings()
-	if len(warnings) != 1 {
-		t.Fatalf("expected 1 warning, got %v", warnings)
+	errs := checker.Errors()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
 	}
-	if !strings.Contains(warnings[0], "use of moved value 's'") {
-		t.Fatalf("unexpected warning: %s", warnings[0])
+	if !strings.Contains(errs[0], "use of moved value 's'") {
+		t.Fatalf("unexpected error: %s", errs[0])
 	}
 }
 
-func TestTypeCheckerMoveReturnWarnsOnReuse(t *testing.T) {
+func TestTypeCheckerMoveReturnErrorsOnReuse(t *testing.T) {
 	input := `
 fn give() -> string {
     let s = "hi";
@@ -269,15 +270,15 @@ fn give() -> string {
 	checker := NewChecker()
 	ok := checker.Check(program)
 
-	if !ok {
-		t.Fatalf("unexpected errors: %v", checker.Errors())
+	if ok {
+		t.Fatal("expected an error, got none")
 	}
-	warnings := checker.Warnings()
-	if len(warnings) != 1 {
-		t.Fatalf("expected 1 warning, got %v", warnings)
+	errs := checker.Errors()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
 	}
-	if !strings.Contains(warnings[0], "use of moved value 's'") {
-		t.Fatalf("unexpected warning: %s", warnings[0])
+	if !strings.Contains(errs[0], "use of moved value 's'") {
+		t.Fatalf("unexpected error: %s", errs[0])
 	}
 }
 
@@ -323,11 +324,12 @@ let r2 = &s;
 	}
 }
 
-func TestBorrowMutableBlocksImmutableWarning(t *testing.T) {
+func TestBorrowMutableBlocksImmutableError(t *testing.T) {
 	input := `
 let s = "hello";
 let r = &mut s;
 let r2 = &s;
+print(len(r));
 `
 	l := lexer.New(input)
 	p := parser.New(l)
@@ -336,26 +338,23 @@ let r2 = &s;
 	checker := NewChecker()
 	ok := checker.Check(program)
 
-	if !ok {
-		t.Fatalf("unexpected errors: %v", checker.Errors())
-	}
-	warnings := checker.Warnings()
-	if len(warnings) == 0 {
-		t.Fatalf("expected warning, got none")
+	if ok {
+		t.Fatal("expected an error, got none")
 	}
+	errs := checker.Errors()
 	found := false
-	for _, warning := range warnings {
-		if strings.Contains(warning, "cannot immutably borrow 's'") {
+	for _, err := range errs {
+		if strings.Contains(err, "cannot immutably borrow 's'") {
 			found = true
 			break
 		}
 	}
 	if !found {
-		t.Fatalf("expected immutable borrow warning, got %v", warnings)
+		t.Fatalf("expected immutable borrow error, got %v", errs)
 	}
 }
 
-func TestBorrowMovedValueWarning(t *testing.T) {
+func TestBorrowMovedValueError(t *testing.T) {
 	input := `
 let s = "hello";
 let t = s;
@@ -368,22 +367,19 @@ let r = &s;
 	checker := NewChecker()
 	ok := checker.Check(program)
 
-	if !ok {
-		t.Fatalf("unexpected errors: %v", checker.Errors())
-	}
-	warnings := checker.Warnings()
-	if len(warnings) == 0 {
-		t.Fatalf("expected warning, got none")
+	if ok {
+		t.Fatal("expected an error, got none")
 	}
+	errs := checker.Errors()
 	found := false
-	for _, warning := range warnings {
-		if strings.Contains(warning, "cannot borrow moved value 's'") {
+	for _, err := range errs {
+		if strings.Contains(err, "cannot borrow moved value 's'") {
 			found = true
 			break
 		}
 	}
 	if !found {
-		t.Fatalf("expected moved borrow warning, got %v", warnings)
+		t.Fatalf("expected moved borrow error, got %v", errs)
 	}
 }
 
@@ -488,11 +484,12 @@ let p = new Point;
 	}
 }
 
-func TestBorrowAssignWhileBorrowedWarning(t *testing.T) {
+func TestBorrowAssignWhileBorrowedError(t *testing.T) {
 	input := `
 mut s = "hello";
 let r = &s;
 s = "world";
+print(len(r));
 `
 	l := lexer.New(input)
 	p := parser.New(l)
@@ -501,22 +498,19 @@ s = "world";
 	checker := NewChecker()
 	ok := checker.Check(program)
 
-	if !ok {
-		t.Fatalf("unexpected errors: %v", checker.Errors())
-	}
-	warnings := checker.Warnings()
-	if len(warnings) == 0 {
-		t.Fatalf("expected warning, got none")
+	if ok {
+		t.Fatal("expected an error, got none")
 	}
+	errs := checker.Errors()
 	found := false
-	for _, warning := range warnings {
-		if strings.Contains(warning, "cannot assign to 's' while it is borrowed") {
+	for _, err := range errs {
+		if strings.Contains(err, "cannot assign to 's' while it is borrowed") {
 			found = true
 			break
 		}
 	}
 	if !found {
-		t.Fatalf("expected assign while borrowed warning, got %v", warnings)
+		t.Fatalf("expected assign while borrowed error, got %v", errs)
 	}
 }
 
@@ -537,22 +531,19 @@ class Foo {
 	checker := NewChecker()
 	ok := checker.Check(program)
 
-	if !ok {
-		t.Fatalf("unexpected errors: %v", checker.Errors())
-	}
-	warnings := checker.Warnings()
-	if len(warnings) == 0 {
-		t.Fatalf("expected warning, got none")
+	if ok {
+		t.Fatal("expected an error, got none")
 	}
+	errs := checker.Errors()
 	found := false
-	for _, warning := range warnings {
-		if strings.Contains(warning, "cannot assign to field through immutable receiver (&self)") {
+	for _, err := range errs {
+		if strings.Contains(err, "cannot assign to field through immutable receiver (&self)") {
 			found = true
 			break
 		}
 	}
 	if !found {
-		t.Fatalf("expected immutable receiver warning, got %v", warnings)
+		t.Fatalf("expected immutable receiver error, got %v", errs)
 	}
 }
 
@@ -577,22 +568,19 @@ impl Readable for Doc {
 	checker := NewChecker()
 	ok := checker.Check(program)
 
-	if !ok {
-		t.Fatalf("unexpected errors: %v", checker.Errors())
-	}
-	warnings := checker.Warnings()
-	if len(warnings) == 0 {
-		t.Fatalf("expected warning, got none")
+	if ok {
+		t.Fatal("expected an error, got none")
 	}
+	errs := checker.Errors()
 	found := false
-	for _, warning := range warnings {
-		if strings.Contains(warning, "receiver mismatch for method read") {
+	for _, err := range errs {
+		if strings.Contains(err, "receiver mismatch for method read") {
 			found = true
 			break
 		}
 	}
 	if !found {
-		t.Fatalf("expected receiver mismatch warning, got %v", warnings)
+		t.Fatalf("expected receiver mismatch error, got %v", errs)
 	}
 }
 
@@ -763,7 +751,7 @@ async fn bad_borrow() -> int {
 	let s = "hello";
 	let r = &s;
 	let x = await fetch();
-	return x;
+	return x + len(r);
 }
 `
 	l := lexer.New(input)
@@ -901,10 +889,10 @@ func TestErrorIssuesReturnsSlice(t *testing.T) {
 
 func TestWarningIssuesReturnsSlice(t *testing.T) {
 	c := checkHasWarning(t, `
-let s = "hello";
-let t = s;
-let u = s;
-`, "use of moved value")
+fn f() {
+	let s = "hello";
+}
+`, "unused variable 's'")
 	issues := c.WarningIssues()
 	if len(issues) == 0 {
 		t.Fatal("WarningIssues() returned empty")
@@ -929,7 +917,7 @@ func TestConstStatementTypeMismatch(t *testing.T) {
 }
 
 func TestConstStatementMoveSemantics(t *testing.T) {
-	checkHasWarning(t, `
+	checkHasError(t, `
 const s = "hello";
 const t = s;
 const u = s;
@@ -1461,8 +1449,8 @@ func TestIsComparableFalse(t *testing.T) {
 
 // --- checkReturnStatement: return reference warning ---
 
-func TestReturnReferenceWarning(t *testing.T) {
-	checkHasWarning(t, `
+func TestReturnReferenceError(t *testing.T) {
+	checkHasError(t, `
 fn f() -> int {
 	let x = 42;
 	let r = &x;
@@ -1710,6 +1698,13 @@ func TestAssignToUndefined(t *testing.T) {
 	checkHasError(t, `x = 5;`, "undefined")
 }
 
+// --- block scopes: a local ends with its block ---
+
+func TestBlockLocalEndsWithBlock(t *testing.T) {
+	checkHasError(t, `if true { let y = 1; } println(y);`, "undefined")
+	checkOK(t, `let x = 1; if true { let x = "s"; println(x); } println(x + 1);`)
+}
+
 // --- Empty array literal ---
 
 func TestEmptyArrayLiteral(t *testing.T) {
@@ -1833,3 +1828,1594 @@ let a = [1, 2, 3];
 a[0] = 5;
 `)
 }
+
+func TestTypeCheckerContinuesPastSyntaxErrors(t *testing.T) {
+	input := `fn f(n: int) -> int {
+	let a = ;
+	let b = a + n;
+	if a < { }
+	return b;
+}
+let s: int = "oops";`
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) == 0 {
+		t.Fatal("expected parser errors")
+	}
+
+	checker := NewChecker()
+	if checker.Check(program) {
+		t.Fatal("expected the type error after the broken function to be reported")
+	}
+	errs := checker.Errors()
+	if len(errs) != 1 || !strings.Contains(errs[0], "cannot assign string to int") {
+		t.Fatalf("expected only the real type error, got %v", errs)
+	}
+}
+
+// --- test functions and assertions ---
+
+func TestTestFunctionAsserts(t *testing.T) {
+	c := checkOK(t, `
+fn double(n: int) -> int { return n * 2; }
+test fn doubles() {
+    let s = "x";
+    assert(double(2) == 4);
+    assert(double(0) == 0, "zero stays zero");
+    assert_eq(double(3), 6);
+    assert_eq(s, "x");
+    print(s);
+}
+`)
+	if len(c.Warnings()) > 0 {
+		t.Fatalf("assert_eq should not move its operands: %v", c.Warnings())
+	}
+}
+
+func TestTestFunctionSignature(t *testing.T) {
+	checkHasError(t, `test fn bad(n: int) -> int { return n; }`, "must take no parameters")
+}
+
+func TestTestFunctionNotCallable(t *testing.T) {
+	checkHasError(t, `
+#[test]
+fn t1() {}
+t1();
+`, "undefined")
+}
+
+func TestAssertErrors(t *testing.T) {
+	checkHasError(t, `assert(1);`, "argument 1")
+	checkHasError(t, `assert();`, "assert expects")
+	checkHasError(t, `assert_eq(1, "one");`, "cannot compare int with string")
+	checkHasError(t, `#[inline] fn f() {}`, "unknown attribute #[inline]")
+}
+
+func checkStatic(t *testing.T, input string) *Checker {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	c := NewChecker()
+	c.SetStaticMemory(true)
+	c.Check(program)
+	return c
+}
+
+func TestStaticMemoryRejectsUnboundedAllocation(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`let m = {"a": 1};`, "maps grow at run time"},
+		{`let xs = [1, 2]; push(xs, 3);`, "push grows an array at run time"},
+		{`let parts = split("a,b", ",");`, "split returns an array of unknown size"},
+		{`let a = args();`, "args returns an array of unknown size"},
+		{"class P { x: int = 0 }\nfn make() { return new P; }", "class instance cannot be returned"},
+		{"class P { x: int = 0 }\nfn make() { let p = new P; let q = p; return q; }", "class instance cannot be returned"},
+		{"async fn spin(n: int) -> int { let r = await spin(n); return r; }", "async function spin calls itself"},
+		{"class P { x: int = 0 }\nclass H { p: P = nil }\nfn keep(h: H) { h.p = new P; }", "class instance cannot be stored where it outlives"},
+		{"class P { x: int = 0 }\nfn keep(xs: []P) { let p = new P; xs[0] = p; }", "class instance cannot be stored where it outlives"},
+		{"class P { x: int = 0 }\nfn make() { let p = new P; return [p]; }", "class instance cannot be returned"},
+		{"class P { x: int = 0 }\nfn make() { let p = new P; return Ok(p); }", "class instance cannot be returned"},
+		{"class P { x: int = 0 }\nfn f(c: bool) { mut q = new P; if c { let p = new P; q = p; } }", "cannot be stored in q, which outlives"},
+		{"class P { x: int = 0 }\nclass H { p: P = nil }\nfn f(c: bool) { let h = new H; if c { h.p = new P; } }", "class instance cannot be stored where it outlives"},
+	}
+	for _, tt := range tests {
+		c := checkStatic(t, tt.input)
+		found := false
+		for _, e := range c.Errors() {
+			if strings.Contains(e, tt.want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%q: expected error containing %q, got %v", tt.input, tt.want, c.Errors())
+		}
+	}
+}
+
+func TestStaticMemoryAllowsBoundedData(t *testing.T) {
+	input := `
+class P { x: int = 0 }
+class H { p: P = nil }
+fn area(w: int) -> int {
+    let p = new P;
+    p.x = w;
+    let h = new H;
+    h.p = p;
+    mut q = new P;
+    q = new P;
+    let xs = [1, 2, 3];
+    return len(xs) + w;
+}
+async fn twice(x: int) -> int { return x * 2; }
+async fn caller() -> int { let a = await twice(1); let b = await twice(a); return b; }
+`
+	if c := checkStatic(t, input); len(c.Errors()) > 0 {
+		t.Fatalf("unexpected errors: %v", c.Errors())
+	}
+	// Without static memory the same rules do not apply.
+	checkOK(t, `let m = {"a": 1}; let xs = [1]; push(xs, 2);`)
+}
+
+func TestFreestandingRejectsHostedBuiltins(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`let s = read_file("a.txt");`, "type error at 1:18: read_file needs an operating system; not available on target cortex-m4"},
+		{`let fd = tcp_listen("0.0.0.0", 80);`, "type error at 1:20: tcp_listen needs an operating system"},
+		{`require "fs" as fs;`, "type error at 1:9: module fs needs an operating system"},
+		{`require { tcp_close } from "net";`, "module net needs an operating system"},
+	}
+	for _, tt := range tests {
+		p := parser.New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		if len(p.Errors()) > 0 {
+			t.Fatalf("parser errors: %v", p.Errors())
+		}
+		c := NewChecker()
+		c.SetFreestanding("cortex-m4")
+		c.Check(program)
+		found := false
+		for _, e := range c.Errors() {
+			if strings.Contains(e, tt.want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%q: expected error containing %q, got %v", tt.input, tt.want, c.Errors())
+		}
+	}
+	// The host has them, and a freestanding target keeps the rest.
+	checkOK(t, `let s = read_file("a.txt"); let fd = tcp_listen("0.0.0.0", 80);`)
+	p := parser.New(lexer.New(`require "gpio" as gpio; gpio.pin_mode(13, 1); let n = len(trim(" a "));`))
+	c := NewChecker()
+	c.SetFreestanding("cortex-m4")
+	if !c.Check(p.ParseProgram()) {
+		t.Errorf("unexpected errors: %v", c.Errors())
+	}
+}
+
+func TestMatchArmsBindPatterns(t *testing.T) {
+	checkOK(t, `fn divide(a: int, b: int) -> Result {
+    if b == 0 {
+        return Err("cannot divide by zero");
+    }
+    return Ok(a / b);
+}
+let result = divide(10, 2);
+match result {
+    Ok(v) => print(v),
+    Err(e) => print("error: " + e),
+};
+`)
+	checkHasError(t, "let r = Ok(1);\nmatch r { Ok(v) => print(v), _ => print(v) };", "undefined")
+}
+
+// --- flow-sensitive ownership ---
+
+const takeFn = `fn take(a: string) {
+    print(a);
+}
+fn consume(a: string) -> bool {
+    return len(a) > 0;
+}
+`
+
+func TestMoveAnalysisAcrossBranches(t *testing.T) {
+	tests := []struct {
+		name, body, want string
+	}{
+		{"moved in one branch", `
+fn f(c: bool) {
+    let s = "hi";
+    if c {
+        take(s);
+    }
+    print(s);
+}`, "use of possibly moved value 's' (moved at line 11, but not on every path to here)"},
+		{"moved in both branches", `
+fn f(c: bool) {
+    let s = "hi";
+    if c {
+        take(s);
+    } else {
+        take(s);
+    }
+    print(s);
+}`, "use of moved value 's' (moved at lines 11 and 13)"},
+		{"moved in the right operand", `
+fn f(c: bool) {
+    let s = "hi";
+    let ok = c && consume(s);
+    print(s);
+}`, "use of possibly moved value 's' (moved at line 10, but not on every path to here)"},
+		{"moved in the next loop iteration", `
+fn f() {
+    let s = "hi";
+    for i in [1, 2] {
+        take(s);
+    }
+}`, "use of possibly moved value 's' (moved at line 11 in an earlier iteration of the loop)"},
+		{"moved after continue", `
+fn f(n: int) {
+    let s = "hi";
+    for (let i = 0; i < n; i = i + 1) {
+        print(s);
+        if i > 1 {
+            continue;
+        }
+        take(s);
+    }
+}`, "use of possibly moved value 's' (moved at line 15 in an earlier iteration of the loop)"},
+		{"moved in a closure", `
+fn f() {
+    let s = "hi";
+    let g = fn() { take(s); };
+    print(s);
+}`, "use of moved value 's' (moved at line 10)"},
+		{"moved in one match arm", `
+fn f(r: Result) {
+    let s = "hi";
+    match r {
+        Ok(v) => take(s),
+        Err(e) => print(e),
+    };
+    print(s);
+}`, "use of possibly moved value 's' (moved at line 11, but not on every path to here)"},
+		{"moved in every match arm", `
+fn f(r: Result) {
+    let s = "hi";
+    match r {
+        Ok(v) => take(s),
+        Err(e) => {
+            take(s);
+        }
+    };
+    print(s);
+}`, "use of moved value 's' (moved at lines 11 and 13)"},
+		{"moved in a match arm that may not run", `
+fn f(r: Result) {
+    let s = "hi";
+    match r {
+        Ok(v) => take(s),
+        Ok(v) => take(s),
+    };
+    print(s);
+}`, "use of possibly moved value 's'"},
+		{"moved in the operand of ?", `
+fn res(s: string) -> Result {
+    return Ok(len(s));
+}
+fn f() -> Result {
+    let s = "hi";
+    let v = res(s)?;
+    print(s);
+    return Ok(v);
+}`, "use of moved value 's' (moved at line 13)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkHasError(t, takeFn+tt.body, tt.want)
+		})
+	}
+}
+
+func TestMoveAnalysisNoFalsePositives(t *testing.T) {
+	tests := []struct {
+		name, body string
+	}{
+		{"moved before an early return", `
+fn f(c: bool) {
+    let s = "hi";
+    if c {
+        take(s);
+        return;
+    }
+    print(s);
+}`},
+		{"moved in each branch separately", `
+fn f(c: bool) {
+    let s = "hi";
+    if c {
+        take(s);
+    } else {
+        print(s);
+    }
+}`},
+		{"reassigned after the move", `
+fn f() {
+    mut s = "hi";
+    for i in [1, 2] {
+        take(s);
+        s = "again";
+    }
+    print(s);
+}`},
+		{"moved then break", `
+fn f() {
+    let s = "hi";
+    for {
+        print(s);
+        take(s);
+        break;
+    }
+}`},
+		{"defined in the loop body", `
+fn f() {
+    for i in [1, 2] {
+        let s = "hi";
+        take(s);
+    }
+}`},
+		{"shadowed in a nested scope", `
+fn f() {
+    let s = "hi";
+    take(s);
+    for i in [1] {
+        let s = "inner";
+        print(s);
+    }
+}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkOK(t, takeFn+tt.body)
+		})
+	}
+}
+
+// --- non-lexical borrows ---
+
+const showFn = `fn show(r: &string) {
+    print(len(r));
+}
+`
+
+func TestBorrowEndsAtLastUse(t *testing.T) {
+	tests := []struct {
+		name, body string
+	}{
+		{"assign after the last use", `
+fn f() {
+    mut x = "a";
+    let r = &x;
+    show(r);
+    x = "b";
+}`},
+		{"borrow passed to a call", `
+fn f() {
+    mut x = "a";
+    show(&x);
+    x = "b";
+    let n = len(&x);
+    x = "c";
+}`},
+		{"last use in one branch", `
+fn f(c: bool) {
+    mut x = "a";
+    let r = &x;
+    if c {
+        show(r);
+        x = "b";
+    } else {
+        show(r);
+    }
+}`},
+		{"reference rebound", `
+fn f() {
+    mut x = "a";
+    mut y = "b";
+    mut r = &x;
+    show(r);
+    r = &y;
+    x = "c";
+    show(r);
+}`},
+		{"mutable borrow after the last shared use", `
+fn f() {
+    mut x = "a";
+    let r = &x;
+    show(r);
+    let m = &mut x;
+}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkOK(t, showFn+tt.body)
+		})
+	}
+}
+
+func TestBorrowConflictsWithLaterUse(t *testing.T) {
+	tests := []struct {
+		name, body, want string
+	}{
+		{"assign before the last use", `
+fn f() {
+    mut x = "a";
+    let r = &x;
+    x = "b";
+    show(r);
+}`, "cannot assign to 'x' while it is borrowed (borrowed at line 7, used later at line 9)"},
+		{"used in the next iteration", `
+fn f() {
+    mut x = "a";
+    let r = &x;
+    for i in [1, 2] {
+        x = "b";
+        show(r);
+    }
+}`, "cannot assign to 'x' while it is borrowed (borrowed at line 7, used later at line 10)"},
+		{"through a copied reference", `
+fn f() {
+    let x = "a";
+    let r = &x;
+    let r2 = r;
+    let y = x;
+    show(r2);
+}`, "cannot move out of 'x' while it is borrowed (borrowed at line 7, used later at line 10)"},
+		{"shared borrow while mutably borrowed", `
+fn f() {
+    mut x = "a";
+    let m = &mut x;
+    let r = &x;
+    print(len(m));
+}`, "cannot immutably borrow 'x': already mutably borrowed at line 7 (used later at line 9)"},
+		{"two borrows in one call", `
+fn pair(a: &mut string, b: &string) {
+}
+fn f() {
+    mut x = "a";
+    pair(&mut x, &x);
+}`, "cannot immutably borrow 'x': already mutably borrowed at line 9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkHasError(t, showFn+tt.body, tt.want)
+		})
+	}
+}
+
+func TestBorrowDeadBeforeAwait(t *testing.T) {
+	checkOK(t, `
+async fn fetch() -> int {
+	return 1;
+}
+async fn f() -> int {
+	let s = "hello";
+	let r = &s;
+	let n = len(r);
+	let x = await fetch();
+	return x + n;
+}
+`)
+	checkHasError(t, `
+async fn fetch() -> int {
+	return 1;
+}
+async fn f() -> int {
+	let s = "hello";
+	let r = &s;
+	let x = await fetch();
+	return x + len(r);
+}
+`, "borrow of 's' cannot be held across await point (borrowed at line 7, used later at line 9)")
+}
+
+// --- fields and elements ---
+
+const bufClass = `class Buf {
+    name: string = ""
+    data: string = ""
+}
+fn consume(s: string) {
+}
+`
+
+func TestPartialMoves(t *testing.T) {
+	tests := []struct {
+		name, body, want string
+	}{
+		{"moved field read again", `
+fn f() {
+    let b = new Buf;
+    consume(b.name);
+    print(b.name);
+}`, "use of moved value 'b.name' (moved at line 10)"},
+		{"whole value after a field move", `
+fn f() {
+    let b = new Buf;
+    consume(b.name);
+    let c = b;
+}`, "use of partially moved value 'b' (b.name moved at line 10)"},
+		{"field of a moved value", `
+fn f() {
+    let b = new Buf;
+    let c = b;
+    print(b.data);
+}`, "use of moved value 'b.data' (moved at line 10)"},
+		{"field moved on one path", `
+fn f(c: bool) {
+    let b = new Buf;
+    if c {
+        consume(b.data);
+    }
+    print(b.data);
+}`, "use of possibly moved value 'b.data' (moved at line 11, but not on every path to here)"},
+		{"assigning a field of a moved value", `
+fn f() {
+    let b = new Buf;
+    let c = b;
+    b.name = "x";
+}`, "cannot assign to field of moved value 'b' (moved at line 10)"},
+		{"field of self", `
+class Sink {
+    data: string = ""
+    fn flush(&mut self) {
+        consume(self.data);
+        consume(self.data);
+    }
+}`, "use of moved value 'self.data' (moved at line 11)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkHasError(t, bufClass+tt.body, tt.want)
+		})
+	}
+}
+
+func TestPartialMovesNoFalsePositives(t *testing.T) {
+	checkOK(t, bufClass+`
+fn f() {
+    let b = new Buf;
+    consume(b.name);
+    print(b.data);
+    b.name = "again";
+    let c = b;
+}
+fn moveIn(s: string) {
+    let b = new Buf;
+    consume(b.name);
+    b.name = s;
+    let c = b;
+}
+fn g(b: Buf) {
+    let n = b.name;
+    let d = b.data;
+}
+`)
+}
+
+func TestMoveOutOfIndexError(t *testing.T) {
+	checkHasError(t, `
+fn f() {
+    let names = ["a", "b"];
+    let n = names[0];
+}
+`, "cannot move out of an element of 'names'; use take or exchange, or clone it")
+	checkHasError(t, bufClass+`
+fn f(bufs: []Buf) {
+    consume(bufs[0].name);
+}
+`, "cannot move out of an element of 'bufs'")
+
+	checkOK(t, `
+fn f() {
+    let nums = [1, 2];
+    let n = nums[0];
+    let names = ["a", "b"];
+    print(names[1]);
+}
+`)
+}
+
+func TestTakeAndExchange(t *testing.T) {
+	checkOK(t, bufClass+`
+fn f() {
+    mut names = ["a", "b"];
+    let first = take(&mut names[0]);
+    let second = exchange(&mut names[1], "c");
+    let b = new Buf;
+    let n = take(&mut b.name);
+    let c = b;
+    let s = replace("abc", "b", "x");
+}
+`)
+
+	checkHasError(t, bufClass+`
+fn f() {
+    let b = new Buf;
+    let n: int = take(&mut b.name);
+}
+`, "cannot assign string to int")
+	checkHasError(t, `
+fn f() {
+    let names = ["a"];
+    let n = take(&names[0]);
+}
+`, "take expects a mutable reference (&mut place), got &string")
+	checkHasError(t, `
+fn f() {
+    mut names = ["a"];
+    let n = exchange(&mut names[0], 1);
+}
+`, "exchange: cannot put int in place of string")
+	// replace is only the string builtin.
+	checkHasError(t, `
+fn f() {
+    mut names = ["a"];
+    let n = replace(&mut names[0], "b");
+}
+`, "function expects 3 arguments, got 2")
+}
+
+// --- lints ---
+
+func TestOwnershipErrorsHaveCodes(t *testing.T) {
+	c := checkHasError(t, `
+fn f() {
+    let s = "a";
+    let t = s;
+    print(s);
+}
+`, "error[E0101] at 5:11: use of moved value 's'")
+	issue := c.ErrorIssues()[0]
+	if issue.Code != "E0101" || issue.Lint != "use_after_move" || issue.Kind != "error" {
+		t.Errorf("issue = %+v", issue)
+	}
+}
+
+func TestUnusedVariableWarning(t *testing.T) {
+	c := checkHasWarning(t, `
+let global = 1;
+fn f(n: int, _ignored: int) {
+    let x = 1;
+    let y = 2;
+    print(y);
+    for i in [1, 2] {
+    }
+}
+`, "warning[unused] at line 3, col 6: unused variable 'n'")
+	want := []string{
+		"warning[unused] at line 3, col 6: unused variable 'n'",
+		"warning[unused] at line 4, col 9: unused variable 'x'",
+		"warning[unused] at line 7, col 9: unused variable 'i'",
+	}
+	if got := c.Warnings(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("warnings = %q, want %q", got, want)
+	}
+
+	// Writing a field, or matching on a value, uses the variable.
+	c = checkOK(t, `
+class H { a: int = 0 }
+fn set(h: &mut H) { h.a = 3; }
+fn fill() { let b = new H; b.a = 4; }
+fn get() -> Result { return Ok(1); }
+fn show() {
+    let r = get();
+    match r {
+        _ => println("done"),
+    };
+}
+`)
+	if got := c.Warnings(); len(got) != 0 {
+		t.Errorf("unexpected warnings: %q", got)
+	}
+}
+
+func TestLintAttributes(t *testing.T) {
+	c := checkOK(t, `
+#[allow(unused)]
+fn quiet() {
+    let x = 1;
+}
+#[warn(use_after_move)]
+fn relaxed() {
+    let s = "a";
+    let t = s;
+    print(s);
+    print(t);
+}
+`)
+	if got := c.Warnings(); len(got) != 1 || !strings.Contains(got[0], "warning[E0101] at line 10") {
+		t.Errorf("warnings = %v, want only the downgraded use after move", got)
+	}
+
+	checkHasError(t, `
+#[deny(unused)]
+fn strict() {
+    let x = 1;
+}
+`, "error[unused] at 4:9: unused variable 'x'")
+	checkHasError(t, `
+#[allow(unused_things)]
+fn f() {
+}
+`, "unknown lint 'unused_things'")
+	checkHasError(t, `
+#[allow]
+fn f() {
+}
+`, "#[allow] needs the lints it applies to")
+}
+
+func TestSetLintLevel(t *testing.T) {
+	input := `
+fn f() {
+    let x = 1;
+}
+#[allow(unused)]
+fn g() {
+    let y = 1;
+}
+`
+	program := parser.New(lexer.New(input)).ParseProgram()
+	c := NewChecker()
+	if err := c.SetLintLevel("unused", LintDeny); err != nil {
+		t.Fatal(err)
+	}
+	c.Check(program)
+	if errs := c.Errors(); len(errs) != 1 || !strings.Contains(errs[0], "unused variable 'x'") {
+		t.Errorf("errors = %v, want only x: the attribute on g overrides the program's level", errs)
+	}
+
+	if err := NewChecker().SetLintLevel("nope", LintAllow); err == nil {
+		t.Error("expected an error for an unknown lint")
+	}
+	if _, err := ParseLintLevel("loud"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
+
+func TestDropInterface(t *testing.T) {
+	checkOK(t, `
+class Guard {
+    name: string = ""
+}
+impl Drop for Guard {
+    fn drop(&mut self) {
+        println(self.name);
+    }
+}
+fn f() {
+    let g = new Guard;
+    println(g.name);
+}
+`)
+	checkHasError(t, `
+interface Shape {
+    fn area(&self) -> int;
+}
+impl Drop for Shape {
+    fn drop(&mut self) {
+    }
+}
+`, "Drop can only be implemented for a class, not Shape")
+	checkHasError(t, `
+class Guard {
+    name: string = ""
+}
+impl Drop for Guard {
+    fn drop(&mut self) {
+    }
+}
+fn f() {
+    let g = new Guard;
+    g.drop();
+}
+`, "drop cannot be called explicitly; Guard is dropped when its owner goes out of scope")
+	checkHasError(t, `
+class Guard {
+    name: string = ""
+}
+impl Drop for Guard {
+    fn drop(&self) {
+    }
+}
+`, "receiver mismatch for method drop: interface expects &mut self, impl has &self")
+}
+
+func TestMoveIntoContainer(t *testing.T) {
+	checkHasError(t, `
+fn f() {
+    let s = "a";
+    let names = [s];
+    println(s);
+    println(names);
+}
+`, "error[E0101] at 5:13: use of moved value 's' (moved at line 4)")
+	checkHasError(t, `
+fn f() {
+    mut names = ["a"];
+    let s = "b";
+    names[0] = s;
+    println(s);
+}
+`, "error[E0101] at 6:13: use of moved value 's' (moved at line 5)")
+	checkHasError(t, `
+fn f() {
+    let s = "a";
+    let m = {"k": s};
+    println(s);
+    println(m);
+}
+`, "use of moved value 's'")
+}
+
+func TestMoveOutOfReference(t *testing.T) {
+	input := `
+class Box {
+    name: string = ""
+    items: []int
+}
+fn name_of(b: &Box) -> string {
+    return b.name;
+}
+fn deref(s: &string) -> string {
+    return *s;
+}
+fn items_of(b: &Box) -> []int {
+    return b.items;
+}
+`
+	c := checkHasError(t, input, "error[E0103] at 13:13: cannot move out of 'b.items', which is behind a reference")
+	if errs := c.Errors(); len(errs) != 1 {
+		t.Errorf("errors = %v, want only the move of items: strings are copied", errs)
+	}
+	checkHasError(t, `
+class Box {
+    items: []int
+}
+fn f(b: &Box) {
+    let r = &b.items;
+    let v = *r;
+}
+`, "cannot move out of '*r', which is behind a reference")
+}
+
+func TestReturnedReferenceLifetimes(t *testing.T) {
+	checkOK(t, `
+class Box {
+    name: string = ""
+    fn label(&self) -> &string {
+        return &self.name;
+    }
+}
+let greeting = "hi";
+fn same(s: &string) -> &string {
+    return s;
+}
+fn name_of(b: &Box) -> &string {
+    let r = &b.name;
+    return r;
+}
+fn pick(a: &'a string, b: &string) -> &'a string {
+    return a;
+}
+fn global() -> &string {
+    return &greeting;
+}
+fn first(names: &[]string) -> &string {
+    return &names[0];
+}
+`)
+	checkHasError(t, `
+fn local() -> &string {
+    let s = "x";
+    let r = &s;
+    return r;
+}
+`, "error[E0206] at 5:12: reference cannot escape function scope: it borrows 's', which is dropped when the function returns")
+	checkHasError(t, `
+fn owned(s: string) -> &string {
+    return &s;
+}
+`, "it borrows 's', which is dropped when the function returns")
+	checkHasError(t, `
+fn pick(a: &'a string, b: &string) -> &'a string {
+    return b;
+}
+`, "error[E0208] at 3:12: returned reference borrows from 'b', but the signature only lets it borrow from 'a'")
+	checkHasError(t, `
+fn either(a: &string, b: &string) -> &string {
+    return a;
+}
+`, "cannot tell which parameter the returned reference borrows from")
+	checkHasError(t, `
+fn f(a: &string) -> &'a string {
+    return a;
+}
+`, "lifetime 'a in the return type is not named by any parameter")
+}
+
+func TestCallResultBorrowsFromItsLifetime(t *testing.T) {
+	src := `
+fn pick(a: &'a string, b: &string) -> &'a string {
+    return a;
+}
+fn main() {
+    mut x = "x";
+    mut y = "y";
+    let r = pick(&x, &y);
+    y = "z";
+    %s
+    println(*r);
+}
+`
+	checkOK(t, fmt.Sprintf(src, ""))
+	checkHasError(t, fmt.Sprintf(src, `x = "w";`), "error[E0202] at 10:5: cannot assign to 'x' while it is borrowed (borrowed at line 8, used later at line 11)")
+}
+
+func TestClassLifetimes(t *testing.T) {
+	view := `
+class View<'a> {
+    data: &'a string
+    fn set(&mut self, s: &'a string) {
+        self.data = s;
+    }
+}
+`
+	checkOK(t, view+`
+fn wrap(s: &string) -> View {
+    let v = new View;
+    v.data = s;
+    return v;
+}
+fn set(v: &mut View<'a>, s: &'a string) {
+    v.data = s;
+}
+`)
+	checkHasError(t, `
+class View {
+    data: &string
+}
+`, "field data holds a reference, so View needs a lifetime parameter, like class View<'a>")
+	checkHasError(t, `
+class View<'a> {
+    data: &'b string
+}
+`, "field data names lifetime 'b, but the lifetime of View is 'a")
+	checkHasError(t, `
+class Box {
+    n: int = 0
+}
+fn f(b: &Box<'a>) {
+}
+`, "Box has no lifetime parameter")
+	checkHasError(t, view+`
+fn make() -> View {
+    let s = "x";
+    let v = new View;
+    v.data = &s;
+    return v;
+}
+`, "error[E0206] at 13:12: reference cannot escape function scope: it borrows 's'")
+	checkHasError(t, view+`
+fn main() {
+    let s = "x";
+    let v = new View;
+    v.data = &s;
+    let t = s;
+    println(*v.data);
+}
+`, "cannot move out of 's' while it is borrowed (borrowed at line 12, used later at line 14)")
+	checkHasError(t, view+`
+fn set(v: &mut View, s: &string) {
+    v.data = s;
+}
+`, "error[E0208] at 10:6: cannot store a reference borrowed from 's' in 'v.data', which may outlive it")
+	checkHasError(t, view+`
+fn set(v: &mut View<'a>) {
+    let s = "x";
+    v.data = &s;
+}
+`, "error[E0206] at 11:6: cannot store a reference to 's' in 'v.data', which outlives it")
+}
+
+func TestBlockLocalLifetimes(t *testing.T) {
+	checkHasError(t, `
+class View<'a> {
+    text: &'a string
+}
+mut v = new View;
+if true {
+    let s = "x";
+    v.text = &s;
+}
+println(*v.text);
+`, "error[E0206] at 8:6: cannot store a reference to 's' in 'v.text', which outlives it")
+	checkHasError(t, `
+fn main() {
+    let z = 3;
+    mut r = &z;
+    if true {
+        let y = 4;
+        r = &y;
+    }
+    println(*r);
+}
+`, "error[E0206] at 7:9: cannot store a reference to 'y' in 'r', which outlives it")
+	checkHasError(t, `
+fn main() {
+    let z = 3;
+    mut r = &z;
+    for i in [1, 2] {
+        let y = i;
+        let q = &y;
+        r = q;
+    }
+    println(*r);
+}
+`, "cannot store a reference to 'y' in 'r', which outlives it")
+	checkHasError(t, `
+fn main() {
+    mut f = fn() -> int { return 0; };
+    if true {
+        let y = 4;
+        f = fn() -> int { return y; };
+    }
+    println(f());
+}
+`, "cannot store a closure that captures 'y' by reference in 'f', which outlives it; make it a move closure")
+	checkOK(t, `
+fn main() {
+    let z = 3;
+    let w = 5;
+    mut r = &z;
+    if true {
+        r = &w;
+        let y = 4;
+        let q = &y;
+        println(*q);
+    }
+    println(*r);
+}
+`)
+}
+
+func TestClosureAndFutureBorrows(t *testing.T) {
+	checkHasError(t, `
+fn main() {
+    mut s = "x";
+    let r = &s;
+    let f = fn() -> int { return len(r); };
+    s = "y";
+    f();
+}
+`, "cannot assign to 's' while it is borrowed")
+	checkHasError(t, `
+fn make() {
+    let s = "x";
+    let r = &s;
+    return fn() -> int { return len(r); };
+}
+`, "reference cannot escape function scope: it borrows 's'")
+	checkHasError(t, `
+async fn load(s: &string) -> int {
+    return len(s);
+}
+async fn main() {
+    mut buf = "x";
+    let f = load(&buf);
+    buf = "y";
+    let n = await f;
+}
+`, "cannot assign to 'buf' while it is borrowed")
+}
+
+func TestClosureCaptureModes(t *testing.T) {
+	c := checkOK(t, `
+fn main() {
+    mut count = 0;
+    let name = "carv";
+    mut items = [1, 2];
+    let s = "owned";
+    let inc = fn() { count = count + 1; };
+    let show = fn() { println(name); };
+    let set = fn() { items[0] = 5; };
+    let take = fn() { let t = s; };
+    inc();
+    show();
+    set();
+    take();
+    let n = 1;
+    let copy = move fn() -> int { return n; };
+    copy();
+}
+`)
+	got := make(map[int]string)
+	for lit, captures := range c.Captures() {
+		line, _ := lit.Pos()
+		var modes []string
+		for _, cp := range captures {
+			modes = append(modes, cp.Name+" "+cp.Mode.String())
+		}
+		got[line] = strings.Join(modes, ", ")
+	}
+	want := map[int]string{
+		7:  "count mut ref",
+		8:  "name ref",
+		9:  "items mut ref",
+		10: "s move",
+		16: "n move",
+	}
+	for line, modes := range want {
+		if got[line] != modes {
+			t.Errorf("closure at line %d captures %q, want %q", line, got[line], modes)
+		}
+	}
+}
+
+func TestClosureCaptureConflicts(t *testing.T) {
+	tests := []struct {
+		name, input, want string
+	}{
+		{"read while captured mutably", `
+fn main() {
+    mut n = 0;
+    let bump = fn() { n = n + 1; };
+    println(n);
+    bump();
+}
+`, "error[E0209] at 5:13: cannot use 'n' while it is mutably borrowed (captured by the closure at line 4, used later at line 6)"},
+		{"assign while captured", `
+fn main() {
+    mut total = 1;
+    let show = fn() { println(total); };
+    total = 2;
+    show();
+}
+`, "error[E0202] at 5:5: cannot assign to 'total' while it is borrowed (captured by the closure at line 4, used later at line 6)"},
+		{"move while captured", `
+fn main() {
+    let s = "hi";
+    let show = fn() { println(s); };
+    let t = s;
+    show();
+}
+`, "cannot move out of 's' while it is borrowed (captured by the closure at line 4, used later at line 6)"},
+		{"two mutable captures", `
+fn main() {
+    mut n = 0;
+    let a = fn() { n = 1; };
+    let b = fn() { n = 2; };
+    a();
+    b();
+}
+`, "cannot mutably borrow 'n': already mutably captured by the closure at line 4 (used later at line 6)"},
+		{"use after a move closure", `
+fn main() {
+    let s = "hi";
+    let f = move fn() { println(s); };
+    println(s);
+    f();
+}
+`, "use of moved value 's'"},
+		{"returned by-reference closure", `
+fn make() {
+    let s = "x";
+    let f = fn() { println(s); };
+    return f;
+}
+`, "error[E0206] at 5:12: closure cannot escape function scope: it captures 's' by reference; make it a move closure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkHasError(t, tt.input, tt.want)
+		})
+	}
+
+	// A conflicting borrow is one error, not also a use of what it borrows.
+	c := check(t, `
+fn main() {
+    mut n = 1;
+    let inc = fn() { n = n + 1; };
+    let r = &n;
+    inc();
+    println(*r);
+}
+`)
+	want := "error[E0201] at 5:13: cannot immutably borrow 'n': already mutably captured by the closure at line 4 (used later at line 6)"
+	if got := c.Errors(); len(got) != 1 || got[0] != want {
+		t.Errorf("errors = %q, want only %q", got, want)
+	}
+
+	// Once the closure is done with, the variable is free again, and a
+	// move closure can leave the function.
+	checkOK(t, `
+fn main() {
+    mut n = 0;
+    let bump = fn() { n = n + 1; };
+    bump();
+    println(n);
+    n = 5;
+}
+fn make() {
+    let s = "x";
+    return move fn() { println(s); };
+}
+`)
+}
+
+func TestFunctionTypes(t *testing.T) {
+	checkOK(t, `
+fn double(x: int) -> int { return x * 2; }
+fn tick(n: int) { println(n); }
+
+class Timer {
+    handler: fn(int) = tick
+    scale: fn(int) -> int
+}
+
+fn apply(f: fn(int) -> int, x: int) -> int {
+    return f(x);
+}
+
+fn adder(k: int) -> fn(int) -> int {
+    return move fn(x: int) -> int { return x + k; };
+}
+
+fn main() {
+    let k = 3;
+    let add_k = fn(x: int) -> int { return x + k; };
+    mut f: fn(int) -> int = double;
+    f = add_k;
+    let n: int = apply(f, 1) + apply(double, 2) + adder(1)(2);
+    println(n);
+    let t = new Timer;
+    t.scale = adder(k);
+    t.handler(t.scale(1));
+    let table: []fn(int) -> int = [double, add_k];
+    println(table[0](4));
+}
+`)
+
+	tests := []struct {
+		name, input, want string
+	}{
+		{"parameter types differ", `
+fn greet(s: string) { println(s); }
+let f: fn(int) -> int = greet;
+`, "cannot assign fn(string) -> void to fn(int) -> int"},
+		{"function is not a value of another type", `
+fn double(x: int) -> int { return x * 2; }
+let s: string = double;
+`, "cannot assign fn(int) -> int to string"},
+		{"by-reference closure stored in a field", `
+class Button {
+    on_click: fn(int) -> int
+}
+fn main() {
+    let k = 1;
+    let b = new Button;
+    b.on_click = fn(x: int) -> int { return x + k; };
+}
+`, "error[E0206] at 8:6: cannot store a closure that captures 'k' by reference in 'b.on_click', which outlives it; make it a move closure"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkHasError(t, tt.input, tt.want)
+		})
+	}
+}
+
+func TestInterruptHandlers(t *testing.T) {
+	checkOK(t, `
+static mut count = 0;
+static let ticks: Atomic<int> = Atomic(0);
+static let level: Mutex<int> = Mutex(0);
+
+fn bump() { count = count + 1; }
+
+interrupt fn SysTick_Handler() {
+    bump();
+    ticks.store(ticks.load() + 1);
+    let l = level.lock();
+    *l = *l + 1;
+}
+
+fn read_count() -> int {
+    return count;
+}
+
+fn main() {
+    mut n = 0;
+    critical {
+        n = read_count();
+        *level.lock() = 0;
+    }
+    println(n + ticks.load());
+}
+main();
+`)
+
+	tests := []struct {
+		name, input, want string
+	}{
+		{"handler takes parameters", `interrupt fn TIM2_IRQHandler(n: int) {}`,
+			"interrupt handler TIM2_IRQHandler must take no parameters and return nothing"},
+		{"handler is called", `
+interrupt fn TIM2_IRQHandler() {}
+TIM2_IRQHandler();
+`, "interrupt handler TIM2_IRQHandler cannot be called; the hardware runs it"},
+		{"handler allocates", `
+interrupt fn TIM2_IRQHandler() { let xs = [1, 2]; }
+`, "interrupt handler TIM2_IRQHandler cannot allocate"},
+		{"handler builds a string", `
+interrupt fn TIM2_IRQHandler() { let s = "a" + "b"; }
+`, "interrupt handler TIM2_IRQHandler cannot allocate"},
+		{"handler prints", `
+interrupt fn TIM2_IRQHandler() { println(1); }
+`, "interrupt handler TIM2_IRQHandler cannot call println, which allocates or is not reentrant"},
+		{"handler makes a closure", `
+interrupt fn TIM2_IRQHandler() { let f = fn() {}; }
+`, "interrupt handler TIM2_IRQHandler cannot make a closure"},
+		{"await in a critical block", `
+async fn get() -> int { return 1; }
+async fn run() {
+    critical { let x = await get(); }
+}
+`, "cannot await inside a critical block"},
+		{"mutex locked with interrupts on", `
+static let m: Mutex<int> = Mutex(0);
+fn main() { *m.lock() = 1; }
+`, "a Mutex can only be locked inside a critical block or an interrupt handler"},
+		{"handler calls a function that prints", `
+fn log(n: int) { println(n); }
+fn helper() { log(1); }
+interrupt fn TIM2_IRQHandler() { helper(); }
+`, "error at 4:40: interrupt handler TIM2_IRQHandler cannot call helper, since log would call println, which allocates or is not reentrant (line 2)"},
+		{"handler calls a function that allocates", `
+fn make() -> int { let xs = [1, 2]; return len(xs); }
+interrupt fn TIM2_IRQHandler() { let n = make(); }
+`, "interrupt handler TIM2_IRQHandler cannot call make, since make would allocate (line 2)"},
+		{"locked reference returned", `
+static let last: Mutex<int> = Mutex(0);
+fn grab() -> &mut int {
+    critical {
+        return last.lock();
+    }
+}
+fn main() { *grab() = 3; }
+`, "error[E0206] at 5:25: the reference lock returns cannot escape the critical block"},
+		{"locked reference kept past the critical block", `
+static let level: Mutex<int> = Mutex(0);
+fn main() {
+    let z = 0;
+    mut r = &mut z;
+    critical {
+        r = level.lock();
+    }
+    *r = 1;
+}
+`, "error[E0206] at 7:9: cannot store the reference lock returns in 'r', which outlives the critical block"},
+		{"locked reference stored behind a parameter", `
+class Slot<'a> {
+    v: &'a mut int
+}
+static let level: Mutex<int> = Mutex(0);
+fn keep(s: &mut Slot<'a>) {
+    critical {
+        s.v = level.lock();
+    }
+}
+`, "cannot store the reference lock returns in 's.v', which outlives the critical block"},
+		{"locked in a closure made in a critical block", `
+static let m: Mutex<int> = Mutex(0);
+fn main() {
+    critical {
+        let f = fn() { *m.lock() = 1; };
+        f();
+    }
+}
+`, "a Mutex can only be locked inside a critical block or an interrupt handler"},
+		{"atomic of a string", `static let a = Atomic("x");`,
+			"Atomic needs an integer or bool, got string"},
+		{"static shared with a handler", `
+static mut count = 0;
+
+fn bump() { count = count + 1; }
+
+interrupt fn TIM2_IRQHandler() { bump(); }
+
+fn main() {
+    println(count);
+}
+main();
+`, "error[E0301] at 9:13: static 'count' is shared with interrupt handler TIM2_IRQHandler; use it through an Atomic or a Mutex, or inside a critical block"},
+		{"static shared from a function main calls", `
+static mut flag = false;
+interrupt fn EXTI0_IRQHandler() { flag = true; }
+fn poll() -> bool { return flag; }
+fn main() {
+    critical { poll(); }
+    poll();
+}
+main();
+`, "error[E0301] at 4:28: static 'flag' is shared with interrupt handler EXTI0_IRQHandler"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkHasError(t, tt.input, tt.want)
+		})
+	}
+
+	// Statics only read by both sides, or only used by a handler, are fine.
+	checkOK(t, `
+static let limit = 10;
+static mut seen = 0;
+interrupt fn TIM2_IRQHandler() { seen = seen + limit; }
+fn main() { println(limit); }
+main();
+`)
+	// So are functions a handler calls that allocate nothing.
+	checkOK(t, `
+static let level: Mutex<int> = Mutex(0);
+fn twice(n: int) -> int { return n * 2; }
+fn bump() {
+    critical {
+        let l = level.lock();
+        *l = twice(*l);
+    }
+}
+interrupt fn TIM2_IRQHandler() { bump(); }
+fn main() { println(twice(2)); }
+main();
+`)
+	checkHasWarning(t, `interrupt fn on_uart() {}`, "is not named like a vector table entry")
+
+	// With the target's vector table, a handler must name one of its entries.
+	core := []string{"Reset_Handler", "HardFault_Handler", "SysTick_Handler"}
+	vectorTests := []struct {
+		name, input, want string
+		device            []string
+	}{
+		{"misspelled device interrupt", `interrupt fn USART1_IRQHandlr() {}`,
+			"type error at 1:11: interrupt handler USART1_IRQHandlr is not an entry of the target's vector table, so nothing would run it; did you mean USART1_IRQHandler?",
+			[]string{"USART1_IRQHandler"}},
+		{"device interrupt the target lacks", `interrupt fn CAN1_IRQHandler() {}`,
+			"interrupt handler CAN1_IRQHandler is not an entry of the target's vector table, so nothing would run it",
+			[]string{"USART1_IRQHandler"}},
+		{"misspelled without a device list", `interrupt fn USART1_IRQHandlr() {}`,
+			"interrupt handler USART1_IRQHandlr is not an entry of the target's vector table", nil},
+		{"misspelled core exception", `interrupt fn SysTick_Handlr() {}`,
+			"did you mean SysTick_Handler?", nil},
+	}
+	for _, tt := range vectorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewChecker()
+			c.SetVectorTable(core, tt.device)
+			program := parser.New(lexer.New(tt.input)).ParseProgram()
+			c.Check(program)
+			found := false
+			for _, e := range c.Errors() {
+				if strings.Contains(e, tt.want) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("expected error containing %q, got %v", tt.want, c.Errors())
+			}
+		})
+	}
+	for _, device := range [][]string{nil, {"USART1_IRQHandler"}} {
+		c := NewChecker()
+		c.SetVectorTable(core, device)
+		program := parser.New(lexer.New("interrupt fn USART1_IRQHandler() {}\ninterrupt fn SysTick_Handler() {}\n")).ParseProgram()
+		if !c.Check(program) {
+			t.Errorf("device %v: unexpected errors %v", device, c.Errors())
+		}
+	}
+
+	c := checkOK(t, `
+static mut count = 0;
+interrupt fn TIM2_IRQHandler() { count = count + 1; }
+#[allow(shared_static)]
+fn main() { println(count); }
+main();
+`)
+	if len(c.Warnings()) != 0 {
+		t.Errorf("expected the allowed lint to be silent, got %v", c.Warnings())
+	}
+}
+
+func TestAtomics(t *testing.T) {
+	checkOK(t, `
+static let hits: atomic<u32> = 0;
+static let ready: atomic<bool> = false;
+
+interrupt fn TIM2_IRQHandler() {
+    hits.fetch_add(1, Ordering.Relaxed);
+    ready.store(true, Ordering.Release);
+}
+
+fn main() {
+    let reg: volatile<u32> = 0;
+    let small: i8 = -128;
+    let before: u32 = hits.fetch_sub(1);
+    mut seen: u32 = hits.load(Ordering.Acquire);
+    while !hits.compare_exchange(seen, seen + 1, Ordering.AcqRel, Ordering.Acquire) {
+        seen = hits.load();
+    }
+    fence(Ordering.Release);
+    fence();
+    compiler_barrier();
+    println(before, ready.load(Ordering.Acquire), reg, small);
+}
+main();
+`)
+
+	tests := []struct {
+		name, input, want string
+	}{
+		{"literal too big", `let b: u8 = 256;`, "256 does not fit in u8"},
+		{"negative unsigned", `let b: u16 = -1;`, "-1 does not fit in u16"},
+		{"atomic of a float", `let a: atomic<f32> = 0;`, "Atomic needs an integer or bool type, got f32"},
+		{"load with release", `
+let a: atomic<u32> = 0;
+a.load(Ordering.Release);
+`, "load cannot be Ordering.Release"},
+		{"store with acquire", `
+let a: atomic<u32> = 0;
+a.store(1, Ordering.Acquire);
+`, "store cannot be Ordering.Acquire"},
+		{"failure ordering releases", `
+let a: atomic<u32> = 0;
+a.compare_exchange(0, 1, Ordering.AcqRel, Ordering.AcqRel);
+`, "the failure ordering of compare_exchange cannot be Ordering.AcqRel"},
+		{"fetch_add on a bool", `
+let a: atomic<bool> = false;
+a.fetch_add(1);
+`, "fetch_add needs an integer atomic, got Atomic<bool>"},
+		{"relaxed fence", `fence(Ordering.Relaxed);`, "fence cannot be Ordering.Relaxed"},
+		{"ordering as a value", `let o = Ordering.SeqCst;`,
+			"Ordering.SeqCst can only be passed to an atomic method or fence"},
+		{"unknown ordering", `
+let a: atomic<u32> = 0;
+a.load(Ordering.Consume);
+`, "undefined member Consume on Ordering"},
+		{"ordering not written out", `
+let a: atomic<u32> = 0;
+a.load(1);
+`, "expected an ordering, like Ordering.Acquire"},
+		{"too many orderings", `
+let a: atomic<u32> = 0;
+a.store(1, Ordering.SeqCst, Ordering.SeqCst);
+`, "store expects 1 to 2 arguments, got 3"},
+		{"assigned directly", `
+let a: atomic<u32> = 0;
+a = 1;
+`, "cannot assign int to Atomic<u32>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkHasError(t, tt.input, tt.want)
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package types
+
+// flowGraph is the control-flow graph of one function body, or of the
+// top-level statements. The checker builds it while it walks the body,
+// appending each block's ownership events in evaluation order, and runs the
+// move and borrow analyses over it once the body is done.
+type flowGraph struct {
+	blocks []*flowBlock
+	cur    *flowBlock // where the next event goes
+	locals []*local
+	loans  []*loan
+	loops  []*flowLoop // enclosing loops, innermost last
+	seq    int         // events recorded so far
+	top    bool        // the top-level statements, whose locals are globals
+
+	// What a value holding references may borrow from when it is returned:
+	// returnsRefs is set if the signature lets it hold any, and returnFrom,
+	// if known, has the parameters it may borrow from. escapes is set once
+	// a flowEscape is recorded.
+	returnsRefs bool
+	returnFrom  map[*local]bool
+	escapes     bool
+
+	// What the expression being checked borrows and which references it
+	// reads: a reference bound from it holds those loans.
+	pendingLoans []*loan
+	pendingReads []*local
+
+	// For a closure, the variables of enclosing functions its body uses.
+	captures []capturedLocal
+}
+
+// flowBlock is a straight-line run of events.
+type flowBlock struct {
+	events []flowEvent
+	preds  []flowEdge
+	live   bool // reachable from the entry block
+}
+
+// flowEdge is an edge into a block. A dead edge leads from a return, break
+// or continue to the code written after it, which is unreachable; it lets
+// that code be checked as if control fell through without letting it
+// affect reachable code.
+type flowEdge struct {
+	from *flowBlock
+	dead bool
+}
+
+// flowLoop is a loop being built: its header, which every iteration starts
+// at, and the blocks continue and break go to.
+type flowLoop struct {
+	head, cont, brk *flowBlock
+}
+
+// local is one binding of a variable.
+type local struct {
+	name      string
+	index     int
+	graph     *flowGraph
+	ref       bool // its type holds references
+	line, col int  // where it is declared
+	depth     int  // of the scope it is declared in, whose block it ends with
+
+	param     bool     // a parameter, or self
+	section   bool     // a critical block or handler, not a variable; see newSection
+	lifetimes []string // for a parameter, the lifetimes its type names
+}
+
+type flowEventKind int
+
+const (
+	flowDef    flowEventKind = iota // the local is given a value
+	flowUse                         // the local is read
+	flowMove                        // the local's value is moved out
+	flowBorrow                      // the local is borrowed
+	flowAwait                       // the function is suspended; no local
+	flowEscape                      // a value holding references leaves the function; no local
+)
+
+type flowEvent struct {
+	kind      flowEventKind
+	local     *local
+	path      string // the field of the local, like a.b, or "" for all of it
+	line, col int
+	seq       int    // position in evaluation order
+	movedTo   string // for flowMove
+	loan      *loan  // for flowBorrow
+	operand   bool   // for a flowUse of what a borrow borrows, which the borrow checks
+
+	// For a flowDef of a reference, the loans its new value holds: those
+	// made by the expression and those held by references it read. The
+	// same for the value of a flowEscape.
+	loans  []*loan
+	copies []*local
+
+	// For a flowEscape, the place behind a parameter the value is stored
+	// in, or "" if it is returned, and the parameters it may borrow from,
+	// or nil if any may do.
+	storedIn string
+	allowed  map[*local]bool
+}
+
+func newFlowGraph() *flowGraph {
+	g := &flowGraph{}
+	g.cur = g.newBlock()
+	return g
+}
+
+// beginFlow starts the graph of a new function body and returns the one it
+// interrupts, for endFlow.
+func (c *Checker) beginFlow() *flowGraph {
+	prev := c.flow
+	c.flow = newFlowGraph()
+	return prev
+}
+
+// endFlow analyses the finished graph, reports what it finds and returns to
+// the enclosing one.
+func (c *Checker) endFlow(prev *flowGraph) {
+	c.reportMoves(c.flow)
+	c.reportBorrows(c.flow)
+	c.reportEscapes(c.flow)
+	c.reportUnused(c.flow)
+	c.flow = prev
+}
+
+func (g *flowGraph) newBlock() *flowBlock {
+	b := &flowBlock{}
+	g.blocks = append(g.blocks, b)
+	return b
+}
+
+func (g *flowGraph) newLocal(name string, t Type) *local {
+	l := &local{name: name, index: len(g.locals), graph: g, ref: holdsBorrows(t)}
+	g.locals = append(g.locals, l)
+	return l
+}
+
+// record appends ev, for ev.local, to the current block of the local's
+// graph, which for a variable captured by a closure is the enclosing
+// function's, and returns its sequence number.
+func (g *flowGraph) record(ev flowEvent) int {
+	lg := g
+	if ev.local != nil {
+		lg = ev.local.graph
+	}
+	lg.seq++
+	ev.seq = lg.seq
+	lg.cur.events = append(lg.cur.events, ev)
+	if lg != g {
+		g.capture(ev.local, captureMode(&ev))
+	}
+	if ev.kind == flowUse && ev.local.ref {
+		// A closure that reads a reference it captured holds what the
+		// reference holds.
+		lg.pendingReads = append(lg.pendingReads, ev.local)
+	}
+	return ev.seq
+}
+
+// jump adds an edge from the current block to b.
+func (g *flowGraph) jump(b *flowBlock) {
+	b.preds = append(b.preds, flowEdge{from: g.cur})
+}
+
+// enter continues in b, which control reaches from the current block.
+func (g *flowGraph) enter(b *flowBlock) {
+	g.jump(b)
+	g.cur = b
+}
+
+// branch starts a block that control may enter from the current block and
+// returns the block the current one was.
+func (g *flowGraph) branch() (from *flowBlock) {
+	from = g.cur
+	g.enter(g.newBlock())
+	return from
+}
+
+// join continues in a new block reached from the current block and from
+// each of others.
+func (g *flowGraph) join(others ...*flowBlock) {
+	b := g.newBlock()
+	g.jump(b)
+	for _, o := range others {
+		b.preds = append(b.preds, flowEdge{from: o})
+	}
+	g.cur = b
+}
+
+// terminate ends the current block after a return, break or continue; what
+// follows goes into an unreachable block.
+func (g *flowGraph) terminate() {
+	b := g.newBlock()
+	b.preds = append(b.preds, flowEdge{from: g.cur, dead: true})
+	g.cur = b
+}
+
+// loop enters the header of a new loop and returns the loop, whose continue
+// target is the header until changed; endLoop finishes it.
+func (g *flowGraph) loop() *flowLoop {
+	head := g.newBlock()
+	g.enter(head)
+	l := &flowLoop{head: head, cont: head, brk: &flowBlock{}}
+	g.loops = append(g.loops, l)
+	return l
+}
+
+// endLoop closes the body with the edge back to the header and continues
+// after the loop.
+func (g *flowGraph) endLoop() {
+	l := g.loops[len(g.loops)-1]
+	g.loops = g.loops[:len(g.loops)-1]
+	g.jump(l.head)
+	g.blocks = append(g.blocks, l.brk)
+	g.cur = l.brk
+}
+
+// exit makes the end of the loop reachable from the current block, as when
+// the loop condition is false there.
+func (l *flowLoop) exit(g *flowGraph) {
+	g.jump(l.brk)
+}
+
+func (g *flowGraph) breakLoop() {
+	if len(g.loops) > 0 {
+		g.jump(g.loops[len(g.loops)-1].brk)
+	}
+	g.terminate()
+}
+
+func (g *flowGraph) continueLoop() {
+	if len(g.loops) > 0 {
+		g.jump(g.loops[len(g.loops)-1].cont)
+	}
+	g.terminate()
+}
+
+// markLive finds the blocks reachable from the entry block.
+func (g *flowGraph) markLive() {
+	if g.blocks[0].live {
+		return
+	}
+	succs := make(map[*flowBlock][]*flowBlock)
+	for _, b := range g.blocks {
+		for _, e := range b.preds {
+			if !e.dead {
+				succs[e.from] = append(succs[e.from], b)
+			}
+		}
+	}
+	work := []*flowBlock{g.blocks[0]}
+	g.blocks[0].live = true
+	for len(work) > 0 {
+		b := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, s := range succs[b] {
+			if !s.live {
+				s.live = true
+				work = append(work, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package types
+
+import "github.com/dev-dami/carv/pkg/ast"
+
+// SetFreestanding names the target when it has no operating system, as
+// every Cortex-M target does, or "" for the host. A freestanding program
+// may not use the file system or sockets, which the runtime cannot provide
+// there.
+func (c *Checker) SetFreestanding(target string) {
+	c.freestanding = target
+}
+
+// hostedBuiltins are the builtins that need an operating system.
+var hostedBuiltins = map[string]bool{
+	"read_file": true, "write_file": true, "append_file": true, "file_exists": true,
+	"delete_file": true, "list_dir": true,
+	"tcp_listen": true, "tcp_accept": true, "tcp_read": true, "tcp_write": true, "tcp_close": true,
+}
+
+// hostedModules are the builtin modules made of hosted builtins.
+var hostedModules = map[string]bool{"fs": true, "net": true, "web": true}
+
+func (c *Checker) checkHostedCall(e *ast.CallExpression) {
+	if ident, ok := e.Function.(*ast.Identifier); ok && hostedBuiltins[ident.Value] && c.isGlobal(ident.Value) {
+		line, col := e.Pos()
+		c.hostedError(line, col, ident.Value)
+	}
+}
+
+func (c *Checker) checkHostedRequire(s *ast.RequireStatement) {
+	if hostedModules[s.Path.Value] {
+		line, col := s.Path.Pos()
+		c.hostedError(line, col, "module "+s.Path.Value)
+	}
+}
+
+func (c *Checker) hostedError(line, col int, what string) {
+	if c.freestanding != "" {
+		c.error(line, col, "%s needs an operating system; not available on target %s", what, c.freestanding)
+	}
+}
@@ -8,19 +8,19 @@ func (c *Checker) checkClassStatement(s *ast.ClassStatement) {
 		var ft Type
 		if f.Type != nil {
 			ft = c.resolveTypeExpr(f.Type)
+			c.checkFieldLifetimes(s, f, ft)
 		} else {
 			ft = Any
 		}
 		fields[f.Name.Value] = ft
 	}
 
-	classType := &ClassType{Name: s.Name.Value, Fields: fields}
+	classType := &ClassType{Name: s.Name.Value, Fields: fields, Lifetime: s.Lifetime}
 	c.scope.Define(s.Name.Value, classType)
 
 	for _, method := range s.Methods {
 		prevScope := c.scope
-		prevOwnership := c.pushOwnership()
-		prevBorrows := c.pushBorrows()
+		prevFlow := c.beginFlow()
 		c.scope = NewScope(prevScope)
 
 		switch method.Receiver {
@@ -31,19 +31,25 @@ func (c *Checker) checkClassStatement(s *ast.ClassStatement) {
 		case ast.RecvValue:
 			c.scope.Define("self", classType)
 		}
+		c.trackReceiver()
 
 		paramTypes := c.resolveParameterTypes(method.Parameters)
 		for i, p := range method.Parameters {
 			c.scope.Define(p.Name.Value, paramTypes[i])
+			c.trackParameter(p.Name, paramTypes[i])
 		}
+		var retType Type = Void
+		if method.ReturnType != nil {
+			retType = c.resolveTypeExpr(method.ReturnType)
+		}
+		c.enterMethodSignature(method, paramTypes, retType, classType)
 
 		if method.Body != nil {
-			c.checkBlockStatement(method.Body)
+			c.checkFunctionBody(method.Body)
 		}
 
 		c.scope = prevScope
-		c.popOwnership(prevOwnership)
-		c.popBorrows(prevBorrows)
+		c.endFlow(prevFlow)
 	}
 }
 
@@ -88,6 +94,11 @@ func (c *Checker) checkImplStatement(s *ast.ImplStatement) {
 		c.error(line, col, "undefined type: %s", s.Type.Value)
 		return
 	}
+	if _, isClass := classType.(*ClassType); !isClass && iface == dropInterface {
+		line, col := s.Type.Pos()
+		c.error(line, col, "Drop can only be implemented for a class, not %s", s.Type.Value)
+		return
+	}
 
 	implMethods := make(map[string]*FunctionType)
 	implReceivers := make(map[string]ast.ReceiverKind)
@@ -105,8 +116,7 @@ func (c *Checker) checkImplStatement(s *ast.ImplStatement) {
 		implDecls[method.Name.Value] = method
 
 		prevScope := c.scope
-		prevOwnership := c.pushOwnership()
-		prevBorrows := c.pushBorrows()
+		prevFlow := c.beginFlow()
 		c.scope = NewScope(prevScope)
 
 		switch method.Receiver {
@@ -117,18 +127,22 @@ func (c *Checker) checkImplStatement(s *ast.ImplStatement) {
 		case ast.RecvValue:
 			c.scope.Define("self", classType)
 		}
+		c.trackReceiver()
 
 		for i, p := range method.Parameters {
 			c.scope.Define(p.Name.Value, paramTypes[i])
+			c.trackParameter(p.Name, paramTypes[i])
+		}
+		if cls, ok := classType.(*ClassType); ok {
+			implMethods[method.Name.Value].Borrows = c.enterMethodSignature(method, paramTypes, retType, cls)
 		}
 
 		if method.Body != nil {
-			c.checkBlockStatement(method.Body)
+			c.checkFunctionBody(method.Body)
 		}
 
 		c.scope = prevScope
-		c.popOwnership(prevOwnership)
-		c.popBorrows(prevBorrows)
+		c.endFlow(prevFlow)
 	}
 
 	for name, ifaceMethod := range iface.Methods {
@@ -163,7 +177,7 @@ func (c *Checker) checkImplStatement(s *ast.ImplStatement) {
 					if decl, ok := implDecls[name]; ok {
 						line, col = decl.Name.Pos()
 					}
-					c.warning(line, col, "receiver mismatch for method %s: interface expects %s, impl has %s",
+					c.lint(lintReceiverMismatch, line, col, "receiver mismatch for method %s: interface expects %s, impl has %s",
 						name, receiverKindName(ifaceReceiver), receiverKindName(implReceiver))
 				}
 			}
@@ -184,7 +198,7 @@ func (c *Checker) checkMemberExpressionForInterface(e *ast.MemberExpression, obj
 					if recv, ok := ifaceReceiverMap[e.Member.Value]; ok {
 						if recv == ast.RecvMutRef && !ref.Mutable {
 							line, col := e.Member.Pos()
-							c.error(line, col, "cannot call &mut self method '%s' through immutable interface reference", e.Member.Value)
+							c.lint(lintSharedMutation, line, col, "cannot call &mut self method '%s' through immutable interface reference", e.Member.Value)
 						}
 					}
 				}
@@ -198,6 +212,33 @@ func (c *Checker) checkMemberExpressionForInterface(e *ast.MemberExpression, obj
 	return nil
 }
 
+// dropInterface is the built-in Drop interface. A class that implements it
+// has its drop method called when an instance is dropped: when its owner
+// goes out of scope, returns, breaks or propagates an error with ?, or is
+// assigned over.
+var dropInterface = &InterfaceType{
+	Name:    "Drop",
+	Methods: map[string]*FunctionType{"drop": {Params: []Type{}, Return: Void}},
+}
+
+func (c *Checker) defineDropInterface() {
+	c.scope.Define(dropInterface.Name, dropInterface)
+	c.ifaceReceivers[dropInterface.Name] = map[string]ast.ReceiverKind{"drop": ast.RecvMutRef}
+}
+
+// checkExplicitDrop rejects calling the drop method of a Drop class by
+// hand, which would drop the instance a second time when its owner does.
+func (c *Checker) checkExplicitDrop(member *ast.MemberExpression) {
+	t := c.nodeTypes[member.Object]
+	if ref, ok := t.(*RefType); ok {
+		t = ref.Inner
+	}
+	if cls, ok := t.(*ClassType); ok && c.impls[cls.Name][dropInterface.Name] {
+		line, col := member.Member.Pos()
+		c.error(line, col, "drop cannot be called explicitly; %s is dropped when its owner goes out of scope", cls.Name)
+	}
+}
+
 func receiverKindName(kind ast.ReceiverKind) string {
 	switch kind {
 	case ast.RecvRef:
@@ -212,3 +253,10 @@ func receiverKindName(kind ast.ReceiverKind) string {
 		return "unknown"
 	}
 }
+
+// trackReceiver starts the local for the self a method was just given.
+func (c *Checker) trackReceiver() {
+	if t, ok := c.scope.symbols["self"]; ok {
+		c.trackOwnership("self", t, 0, 0)
+	}
+}
@@ -0,0 +1,502 @@
+package types
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/dev-dami/carv/pkg/ast"
+)
+
+// An interrupt handler, interrupt fn USART1_IRQHandler(), is run by the
+// hardware, between any two instructions of the code it interrupts, so it
+// takes nothing, returns nothing and is never called. It may not allocate,
+// await, or call the builtins that allocate or keep state of their own:
+// the code it interrupted may be in the middle of them, and neither may
+// any function it calls, however indirectly.
+//
+// A static that a handler and the main program both use, and one of them
+// writes, can be seen half written. The main program has to reach it with
+// interrupts held off, inside a critical block or a function only called
+// from one, unless it is an Atomic<T>, which is read and written whole, or
+// a Mutex<T>, which is only reached through lock, in a critical block or a
+// handler. The reference lock returns borrows that block or handler, so it
+// cannot outlive it. Handlers are taken not to interrupt each other.
+
+var (
+	atomicBuiltin = &FunctionType{Params: []Type{Any}, Return: Any}
+	mutexBuiltin  = &FunctionType{Params: []Type{Any}, Return: Any}
+)
+
+// interruptUnsafeBuiltins are the builtins a handler may not call, because
+// they allocate, or use the C library in ways that are not reentrant.
+var interruptUnsafeBuiltins = map[string]bool{
+	"print": true, "println": true, "str": true, "push": true, "tail": true,
+	"split": true, "join": true, "trim": true, "substr": true, "replace": true,
+	"to_upper": true, "to_lower": true, "clone": true,
+	"keys": true, "values": true, "set": true, "delete": true, "args": true,
+	"read_file": true, "write_file": true, "append_file": true, "file_exists": true,
+	"mkdir": true, "remove_file": true, "rename_file": true, "read_dir": true,
+	"cwd": true, "getenv": true, "setenv": true, "exec": true, "exec_output": true,
+	"tcp_listen": true, "tcp_accept": true, "tcp_read": true, "tcp_write": true, "tcp_close": true,
+}
+
+// staticUse is a use of a top-level static, in the function fn, "" for
+// the top level.
+type staticUse struct {
+	name      string
+	fn        string
+	guarded   bool // in a critical block or a handler
+	write     bool
+	line, col int
+	level     LintLevel // of shared_static where the use is
+}
+
+// staticCall is a call of the function callee from caller.
+type staticCall struct {
+	caller, callee string
+	guarded        bool
+	line, col      int
+}
+
+// unsafeUse is something a handler may not do, done in the function fn, so
+// that a handler may not call fn either.
+type unsafeUse struct {
+	fn        string
+	what      string // what fn would do, like "allocate"
+	line, col int
+}
+
+// SetVectorTable gives the entries of the target's vector table, one of
+// which each handler must be named after: its core exceptions, and its
+// device interrupts, or nil if the target does not list them, in which case
+// any name ending in _IRQHandler may be one. Without a table, a handler
+// named unlike any entry is only warned about.
+func (c *Checker) SetVectorTable(core, device []string) {
+	c.vectors = make(map[string]bool)
+	for _, name := range append(append([]string(nil), core...), device...) {
+		c.vectors[name] = true
+	}
+	c.vectorIRQs = device != nil
+}
+
+// checkVectorName checks that the handler s is named after an entry of the
+// vector table, which is what runs it.
+func (c *Checker) checkVectorName(s *ast.FunctionStatement) {
+	name := s.Name.Value
+	line, col := s.Pos()
+	if c.vectors == nil {
+		if !strings.HasSuffix(name, "_Handler") && !strings.HasSuffix(name, "_IRQHandler") {
+			// The startup code's vector table names its entries this way.
+			c.warning(line, col, "interrupt handler %s is not named like a vector table entry, such as USART1_IRQHandler, so nothing will run it", name)
+		}
+		return
+	}
+	if c.vectors[name] || !c.vectorIRQs && strings.HasSuffix(name, "_IRQHandler") {
+		return
+	}
+	best, bestDist := "", 3
+	for entry := range c.vectors {
+		if d := editDistance(name, entry); d < bestDist || d == bestDist && entry < best {
+			best, bestDist = entry, d
+		}
+	}
+	if best != "" {
+		c.error(line, col, "interrupt handler %s is not an entry of the target's vector table, so nothing would run it; did you mean %s?", name, best)
+		return
+	}
+	c.error(line, col, "interrupt handler %s is not an entry of the target's vector table, so nothing would run it", name)
+}
+
+// editDistance is the number of single-byte insertions, deletions and
+// substitutions that turn a into b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// checkInterruptFunction checks the signature of the handler s.
+func (c *Checker) checkInterruptFunction(s *ast.FunctionStatement, retType Type) {
+	line, col := s.Pos()
+	if len(s.Parameters) > 0 || !retType.Equals(Void) || s.Async {
+		c.error(line, col, "interrupt handler %s must take no parameters and return nothing", s.Name.Value)
+	}
+	if s.Test {
+		c.error(line, col, "interrupt handler %s cannot be a test", s.Name.Value)
+	}
+	c.checkVectorName(s)
+	if c.interrupts == nil {
+		c.interrupts = make(map[string]bool)
+	}
+	c.interrupts[s.Name.Value] = true
+}
+
+// checkInterruptSafe reports what a handler may not do in expr, of type t,
+// and records it in any other function, for checkInterruptCalls.
+func (c *Checker) checkInterruptSafe(expr ast.Expression, t Type) {
+	if c.interrupt == "" && c.fnName == "" {
+		return
+	}
+	what := c.interruptUnsafe(expr, t)
+	if what == "" {
+		return
+	}
+	line, col := expr.Pos()
+	if c.interrupt == "" {
+		c.unsafeUses = append(c.unsafeUses, unsafeUse{fn: c.fnName, what: what, line: line, col: col})
+		return
+	}
+	c.error(line, col, "interrupt handler %s cannot %s", c.interrupt, what)
+}
+
+// interruptUnsafe says what expr, of type t, would do that a handler may
+// not, or "" if nothing.
+func (c *Checker) interruptUnsafe(expr ast.Expression, t Type) string {
+	switch e := expr.(type) {
+	case *ast.NewExpression, *ast.ArrayLiteral, *ast.MapLiteral, *ast.InterpolatedString:
+		return "allocate"
+	case *ast.InfixExpression:
+		if e.Operator == "+" && t.Equals(String) {
+			return "allocate"
+		}
+	case *ast.FunctionLiteral:
+		return "make a closure, whose environment is allocated"
+	case *ast.SpawnExpression:
+		return "spawn"
+	case *ast.CallExpression:
+		if ident, ok := e.Function.(*ast.Identifier); ok && interruptUnsafeBuiltins[ident.Value] && c.isGlobal(ident.Value) {
+			return "call " + ident.Value + ", which allocates or is not reentrant"
+		}
+	}
+	return ""
+}
+
+// checkInterruptCalls reports the calls from a handler of functions that
+// do, or call functions that do, what a handler may not.
+func (c *Checker) checkInterruptCalls() {
+	if len(c.interrupts) == 0 || len(c.unsafeUses) == 0 {
+		return
+	}
+	unsafe := make(map[string]*unsafeUse)
+	for i := range c.unsafeUses {
+		if u := &c.unsafeUses[i]; unsafe[u.fn] == nil {
+			unsafe[u.fn] = u
+		}
+	}
+	// reach finds something unsafe that fn does, or that a function it
+	// calls does.
+	reach := func(fn string) *unsafeUse {
+		queue := []string{fn}
+		seen := map[string]bool{fn: true}
+		for len(queue) > 0 {
+			fn := queue[0]
+			queue = queue[1:]
+			if u := unsafe[fn]; u != nil {
+				return u
+			}
+			for _, call := range c.staticCalls {
+				if call.caller == fn && !seen[call.callee] {
+					seen[call.callee] = true
+					queue = append(queue, call.callee)
+				}
+			}
+		}
+		return nil
+	}
+	for _, call := range c.staticCalls {
+		if !c.interrupts[call.caller] {
+			continue
+		}
+		if u := reach(call.callee); u != nil {
+			c.error(call.line, call.col, "interrupt handler %s cannot call %s, since %s would %s (line %d)",
+				call.caller, call.callee, u.fn, u.what, u.line)
+		}
+	}
+}
+
+// checkCriticalStatement checks a critical block, whose body runs with
+// interrupts held off.
+func (c *Checker) checkCriticalStatement(s *ast.CriticalStatement) {
+	prev := c.section
+	c.critical++
+	c.section = c.newSection("critical block", c.scope.depth+1)
+	c.checkBlockStatement(s.Body)
+	c.critical--
+	c.section = prev
+}
+
+// newSection starts the local that the references lock returns borrow: a
+// critical block, or a handler's body, which ends with the block at depth.
+func (c *Checker) newSection(name string, depth int) *local {
+	l := c.flow.newLocal(name, Void)
+	l.depth, l.section = depth, true
+	return l
+}
+
+// borrowSection records that the reference lock returns, at line and col,
+// borrows the critical block or handler it is called in.
+func (c *Checker) borrowSection(line, col int) {
+	l := c.section
+	if l == nil || l.graph != c.flow {
+		return
+	}
+	ln := &loan{place: l, line: line, col: col}
+	ln.seq = c.flow.record(flowEvent{kind: flowBorrow, local: l, line: line, col: col, loan: ln})
+	c.flow.pendingLoans = append(c.flow.pendingLoans, ln)
+	c.flow.loans = append(c.flow.loans, ln)
+}
+
+// checkSyncConstructor checks Atomic(v) or Mutex(v).
+func (c *Checker) checkSyncConstructor(e *ast.CallExpression, ft *FunctionType) Type {
+	name := "Atomic"
+	if ft == mutexBuiltin {
+		name = "Mutex"
+	}
+	if len(e.Arguments) != 1 {
+		line, col := e.Pos()
+		c.error(line, col, "%s expects 1 argument, got %d", name, len(e.Arguments))
+		return Invalid
+	}
+	t := c.checkExpression(e.Arguments[0])
+	if IsInvalid(t) {
+		return Invalid
+	}
+	if ft == atomicBuiltin {
+		if !IsInteger(t) && !t.Equals(Bool) {
+			line, col := e.Arguments[0].Pos()
+			c.error(line, col, "Atomic needs an integer or bool, got %s", t.String())
+		}
+		return &AtomicType{Inner: t}
+	}
+	if IsMoveType(t) {
+		line, _ := e.Arguments[0].Pos()
+		c.markMoveFromExpression(e.Arguments[0], line, "Mutex")
+	}
+	return &MutexType{Inner: t}
+}
+
+// resolveSyncType resolves Atomic<T> or Mutex<T>.
+func (c *Checker) resolveSyncType(t *ast.NamedType) Type {
+	line, col := t.Pos()
+	if len(t.Args) != 1 {
+		c.error(line, col, "%s needs one type argument, like %s<int>", t.Name.Value, t.Name.Value)
+		return Invalid
+	}
+	inner := c.resolveTypeExpr(t.Args[0])
+	if t.Name.Value == "Mutex" {
+		return &MutexType{Inner: inner}
+	}
+	if !IsInteger(inner) && !inner.Equals(Bool) {
+		c.error(line, col, "Atomic needs an integer or bool type, got %s", inner.String())
+		return Invalid
+	}
+	return &AtomicType{Inner: inner}
+}
+
+// syncMember returns the type of the method member of an Atomic or a
+// Mutex, or nil if t is neither.
+func (c *Checker) syncMember(e *ast.MemberExpression, t Type) Type {
+	line, col := e.Member.Pos()
+	switch t := t.(type) {
+	case *AtomicType:
+		if m := c.atomicMember(e, t); m != nil {
+			return m
+		}
+	case *MutexType:
+		if e.Member.Value == "lock" {
+			if c.critical == 0 && c.interrupt == "" {
+				c.error(line, col, "a Mutex can only be locked inside a critical block or an interrupt handler")
+			}
+			c.borrowSection(line, col)
+			return &FunctionType{Return: &RefType{Inner: t.Inner, Mutable: true}}
+		}
+	default:
+		return nil
+	}
+	c.error(line, col, "undefined member %s on %s", e.Member.Value, t.String())
+	return Invalid
+}
+
+// isGlobal reports whether name refers to something defined at the top
+// level: a builtin, function or static, not a local that shadows one.
+func (c *Checker) isGlobal(name string) bool {
+	for sc := c.scope; sc != nil; sc = sc.parent {
+		if _, ok := sc.symbols[name]; ok {
+			return sc.parent == nil
+		}
+	}
+	return false
+}
+
+// declareStatic notes the top-level static s, if it needs to be kept from
+// handlers and the main program at once.
+func (c *Checker) declareStatic(s *ast.LetStatement) {
+	t, ok := c.scope.Lookup(s.Name.Value)
+	if !ok {
+		return
+	}
+	switch t.(type) {
+	case *AtomicType, *MutexType:
+		return
+	}
+	if c.statics == nil {
+		c.statics = make(map[string]bool)
+	}
+	c.statics[s.Name.Value] = true
+}
+
+// noteStaticUse records a use of ident, if it names a top-level static.
+func (c *Checker) noteStaticUse(ident *ast.Identifier, write bool) {
+	if !c.statics[ident.Value] || !c.isGlobal(ident.Value) {
+		return
+	}
+	line, col := ident.Pos()
+	c.staticUses = append(c.staticUses, staticUse{
+		name:    ident.Value,
+		fn:      c.fnName,
+		guarded: c.critical > 0 || c.interrupt != "",
+		write:   write,
+		line:    line,
+		col:     col,
+		level:   c.lintLevel(lintSharedStatic),
+	})
+}
+
+// noteStaticWrite records a write of the static that target is, or is a
+// field or element of.
+func (c *Checker) noteStaticWrite(target ast.Expression) {
+	for {
+		switch e := target.(type) {
+		case *ast.Identifier:
+			c.noteStaticUse(e, true)
+			return
+		case *ast.MemberExpression:
+			target = e.Object
+		case *ast.IndexExpression:
+			target = e.Left
+		default:
+			return
+		}
+	}
+}
+
+// noteCall records a call, for the static analysis, of the top-level
+// function callee names; a handler cannot be called at all.
+func (c *Checker) noteCall(e *ast.CallExpression) {
+	ident, ok := e.Function.(*ast.Identifier)
+	if !ok || !c.isGlobal(ident.Value) {
+		return
+	}
+	line, col := e.Pos()
+	if c.interrupts[ident.Value] {
+		c.error(line, col, "interrupt handler %s cannot be called; the hardware runs it", ident.Value)
+		return
+	}
+	c.staticCalls = append(c.staticCalls, staticCall{
+		caller:  c.fnName,
+		callee:  ident.Value,
+		guarded: c.critical > 0 || c.interrupt != "",
+		line:    line,
+		col:     col,
+	})
+}
+
+// checkSharedStatics reports the statics that a handler and the main
+// program both use, and one of them writes, where the main program uses
+// them with interrupts on.
+func (c *Checker) checkSharedStatics() {
+	if len(c.interrupts) == 0 || len(c.staticUses) == 0 {
+		return
+	}
+
+	// The handler each function may run in, by name.
+	handlerOf := make(map[string]string)
+	handlers := make([]string, 0, len(c.interrupts))
+	for h := range c.interrupts {
+		handlers = append(handlers, h)
+	}
+	sort.Strings(handlers)
+	for _, h := range handlers {
+		queue := []string{h}
+		seen := map[string]bool{h: true}
+		for len(queue) > 0 {
+			fn := queue[0]
+			queue = queue[1:]
+			if _, ok := handlerOf[fn]; !ok {
+				handlerOf[fn] = h
+			}
+			for _, call := range c.staticCalls {
+				if call.caller == fn && !seen[call.callee] {
+					seen[call.callee] = true
+					queue = append(queue, call.callee)
+				}
+			}
+		}
+	}
+
+	// The functions the main program may run with interrupts on, from
+	// the top level.
+	type state struct {
+		fn      string
+		guarded bool
+	}
+	unguarded := make(map[string]bool)
+	queue := []state{{"", false}}
+	seen := map[state]bool{queue[0]: true}
+	for len(queue) > 0 {
+		st := queue[0]
+		queue = queue[1:]
+		if !st.guarded {
+			unguarded[st.fn] = true
+		}
+		for _, call := range c.staticCalls {
+			if call.caller != st.fn {
+				continue
+			}
+			next := state{call.callee, st.guarded || call.guarded}
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	written := make(map[string]bool)
+	handler := make(map[string]string)
+	for _, u := range c.staticUses {
+		if u.write {
+			written[u.name] = true
+		}
+		if h, ok := handlerOf[u.fn]; ok && handler[u.name] == "" {
+			handler[u.name] = h
+		}
+	}
+	uses := append([]staticUse(nil), c.staticUses...)
+	sort.SliceStable(uses, func(i, j int) bool {
+		return uses[i].line < uses[j].line || (uses[i].line == uses[j].line && uses[i].col < uses[j].col)
+	})
+	reported := make(map[string]bool)
+	for _, u := range uses {
+		h := handler[u.name]
+		if h == "" || !written[u.name] || reported[u.name] || u.guarded || !unguarded[u.fn] {
+			continue
+		}
+		reported[u.name] = true
+		c.lintAt(u.level, lintSharedStatic, u.line, u.col,
+			"static '%s' is shared with interrupt handler %s; use it through an Atomic or a Mutex, or inside a critical block", u.name, h)
+	}
+}
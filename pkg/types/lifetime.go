@@ -0,0 +1,439 @@
+package types
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/dev-dami/carv/pkg/ast"
+)
+
+// A reference may not outlive what it borrows. Inside a function that is
+// checked with the loans of borrow.go: every parameter holding references
+// starts out with an origin loan, standing for whatever its caller lent
+// it, and a value holding references that is returned, or stored behind a
+// parameter, must hold nothing but origin loans, and globals.
+//
+// Signatures say which parameters those may be. A lifetime like 'a names
+// the references of the parameters that mention it, and the return type
+// may mention one. Without one the returned references borrow from self,
+// if the method takes a reference to it, or else from the only parameter
+// holding references. A class whose fields hold references has a lifetime
+// parameter, class View<'a>, and so does every reference in them.
+//
+// Within a function each local lives until the end of the block it is
+// declared in, so a reference given to a local, or to a field of one, in
+// a block nested deeper than the local's may only borrow from what lives
+// at least as long.
+
+// holdsBorrows reports whether values of t may hold loans: t holds
+// references, or closures, which hold those they captured, or futures,
+// which hold their arguments.
+func holdsBorrows(t Type) bool {
+	switch t := t.(type) {
+	case *FunctionType, *FutureType:
+		return true
+	case *ArrayType:
+		return holdsBorrows(t.Element)
+	case *MapType:
+		return holdsBorrows(t.Key) || holdsBorrows(t.Value)
+	case *VolatileType:
+		return holdsBorrows(t.Inner)
+	case *MutexType:
+		return holdsBorrows(t.Inner)
+	}
+	return containsRef(t)
+}
+
+// typeLifetimes returns the lifetimes named in t, in order, once each.
+func typeLifetimes(t ast.TypeExpr) []string {
+	var names []string
+	add := func(name string) {
+		for _, n := range names {
+			if n == name {
+				return
+			}
+		}
+		names = append(names, name)
+	}
+	var walk func(ast.TypeExpr)
+	walk = func(t ast.TypeExpr) {
+		switch t := t.(type) {
+		case *ast.RefType:
+			if t.Lifetime != "" {
+				add(t.Lifetime)
+			}
+			walk(t.Inner)
+		case *ast.NamedType:
+			if t.Lifetime != "" {
+				add(t.Lifetime)
+			}
+		case *ast.ArrayType:
+			walk(t.ElementType)
+		case *ast.MapType:
+			walk(t.KeyType)
+			walk(t.ValueType)
+		case *ast.VolatileType:
+			walk(t.Inner)
+		}
+	}
+	walk(t)
+	return names
+}
+
+// returnBorrows works out which parameters the references returned by a
+// function with the given signature borrow from, by index, with -1 for
+// self; self is the receiver's type, or nil. It returns nil when the
+// return type holds no references, or when the signature is reported as
+// ambiguous.
+func (c *Checker) returnBorrows(params []*ast.Parameter, types []Type, ret ast.TypeExpr, retType Type, self Type) []int {
+	if !containsRef(retType) {
+		return nil
+	}
+	line, col := ret.Pos()
+	names := typeLifetimes(ret)
+	if len(names) > 1 {
+		c.error(line, col, "the return type names lifetimes %s and %s, but it can only borrow for one", names[0], names[1])
+		return nil
+	}
+
+	borrows := []int{}
+	if len(names) == 1 {
+		if cls := selfClass(self); cls != nil && cls.Lifetime == names[0] {
+			borrows = append(borrows, -1)
+		}
+		for i, p := range params {
+			if p.Type != nil && hasLifetime(typeLifetimes(p.Type), names[0]) {
+				borrows = append(borrows, i)
+			}
+		}
+		if len(borrows) == 0 {
+			c.error(line, col, "lifetime %s in the return type is not named by any parameter", names[0])
+			return nil
+		}
+		return borrows
+	}
+
+	if self != nil && containsRef(self) {
+		return []int{-1}
+	}
+	for i, t := range types {
+		if containsRef(t) {
+			borrows = append(borrows, i)
+		}
+	}
+	if len(borrows) > 1 {
+		c.error(line, col, "cannot tell which parameter the returned reference borrows from; name a lifetime in the return type and in that parameter, like &'a T")
+		return nil
+	}
+	return borrows
+}
+
+// futureBorrows lists the parameters of an async function that hold
+// references: the future it returns holds them until it is done.
+func futureBorrows(types []Type) []int {
+	borrows := []int{}
+	for i, t := range types {
+		if containsRef(t) {
+			borrows = append(borrows, i)
+		}
+	}
+	return borrows
+}
+
+func selfClass(self Type) *ClassType {
+	if ref, ok := self.(*RefType); ok {
+		self = ref.Inner
+	}
+	cls, _ := self.(*ClassType)
+	return cls
+}
+
+func hasLifetime(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// endUnborrowedArguments ends, at a call of ft, the borrows made by the
+// arguments its result does not borrow from; marks[i] is where argument i
+// started, and the last mark where the arguments ended.
+func (c *Checker) endUnborrowedArguments(ft *FunctionType, marks []pendingMark) {
+	if ft.Borrows == nil {
+		return
+	}
+	for i := len(marks) - 2; i >= 0; i-- {
+		if !borrowsFrom(ft.Borrows, i) {
+			c.flow.endBetween(marks[i], marks[i+1])
+		}
+	}
+}
+
+func borrowsFrom(borrows []int, i int) bool {
+	for _, b := range borrows {
+		if b == i {
+			return true
+		}
+	}
+	return false
+}
+
+// enterSignature starts checking a body against its signature, once its
+// parameters and self are tracked: what they hold comes from the caller,
+// and what the body returns may borrow from the parameters in borrows.
+func (c *Checker) enterSignature(params []*ast.Parameter, self *ClassType, retType Type, borrows []int) {
+	g := c.flow
+	for _, p := range params {
+		if l := c.scope.locals[p.Name.Value]; l != nil {
+			l.param = true
+			if p.Type != nil {
+				l.lifetimes = typeLifetimes(p.Type)
+			}
+		}
+	}
+	if l := c.scope.locals["self"]; l != nil && self != nil {
+		l.param = true
+		if self.Lifetime != "" {
+			l.lifetimes = []string{self.Lifetime}
+		}
+	}
+	for i := range g.blocks[0].events {
+		ev := &g.blocks[0].events[i]
+		if ev.kind == flowDef && ev.local.param && ev.local.ref {
+			ev.loans = append(ev.loans, &loan{place: ev.local, origin: true})
+		}
+	}
+
+	g.returnsRefs = containsRef(retType)
+	if !g.returnsRefs || borrows == nil {
+		return
+	}
+	g.returnFrom = make(map[*local]bool)
+	for _, i := range borrows {
+		name := "self"
+		if i >= 0 {
+			name = params[i].Name.Value
+		}
+		if l := c.scope.locals[name]; l != nil {
+			g.returnFrom[l] = true
+		}
+	}
+}
+
+// enterMethodSignature is enterSignature for a method of cls, returning
+// what the references in its result borrow from.
+func (c *Checker) enterMethodSignature(m *ast.MethodDecl, paramTypes []Type, retType Type, cls *ClassType) []int {
+	self := c.scope.symbols["self"]
+	borrows := c.returnBorrows(m.Parameters, paramTypes, m.ReturnType, retType, self)
+	if self == nil {
+		cls = nil
+	}
+	c.enterSignature(m.Parameters, cls, retType, borrows)
+	return borrows
+}
+
+// checkFieldLifetimes checks that field f of class s, of type t, only
+// holds references for the lifetime of s.
+func (c *Checker) checkFieldLifetimes(s *ast.ClassStatement, f *ast.FieldDecl, t Type) {
+	if !containsRef(t) {
+		return
+	}
+	line, col := f.Name.Pos()
+	if s.Lifetime == "" {
+		c.error(line, col, "field %s holds a reference, so %s needs a lifetime parameter, like class %s<'a>",
+			f.Name.Value, s.Name.Value, s.Name.Value)
+		return
+	}
+	for _, name := range typeLifetimes(f.Type) {
+		if name != s.Lifetime {
+			c.error(line, col, "field %s names lifetime %s, but the lifetime of %s is %s", f.Name.Value, name, s.Name.Value, s.Lifetime)
+			return
+		}
+	}
+}
+
+// checkReturnedBorrows records the return of value, of type t, which may
+// only borrow from what the signature allows.
+func (c *Checker) checkReturnedBorrows(value ast.Expression, t Type) {
+	g := c.flow
+	if g.top || !holdsBorrows(t) {
+		return
+	}
+	line, col := value.Pos()
+	if containsRef(t) && !g.returnsRefs {
+		c.lint(lintEscapingReference, line, col, "reference cannot escape function scope")
+		return
+	}
+	ev := flowEvent{kind: flowEscape, line: line, col: col, allowed: g.returnFrom}
+	ev.loans, ev.copies = g.bindPending()
+	g.escapes = true
+	g.record(ev)
+}
+
+// checkStoredBorrows records the assignment of a value of type t to
+// target, a field where it may outlive what it borrows. In a field behind
+// a parameter, which lives on after the call, it may only borrow from the
+// parameters that name the same lifetime. A closure in a field of a class
+// without a lifetime may not borrow at all.
+func (c *Checker) checkStoredBorrows(target *ast.MemberExpression, t Type) {
+	p, l := c.placeOf(target)
+	if l == nil || p.indexed || l.graph != c.flow || c.flow.top || !holdsBorrows(t) {
+		return
+	}
+	allowed := make(map[*local]bool)
+	switch {
+	case l.param && c.behindReference(p.root):
+		for _, other := range c.flow.locals {
+			for _, name := range l.lifetimes {
+				if other.param && hasLifetime(other.lifetimes, name) {
+					allowed[other] = true
+				}
+			}
+		}
+	default:
+		if cls := selfClass(c.nodeTypes[target.Object]); containsRef(t) || cls == nil || cls.Lifetime != "" {
+			return
+		}
+	}
+	line, col := target.Pos()
+	ev := flowEvent{kind: flowEscape, line: line, col: col, storedIn: placeName(l, p.path), allowed: allowed}
+	ev.loans, ev.copies = c.flow.bindPending()
+	c.flow.escapes = true
+	c.flow.record(ev)
+}
+
+// reportEscapes finds the returned and stored values that borrow from
+// what does not outlive the function, or from a parameter the signature
+// does not allow, and the locals given references to what they outlive.
+func (c *Checker) reportEscapes(g *flowGraph) {
+	if !g.escapes {
+		return
+	}
+	g.markLive()
+	holdsIn := g.analyseHolds()
+	for _, b := range g.blocks {
+		if !b.live {
+			continue
+		}
+		holds := copyHolds(holdsIn[b])
+		for i := range b.events {
+			ev := &b.events[i]
+			switch {
+			case ev.kind == flowEscape:
+				c.checkEscape(g, ev, holds.resolve(ev.loans, ev.copies))
+			case ev.kind == flowDef && ev.local.ref && ev.local.graph == g:
+				c.checkOutliving(g, ev, holds.resolve(ev.loans, ev.copies))
+			}
+			holds.apply(ev)
+		}
+	}
+}
+
+// noteOutliving notes that l is given a value in the current scope, which
+// may hold references to what l outlives.
+func (c *Checker) noteOutliving(l *local) {
+	if c.scope.depth > l.depth {
+		c.flow.escapes = true
+	}
+}
+
+// sortedLoans returns the loans in held in the order they were made.
+func sortedLoans(held map[*loan]bool) []*loan {
+	loans := make([]*loan, 0, len(held))
+	for ln := range held {
+		loans = append(loans, ln)
+	}
+	sort.Slice(loans, func(i, j int) bool {
+		a, b := loans[i], loans[j]
+		return a.seq < b.seq || (a.seq == b.seq && a.place.index < b.place.index)
+	})
+	return loans
+}
+
+// checkOutliving checks the definition ev of a local, or a field of one,
+// whose new value holds the loans in held: none may borrow from a local
+// dropped at the end of a block the local outlives.
+func (c *Checker) checkOutliving(g *flowGraph, ev *flowEvent, held map[*loan]bool) {
+	for _, ln := range sortedLoans(held) {
+		l := ln.place
+		if ln.through || ln.origin || l.graph != g || l.depth <= ev.local.depth {
+			continue
+		}
+		target := placeName(ev.local, ev.path)
+		switch {
+		case l.section:
+			c.lint(lintEscapingReference, ev.line, ev.col, "cannot store the reference lock returns in '%s', which outlives the %s", target, l.name)
+		case ln.closure:
+			c.lint(lintEscapingReference, ev.line, ev.col, "cannot store a closure that captures '%s' by reference in '%s', which outlives it; make it a move closure",
+				l.name, target)
+		default:
+			c.lint(lintEscapingReference, ev.line, ev.col, "cannot store a reference to '%s' in '%s', which outlives it", l.name, target)
+		}
+		return
+	}
+}
+
+func (c *Checker) checkEscape(g *flowGraph, ev *flowEvent, held map[*loan]bool) {
+	for _, ln := range sortedLoans(held) {
+		l := ln.place
+		switch {
+		case ln.through:
+			// Held through what l borrows, which resolve added.
+		case l.graph != g:
+			// A global, or a variable of the function a closure is in.
+		case ln.origin:
+			if ev.allowed == nil || ev.allowed[l] {
+				continue
+			}
+			if ev.storedIn != "" {
+				c.lint(lintLifetimeMismatch, ev.line, ev.col, "cannot store a reference borrowed from '%s' in '%s', which may outlive it; give both the same lifetime, like &'a",
+					l.name, ev.storedIn)
+			} else {
+				c.lint(lintLifetimeMismatch, ev.line, ev.col, "returned reference borrows from '%s', but the signature only lets it borrow from %s",
+					l.name, describeParams(ev.allowed))
+			}
+			return
+		case l.section:
+			if ev.storedIn != "" {
+				c.lint(lintEscapingReference, ev.line, ev.col, "cannot store the reference lock returns in '%s', which outlives the %s", ev.storedIn, l.name)
+			} else {
+				c.lint(lintEscapingReference, ev.line, ev.col, "the reference lock returns cannot escape the %s", l.name)
+			}
+			return
+		case ln.closure:
+			if ev.storedIn != "" {
+				c.lint(lintEscapingReference, ev.line, ev.col, "cannot store a closure that captures '%s' by reference in '%s', which outlives it; make it a move closure",
+					l.name, ev.storedIn)
+			} else {
+				c.lint(lintEscapingReference, ev.line, ev.col, "closure cannot escape function scope: it captures '%s' by reference; make it a move closure", l.name)
+			}
+			return
+		default:
+			if ev.storedIn != "" {
+				c.lint(lintEscapingReference, ev.line, ev.col, "cannot store a reference to '%s' in '%s', which outlives it", l.name, ev.storedIn)
+			} else {
+				c.lint(lintEscapingReference, ev.line, ev.col, "reference cannot escape function scope: it borrows '%s', which is dropped when the function returns", l.name)
+			}
+			return
+		}
+	}
+}
+
+// describeParams lists the parameters in set, in order.
+func describeParams(set map[*local]bool) string {
+	var params []*local
+	for l := range set {
+		params = append(params, l)
+	}
+	if len(params) == 0 {
+		return "globals"
+	}
+	sort.Slice(params, func(i, j int) bool { return params[i].index < params[j].index })
+	names := make([]string, len(params))
+	for i, l := range params {
+		names[i] = "'" + l.name + "'"
+	}
+	return strings.Join(names, " or ")
+}
@@ -0,0 +1,238 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dev-dami/carv/pkg/ast"
+)
+
+// Lints are the diagnostics whose level can be changed: with #[allow(...)],
+// #[warn(...)] or #[deny(...)] on a function, or with the [lints] table of
+// carv.toml for the whole program. The ones that guard memory safety are
+// denied by default, so they are errors, and each has a stable code; the
+// style ones warn.
+
+// LintLevel is what is done with a lint's diagnostics.
+type LintLevel int
+
+const (
+	LintAllow LintLevel = iota // not reported
+	LintWarn                   // reported as a warning
+	LintDeny                   // reported as an error
+)
+
+func (l LintLevel) String() string {
+	switch l {
+	case LintAllow:
+		return "allow"
+	case LintWarn:
+		return "warn"
+	}
+	return "deny"
+}
+
+// ParseLintLevel parses "allow", "warn" or "deny".
+func ParseLintLevel(s string) (LintLevel, error) {
+	switch s {
+	case "allow":
+		return LintAllow, nil
+	case "warn":
+		return LintWarn, nil
+	case "deny":
+		return LintDeny, nil
+	}
+	return LintAllow, fmt.Errorf("unknown lint level %q (want \"allow\", \"warn\" or \"deny\")", s)
+}
+
+// Lint describes one lint.
+type Lint struct {
+	Name    string
+	Code    string // stable code for the memory-safety lints, or ""
+	Default LintLevel
+	Summary string
+}
+
+const (
+	lintUseAfterMove      = "use_after_move"
+	lintMoveOutOfIndex    = "move_out_of_index"
+	lintMoveOutOfRef      = "move_out_of_reference"
+	lintBorrowConflict    = "borrow_conflict"
+	lintAssignWhileBorrow = "assign_while_borrowed"
+	lintMoveWhileBorrowed = "move_while_borrowed"
+	lintUseWhileBorrowed  = "use_while_borrowed"
+	lintBorrowAcrossAwait = "borrow_across_await"
+	lintSharedMutation    = "shared_mutation"
+	lintEscapingReference = "escaping_reference"
+	lintReceiverMismatch  = "receiver_mismatch"
+	lintLifetimeMismatch  = "lifetime_mismatch"
+	lintUnused            = "unused"
+	lintNonReferenceDeref = "non_reference_deref"
+	lintSharedStatic      = "shared_static"
+)
+
+var lints = []Lint{
+	{lintUseAfterMove, "E0101", LintDeny, "use of a value, or a field of one, after it was moved"},
+	{lintMoveOutOfIndex, "E0102", LintDeny, "move out of an array or map element"},
+	{lintMoveOutOfRef, "E0103", LintDeny, "move of a value other than a string out from behind a reference"},
+	{lintBorrowConflict, "E0201", LintDeny, "borrow that conflicts with a live mutable borrow"},
+	{lintAssignWhileBorrow, "E0202", LintDeny, "assignment to a value while it is borrowed"},
+	{lintMoveWhileBorrowed, "E0203", LintDeny, "move out of a value while it is borrowed"},
+	{lintBorrowAcrossAwait, "E0204", LintDeny, "borrow held across an await"},
+	{lintSharedMutation, "E0205", LintDeny, "mutation through a shared reference such as &self"},
+	{lintEscapingReference, "E0206", LintDeny, "reference returned or stored where it outlives what it borrows"},
+	{lintReceiverMismatch, "E0207", LintDeny, "impl method receiver that differs from the interface's"},
+	{lintLifetimeMismatch, "E0208", LintDeny, "reference that borrows from a parameter its signature does not allow"},
+	{lintUseWhileBorrowed, "E0209", LintDeny, "use of a value while it is mutably borrowed"},
+	{lintSharedStatic, "E0301", LintDeny, "static shared with an interrupt handler outside an Atomic, a Mutex or a critical block"},
+	{lintUnused, "", LintWarn, "variable that is never read"},
+	{lintNonReferenceDeref, "", LintWarn, "dereference of a value that is not a reference"},
+}
+
+func findLint(name string) *Lint {
+	for i := range lints {
+		if lints[i].Name == name {
+			return &lints[i]
+		}
+	}
+	return nil
+}
+
+// Lints returns every lint, the memory-safety ones first.
+func Lints() []Lint {
+	return append([]Lint(nil), lints...)
+}
+
+// SetLintLevel sets the level of the named lint for the whole program, as
+// the [lints] table of carv.toml does. Attributes on a function still
+// override it there.
+func (c *Checker) SetLintLevel(name string, level LintLevel) error {
+	if findLint(name) == nil {
+		return fmt.Errorf("unknown lint %q", name)
+	}
+	if c.lintLevels == nil {
+		c.lintLevels = make(map[string]LintLevel)
+	}
+	c.lintLevels[name] = level
+	return nil
+}
+
+// lintAttributes lists the attributes that set lint levels.
+var lintAttributes = map[string]LintLevel{
+	"allow": LintAllow,
+	"warn":  LintWarn,
+	"deny":  LintDeny,
+}
+
+// pushLintAttributes applies the lint attributes of a function while it is
+// checked; popLintAttributes undoes it.
+func (c *Checker) pushLintAttributes(attrs []*ast.Attribute) {
+	var levels map[string]LintLevel
+	for _, attr := range attrs {
+		level, ok := lintAttributes[attr.Name.Value]
+		if !ok {
+			continue
+		}
+		for _, arg := range attr.Args {
+			if findLint(arg.Value) != nil {
+				if levels == nil {
+					levels = make(map[string]LintLevel)
+				}
+				levels[arg.Value] = level
+			}
+		}
+	}
+	c.lintScopes = append(c.lintScopes, levels)
+}
+
+func (c *Checker) popLintAttributes() {
+	c.lintScopes = c.lintScopes[:len(c.lintScopes)-1]
+}
+
+// checkLintAttribute checks the lint names of an #[allow], #[warn] or
+// #[deny].
+func (c *Checker) checkLintAttribute(attr *ast.Attribute) {
+	if len(attr.Args) == 0 {
+		line, col := attr.Pos()
+		c.error(line, col, "#[%s] needs the lints it applies to, like #[%s(unused)]", attr.Name.Value, attr.Name.Value)
+	}
+	for _, arg := range attr.Args {
+		if findLint(arg.Value) == nil {
+			line, col := arg.Pos()
+			c.error(line, col, "unknown lint '%s'", arg.Value)
+		}
+	}
+}
+
+// lintLevel returns the level of the named lint where the checker is.
+func (c *Checker) lintLevel(name string) LintLevel {
+	for i := len(c.lintScopes) - 1; i >= 0; i-- {
+		if level, ok := c.lintScopes[i][name]; ok {
+			return level
+		}
+	}
+	if level, ok := c.lintLevels[name]; ok {
+		return level
+	}
+	return findLint(name).Default
+}
+
+// lint reports a diagnostic of the named lint at its level.
+func (c *Checker) lint(name string, line, col int, format string, args ...interface{}) {
+	c.lintAt(c.lintLevel(name), name, line, col, format, args...)
+}
+
+// lintAt reports a diagnostic of the named lint at level, for one found
+// after the checker has left where it is.
+func (c *Checker) lintAt(level LintLevel, name string, line, col int, format string, args ...interface{}) {
+	issue := CheckIssue{
+		Line:    line,
+		Column:  col,
+		Lint:    name,
+		Code:    findLint(name).Code,
+		Message: fmt.Sprintf(format, args...),
+	}
+	switch level {
+	case LintDeny:
+		issue.Kind = "error"
+		c.errors = append(c.errors, issue)
+	case LintWarn:
+		issue.Kind = "warning"
+		c.warnings = append(c.warnings, issue)
+	}
+}
+
+// tag is how an issue of a lint is labelled: by its code if it has one,
+// or else by the lint's name.
+func (i CheckIssue) tag() string {
+	if i.Code != "" {
+		return "[" + i.Code + "]"
+	}
+	if i.Lint != "" {
+		return "[" + i.Lint + "]"
+	}
+	return ""
+}
+
+// reportUnused warns about the locals of a function that are never read.
+// Writing a field counts as a use, since the object outlives the write.
+// Top-level variables are globals, which any function may read, and self
+// and names starting with _ are exempt.
+func (c *Checker) reportUnused(g *flowGraph) {
+	if g.top {
+		return
+	}
+	read := make([]bool, len(g.locals))
+	for _, b := range g.blocks {
+		for _, ev := range b.events {
+			if ev.local != nil && ev.local.graph == g && (ev.kind != flowDef || ev.path != "") {
+				read[ev.local.index] = true
+			}
+		}
+	}
+	for _, l := range g.locals {
+		if !read[l.index] && !l.section && l.name != "self" && !strings.HasPrefix(l.name, "_") {
+			c.lint(lintUnused, l.line, l.col, "unused variable '%s'", l.name)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package types
+
+import "github.com/dev-dami/carv/pkg/ast"
+
+// SetStaticMemory turns on the static memory rules: nothing may allocate an
+// amount of memory that is only known at run time, class instances may not
+// outlive the block that creates them, and async functions may not
+// recurse, since each gets a single statically placed frame.
+func (c *Checker) SetStaticMemory(on bool) {
+	c.staticMemory = on
+}
+
+// unboundedBuiltins are the builtins whose result size depends on run-time
+// data.
+var unboundedBuiltins = map[string]string{
+	"push":     "grows an array at run time",
+	"split":    "returns an array of unknown size",
+	"keys":     "returns an array of unknown size",
+	"values":   "returns an array of unknown size",
+	"args":     "returns an array of unknown size",
+	"read_dir": "returns an array of unknown size",
+}
+
+func (c *Checker) checkStaticCall(e *ast.CallExpression) {
+	if !c.staticMemory {
+		return
+	}
+	ident, ok := e.Function.(*ast.Identifier)
+	if !ok {
+		return
+	}
+	if why, ok := unboundedBuiltins[ident.Value]; ok {
+		line, col := e.Pos()
+		c.error(line, col, "%s %s; not available with static memory", ident.Value, why)
+	}
+}
+
+func (c *Checker) checkStaticMapLiteral(e *ast.MapLiteral) {
+	if c.staticMemory {
+		line, col := e.Pos()
+		c.error(line, col, "maps grow at run time; not available with static memory")
+	}
+}
+
+// stackObject returns the depth of the block that the class instance expr
+// evaluates to lives in, if it is one that a function creates in its frame:
+// directly, through a variable bound to one, or inside an array, Ok or Err.
+// Instances that top-level code creates outside any block live as long as
+// the program, and do not count.
+func (c *Checker) stackObject(expr ast.Expression) (int, bool) {
+	switch e := expr.(type) {
+	case *ast.NewExpression:
+		return c.scope.depth, c.scope.depth > 0
+	case *ast.Identifier:
+		if sc := c.scope.defining(e.Value); sc != nil {
+			depth, ok := sc.objects[e.Value]
+			return depth, ok
+		}
+	case *ast.ArrayLiteral:
+		depth, found := 0, false
+		for _, el := range e.Elements {
+			if d, ok := c.stackObject(el); ok {
+				depth, found = max(depth, d), true
+			}
+		}
+		return depth, found
+	case *ast.OkExpression:
+		return c.stackObject(e.Value)
+	case *ast.ErrExpression:
+		return c.stackObject(e.Value)
+	}
+	return 0, false
+}
+
+// trackStackObject records whether the variable name, defined in the
+// current scope or one around it, now holds a stack object.
+func (c *Checker) trackStackObject(name string, value ast.Expression) {
+	if !c.staticMemory {
+		return
+	}
+	sc := c.scope.defining(name)
+	if sc == nil {
+		return
+	}
+	if depth, ok := c.stackObject(value); ok {
+		if sc.objects == nil {
+			sc.objects = make(map[string]int)
+		}
+		sc.objects[name] = depth
+	} else {
+		delete(sc.objects, name)
+	}
+}
+
+// checkStaticStore checks storing value in target, which may not outlive
+// the block a stack object in value lives in. A variable lives as long as
+// the block that defines it, and a field or element as long as the stack
+// object holding it; anything else may outlive the frame.
+func (c *Checker) checkStaticStore(target, value ast.Expression) {
+	if !c.staticMemory {
+		return
+	}
+	if ident, ok := target.(*ast.Identifier); ok {
+		if sc := c.scope.defining(ident.Value); sc != nil {
+			if depth, ok := c.stackObject(value); ok && sc.depth < depth {
+				line, col := value.Pos()
+				c.error(line, col, "class instance cannot be stored in %s, which outlives the block it lives in, with static memory", ident.Value)
+			}
+		}
+		c.trackStackObject(ident.Value, value)
+		return
+	}
+	depth, ok := c.stackObject(value)
+	if !ok {
+		return
+	}
+	holder := 0
+	root := target
+	for {
+		if member, ok := root.(*ast.MemberExpression); ok {
+			root = member.Object
+		} else if index, ok := root.(*ast.IndexExpression); ok {
+			root = index.Left
+		} else {
+			break
+		}
+	}
+	if _, ok := target.(*ast.DerefExpression); !ok {
+		if d, ok := c.stackObject(root); ok {
+			holder = d
+		}
+	}
+	if holder < depth {
+		line, col := value.Pos()
+		c.error(line, col, "class instance cannot be stored where it outlives the block it lives in, with static memory")
+	}
+}
+
+func (c *Checker) checkStaticReturn(s *ast.ReturnStatement) {
+	if !c.staticMemory {
+		return
+	}
+	if _, ok := c.stackObject(s.ReturnValue); ok {
+		line, col := s.ReturnValue.Pos()
+		c.error(line, col, "class instance cannot be returned with static memory; it lives in the frame that creates it")
+	}
+}
+
+// checkStaticAsyncCall rejects an async function calling itself. Each async
+// function has one static frame, so a second live activation would
+// overwrite the first. Functions are only visible after their declaration,
+// so recursion through other functions cannot arise.
+func (c *Checker) checkStaticAsyncCall(e *ast.CallExpression, fnType *FunctionType) {
+	if !c.staticMemory || !c.inAsyncFn {
+		return
+	}
+	if _, ok := fnType.Return.(*FutureType); !ok {
+		return
+	}
+	if ident, ok := e.Function.(*ast.Identifier); ok && ident.Value == c.fnName {
+		line, col := e.Pos()
+		c.error(line, col, "async function %s calls itself; not available with static memory", ident.Value)
+	}
+}
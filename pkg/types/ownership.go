@@ -1,54 +1,557 @@
 package types
 
-import "github.com/dev-dami/carv/pkg/ast"
+import (
+	"fmt"
+	"sort"
+	"strings"
 
-// OwnershipState tracks whether a variable's value has been moved.
-type OwnershipState int
-
-const (
-	Owned OwnershipState = iota // variable holds its value
-	Moved                       // value has been moved to another binding
+	"github.com/dev-dami/carv/pkg/ast"
 )
 
-// VarOwnership tracks ownership metadata for a variable.
-type VarOwnership struct {
-	State   OwnershipState
-	MovedAt int    // line number where the move occurred
-	MovedTo string // what it was moved to (variable name or "function call")
+// Ownership is checked per function body on a control-flow graph (see
+// flow.go): the checker records where each local is defined, read, moved
+// and borrowed, and a dataflow analysis then finds the reads of values
+// that were moved on some or every path to them.
+//
+// Events are about places: a local or a field path within it, like x.a.b.
+// Moving a field leaves the rest of the value usable, but not the value as
+// a whole. Nothing is tracked below an index, so an element can only be
+// moved out with take or exchange.
+
+// trackOwnership starts a new local for name, just defined in the current
+// scope at line and col.
+func (c *Checker) trackOwnership(name string, t Type, line, col int) {
+	if c.scope.locals == nil {
+		c.scope.locals = make(map[string]*local)
+	}
+	l := c.flow.newLocal(name, t)
+	l.line, l.col = line, col
+	l.depth = c.scope.depth
+	c.scope.locals[name] = l
+	c.defineLocal(l, 0, 0)
+}
+
+// trackParameter starts the local for a parameter or loop variable.
+func (c *Checker) trackParameter(name *ast.Identifier, t Type) {
+	line, col := name.Pos()
+	c.trackOwnership(name.Value, t, line, col)
+}
+
+// defineLocal records that l is given a value, which for a reference holds
+// what the expression just checked borrowed.
+func (c *Checker) defineLocal(l *local, line, col int) {
+	ev := flowEvent{kind: flowDef, local: l, line: line, col: col}
+	if l.ref && l.graph == c.flow {
+		ev.loans, ev.copies = c.flow.bindPending()
+		c.noteOutliving(l)
+	}
+	c.flow.record(ev)
 }
 
-func (c *Checker) pushOwnership() map[string]*VarOwnership {
-	prev := c.ownership
-	next := make(map[string]*VarOwnership, len(prev))
-	for name, ownership := range prev {
-		next[name] = ownership
+// noteOwnership records an event for the local name refers to, if it is one.
+func (c *Checker) noteOwnership(kind flowEventKind, name string, line, col int, movedTo string) {
+	l := c.scope.lookupLocal(name)
+	switch {
+	case l == nil:
+	case kind == flowDef:
+		c.defineLocal(l, line, col)
+	default:
+		if kind == flowMove && l.graph != c.flow {
+			movedTo = "closure"
+		}
+		c.flow.record(flowEvent{kind: kind, local: l, line: line, col: col, movedTo: movedTo})
 	}
-	c.ownership = next
-	return prev
 }
 
-func (c *Checker) popOwnership(prev map[string]*VarOwnership) {
-	c.ownership = prev
+// place is where an expression like x.a[i].b lives: the local x and the
+// fields, a, that can be tracked before the first index.
+type place struct {
+	root    *ast.Identifier
+	path    string
+	indexed bool
+}
+
+// placeOf returns the place expr names, if it is a local or a field or
+// element of one.
+func (c *Checker) placeOf(expr ast.Expression) (place, *local) {
+	var fields []string
+	var p place
+	for p.root == nil {
+		switch e := expr.(type) {
+		case *ast.Identifier:
+			p.root = e
+		case *ast.MemberExpression:
+			fields = append(fields, e.Member.Value)
+			expr = e.Object
+		case *ast.IndexExpression:
+			fields = fields[:0]
+			p.indexed = true
+			expr = e.Left
+		default:
+			return place{}, nil
+		}
+	}
+	for i := len(fields) - 1; i >= 0; i-- {
+		p.path = joinPath(p.path, fields[i])
+	}
+	return p, c.scope.lookupLocal(p.root.Value)
+}
+
+func joinPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
 }
 
-func (c *Checker) trackOwnership(name string, t Type) {
-	if IsMoveType(t) {
-		c.ownership[name] = &VarOwnership{State: Owned}
+// within reports whether path is p or a field of it.
+func within(path, p string) bool {
+	return p == "" || path == p || strings.HasPrefix(path, p+".")
+}
+
+func placeName(l *local, path string) string {
+	if path == "" {
+		return l.name
+	}
+	return l.name + "." + path
+}
+
+// narrowUse turns the read of obj just recorded into a read of its field.
+func (c *Checker) narrowUse(obj ast.Expression, field string) {
+	p, l := c.placeOf(obj)
+	if l == nil || p.indexed {
 		return
 	}
-	delete(c.ownership, name)
+	events := l.graph.cur.events
+	if n := len(events); n > 0 {
+		ev := &events[n-1]
+		if ev.local == l && ev.kind == flowUse && ev.path == p.path {
+			ev.path = joinPath(p.path, field)
+		}
+	}
 }
 
-func (c *Checker) markMoved(name string, line int, movedTo string) {
-	if own, exists := c.ownership[name]; exists && own.State == Owned {
-		own.State = Moved
-		own.MovedAt = line
-		own.MovedTo = movedTo
+// defineField turns the read of the field just recorded for target into
+// an assignment to it, which gives a moved field a value again.
+func (c *Checker) defineField(target *ast.MemberExpression) {
+	p, l := c.placeOf(target)
+	if l == nil || p.indexed {
+		return
+	}
+	events := l.graph.cur.events
+	if n := len(events); n > 0 {
+		ev := &events[n-1]
+		if ev.local == l && ev.kind == flowUse && ev.path == p.path {
+			ev.kind = flowDef
+			ev.line, ev.col = target.Pos()
+			if l.ref && l.graph == c.flow {
+				ev.loans, ev.copies = c.flow.bindPending()
+				c.noteOutliving(l)
+			}
+		}
 	}
 }
 
 func (c *Checker) markMoveFromExpression(expr ast.Expression, line int, movedTo string) {
-	if ident, ok := expr.(*ast.Identifier); ok {
-		c.markMoved(ident.Value, line, movedTo)
+	if d, ok := expr.(*ast.DerefExpression); ok {
+		_, col := d.Pos()
+		name := "a reference"
+		if p, l := c.placeOf(d.Value); l != nil && !p.indexed {
+			name = "'*" + placeName(l, p.path) + "'"
+		}
+		c.moveOutOfReference(d, line, col, name)
+		return
+	}
+	p, l := c.placeOf(expr)
+	if l == nil {
+		return
+	}
+	_, col := expr.Pos()
+	if p.indexed {
+		c.lint(lintMoveOutOfIndex, line, col, "cannot move out of an element of '%s'; use take or exchange, or clone it", p.root.Value)
+		return
+	}
+	if p.path != "" && c.behindReference(p.root) && !c.moveOutOfReference(expr, line, col, "'"+placeName(l, p.path)+"'") {
+		return
+	}
+	c.moves[expr] = true
+	if l.graph != c.flow {
+		movedTo = "closure"
+	}
+	c.flow.record(flowEvent{kind: flowMove, local: l, path: p.path, line: line, col: col, movedTo: movedTo})
+}
+
+// behindReference reports whether the fields of root belong to someone
+// else: root is a reference, or it is self, which even a method taking self
+// by value shares with its caller.
+func (c *Checker) behindReference(root *ast.Identifier) bool {
+	if root.Value == "self" {
+		return true
+	}
+	t, _ := c.scope.Lookup(root.Value)
+	_, isRef := t.(*RefType)
+	return isRef
+}
+
+// moveOutOfReference checks a move of expr, whose value is behind a
+// reference. Only a string may be moved from there: it is copied, since
+// the owner behind the reference still drops it.
+func (c *Checker) moveOutOfReference(expr ast.Expression, line, col int, name string) bool {
+	if t := c.nodeTypes[expr]; t != nil && t.Equals(String) {
+		c.moves[expr] = true
+		return true
+	}
+	c.lint(lintMoveOutOfRef, line, col, "cannot move out of %s, which is behind a reference", name)
+	return false
+}
+
+// The take and exchange builtins, which a function of the same name hides.
+var (
+	takeBuiltin     = &FunctionType{Params: []Type{Any}, Return: Any}
+	exchangeBuiltin = &FunctionType{Params: []Type{Any, Any}, Return: Any}
+)
+
+// checkTakeCall checks take(&mut place), which moves the value out of a
+// place and leaves the zero value of its type behind, and exchange(&mut
+// place, value), which leaves value there instead. Unlike a move, either
+// works on an element of an array or map.
+func (c *Checker) checkTakeCall(e *ast.CallExpression, name string) Type {
+	line, col := e.Pos()
+	want := 1
+	if name == "exchange" {
+		want = 2
+	}
+	if len(e.Arguments) != want {
+		c.error(line, col, "%s expects %d arguments, got %d", name, want, len(e.Arguments))
+		for _, arg := range e.Arguments {
+			c.checkExpression(arg)
+		}
+		return Any
+	}
+
+	argType := c.checkExpression(e.Arguments[0])
+	ref, ok := argType.(*RefType)
+	if !ok || !ref.Mutable {
+		if !IsInvalid(argType) {
+			line, col := e.Arguments[0].Pos()
+			c.error(line, col, "%s expects a mutable reference (&mut place), got %s", name, argType.String())
+		}
+		if want == 2 {
+			c.checkExpression(e.Arguments[1])
+		}
+		return Any
+	}
+	if want == 2 {
+		valType := c.checkExpression(e.Arguments[1])
+		if !c.isAssignable(ref.Inner, valType) {
+			line, col := e.Arguments[1].Pos()
+			c.error(line, col, "exchange: cannot put %s in place of %s", valType.String(), ref.Inner.String())
+		}
+		if IsMoveType(valType) {
+			line, _ := e.Arguments[1].Pos()
+			c.markMoveFromExpression(e.Arguments[1], line, "function call")
+		}
+	}
+	return ref.Inner
+}
+
+// moveFact is what the analysis knows about one place at one point: the
+// moves that may have happened on some path to it, and whether one has on
+// every path.
+type moveFact struct {
+	moves map[*flowEvent]bool
+	all   bool
+}
+
+func (f *moveFact) merge(o moveFact) {
+	for ev := range o.moves {
+		if f.moves == nil {
+			f.moves = make(map[*flowEvent]bool)
+		}
+		f.moves[ev] = true
+	}
+}
+
+// placeMoves holds the facts about the moved places within one local, by
+// path. It is never changed once made, so states can share it.
+type placeMoves map[string]moveFact
+
+// without returns m less the facts about path and its fields.
+func (m placeMoves) without(path string) placeMoves {
+	next := make(placeMoves, len(m))
+	for p, f := range m {
+		if !within(p, path) {
+			next[p] = f
+		}
+	}
+	return next
+}
+
+// covering returns the fact about the closest place that holds path.
+func (m placeMoves) covering(path string) (moveFact, bool) {
+	for p := path; ; {
+		if f, ok := m[p]; ok {
+			return f, true
+		}
+		if p == "" {
+			return moveFact{}, false
+		}
+		if i := strings.LastIndexByte(p, '.'); i >= 0 {
+			p = p[:i]
+		} else {
+			p = ""
+		}
+	}
+}
+
+type moveState []placeMoves
+
+// analyseMoves computes which moves may reach, and which must have
+// happened, at the start of every block. Live blocks only take in live
+// predecessors; unreachable ones take in everything, dead edges included.
+func (g *flowGraph) analyseMoves() map[*flowBlock]moveState {
+	g.markLive()
+	in := make(map[*flowBlock]moveState, len(g.blocks))
+	out := make(map[*flowBlock]moveState, len(g.blocks))
+
+	for changed := true; changed; {
+		changed = false
+		for i, b := range g.blocks {
+			var preds []moveState
+			for _, e := range b.preds {
+				if s, ok := out[e.from]; ok && (!b.live || e.from.live) {
+					preds = append(preds, s)
+				}
+			}
+			if i > 0 && len(preds) == 0 && len(b.preds) > 0 {
+				continue // nothing known yet about how control gets here
+			}
+			state := joinMoves(len(g.locals), preds)
+			in[b] = state
+			next := g.transfer(b, state)
+			if prev, ok := out[b]; !ok || !sameMoves(prev, next) {
+				out[b] = next
+				changed = true
+			}
+		}
+	}
+	return in
+}
+
+func (g *flowGraph) transfer(b *flowBlock, state moveState) moveState {
+	next := make(moveState, len(state))
+	copy(next, state)
+	for i := range b.events {
+		next.apply(&b.events[i])
+	}
+	return next
+}
+
+// apply updates the state for what ev does to its place.
+func (s moveState) apply(ev *flowEvent) {
+	switch ev.kind {
+	case flowDef:
+		s[ev.local.index] = s[ev.local.index].without(ev.path)
+	case flowMove:
+		m := s[ev.local.index].without(ev.path)
+		m[ev.path] = moveFact{moves: map[*flowEvent]bool{ev: true}, all: true}
+		s[ev.local.index] = m
+	}
+}
+
+func joinMoves(n int, preds []moveState) moveState {
+	state := make(moveState, n)
+	if len(preds) == 0 {
+		return state
+	}
+	for i := range state {
+		paths := make(map[string]bool)
+		for _, p := range preds {
+			for path := range p[i] {
+				paths[path] = true
+			}
+		}
+		if len(paths) == 0 {
+			continue
+		}
+		m := make(placeMoves, len(paths))
+		for path := range paths {
+			fact := moveFact{all: true}
+			for _, p := range preds {
+				f, ok := p[i].covering(path)
+				fact.all = fact.all && ok && f.all
+				fact.merge(f)
+			}
+			m[path] = fact
+		}
+		state[i] = m
+	}
+	return state
+}
+
+func sameMoves(a, b moveState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for path, fa := range a[i] {
+			fb, ok := b[i][path]
+			if !ok || fa.all != fb.all || len(fa.moves) != len(fb.moves) {
+				return false
+			}
+			for ev := range fa.moves {
+				if !fb.moves[ev] {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// reportMoves warns about every use or borrow of a place that has been
+// moved, or had a field moved out of it, on some path to it.
+func (c *Checker) reportMoves(g *flowGraph) {
+	if len(g.locals) == 0 {
+		return
+	}
+	in := g.analyseMoves()
+	for _, b := range g.blocks {
+		entry, ok := in[b]
+		if !ok {
+			continue
+		}
+		state := make(moveState, len(entry))
+		copy(state, entry)
+		for i := range b.events {
+			ev := &b.events[i]
+			switch {
+			case ev.kind == flowUse || ev.kind == flowBorrow:
+				c.checkMovedUse(ev, state[ev.local.index])
+			case ev.kind == flowDef && ev.path != "":
+				c.checkMovedField(ev, state[ev.local.index])
+			}
+			state.apply(ev)
+		}
+	}
+}
+
+func (c *Checker) checkMovedUse(ev *flowEvent, moved placeMoves) {
+	var whole moveFact
+	parts := make(map[string]moveFact)
+	for path, f := range moved {
+		switch {
+		case within(ev.path, path):
+			whole.all = whole.all || f.all
+			whole.merge(f)
+		case within(path, ev.path):
+			parts[path] = f
+		}
+	}
+
+	what := "use of moved value"
+	if ev.kind == flowBorrow {
+		what = "cannot borrow moved value"
+	}
+	if len(whole.moves) > 0 {
+		if !whole.all {
+			what = strings.Replace(what, "moved", "possibly moved", 1)
+		}
+		c.lint(lintUseAfterMove, ev.line, ev.col, "%s '%s' (%s)", what, placeName(ev.local, ev.path), describeMoves(ev, whole))
+		return
+	}
+	if len(parts) == 0 {
+		return
+	}
+
+	paths := make([]string, 0, len(parts))
+	all := false
+	for path, f := range parts {
+		paths = append(paths, path)
+		all = all || f.all
+	}
+	sort.Strings(paths)
+	what = strings.Replace(what, "moved", "partially moved", 1)
+	if !all {
+		what = strings.Replace(what, "partially", "possibly partially", 1)
+	}
+	var where []string
+	for _, path := range paths {
+		where = append(where, placeName(ev.local, path)+" "+describeMoves(ev, parts[path]))
+	}
+	c.lint(lintUseAfterMove, ev.line, ev.col, "%s '%s' (%s)", what, placeName(ev.local, ev.path), strings.Join(where, "; "))
+}
+
+// checkMovedField warns about an assignment to a field of a value that has
+// been moved as a whole, which cannot give it a value again.
+func (c *Checker) checkMovedField(ev *flowEvent, moved placeMoves) {
+	var outer moveFact
+	for path, f := range moved {
+		if path != ev.path && within(ev.path, path) {
+			outer.all = outer.all || f.all
+			outer.merge(f)
+		}
+	}
+	if len(outer.moves) == 0 {
+		return
+	}
+	what := "cannot assign to field of moved value"
+	if !outer.all {
+		what = "cannot assign to field of possibly moved value"
+	}
+	parent := ""
+	if i := strings.LastIndexByte(ev.path, '.'); i >= 0 {
+		parent = ev.path[:i]
+	}
+	c.lint(lintUseAfterMove, ev.line, ev.col, "%s '%s' (%s)", what, placeName(ev.local, parent), describeMoves(ev, outer))
+}
+
+// describeMoves says where the moves in fact happened, relative to ev.
+func describeMoves(ev *flowEvent, fact moveFact) string {
+	// A move after the use in evaluation order only reaches it through the
+	// edge back to a loop header.
+	var before, after []int
+	for m := range fact.moves {
+		if m.seq < ev.seq {
+			before = appendLine(before, m.line)
+		} else {
+			after = appendLine(after, m.line)
+		}
+	}
+
+	var where []string
+	if len(before) > 0 {
+		where = append(where, "at "+lineList(before))
+	}
+	if len(after) > 0 {
+		where = append(where, "at "+lineList(after)+" in an earlier iteration of the loop")
+	}
+	msg := "moved " + strings.Join(where, ", and ")
+	if !fact.all && len(after) == 0 {
+		msg += ", but not on every path to here"
+	}
+	return msg
+}
+
+// appendLine adds line to the sorted list lines unless it is there.
+func appendLine(lines []int, line int) []int {
+	i := sort.SearchInts(lines, line)
+	if i < len(lines) && lines[i] == line {
+		return lines
+	}
+	return append(lines[:i], append([]int{line}, lines[i:]...)...)
+}
+
+func lineList(lines []int) string {
+	if len(lines) == 1 {
+		return fmt.Sprintf("line %d", lines[0])
+	}
+	parts := make([]string, len(lines))
+	for i, l := range lines {
+		parts[i] = fmt.Sprint(l)
 	}
+	return "lines " + strings.Join(parts[:len(parts)-1], ", ") + " and " + parts[len(parts)-1]
 }
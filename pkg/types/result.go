@@ -0,0 +1,135 @@
+package types
+
+import "github.com/dev-dami/carv/pkg/ast"
+
+// A Result is not typed by what it carries, so what an Ok or Err pattern
+// binds is worked out as the C generator does: from the Ok and Err values
+// a function returns, or a variable starts with. What is not known is an
+// int in Ok and a string in Err.
+
+// resultPayload is what a Result carries in Ok and in Err, where known.
+type resultPayload struct {
+	ok, err Type
+}
+
+// checkResultValue checks the value inside Ok(...) or Err(...).
+func (c *Checker) checkResultValue(value ast.Expression) Type {
+	if value != nil {
+		c.checkExpression(value)
+	}
+	return Any
+}
+
+// resultOf returns what the Result expr evaluates to carries.
+func (c *Checker) resultOf(expr ast.Expression) resultPayload {
+	var p resultPayload
+	switch e := expr.(type) {
+	case *ast.OkExpression:
+		p.ok = c.nodeTypes[e.Value]
+	case *ast.ErrExpression:
+		p.err = c.nodeTypes[e.Value]
+	case *ast.CallExpression:
+		if ident, ok := e.Function.(*ast.Identifier); ok {
+			return c.resultOf(ident)
+		}
+	case *ast.Identifier:
+		if sc := c.scope.defining(e.Value); sc != nil {
+			p = sc.results[e.Value]
+		}
+	}
+	return p
+}
+
+// recordResult notes what the Result that value, returned by the function
+// name or bound to the variable name, carries.
+func (c *Checker) recordResult(name string, value ast.Expression) {
+	p := c.resultOf(value)
+	if name == "" || p.ok == nil && p.err == nil {
+		return
+	}
+	sc := c.scope.defining(name)
+	if sc == nil {
+		return
+	}
+	if sc.results == nil {
+		sc.results = make(map[string]resultPayload)
+	}
+	known := sc.results[name]
+	if known.ok == nil {
+		known.ok = p.ok
+	}
+	if known.err == nil {
+		known.err = p.err
+	}
+	sc.results[name] = known
+}
+
+// checkTryExpression checks value?, which returns an Err from the function
+// there and then: control goes on after it only with an Ok.
+func (c *Checker) checkTryExpression(e *ast.TryExpression) Type {
+	c.checkExpression(e.Value)
+	from := c.flow.branch()
+	c.flow.terminate()
+	c.flow.cur = from
+	c.flow.branch()
+	return Any
+}
+
+// checkMatchExpression checks a match, whose arms are branches from after
+// the value, as those of an if are. Unless an arm matches anything, or one
+// matches Ok and another Err, control may also pass no arm.
+func (c *Checker) checkMatchExpression(e *ast.MatchExpression) Type {
+	c.checkExpression(e.Value)
+	payload := c.resultOf(e.Value)
+
+	from := c.flow.cur
+	var ends []*flowBlock
+	hasOk, hasErr, hasAny := false, false, false
+	for _, arm := range e.Arms {
+		c.flow.cur = from
+		c.flow.branch()
+		prevScope := c.scope
+		c.scope = NewScope(prevScope)
+		switch p := arm.Pattern.(type) {
+		case *ast.OkExpression:
+			hasOk = true
+			c.bindMatchPattern(p.Value, payload.ok, Int)
+		case *ast.ErrExpression:
+			hasErr = true
+			c.bindMatchPattern(p.Value, payload.err, String)
+		default:
+			hasAny = true
+		}
+		if block, ok := arm.Body.(*ast.BlockExpression); ok {
+			c.checkBlockStatement(block.Block)
+		} else {
+			c.checkExpression(arm.Body)
+		}
+		c.scope = prevScope
+		ends = append(ends, c.flow.cur)
+	}
+
+	if len(ends) == 0 {
+		return Any
+	}
+	c.flow.cur = ends[len(ends)-1]
+	others := ends[:len(ends)-1]
+	if !hasAny && !(hasOk && hasErr) {
+		others = append(others, from)
+	}
+	c.flow.join(others...)
+	return Any
+}
+
+// bindMatchPattern defines the variable an Ok or Err pattern binds, if it
+// binds one, as t, or as otherwise when t is not known.
+func (c *Checker) bindMatchPattern(value ast.Expression, t, otherwise Type) {
+	ident, ok := value.(*ast.Identifier)
+	if !ok {
+		return
+	}
+	if t == nil || t.Equals(Any) {
+		t = otherwise
+	}
+	c.scope.Define(ident.Value, t)
+}
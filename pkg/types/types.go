@@ -32,6 +32,11 @@ func (a *ArrayType) Equals(other Type) bool {
 type FunctionType struct {
 	Params []Type
 	Return Type
+
+	// Borrows lists the parameters that the references in the return value
+	// may borrow from, by index, with -1 for self. It is nil when the
+	// return value holds no references or nothing is known about them.
+	Borrows []int
 }
 
 func (f *FunctionType) String() string {
@@ -87,8 +92,9 @@ func (o *OptionalType) Equals(other Type) bool {
 }
 
 type ClassType struct {
-	Name   string
-	Fields map[string]Type
+	Name     string
+	Fields   map[string]Type
+	Lifetime string // of the references in its fields, like 'a, or ""
 }
 
 func (c *ClassType) String() string { return c.Name }
@@ -126,15 +132,20 @@ func (m *MapType) Equals(other Type) bool {
 }
 
 type RefType struct {
-	Inner   Type
-	Mutable bool
+	Inner    Type
+	Mutable  bool
+	Lifetime string // like 'a, or "" if not named; it does not affect Equals
 }
 
 func (r *RefType) String() string {
+	s := "&"
+	if r.Lifetime != "" {
+		s += r.Lifetime + " "
+	}
 	if r.Mutable {
-		return "&mut " + r.Inner.String()
+		s += "mut "
 	}
-	return "&" + r.Inner.String()
+	return s + r.Inner.String()
 }
 
 func (r *RefType) Equals(other Type) bool {
@@ -179,6 +190,10 @@ var (
 	Any    = &BasicType{Name: "any"}
 	Nil    = &BasicType{Name: "nil"}
 
+	// Invalid is the type of an expression that failed to parse. It is
+	// accepted everywhere so one syntax error does not cascade into type errors.
+	Invalid = &BasicType{Name: "invalid"}
+
 	// Sized integer types
 	U8    = &BasicType{Name: "u8"}
 	U16   = &BasicType{Name: "u16"}
@@ -194,6 +209,11 @@ var (
 	Isize = &BasicType{Name: "isize"}
 )
 
+// IsInvalid reports whether t is the type of a broken expression.
+func IsInvalid(t Type) bool {
+	return t != nil && t.Equals(Invalid)
+}
+
 func IsNumeric(t Type) bool {
 	if b, ok := t.(*BasicType); ok {
 		switch b.Name {
@@ -207,6 +227,11 @@ func IsNumeric(t Type) bool {
 	return false
 }
 
+// IsInteger reports whether t is int or a sized integer type.
+func IsInteger(t Type) bool {
+	return IsNumeric(t) && !t.Equals(Float) && !t.Equals(F32) && !t.Equals(F64)
+}
+
 func IsComparable(t Type) bool {
 	if b, ok := t.(*BasicType); ok {
 		switch b.Name {
@@ -232,6 +257,34 @@ func (v *VolatileType) Equals(other Type) bool {
 	return false
 }
 
+// AtomicType is Atomic<T>, an integer or bool that an interrupt handler and
+// the code it interrupts can both use, through load and store.
+type AtomicType struct {
+	Inner Type
+}
+
+func (a *AtomicType) String() string { return "Atomic<" + a.Inner.String() + ">" }
+func (a *AtomicType) Equals(other Type) bool {
+	if o, ok := other.(*AtomicType); ok {
+		return a.Inner.Equals(o.Inner)
+	}
+	return false
+}
+
+// MutexType is Mutex<T>, a value that is only reached, through lock, with
+// interrupts held off.
+type MutexType struct {
+	Inner Type
+}
+
+func (m *MutexType) String() string { return "Mutex<" + m.Inner.String() + ">" }
+func (m *MutexType) Equals(other Type) bool {
+	if o, ok := other.(*MutexType); ok {
+		return m.Inner.Equals(o.Inner)
+	}
+	return false
+}
+
 // TypeCategory classifies types for ownership semantics
 type TypeCategory int
 
@@ -259,11 +312,13 @@ func Category(t Type) TypeCategory {
 	case t.Equals(Any):
 		return CopyType // Any is treated as copy for backward compat
 	}
-	switch t.(type) {
+	switch t := t.(type) {
 	case *ArrayType, *MapType, *ClassType, *FutureType:
 		return MoveType
 	case *RefType:
 		return CopyType
+	case *MutexType:
+		return Category(t.Inner)
 	default:
 		return CopyType
 	}